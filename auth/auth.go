@@ -46,14 +46,18 @@ type Provider interface {
 // given specification.
 //
 // It uses an authorization endpoint when a
-// http(s):// prefix is detected and otherwise
-// the specification is considered to be a
-// file-name. If no specification is used,
-// then it will use environment variables.
+// http(s):// prefix is detected, a JWT provider
+// configured by the file following a jwt://
+// prefix, and otherwise the specification is
+// considered to be a file-name. If no specification
+// is used, then it will use environment variables.
 func Parse(spec string) (Provider, error) {
 	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
 		return FromEndPoint(spec)
 	}
+	if strings.HasPrefix(spec, "jwt://") {
+		return FromJWTFile(strings.TrimPrefix(spec, "jwt://"))
+	}
 
 	if spec != "" {
 		return FromFile(spec)
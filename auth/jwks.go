@@ -0,0 +1,377 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// default time for which a key set is cached
+	defaultKeyTTL = time.Hour
+	// minimum time between fetches of a key set
+	// when a token references an unknown key
+	// or after a fetch has failed
+	minKeyRefresh = time.Minute
+	// maximum time spent fetching a key set
+	keyFetchTimeout = 30 * time.Second
+	// maximum size of a key set
+	maxKeySetSize = 1 << 20
+)
+
+// jwk is a JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	kid string
+	alg string // empty if the key does not restrict the algorithm
+	key crypto.PublicKey
+}
+
+func b64int(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31 || n.BitLen() < 2048 {
+			return nil, errors.New("unsupported RSA key size or exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// parseKeySet parses a JSON Web Key Set,
+// ignoring keys that cannot be used to
+// verify signatures
+func parseKeySet(buf []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, fmt.Errorf("parsing key set: %w", err)
+	}
+	var out []publicKey
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		out = append(out, publicKey{kid: k.Kid, alg: k.Alg, key: pub})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("key set has no usable keys")
+	}
+	return out, nil
+}
+
+// keySet caches the keys of a
+// JSON Web Key Set loaded from a
+// URL or a file
+type keySet struct {
+	src    string
+	ttl    time.Duration
+	client *http.Client
+
+	lock      sync.Mutex
+	keys      []publicKey
+	fetched   time.Time     // time of the last successful fetch
+	attempted time.Time     // time of the last fetch
+	err       error         // result of the last fetch
+	loading   chan struct{} // closed when the current fetch is done
+}
+
+func (k *keySet) load(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(k.src, "http://") && !strings.HasPrefix(k.src, "https://") {
+		return os.ReadFile(strings.TrimPrefix(k.src, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.src, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	cl := k.client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	res, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching key set: %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxKeySetSize))
+}
+
+// refresh re-loads the key set, unless the
+// last fetch was less than backoff ago.
+// Only one goroutine fetches the key set at a time;
+// if a fetch is already in progress, refresh waits
+// for it to complete if wait is set, or returns
+// immediately otherwise.
+func (k *keySet) refresh(ctx context.Context, backoff time.Duration, wait bool) error {
+	k.lock.Lock()
+	if ch := k.loading; ch != nil {
+		k.lock.Unlock()
+		if !wait {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		return k.err
+	}
+	if !k.attempted.IsZero() && time.Since(k.attempted) < backoff {
+		err := k.err
+		k.lock.Unlock()
+		return err
+	}
+	ch := make(chan struct{})
+	k.loading = ch
+	k.attempted = time.Now()
+	k.lock.Unlock()
+
+	// the fetch is shared by every waiting
+	// request, so it isn't tied to ctx
+	fctx, cancel := context.WithTimeout(context.Background(), keyFetchTimeout)
+	buf, err := k.load(fctx)
+	cancel()
+	var keys []publicKey
+	if err == nil {
+		keys, err = parseKeySet(buf)
+	}
+
+	k.lock.Lock()
+	if err == nil {
+		k.keys = keys
+		k.fetched = time.Now()
+	}
+	k.err = err
+	k.loading = nil
+	k.lock.Unlock()
+	close(ch)
+	return err
+}
+
+// cached returns the current keys
+// and the time they were fetched
+func (k *keySet) cached() ([]publicKey, time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.keys, k.fetched
+}
+
+// find returns the keys that match kid
+// (or every key if kid is empty) and
+// that can be used with alg
+func (k *keySet) find(ctx context.Context, kid, alg string) ([]publicKey, error) {
+	ttl := k.ttl
+	if ttl == 0 {
+		ttl = defaultKeyTTL
+	}
+	backoff := minKeyRefresh
+	if ttl < backoff {
+		backoff = ttl
+	}
+	keys, fetched := k.cached()
+	if keys == nil {
+		// nothing to fall back on
+		if err := k.refresh(ctx, backoff, true); err != nil {
+			return nil, err
+		}
+		keys, fetched = k.cached()
+	} else if time.Since(fetched) >= ttl {
+		// keep using the cached keys
+		// if the fetch fails or if another
+		// goroutine is already fetching them
+		k.refresh(ctx, backoff, false)
+		keys, fetched = k.cached()
+	}
+	match := func(keys []publicKey) []publicKey {
+		var out []publicKey
+		for i := range keys {
+			if (kid == "" || keys[i].kid == kid) &&
+				(keys[i].alg == "" || keys[i].alg == alg) {
+				out = append(out, keys[i])
+			}
+		}
+		return out
+	}
+	out := match(keys)
+	// the key may have been rotated; fetch
+	// the key set again, but don't let
+	// bad tokens trigger too many fetches
+	if len(out) == 0 && time.Since(fetched) >= minKeyRefresh {
+		if err := k.refresh(ctx, minKeyRefresh, true); err != nil {
+			return nil, err
+		}
+		keys, _ = k.cached()
+		out = match(keys)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no key matching kid %q", kid)
+	}
+	return out, nil
+}
+
+// verifySignature checks that sig is a valid
+// signature of signed by key using alg
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return errBadSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hh := h.New()
+	hh.Write(signed)
+	digest := hh.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(pub, h, digest, sig)
+		case 'P':
+			err = rsa.VerifyPSS(pub, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			err = errBadSignature
+		}
+		if err != nil {
+			return errBadSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		// ES256, ES384 and ES512 each
+		// require a particular curve
+		bits := pub.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size || bits != ecdsaBits[h] {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errBadSignature
+		}
+		return nil
+	}
+	return errBadSignature
+}
+
+var errBadSignature = errors.New("invalid token signature")
+
+var ecdsaBits = map[crypto.Hash]int{
+	crypto.SHA256: 256,
+	crypto.SHA384: 384,
+	crypto.SHA512: 521,
+}
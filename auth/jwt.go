@@ -0,0 +1,423 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/db"
+)
+
+// JWTClaims names the claims of a JSON Web Token
+// that determine the identity of a tenant.
+type JWTClaims struct {
+	// Tenant is the claim holding the tenant ID.
+	// The default is "sub".
+	Tenant string `json:"tenant,omitempty"`
+	// Databases, if set, is the claim holding
+	// the databases (or glob patterns matching
+	// the databases) the tenant may access,
+	// as a list of strings or a space-separated string.
+	// A token without the claim may not
+	// access any database, unless it is
+	// granted access to tables by Tables.
+	Databases string `json:"databases,omitempty"`
+	// Tables, if set, is the claim holding
+	// the tables the tenant may access, as
+	// glob patterns of the form "db/table"
+	// (see Policy).
+	Tables string `json:"tables,omitempty"`
+	// Roles, if set, is the claim holding the
+	// names of the access policies in table
+	// definitions that apply to the tenant
+	// (see Policy.Roles).
+	Roles string `json:"roles,omitempty"`
+	// Bucket, if set, is the claim holding the
+	// s3:// bucket of the tenant, which overrides
+	// JWT.Bucket.
+	Bucket string `json:"bucket,omitempty"`
+	// Role, if set, is the claim holding the ARN
+	// of the role to assume, which overrides JWT.Role.
+	Role string `json:"role,omitempty"`
+}
+
+// JWT is a Provider that validates JSON Web Tokens
+// locally against a JSON Web Key Set and maps
+// the claims of each token to a tenant.
+//
+// The S3 credentials of a tenant are either
+// JWT.Credentials or the temporary credentials
+// returned by assuming a role with the token
+// through the STS AssumeRoleWithWebIdentity API.
+type JWT struct {
+	// JWKS is the http:// or https:// URL
+	// or the path of the JSON Web Key Set
+	// used to verify tokens.
+	JWKS string `json:"jwks"`
+	// KeyTTL is how long the key set is
+	// cached before it is fetched again.
+	// Keys are also re-fetched when a token
+	// references a key that is not in the set.
+	KeyTTL time.Duration `json:"-"`
+	// Issuer and Audience, if non-empty,
+	// must match the "iss" and "aud" claims.
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// Claims determines how claims are
+	// mapped to the identity of the tenant.
+	Claims JWTClaims `json:"claims"`
+
+	// Region, IndexKey and Bucket are used
+	// for every tenant (see S3BearerIdentity),
+	// except that Bucket may be overridden by a claim.
+	Region   string `json:"region"`
+	IndexKey []byte `json:"index_key"`
+	Bucket   string `json:"bucket,omitempty"`
+	// Credentials are the S3 credentials used when
+	// no role is configured for a token.
+	// (When a role is assumed, only Credentials.BaseURI
+	// is used, if Credentials is non-nil.)
+	Credentials *S3BearerCredentials `json:"credentials,omitempty"`
+	// Role is the ARN of the role assumed with
+	// the token when the token has no role claim.
+	Role string `json:"role,omitempty"`
+	// STS is the STS endpoint used to assume roles.
+	// The default is the regional endpoint of Region.
+	STS string `json:"sts,omitempty"`
+
+	// Client, if non-nil, is the client
+	// used for requests to fetch keys
+	// and to assume roles.
+	Client *http.Client `json:"-"`
+
+	once  sync.Once
+	keys  *keySet
+	lock  sync.Mutex
+	creds map[[sha256.Size]byte]*S3BearerCredentials
+}
+
+var _ Provider = &JWT{}
+
+// FromJWTFile creates a JWT provider
+// from a JSON configuration file.
+// See also JWT.
+func FromJWTFile(fileName string) (Provider, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	j := new(JWT)
+	if err := json.Unmarshal(buf, j); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if j.JWKS == "" {
+		return nil, fmt.Errorf("%s: missing jwks", fileName)
+	}
+	return j, nil
+}
+
+const (
+	// allowed clock skew when
+	// checking exp and nbf
+	jwtLeeway = time.Minute
+	// assumed credentials are refreshed
+	// this long before they expire
+	credsMargin = 5 * time.Minute
+	// maximum number of cached credentials
+	maxCachedCreds = 4096
+)
+
+func (j *JWT) init() {
+	j.once.Do(func() {
+		j.keys = &keySet{src: j.JWKS, ttl: j.KeyTTL, client: j.Client}
+	})
+}
+
+func (j *JWT) client() *http.Client {
+	if j.Client == nil {
+		return http.DefaultClient
+	}
+	return j.Client
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature of token
+// and returns its claims
+func (j *JWT) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	hdrbuf, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var hdr jwtHeader
+	if err := json.Unmarshal(hdrbuf, &hdr); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	keys, err := j.keys.find(ctx, hdr.Kid, hdr.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+	err = errBadSignature
+	for i := range keys {
+		if err = verifySignature(hdr.Alg, keys[i].key, signed, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return claims, nil
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// stringsClaim returns a claim that
+// is either a list of strings or a
+// space-separated string
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for i := range v {
+			if s, ok := v[i].(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// check validates the registered claims
+func (j *JWT) check(claims map[string]interface{}, now time.Time) error {
+	exp, ok := numericDate(claims, "exp")
+	if !ok {
+		return errors.New("token has no expiration")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims, "nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.New("token not yet valid")
+	}
+	if j.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.Issuer {
+			return errors.New("token has the wrong issuer")
+		}
+	}
+	if j.Audience != "" {
+		found := false
+		for _, aud := range stringsClaim(claims, "aud") {
+			if aud == j.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("token has the wrong audience")
+		}
+	}
+	return nil
+}
+
+// Authorize implements Provider.Authorize
+//
+// The token must be a JWT signed by one of
+// the keys in j.JWKS, and its claims are mapped
+// to the tenant identity according to j.Claims.
+func (j *JWT) Authorize(ctx context.Context, token string) (db.Tenant, error) {
+	j.init()
+	claims, err := j.verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("JWT: %w", err)
+	}
+	now := time.Now()
+	if err := j.check(claims, now); err != nil {
+		return nil, fmt.Errorf("JWT: %w", err)
+	}
+	tenantClaim := j.Claims.Tenant
+	if tenantClaim == "" {
+		tenantClaim = "sub"
+	}
+	id, _ := claims[tenantClaim].(string)
+	if id == "" {
+		return nil, fmt.Errorf("JWT: token has no %q claim", tenantClaim)
+	}
+	identity := S3BearerIdentity{
+		ID:       id,
+		Region:   j.Region,
+		IndexKey: j.IndexKey,
+		Bucket:   j.Bucket,
+	}
+	if j.Claims.Bucket != "" {
+		if b, _ := claims[j.Claims.Bucket].(string); b != "" {
+			identity.Bucket = b
+		}
+	}
+	role := j.Role
+	if j.Claims.Role != "" {
+		if r, _ := claims[j.Claims.Role].(string); r != "" {
+			role = r
+		}
+	}
+	switch {
+	case role != "":
+		c, err := j.assume(ctx, role, id, token)
+		if err != nil {
+			return nil, fmt.Errorf("JWT: assuming role: %w", err)
+		}
+		identity.Credentials = *c
+	case j.Credentials != nil:
+		identity.Credentials = *j.Credentials
+	default:
+		return nil, errors.New("JWT: no role or credentials for token")
+	}
+	if j.Claims.Databases != "" || j.Claims.Tables != "" {
+		// database names are patterns that
+		// match every table in the database
+		identity.Policy = &Policy{
+			Tables: append(stringsClaim(claims, j.Claims.Databases),
+				stringsClaim(claims, j.Claims.Tables)...),
+		}
+	}
+	if j.Claims.Roles != "" {
+		if identity.Policy == nil {
+			identity.Policy = &Policy{Tables: []string{"*"}}
+		}
+		identity.Policy.Roles = stringsClaim(claims, j.Claims.Roles)
+	}
+	return identity.Tenant()
+}
+
+var sessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+type assumeRoleResult struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// assume returns the credentials of role,
+// assuming it with token if necessary
+func (j *JWT) assume(ctx context.Context, role, tenant, token string) (*S3BearerCredentials, error) {
+	key := sha256.Sum256([]byte(role + "\x00" + token))
+	j.lock.Lock()
+	c := j.creds[key]
+	j.lock.Unlock()
+	if c != nil && time.Now().Add(credsMargin).Before(c.Expires) {
+		return c, nil
+	}
+
+	endpoint := j.STS
+	if endpoint == "" {
+		endpoint = "https://sts." + j.Region + ".amazonaws.com/"
+	}
+	session := sessionNameChars.ReplaceAllString("sneller-"+tenant, "_")
+	if len(session) > 64 {
+		session = session[:64]
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {token},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := j.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// don't read an arbitrarily large response
+		text := make([]byte, 1024)
+		n, _ := io.ReadFull(res.Body, text)
+		return nil, fmt.Errorf("STS: code %d (%q)", res.StatusCode, text[:n])
+	}
+	var result assumeRoleResult
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("STS: %w", err)
+	}
+	rc := &result.Credentials
+	c = &S3BearerCredentials{
+		AccessKeyID:     rc.AccessKeyID,
+		SecretAccessKey: rc.SecretAccessKey,
+		SessionToken:    rc.SessionToken,
+		Source:          "AssumeRoleWithWebIdentity",
+		Expires:         rc.Expiration,
+		CanExpire:       true,
+	}
+	if j.Credentials != nil {
+		c.BaseURI = j.Credentials.BaseURI
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.creds == nil || len(j.creds) >= maxCachedCreds {
+		j.creds = make(map[[sha256.Size]byte]*S3BearerCredentials)
+	}
+	j.creds[key] = c
+	return c, nil
+}
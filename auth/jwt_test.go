@@ -0,0 +1,447 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSigner is a key pair that
+// can sign tokens and that appears
+// in a key set as a JWK
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func b64(buf []byte) string { return base64.RawURLEncoding.EncodeToString(buf) }
+
+func (s *testSigner) jwk() map[string]string {
+	m := map[string]string{"kid": s.kid, "use": "sig"}
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		m["kty"] = "RSA"
+		m["n"] = b64(pub.N.Bytes())
+		m["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		m["kty"] = "EC"
+		m["crv"] = pub.Curve.Params().Name
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		m["x"] = b64(pub.X.FillBytes(make([]byte, size)))
+		m["y"] = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		m["kty"] = "OKP"
+		m["crv"] = "Ed25519"
+		m["x"] = b64(pub)
+	}
+	return m
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(body)
+	var sig []byte
+	var err error
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, sum[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func testSigners(t *testing.T) []*testSigner {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*testSigner{
+		{kid: "rsa", alg: "RS256", key: rk},
+		{kid: "ec", alg: "ES256", key: ek},
+		{kid: "ed", alg: "EdDSA", key: edk},
+	}
+}
+
+// keyServer serves a key set
+// that can be changed by tests
+type keyServer struct {
+	lock    sync.Mutex
+	signers []*testSigner
+	fetches int32
+	fail    bool          // respond with an error
+	block   chan struct{} // if non-nil, wait for it before responding
+}
+
+func (k *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&k.fetches, 1)
+	k.lock.Lock()
+	block, fail := k.block, k.fail
+	k.lock.Unlock()
+	if block != nil {
+		<-block
+	}
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	var keys []map[string]string
+	for _, s := range k.signers {
+		keys = append(keys, s.jwk())
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func claims(extra ...interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss":       "https://issuer.example",
+		"aud":       []string{"sneller"},
+		"sub":       "tenant-a",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"databases": []string{"sales", "logs-*"},
+	}
+	for i := 0; i < len(extra); i += 2 {
+		if extra[i+1] == nil {
+			delete(c, extra[i].(string))
+		} else {
+			c[extra[i].(string)] = extra[i+1]
+		}
+	}
+	return c
+}
+
+func TestJWT(t *testing.T) {
+	signers := testSigners(t)
+	ks := &keyServer{signers: signers[:2]}
+	srv := httptest.NewServer(ks)
+	defer srv.Close()
+
+	j := &JWT{
+		JWKS:     srv.URL,
+		Issuer:   "https://issuer.example",
+		Audience: "sneller",
+		Claims:   JWTClaims{Databases: "databases", Tables: "tables", Roles: "roles", Bucket: "bucket"},
+		Region:   "us-east-1",
+		IndexKey: make([]byte, 32),
+		Bucket:   "s3://default-bucket",
+		Credentials: &S3BearerCredentials{
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "secret",
+		},
+	}
+	ctx := context.Background()
+	for _, s := range signers[:2] {
+		tn, err := j.Authorize(ctx, s.sign(t, claims()))
+		if err != nil {
+			t.Fatalf("%s: %s", s.alg, err)
+		}
+		if tn.ID() != "tenant-a" {
+			t.Errorf("%s: tenant ID %q", s.alg, tn.ID())
+		}
+		sc, ok := tn.(Scoped)
+		if !ok {
+			t.Fatalf("%s: tenant is not scoped", s.alg)
+		}
+		for db, want := range map[string]bool{"sales": true, "logs-2022": true, "other": false} {
+			if got := sc.Policy().AllowDatabase(db); got != want {
+				t.Errorf("%s: AllowDatabase(%q) = %v", s.alg, db, got)
+			}
+		}
+	}
+	tn, err := j.Authorize(ctx, signers[0].sign(t, claims("bucket", "s3://tenant-bucket")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := tn.(*scopedTenant).root.Bucket; b != "tenant-bucket" {
+		t.Errorf("bucket %q", b)
+	}
+	tn, err = j.Authorize(ctx, signers[0].sign(t, claims("databases", nil, "tables", "hr/payroll")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := tn.(Scoped).Policy(); !p.AllowTable("hr", "payroll") || p.AllowTable("hr", "reviews") || p.AllowTable("sales", "x") {
+		t.Errorf("unexpected policy %v", p.Tables)
+	}
+	tn, err = j.Authorize(ctx, signers[0].sign(t, claims("databases", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.(Scoped).Policy().AllowDatabase("sales") {
+		t.Error("token without databases claim can access a database")
+	}
+	tn, err = j.Authorize(ctx, signers[0].sign(t, claims("roles", "support eu")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := tn.(Scoped).Policy(); !reflect.DeepEqual(p.Roles, []string{"support", "eu"}) {
+		t.Errorf("unexpected roles %v", p.Roles)
+	}
+
+	bad := []struct {
+		name  string
+		token string
+	}{
+		{"expired", signers[0].sign(t, claims("exp", time.Now().Add(-time.Hour).Unix()))},
+		{"no exp", signers[0].sign(t, claims("exp", nil))},
+		{"not yet valid", signers[0].sign(t, claims("nbf", time.Now().Add(time.Hour).Unix()))},
+		{"issuer", signers[0].sign(t, claims("iss", "https://other.example"))},
+		{"audience", signers[0].sign(t, claims("aud", "other"))},
+		{"no subject", signers[0].sign(t, claims("sub", nil))},
+		{"garbage", "not.a.token"},
+	}
+	for i := range bad {
+		if _, err := j.Authorize(ctx, bad[i].token); err == nil {
+			t.Errorf("%s: token accepted", bad[i].name)
+		}
+	}
+
+	// tamper with the claims of a valid token
+	tok := signers[0].sign(t, claims())
+	parts := strings.Split(tok, ".")
+	body, _ := json.Marshal(claims("sub", "tenant-b"))
+	parts[1] = b64(body)
+	if _, err := j.Authorize(ctx, strings.Join(parts, ".")); err == nil {
+		t.Error("tampered token accepted")
+	}
+	// unsigned tokens are never accepted
+	hdr, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+	if _, err := j.Authorize(ctx, b64(hdr)+"."+parts[1]+"."); err == nil {
+		t.Error("unsigned token accepted")
+	}
+
+	// a token signed by a new key is
+	// accepted once the key set is re-fetched
+	fetches := atomic.LoadInt32(&ks.fetches)
+	ks.lock.Lock()
+	ks.signers = signers[1:]
+	ks.lock.Unlock()
+	j.keys.lock.Lock()
+	j.keys.fetched = time.Now().Add(-minKeyRefresh)
+	j.keys.attempted = j.keys.fetched
+	j.keys.lock.Unlock()
+	if _, err := j.Authorize(ctx, signers[2].sign(t, claims())); err != nil {
+		t.Fatalf("after key rotation: %s", err)
+	}
+	if n := atomic.LoadInt32(&ks.fetches); n != fetches+1 {
+		t.Errorf("%d fetches after rotation", n-fetches)
+	}
+	// ... but unknown keys do not cause
+	// the key set to be fetched again immediately
+	if _, err := j.Authorize(ctx, (&testSigner{kid: "unknown", alg: "ES256", key: signers[1].key}).sign(t, claims())); err == nil {
+		t.Error("token with unknown kid accepted")
+	}
+	if n := atomic.LoadInt32(&ks.fetches); n != fetches+1 {
+		t.Errorf("%d fetches after unknown kid", n-fetches)
+	}
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	signers := testSigners(t)
+	ks := &keyServer{signers: signers, fail: true}
+	srv := httptest.NewServer(ks)
+	defer srv.Close()
+	k := &keySet{src: srv.URL, ttl: time.Hour}
+	ctx := context.Background()
+
+	// a failed fetch is not retried
+	// until minKeyRefresh has passed
+	for i := 0; i < 3; i++ {
+		if _, err := k.find(ctx, "ec", "ES256"); err == nil {
+			t.Fatal("found a key in an unavailable key set")
+		}
+	}
+	if n := atomic.LoadInt32(&ks.fetches); n != 1 {
+		t.Errorf("%d fetches after failures", n)
+	}
+	ks.lock.Lock()
+	ks.fail = false
+	ks.lock.Unlock()
+	k.lock.Lock()
+	k.attempted = time.Now().Add(-minKeyRefresh)
+	k.lock.Unlock()
+	if _, err := k.find(ctx, "ec", "ES256"); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the keys have expired, one request
+	// fetches them while the others keep using
+	// the cached keys
+	block := make(chan struct{})
+	ks.lock.Lock()
+	ks.block = block
+	ks.lock.Unlock()
+	k.lock.Lock()
+	k.fetched = time.Now().Add(-2 * time.Hour)
+	k.attempted = k.fetched
+	k.lock.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := k.find(ctx, "ec", "ES256")
+		done <- err
+	}()
+	for atomic.LoadInt32(&ks.fetches) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cached := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := k.find(ctx, "ec", "ES256"); err != nil {
+				cached <- err
+				return
+			}
+		}
+		cached <- nil
+	}()
+	select {
+	case err := <-cached:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookups blocked by the key set fetch")
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&ks.fetches); n != 3 {
+		t.Errorf("%d fetches", n)
+	}
+}
+
+func TestJWTRole(t *testing.T) {
+	signers := testSigners(t)
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "jwks.json")
+	buf, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{signers[2].jwk()}})
+	if err := os.WriteFile(keyfile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/tenant-a" {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <SessionToken>session-%s</SessionToken>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <Expiration>%s</Expiration>
+      <AccessKeyId>ASIA</AccessKeyId>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, r.Form.Get("RoleSessionName"), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	config := filepath.Join(dir, "jwt.json")
+	buf, _ = json.Marshal(map[string]interface{}{
+		"jwks":      keyfile,
+		"claims":    map[string]string{"tenant": "tenant", "role": "role"},
+		"region":    "us-east-1",
+		"index_key": make([]byte, 32),
+		"bucket":    "s3://bucket",
+		"sts":       sts.URL,
+	})
+	if err := os.WriteFile(config, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse("jwt://" + config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tok := signers[2].sign(t, claims("tenant", "tenant-a", "role", "arn:aws:iam::123456789012:role/tenant-a"))
+	for i := 0; i < 2; i++ {
+		tn, err := p.Authorize(ctx, tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tn.ID() != "tenant-a" {
+			t.Errorf("tenant ID %q", tn.ID())
+		}
+		if _, ok := tn.(Scoped); ok {
+			t.Error("tenant should not be scoped")
+		}
+		key := tn.(*s3Tenant).root.Key
+		if key.AccessKey != "ASIA" || key.Token != "session-sneller-tenant-a" {
+			t.Errorf("unexpected key %+v", key)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d calls to STS; expected cached credentials", n)
+	}
+	tok = signers[2].sign(t, claims("tenant", "tenant-a", "role", "arn:aws:iam::123456789012:role/tenant-b"))
+	if _, err := p.Authorize(ctx, tok); err == nil {
+		t.Error("STS error not returned")
+	}
+	// no role and no static credentials
+	tok = signers[2].sign(t, claims("tenant", "tenant-a"))
+	if _, err := p.Authorize(ctx, tok); err == nil {
+		t.Error("token without a role accepted")
+	}
+}
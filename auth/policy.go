@@ -0,0 +1,122 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/SnellerInc/sneller/db"
+)
+
+// Scoped is implemented by the db.Tenant
+// returned from a Provider when the tables
+// that the tenant may access are restricted.
+type Scoped interface {
+	// Policy returns the access policy
+	// of the tenant.
+	Policy() *Policy
+}
+
+// Policy describes the databases and
+// tables that a tenant may access.
+type Policy struct {
+	// Tables are glob patterns (see path.Match)
+	// of the form "db/table" that match the
+	// tables the tenant may access.
+	// A pattern without a "/" matches
+	// databases, and it grants access to
+	// every table in the matching databases.
+	Tables []string `json:"Tables"`
+	// Roles are the names of the access
+	// policies in table definitions
+	// (see db.Definition.Policies) that
+	// apply to the tenant.
+	Roles []string `json:"Roles,omitempty"`
+	// Access maps patterns like the ones in
+	// Tables to access policies that apply
+	// to the tenant in addition to the ones
+	// selected by Roles.
+	Access map[string]*db.AccessPolicy `json:"Access,omitempty"`
+}
+
+// AccessPolicies returns the access policies
+// that apply to db.table, given the definition
+// of the table, which may be nil.
+func (p *Policy) AccessPolicies(dbname, table string, def *db.Definition) []*db.AccessPolicy {
+	var out []*db.AccessPolicy
+	pats := make([]string, 0, len(p.Access))
+	for pat := range p.Access {
+		pats = append(pats, pat)
+	}
+	sort.Strings(pats)
+	for _, pat := range pats {
+		if match(pat, dbname, table) {
+			out = append(out, p.Access[pat])
+		}
+	}
+	if def != nil {
+		for _, role := range p.Roles {
+			if ap := def.Policies[role]; ap != nil {
+				out = append(out, ap)
+			}
+		}
+	}
+	return out
+}
+
+// AllowDatabase returns whether the policy
+// allows access to any table in db.
+func (p *Policy) AllowDatabase(db string) bool {
+	for _, pat := range p.Tables {
+		dbpat, _, _ := strings.Cut(pat, "/")
+		if ok, _ := path.Match(dbpat, db); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowTable returns whether the policy
+// allows access to db.table.
+func (p *Policy) AllowTable(db, table string) bool {
+	for _, pat := range p.Tables {
+		if match(pat, db, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches a "db" or "db/table" pattern
+func match(pat, db, table string) bool {
+	if !strings.Contains(pat, "/") {
+		ok, _ := path.Match(pat, db)
+		return ok
+	}
+	ok, _ := path.Match(pat, db+"/"+table)
+	return ok
+}
+
+// scopedTenant is an s3Tenant
+// restricted by a Policy
+type scopedTenant struct {
+	*s3Tenant
+	policy *Policy
+}
+
+// Policy implements Scoped.Policy
+func (s *scopedTenant) Policy() *Policy { return s.policy }
@@ -0,0 +1,70 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/SnellerInc/sneller/db"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{Tables: []string{"sales", "logs-*/events", "hr/payroll"}}
+	tcs := []struct {
+		db, table     string
+		dbOK, tableOK bool
+	}{
+		{"sales", "orders", true, true},
+		{"logs-2022", "events", true, true},
+		{"logs-2022", "requests", true, false},
+		{"hr", "payroll", true, true},
+		{"hr", "reviews", true, false},
+		{"other", "payroll", false, false},
+	}
+	for _, tc := range tcs {
+		if got := p.AllowDatabase(tc.db); got != tc.dbOK {
+			t.Errorf("AllowDatabase(%q) = %v", tc.db, got)
+		}
+		if got := p.AllowTable(tc.db, tc.table); got != tc.tableOK {
+			t.Errorf("AllowTable(%q, %q) = %v", tc.db, tc.table, got)
+		}
+	}
+}
+
+func TestAccessPolicies(t *testing.T) {
+	eu := &db.AccessPolicy{Filter: "region = 'eu'"}
+	support := &db.AccessPolicy{Mask: map[string]string{"email": "NULL"}}
+	admin := &db.AccessPolicy{}
+	p := &Policy{
+		Tables: []string{"*"},
+		Roles:  []string{"support", "missing"},
+		Access: map[string]*db.AccessPolicy{"crm": eu},
+	}
+	def := &db.Definition{
+		Name:     "tickets",
+		Policies: map[string]*db.AccessPolicy{"support": support, "admin": admin},
+	}
+	got := p.AccessPolicies("crm", "tickets", def)
+	if len(got) != 2 || got[0] != eu || got[1] != support {
+		t.Errorf("crm.tickets: got %v", got)
+	}
+	got = p.AccessPolicies("sales", "tickets", def)
+	if len(got) != 1 || got[0] != support {
+		t.Errorf("sales.tickets: got %v", got)
+	}
+	if got = p.AccessPolicies("sales", "orders", nil); len(got) != 0 {
+		t.Errorf("sales.orders: got %v", got)
+	}
+}
@@ -53,6 +53,9 @@ type S3BearerIdentity struct {
 	// Credentials is a JSON-compatible
 	// representation of the AWS SDK "Credentials" structure
 	Credentials S3BearerCredentials `json:"Credentials"`
+	// Policy, if non-nil, restricts the
+	// tables that the tenant may access.
+	Policy *Policy `json:"Policy,omitempty"`
 }
 
 type S3BearerCredentials struct {
@@ -109,6 +112,9 @@ func (s *S3BearerIdentity) Tenant() (db.Tenant, error) {
 	ret.DeriveKey = func(_ string) (*aws.SigningKey, error) {
 		return ret.root.Key, nil
 	}
+	if s.Policy != nil {
+		return &scopedTenant{s3Tenant: ret, policy: s.Policy}, nil
+	}
 	return ret, nil
 }
 
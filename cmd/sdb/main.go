@@ -20,16 +20,22 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/SnellerInc/sneller/auth"
 	"github.com/SnellerInc/sneller/aws"
 	"github.com/SnellerInc/sneller/aws/s3"
 	"github.com/SnellerInc/sneller/db"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
 	"github.com/SnellerInc/sneller/ion/blockfmt"
 )
 
@@ -40,6 +46,10 @@ var (
 	dashm        int64
 	dashk        string
 	dasho        string
+	dashw        string
+	dashwindow   time.Duration
+	dashwarm     string
+	dashinsecure bool
 	token        string
 	authEndPoint string
 )
@@ -56,6 +66,10 @@ func init() {
 	flag.Int64Var(&dashm, "m", 100*giga, "maximum input bytes read per index update")
 	flag.StringVar(&dashk, "k", "", "key file to use for signing+authenticating indexes")
 	flag.StringVar(&dasho, "o", "-", "output file (or - for stdin) for unpack")
+	flag.StringVar(&dashw, "w", "", "timestamp path for time-window compaction (default: size-tiered compaction)")
+	flag.DurationVar(&dashwindow, "window", 24*time.Hour, "window size for time-window compaction")
+	flag.StringVar(&dashwarm, "warm", "", "snellerd URL to ask to warm its caches after the daemon updates a table")
+	flag.BoolVar(&dashinsecure, "insecure", false, "accept unauthenticated notifications in 'sdb daemon http' when $SNELLER_NOTIFY_TOKEN is unset")
 	flag.StringVar(&token, "token", "", "JWT token or custom bearer token (default: fetch from SNELLER_TOKEN environment variable)")
 	flag.StringVar(&authEndPoint, "a", "", "authorization specification (file://, http://, https://, empty uses environment)")
 }
@@ -175,6 +189,170 @@ func sync(dbname, tblpat string) {
 	}
 }
 
+// entry point for 'sdb compact ...'
+func compact(creds db.Tenant, dbname, tblpat string) {
+	tables, err := db.Tables(root(creds), dbname)
+	if err != nil {
+		exitf("listing db %s: %s\n", dbname, err)
+	}
+	b := db.Builder{
+		Align:           1024 * 1024,
+		RangeMultiple:   100,
+		MaxCompactBytes: dashm,
+		GCMinimumAge:    5 * time.Minute,
+	}
+	if dashw != "" {
+		p, err := blockfmt.ParseClusterPath(dashw)
+		if err != nil {
+			exitf("bad -w path: %s\n", err)
+		}
+		b.Compaction = &db.TimeWindow{Path: p, Window: dashwindow}
+	}
+	if dashv {
+		b.Logf = logf
+	}
+	for _, tab := range tables {
+		match, err := path.Match(tblpat, tab)
+		if err != nil {
+			exitf("bad pattern %q: %s\n", tblpat, err)
+		}
+		if !match {
+			continue
+		}
+		n, err := b.Compact(creds, dbname, tab)
+		if err != nil {
+			exitf("compacting %s/%s: %s\n", dbname, tab, err)
+		}
+		if dashv {
+			logf("table %s/%s: merged %d objects", dbname, tab, n)
+		}
+	}
+}
+
+// entry point for 'sdb delete ...'
+func erase(creds db.Tenant, dbname, table, where string) {
+	q, err := partiql.Parse([]byte("SELECT * FROM t WHERE " + where))
+	if err != nil {
+		exitf("parsing predicate %q: %s\n", where, err)
+	}
+	sel, ok := q.Body.(*expr.Select)
+	if !ok || sel.Where == nil {
+		exitf("bad predicate %q\n", where)
+	}
+	b := db.Builder{
+		Align:         1024 * 1024,
+		RangeMultiple: 100,
+		GCMinimumAge:  5 * time.Minute,
+	}
+	if dashv {
+		b.Logf = logf
+	}
+	n, err := b.Delete(creds, dbname, table, sel.Where)
+	if err != nil {
+		exitf("deleting from %s/%s: %s\n", dbname, table, err)
+	}
+	if dashv {
+		logf("table %s/%s: deleted %d rows", dbname, table, n)
+	}
+}
+
+// notifyQueue is a db.Queue
+// that can be shut down
+type notifyQueue interface {
+	db.Queue
+	Close() error
+}
+
+// entry point for 'sdb daemon ...'
+func daemon(creds db.Tenant, kind, arg string) {
+	var q notifyQueue
+	switch kind {
+	case "sqs":
+		key, err := aws.AmbientKey("sqs", aws.DefaultDerive)
+		if err != nil {
+			exitf("deriving SQS key: %s\n", err)
+		}
+		q = &db.SQSQueue{Key: key, QueueURL: arg, Logf: logf}
+	case "dir":
+		q = &db.DirQueue{Root: root(creds), Dir: arg, Logf: logf}
+	case "http":
+		hq := &db.HTTPQueue{
+			Token:           os.Getenv("SNELLER_NOTIFY_TOKEN"),
+			Unauthenticated: dashinsecure,
+			Logf:            logf,
+		}
+		if hq.Token == "" && !dashinsecure {
+			exitf("$SNELLER_NOTIFY_TOKEN must be set (or -insecure given) to accept notifications over http\n")
+		}
+		go func() {
+			exitf("serving notifications: %s\n", http.ListenAndServe(arg, hq))
+		}()
+		q = hq
+	default:
+		exitf("unknown notification source %q\n", kind)
+	}
+	r := &db.QueueRunner{
+		Owner: creds,
+		Conf: db.Builder{
+			Align:         1024 * 1024,
+			RangeMultiple: 100,
+			MaxScanBytes:  dashm,
+			GCMinimumAge:  5 * time.Minute,
+		},
+		Logf:          logf,
+		BatchSize:     100,
+		BatchInterval: time.Second,
+		IOErrDelay:    time.Second,
+	}
+	if dashv {
+		r.Conf.Logf = logf
+	}
+	if dashwarm != "" {
+		r.OnUpdate = warmer(dashwarm, bearer())
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		q.Close()
+	}()
+	err := r.Run(q)
+	if err != nil {
+		exitf("daemon: %s\n", err)
+	}
+}
+
+// warmer returns a function that asks the
+// snellerd at endpoint to warm its caches
+// with the new objects of a table
+func warmer(endpoint, tok string) func(dbname, table string) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	return func(dbname, table string) {
+		uri := fmt.Sprintf("%s/warmup?database=%s&table=%s",
+			endpoint, url.QueryEscape(dbname), url.QueryEscape(table))
+		req, err := http.NewRequest(http.MethodPost, uri, nil)
+		if err != nil {
+			logf("warming %s.%s: %s", dbname, table, err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		// don't hold up ingestion
+		go func() {
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				logf("warming %s.%s: %s", dbname, table, err)
+				return
+			}
+			res.Body.Close()
+			switch res.StatusCode {
+			case http.StatusOK, http.StatusAccepted, http.StatusConflict:
+			default:
+				logf("warming %s.%s: %s", dbname, table, res.Status)
+			}
+		}()
+	}
+}
+
 var hsizes = []byte{'K', 'M', 'G', 'T', 'P'}
 
 func human(size int64) string {
@@ -283,7 +461,8 @@ func inputs(creds db.Tenant, dbname, table string) {
 	}
 }
 
-func creds() db.Tenant {
+// bearer returns the token used to authorize requests
+func bearer() string {
 	activeToken := token
 	if activeToken == "" {
 		activeToken = os.Getenv("SNELLER_TOKEN")
@@ -291,6 +470,11 @@ func creds() db.Tenant {
 	if activeToken == "" {
 		exitf("no token provided via -token or $SNELLER_TOKEN")
 	}
+	return activeToken
+}
+
+func creds() db.Tenant {
+	activeToken := bearer()
 
 	provider, err := auth.Parse(authEndPoint)
 	if err != nil {
@@ -482,6 +666,99 @@ in the associated definition.json files (see also "create")
 			return true
 		},
 	},
+	{
+		name: "compact",
+		help: "<db> <table-pattern?>",
+		desc: `merge packed objects in a db (+ table-pattern)
+The command
+  $ sdb compact <db> <table-pattern>
+merges existing packed objects in the set of tables
+that match the glob pattern <table-pattern> without
+ingesting any new input objects.
+
+By default, objects of similar size are merged together.
+If the -w <path> flag is provided, then objects are instead
+merged when the maximum value of the timestamp at <path>
+falls within the same -window interval.
+
+If a table definition has a retention_policy, then
+objects that only contain expired rows are removed,
+and objects that contain some expired rows are rewritten.
+
+At most -m bytes of packed objects are rewritten per table.
+The merged objects are left to be removed by "gc".
+`,
+		run: func(args []string) bool {
+			if len(args) < 2 || len(args) > 3 {
+				return false
+			}
+			if len(args) == 2 {
+				args = append(args, "*")
+			}
+			compact(creds(), args[1], args[2])
+			return true
+		},
+	},
+	{
+		name: "delete",
+		help: "<db> <table> <predicate>",
+		desc: `delete rows from a table
+The command
+  $ sdb delete <db> <table> <predicate>
+removes every row matching the SQL predicate
+<predicate> (i.e. "user_id = 'abc'") from the table.
+
+Only the packed objects that contain matching rows
+are rewritten. The predicate may use comparisons
+against constants, IN, IS [NOT] NULL/MISSING,
+AND, OR, and NOT. Comparisons against timestamps
+are used to skip objects that cannot contain
+matching rows.
+
+The rewritten objects are left to be removed by "gc".
+`,
+		run: func(args []string) bool {
+			if len(args) != 4 {
+				return false
+			}
+			erase(creds(), args[1], args[2], args[3])
+			return true
+		},
+	},
+	{
+		name: "daemon",
+		help: "<sqs|dir|http> <queue-url|directory|listen-addr>",
+		desc: `continuously ingest new objects
+The command
+  $ sdb daemon <source> <arg>
+appends new objects to every table whose definition
+has a matching input pattern as soon as a notification
+for the object is received. The notification source is
+one of:
+
+  sqs <queue-url>    S3 event notifications read from an SQS queue
+                     (or an SQS-compatible service); the AWS credentials
+                     are taken from the environment
+  dir <directory>    new or modified files in a directory of the
+                     root filesystem, found by listing it periodically
+  http <listen-addr> S3 event notifications (optionally wrapped in SNS)
+                     POSTed to the given address; requests must present
+                     $SNELLER_NOTIFY_TOKEN as a bearer token (the daemon
+                     refuses to start without it unless -insecure is given)
+
+If -warm is given the URL of a snellerd instance, the daemon
+asks it to warm its caches with the new objects of each
+table it updates (see the /warmup endpoint of snellerd).
+The daemon runs until it is interrupted.
+`,
+		run: func(args []string) bool {
+			if len(args) != 3 {
+				return false
+			}
+			daemon(creds(), args[1], args[2])
+			return true
+		},
+	},
 	{
 		name: "gc",
 		help: "<db> <table-pattern?>",
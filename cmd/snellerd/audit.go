@@ -0,0 +1,140 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/expr"
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time         time.Time `json:"time"`
+	TenantID     string    `json:"tenant_id"`
+	QueryID      string    `json:"query_id"`
+	Client       string    `json:"client"`
+	Query        string    `json:"query"` // redacted
+	Tables       []string  `json:"tables"`
+	PlanHash     []byte    `json:"plan_hash,omitempty"`
+	Status       string    `json:"status"`
+	Duration     float64   `json:"duration"` // seconds
+	BytesScanned int64     `json:"bytes_scanned"`
+	CacheHits    int64     `json:"cache_hits"`
+	CacheMisses  int64     `json:"cache_misses"`
+	Cached       bool      `json:"cached,omitempty"` // served from the result cache
+}
+
+// statuses that are only reported by the audit log
+const (
+	statusDenied      = "denied"       // tenant not allowed to query
+	statusNotModified = "not_modified" // answered with 304 Not Modified
+)
+
+// auditLog writes one JSON object
+// per line for each query executed
+type auditLog struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{enc: json.NewEncoder(w)}
+}
+
+// write writes e to the log;
+// it is a no-op if a is nil
+func (a *auditLog) write(e *auditEntry) error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.enc.Encode(e)
+}
+
+// auditQuery writes e to the audit log, if there is one
+func (s *server) auditQuery(e *auditEntry) {
+	if err := s.audit.write(e); err != nil {
+		s.logger.Printf("writing audit log: %s", err)
+	}
+}
+
+// tablesVisitor collects the tables
+// referenced in a query, except for
+// the ones bound by WITH
+type tablesVisitor struct {
+	bound  map[string]bool
+	tables map[string]struct{}
+}
+
+func (t *tablesVisitor) add(e expr.Node) {
+	switch e := e.(type) {
+	case *expr.Select:
+		// walked separately
+	case *expr.Appended:
+		for i := range e.Values {
+			t.add(e.Values[i])
+		}
+	case *expr.Path:
+		if e.Rest == nil && t.bound[e.First] {
+			return
+		}
+		t.tables[expr.ToString(e)] = struct{}{}
+	default:
+		t.tables[expr.ToString(e)] = struct{}{}
+	}
+}
+
+func (t *tablesVisitor) Visit(e expr.Node) expr.Visitor {
+	s, ok := e.(*expr.Select)
+	if !ok || s.From == nil {
+		return t
+	}
+	// joined bindings that are paths into
+	// earlier bindings are not tables
+	aliases := make(map[string]bool)
+	for _, b := range s.From.Tables() {
+		if p, ok := b.Expr.(*expr.Path); !ok || !aliases[p.First] {
+			t.add(b.Expr)
+		}
+		aliases[b.Result()] = true
+	}
+	return t
+}
+
+// queryTables returns the sorted
+// list of tables referenced by q
+func queryTables(q *expr.Query) []string {
+	t := &tablesVisitor{
+		bound:  make(map[string]bool),
+		tables: make(map[string]struct{}),
+	}
+	for i := range q.With {
+		t.bound[q.With[i].Table] = true
+		expr.Walk(t, q.With[i].As)
+	}
+	expr.Walk(t, q.Body)
+	out := make([]string, 0, len(t.tables))
+	for k := range t.tables {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/db"
+	"github.com/SnellerInc/sneller/expr/partiql"
+)
+
+func TestQueryTables(t *testing.T) {
+	run := func(query string, want []string) {
+		t.Helper()
+		q, err := partiql.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+		got := queryTables(q)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got tables %v, want %v", query, got, want)
+		}
+	}
+	run("SELECT COUNT(*) FROM taxi WHERE fare > 10", []string{"taxi"})
+	run("SELECT * FROM db.foo", []string{"db.foo"})
+	run("SELECT * FROM t AS x, x.arr AS y", []string{"t"})
+	run("SELECT * FROM a ++ b", []string{"a", "b"})
+	run("SELECT * FROM (SELECT * FROM nested) WHERE x IN (SELECT y FROM other)", []string{"nested", "other"})
+	run("WITH x AS (SELECT a FROM db.t1) SELECT * FROM x, t2 AS y", []string{"db.t1", "t2"})
+}
+
+// rootlessTenant is a tenant that
+// is not allowed to read its root
+type rootlessTenant struct {
+	db.Tenant
+}
+
+func (r rootlessTenant) Root() (db.InputFS, error) {
+	return nil, errors.New("no root for you")
+}
+
+// test that requests that never run a query
+// are still recorded in the audit log
+func TestAuditRejected(t *testing.T) {
+	var audit lockedBuffer
+	query := func(self db.Tenant, method, text, hdr, val string) *httptest.ResponseRecorder {
+		t.Helper()
+		s := server{
+			logger: testlogger(t),
+			peers:  noPeers{},
+			auth:   testAuth{self},
+			audit:  newAuditLog(&audit),
+		}
+		r := httptest.NewRequest(method, "/executeQuery?query="+url.QueryEscape(text), nil)
+		r.Header.Set("Authorization", "Bearer snellerd-test")
+		if hdr != "" {
+			r.Header.Set(hdr, val)
+		}
+		w := httptest.NewRecorder()
+		s.executeQueryHandler(w, r)
+		return w
+	}
+	// last returns the most recent audit entry
+	last := func() auditEntry {
+		t.Helper()
+		var e auditEntry
+		lines := bytes.Split(bytes.TrimSpace(audit.Bytes()), []byte("\n"))
+		err := json.Unmarshal(lines[len(lines)-1], &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	const text = "SELECT 1 AS x"
+	tenant := newTenant(db.NewDirFS(t.TempDir()))
+	w := query(rootlessTenant{tenant}, http.MethodGet, text, "", "")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if e := last(); e.Status != statusDenied || e.Query == "" {
+		t.Errorf("403: got audit entry %+v", e)
+	}
+	w = query(tenant, http.MethodGet, "SELECT FROM", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("parse error: got status %d", w.Code)
+	}
+	if e := last(); e.Status != statusError || e.TenantID == "" {
+		t.Errorf("parse error: got audit entry %+v", e)
+	}
+	w = query(tenant, http.MethodHead, text, "", "")
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("no ETag in response (status %d)", w.Code)
+	}
+	w = query(tenant, http.MethodGet, text, "If-None-Match", etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: got status %d", w.Code)
+	}
+	if e := last(); e.Status != statusNotModified || e.QueryID == "" {
+		t.Errorf("If-None-Match: got audit entry %+v", e)
+	}
+	w = query(tenant, http.MethodGet, text, "If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since: got status %d", w.Code)
+	}
+	if e := last(); e.Status != statusNotModified {
+		t.Errorf("If-Modified-Since: got audit entry %+v", e)
+	}
+}
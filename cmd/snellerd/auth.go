@@ -15,49 +15,51 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"os"
-	"strings"
+	"fmt"
+	"io/fs"
 
 	"github.com/SnellerInc/sneller/auth"
+	"github.com/SnellerInc/sneller/db"
 )
 
+// prepareAuth sets s.auth from an authorization
+// specification; see auth.Parse for the
+// supported specifications
 func (s *server) prepareAuth(spec string) {
-	if strings.HasPrefix(spec, "http://") ||
-		strings.HasPrefix(spec, "https://") {
-		s.auth = &auth.S3Bearer{
-			URI: spec,
-		}
-		return
-	}
-
-	// for clarity, allow file:// in the spec
-	spec = strings.TrimPrefix(spec, "file://")
-	f, err := os.Open(spec)
-	if err != nil {
-		s.logger.Fatal(err)
-	}
-	var static fileCreds
-	err = json.NewDecoder(f).Decode(&f)
+	provider, err := auth.Parse(spec)
 	if err != nil {
 		s.logger.Fatal(err)
 	}
-	if static.Allowed != nil {
-		allowed := make(map[string]struct{}, len(static.Allowed))
-		notAllowed := errors.New("token not allowed")
-		static.CheckToken = func(tok string) error {
-			_, ok := allowed[tok]
-			if !ok {
-				return notAllowed
-			}
-			return nil
-		}
+	s.auth = provider
+}
+
+// policy returns the access policy of t
+// (see auth.Scoped), or nil if t may
+// access every table
+func policy(t db.Tenant) *auth.Policy {
+	if s, ok := t.(auth.Scoped); ok {
+		return s.Policy()
 	}
-	s.auth = &static
+	return nil
+}
+
+// allowDatabase returns whether t may
+// access any table in the database name
+func allowDatabase(t db.Tenant, name string) bool {
+	p := policy(t)
+	return p == nil || p.AllowDatabase(name)
+}
+
+// allowTable returns whether t may
+// access the table dbname.table
+func allowTable(t db.Tenant, dbname, table string) bool {
+	p := policy(t)
+	return p == nil || p.AllowTable(dbname, table)
 }
 
-type fileCreds struct {
-	auth.S3Static
-	Allowed []string `json:"allowed_tokens"`
+// errNoTable is returned in place of
+// a table the tenant may not access,
+// so that its existence is not revealed
+func errNoTable(dbname, table string) error {
+	return fmt.Errorf("table %s.%s: %w", dbname, table, fs.ErrNotExist)
 }
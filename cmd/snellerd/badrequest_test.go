@@ -29,11 +29,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/SnellerInc/sneller/auth"
 	"github.com/SnellerInc/sneller/db"
 	"github.com/SnellerInc/sneller/expr"
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/plan"
 	"github.com/SnellerInc/sneller/vm"
+	"github.com/google/uuid"
 )
 
 // tsbuf is a threadsafe buffer;
@@ -120,6 +122,12 @@ func (r *requester) getQueryJSON(db, query string) *http.Request {
 	return req
 }
 
+func (r *requester) getQueryAccept(db, query, accept string) *http.Request {
+	req := r.getQuery(db, query)
+	req.Header.Set("Accept", accept)
+	return req
+}
+
 func (r *requester) getDBs() *http.Request {
 	req := r.get("/databases")
 	req.Header.Set("Authorization", "Bearer snellerd-test")
@@ -146,9 +154,26 @@ func (a testAuth) Authorize(_ context.Context, token string) (db.Tenant, error)
 	if token == "snellerd-test" {
 		return a.self, nil
 	}
+	if token == "snellerd-scoped" {
+		return &scopedTenant{Tenant: a.self, policy: &auth.Policy{Tables: []string{"other*"}}}, nil
+	}
+	if token == "snellerd-support" {
+		return &scopedTenant{Tenant: a.self, policy: &auth.Policy{Tables: []string{"*"}, Roles: []string{"support"}}}, nil
+	}
+	if token == "snellerd-contractor" {
+		return &scopedTenant{Tenant: a.self, policy: &auth.Policy{Tables: []string{"default/parking"}}}, nil
+	}
 	return nil, errors.New("no such tenant: " + token)
 }
 
+// scopedTenant is a tenant restricted by a policy
+type scopedTenant struct {
+	db.Tenant
+	policy *auth.Policy
+}
+
+func (s *scopedTenant) Policy() *auth.Policy { return s.policy }
+
 func empty(t *testing.T, env cachedEnv) *server {
 	tt := testdirEnviron(t)
 	s := &server{
@@ -208,3 +233,58 @@ func TestBadRequest(t *testing.T) {
 		t.Logf("error text: %q", bodytext)
 	}
 }
+
+func TestCancelQuery(t *testing.T) {
+	testFiles(t)
+	s := empty(t, emptyEnv{})
+
+	httpsock := listen(t)
+	go s.Serve(httpsock, nil)
+
+	rqe := &requester{
+		t:    t,
+		host: "http://" + httpsock.Addr().String(),
+	}
+	del := func(id string) int {
+		req, err := http.NewRequest(http.MethodDelete, rqe.host+"/queries/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer snellerd-test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	self := s.auth.(testAuth).self.ID()
+	mine, theirs := uuid.New(), uuid.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.queries.add(mine, self, cancel)
+	defer s.queries.remove(mine)
+	other := false
+	s.queries.add(theirs, "other-tenant", func() { other = true })
+	defer s.queries.remove(theirs)
+
+	if code := del("not-a-uuid"); code != http.StatusBadRequest {
+		t.Errorf("invalid id: got status code %d", code)
+	}
+	if code := del(uuid.New().String()); code != http.StatusNotFound {
+		t.Errorf("missing id: got status code %d", code)
+	}
+	if code := del(theirs.String()); code != http.StatusNotFound {
+		t.Errorf("other tenant: got status code %d", code)
+	}
+	if other {
+		t.Error("canceled another tenant's query")
+	}
+	if code := del(mine.String()); code != http.StatusNoContent {
+		t.Errorf("got status code %d", code)
+	}
+	if ctx.Err() == nil {
+		t.Error("query not canceled")
+	}
+}
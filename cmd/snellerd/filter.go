@@ -15,8 +15,11 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/SnellerInc/sneller/date"
 	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/ion/blockfmt"
 )
 
@@ -173,6 +176,9 @@ func logical(left filter, op expr.LogicalOp, right filter) (filter, bool) {
 // compileComparisonFilter compiles a filter from a
 // comparison expression.
 func compileComparisonFilter(e *expr.Comparison) (filter, bool) {
+	if f, ok := compileValueFilter(e); ok {
+		return f, true
+	}
 	fn, ok1 := e.Left.(*expr.Builtin)
 	im, ok2 := e.Right.(expr.Integer)
 	op := e.Op
@@ -208,6 +214,92 @@ func compileComparisonFilter(e *expr.Comparison) (filter, bool) {
 	return nil, false
 }
 
+// compileValueFilter compiles a filter from a
+// comparison between a path and an integer or string
+// constant, which can be evaluated using the ranges
+// recorded for cluster keys. The filter only ever
+// returns never or maybe, since values that do not
+// contribute to a range (like NULL) are not known
+// to satisfy the comparison.
+func compileValueFilter(e *expr.Comparison) (filter, bool) {
+	path, ok := e.Left.(*expr.Path)
+	imm, op := e.Right, e.Op
+	if !ok {
+		path, ok = e.Right.(*expr.Path)
+		if !ok {
+			return nil, false
+		}
+		imm, op = e.Left, e.Op.Flip()
+	}
+	var d ion.Datum
+	switch imm := imm.(type) {
+	case expr.Integer:
+		d = ion.Int(imm)
+	case expr.String:
+		d = ion.String(imm)
+	default:
+		return nil, false
+	}
+	// outside reports whether "path op d" is
+	// false for every value in [min, max]
+	var outside func(lo, hi int) bool
+	switch op {
+	case expr.Equals:
+		outside = func(lo, hi int) bool { return lo < 0 || hi > 0 }
+	case expr.Less:
+		outside = func(lo, hi int) bool { return lo <= 0 }
+	case expr.LessEquals:
+		outside = func(lo, hi int) bool { return lo < 0 }
+	case expr.Greater:
+		outside = func(lo, hi int) bool { return hi >= 0 }
+	case expr.GreaterEquals:
+		outside = func(lo, hi int) bool { return hi > 0 }
+	default:
+		return nil, false
+	}
+	return pathFilter(path, func(r blockfmt.Range) ternary {
+		lo, ok1 := compareValue(d, r.Min())
+		hi, ok2 := compareValue(d, r.Max())
+		if ok1 && ok2 && outside(lo, hi) {
+			return never
+		}
+		return maybe
+	}), true
+}
+
+// compareValue compares an integer or string
+// constant with a value from a range, or returns
+// false if the values are not comparable
+func compareValue(d, v ion.Datum) (int, bool) {
+	switch d := d.(type) {
+	case ion.Int:
+		switch v := v.(type) {
+		case ion.Int:
+			return cmp3(d < v, d > v), true
+		case ion.Uint:
+			if d < 0 {
+				return -1, true
+			}
+			return cmp3(ion.Uint(d) < v, ion.Uint(d) > v), true
+		}
+	case ion.String:
+		if v, ok := v.(ion.String); ok {
+			return strings.Compare(string(d), string(v)), true
+		}
+	}
+	return 0, false
+}
+
+func cmp3(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
 // compareFunc returns a function that returns whether
 // "min op v" always, maybe, or never evaluates to true
 // for any value v in the range [min, max] (inclusive).
@@ -472,6 +472,55 @@ func TestCompileFilter(t *testing.T) {
 				expect: never,
 			},
 		},
+	}, {
+		expr: parseExpr("tenant = 'b'"),
+		checks: []check{{
+			// Within range
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"tenant"}, ion.String("a"), ion.String("c"),
+			)},
+			expect: maybe,
+		}, {
+			// After the range
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"tenant"}, ion.String("c"), ion.String("d"),
+			)},
+			expect: never,
+		}, {
+			// Not comparable
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"tenant"}, ion.Int(1), ion.Int(2),
+			)},
+			expect: maybe,
+		}},
+	}, {
+		expr: parseExpr("shard < 10"),
+		checks: []check{{
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"shard"}, ion.Int(9), ion.Uint(20),
+			)},
+			expect: maybe,
+		}, {
+			// Right at min
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"shard"}, ion.Int(10), ion.Int(20),
+			)},
+			expect: never,
+		}},
+	}, {
+		expr: parseExpr("10 <= shard"),
+		checks: []check{{
+			// Right at max
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"shard"}, ion.Int(-1), ion.Int(10),
+			)},
+			expect: maybe,
+		}, {
+			ranges: []blockfmt.Range{blockfmt.NewRange(
+				[]string{"shard"}, ion.Int(-1), ion.Int(9),
+			)},
+			expect: never,
+		}},
 	}}
 	for i := range cases {
 		c := cases[i]
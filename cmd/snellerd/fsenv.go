@@ -15,9 +15,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"path"
 	"time"
 
@@ -96,28 +98,33 @@ func (f *fsEnv) CacheValues() ([]byte, time.Time) {
 	return f.hash.Sum(nil), f.modtime.Time()
 }
 
-func (f *fsEnv) index(e expr.Node) (*blockfmt.Index, error) {
-	var dbname, table string
-	var err error
+// tableName returns the database and
+// table referenced by a table expression
+func (f *fsEnv) tableName(e expr.Node) (dbname, table string, err error) {
 	p, ok := e.(*expr.Path)
 	if !ok {
-		return nil, syntax("unexpected table expression %q", expr.ToString(e))
+		return "", "", syntax("unexpected table expression %q", expr.ToString(e))
 	}
 	// if a database was already provided,
 	// then we expect just the table identifier;
 	// otherwise, we expect db.table
 	if f.db == "" {
-		dbname, table, err = tsplit(p)
-	} else {
-		dbname = f.db
-		table = p.First
-		if p.Rest != nil {
-			err = syntax("trailing path expression %q in table not supported", p.Rest)
-		}
+		return tsplit(p)
+	}
+	if p.Rest != nil {
+		return "", "", syntax("trailing path expression %q in table not supported", p.Rest)
 	}
+	return f.db, p.First, nil
+}
+
+func (f *fsEnv) index(e expr.Node) (*blockfmt.Index, error) {
+	dbname, table, err := f.tableName(e)
 	if err != nil {
 		return nil, err
 	}
+	if !allowTable(f.tenant, dbname, table) {
+		return nil, errNoTable(dbname, table)
+	}
 
 	// if a query references the same table
 	// more than once (common with CTEs, nested SELECTs, etc.),
@@ -182,6 +189,51 @@ func (f *fsEnv) TimeRange(tbl expr.Node, p *expr.Path) (min, max date.Time, ok b
 	return index.TimeRange(p)
 }
 
+var _ plan.TableAuthorizer = (*fsEnv)(nil)
+
+// AllowTable implements plan.TableAuthorizer.AllowTable
+func (f *fsEnv) AllowTable(dbname, table string) bool {
+	if dbname == "" {
+		dbname = f.db
+	}
+	return allowTable(f.tenant, dbname, table)
+}
+
+var _ plan.Policer = (*fsEnv)(nil)
+
+// Policy implements plan.Policer.Policy
+func (f *fsEnv) Policy(e expr.Node) (*plan.Policy, error) {
+	p := policy(f.tenant)
+	if p == nil || (len(p.Roles) == 0 && len(p.Access) == 0) {
+		return nil, nil
+	}
+	dbname, table, err := f.tableName(e)
+	if err != nil || !allowTable(f.tenant, dbname, table) {
+		// not a table; Stat will produce the error
+		return nil, nil
+	}
+	var def *db.Definition
+	if len(p.Roles) > 0 {
+		def, err = db.OpenDefinition(f.root, dbname, table)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var out *plan.Policy
+	for _, ap := range p.AccessPolicies(dbname, table, def) {
+		pp, err := plan.ParsePolicy(ap.Filter, ap.Mask)
+		if err != nil {
+			return nil, fmt.Errorf("access policy of table %s.%s: %s", dbname, table, err)
+		}
+		out = out.Merge(pp)
+	}
+	if out != nil {
+		// the policy is part of the plan
+		io.WriteString(f.hash, out.String())
+	}
+	return out, nil
+}
+
 var _ plan.TableLister = (*fsEnv)(nil)
 
 // ListTables implements plan.TableLister.ListTables
@@ -189,6 +241,9 @@ func (f *fsEnv) ListTables(dbname string) ([]string, error) {
 	if dbname == "" {
 		dbname = f.db
 	}
+	if !allowDatabase(f.tenant, dbname) {
+		return nil, fmt.Errorf("database %q: %w", dbname, fs.ErrNotExist)
+	}
 	for i := range f.lists {
 		if f.lists[i].db == dbname {
 			return f.lists[i].list, nil
@@ -198,6 +253,15 @@ func (f *fsEnv) ListTables(dbname string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if policy(f.tenant) != nil {
+		allowed := li[:0:0]
+		for i := range li {
+			if allowTable(f.tenant, dbname, li[i]) {
+				allowed = append(allowed, li[i])
+			}
+		}
+		li = allowed
+	}
 	f.lists = append(f.lists, savedList{
 		db:   dbname,
 		list: li,
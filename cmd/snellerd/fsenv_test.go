@@ -24,6 +24,8 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -38,6 +40,7 @@ import (
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/ion/blockfmt"
 	"github.com/SnellerInc/sneller/tenant"
+	"github.com/google/uuid"
 )
 
 func TestMain(m *testing.M) {
@@ -134,6 +137,12 @@ func testdirEnviron(t *testing.T) db.Tenant {
 		Inputs: []db.Input{
 			{Pattern: "file://a-prefix/*.10n"},
 		},
+		Policies: map[string]*db.AccessPolicy{
+			"support": {
+				Filter: "Route = '2A75'",
+				Mask:   map[string]string{"Location": "HASH('salt', Location)"},
+			},
+		},
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -210,6 +219,13 @@ func TestSimpleFS(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	var audit lockedBuffer
+	s.audit = newAuditLog(&audit)
+	s.results = &resultCache{
+		Memory: 1024 * 1024,
+		Disk:   1024 * 1024,
+		Dir:    t.TempDir(),
+	}
 	httpsock := listen(t)
 	// this second peer is just here
 	// to allow for the query to actually
@@ -451,4 +467,676 @@ SELECT SUM(total_amount) FROM default.taxi WHERE VendorID = (SELECT VendorID FRO
 		}
 		checkTiming(res)
 	}
+
+	// get coverage of CSV responses
+	r := rq.getQueryAccept("", `SELECT Ticket, Location FROM default.parking WHERE Route = '2A75' AND IssueTime <= 1100`, "text/csv")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", res.Status)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 4 || lines[0] != "Ticket,Location" || !strings.HasPrefix(lines[1], "1106506402,") {
+		t.Errorf("unexpected CSV output %q", got)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("content type %q", ct)
+	}
+	// SELECT * has no known columns,
+	// so it is rejected before any output
+	for _, accept := range []string{"text/csv", "application/vnd.apache.arrow.stream"} {
+		r = rq.getQueryAccept("", `SELECT * FROM default.parking LIMIT 1`, accept)
+		res, err = http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("SELECT * as %s: status %s", accept, res.Status)
+		}
+	}
+
+	testParams(t, rq)
+	testExplain(t, rq)
+	testAsync(t, rq, &s)
+	testResultCache(t, rq)
+	testLimits(t, rq)
+	testMetrics(t, &s)
+	testAudit(t, &audit)
+	testScoped(t, rq)
+	testPolicies(t, rq)
+	testWarmup(t, rq)
+}
+
+// test that /warmup reads the objects
+// added since the previous warm-up
+func testWarmup(t *testing.T, rq *requester) {
+	warm := func(method, since string) (int, warmStatus) {
+		t.Helper()
+		uri := "/warmup?database=default&table=parking"
+		if since != "" {
+			uri += "&since=" + url.QueryEscape(since)
+		}
+		req := rq.get(uri)
+		req.Method = method
+		req.Header.Set("Authorization", "Bearer snellerd-test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var st warmStatus
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted {
+			if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode, st
+	}
+	wait := func() warmStatus {
+		t.Helper()
+		for {
+			code, st := warm(http.MethodGet, "")
+			if code != http.StatusOK {
+				t.Fatalf("GET /warmup: %d", code)
+			}
+			if !st.Running {
+				return st
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	code, st := warm(http.MethodPost, "")
+	if code != http.StatusAccepted || st.Blobs == 0 || st.Bytes == 0 {
+		t.Fatalf("POST /warmup: %d %+v", code, st)
+	}
+	st = wait()
+	if st.Error != "" || st.Finished == nil || st.CacheHits+st.CacheMisses == 0 {
+		t.Fatalf("warm-up: %+v", st)
+	}
+	// nothing has been added since
+	code, st = warm(http.MethodPost, "")
+	if code != http.StatusOK || st.Blobs != 0 || st.Running {
+		t.Fatalf("second POST /warmup: %d %+v", code, st)
+	}
+	// everything should already be cached
+	code, st = warm(http.MethodPost, "1970-01-01T00:00:00Z")
+	if code != http.StatusAccepted || st.Blobs == 0 {
+		t.Fatalf("POST /warmup?since=...: %d %+v", code, st)
+	}
+	st = wait()
+	if st.Error != "" || st.CacheMisses != 0 || st.CacheHits == 0 {
+		t.Errorf("re-warm: %+v", st)
+	}
+}
+
+// test that the access policies selected
+// by a tenant's roles filter and mask rows
+func testPolicies(t *testing.T, rq *requester) {
+	get := func(token, query string) (int, string) {
+		t.Helper()
+		req := rq.getQueryJSON("default", query)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+	equivalent := []struct {
+		support, admin string
+	}{
+		{
+			"SELECT COUNT(*) FROM parking",
+			"SELECT COUNT(*) FROM parking WHERE Route = '2A75'",
+		},
+		{
+			"SELECT Ticket, Location FROM parking ORDER BY Ticket LIMIT 100",
+			"SELECT Ticket, HASH('salt', Location) AS Location FROM parking WHERE Route = '2A75' ORDER BY Ticket LIMIT 100",
+		},
+		{
+			"SELECT COUNT(*) FROM taxi",
+			"SELECT COUNT(*) FROM taxi",
+		},
+	}
+	for _, q := range equivalent {
+		code, want := get("snellerd-test", q.admin)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got %d %q", q.admin, code, want)
+		}
+		code, got := get("snellerd-support", q.support)
+		if code != http.StatusOK || got != want {
+			t.Errorf("%s: got %d %q, wanted %q", q.support, code, got, want)
+		}
+	}
+	// whole rows would expose masked values
+	for _, query := range []string{
+		"SELECT * FROM parking LIMIT 1",
+		"SELECT p FROM parking AS p LIMIT 1",
+	} {
+		if code, body := get("snellerd-support", query); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %q", query, code, body)
+		}
+	}
+	// errors and plans must not reveal the policy
+	query := "SELECT COUNT(*) FROM parking WHERE Location = 'ALHAMBRA/WESTLAKE'"
+	if code, body := get("snellerd-support", query); code != http.StatusBadRequest || strings.Contains(body, "salt") {
+		t.Errorf("%s: got %d %q", query, code, body)
+	}
+	req := rq.get("/explain?database=default&query=" + url.QueryEscape("SELECT COUNT(*) FROM parking"))
+	req.Header.Set("Authorization", "Bearer snellerd-support")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("explain: got %s", res.Status)
+	}
+}
+
+// test that tenants restricted by a policy
+// cannot see the databases and tables
+// they have not been granted
+func testScoped(t *testing.T, rq *requester) {
+	token := "snellerd-scoped"
+	get := func(req *http.Request) (int, string) {
+		t.Helper()
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+	if code, body := get(rq.getDBs()); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("/databases: got %d %q", code, body)
+	}
+	if code, body := get(rq.getTables("default")); code != http.StatusNotFound {
+		t.Errorf("/tables: got %d %q", code, body)
+	}
+	if code, body := get(rq.getInputs("default", "taxi")); code != http.StatusNotFound {
+		t.Errorf("/inputs: got %d %q", code, body)
+	}
+	for _, db := range []string{"", "default"} {
+		query := "SELECT COUNT(*) FROM default.taxi"
+		if db != "" {
+			query = "SELECT COUNT(*) FROM taxi"
+		}
+		if code, body := get(rq.getQuery(db, query)); code != http.StatusNotFound {
+			t.Errorf("%s: got %d %q", query, code, body)
+		}
+	}
+
+	// a tenant that may only access default.parking
+	token = "snellerd-contractor"
+	if code, body := get(rq.getDBs()); code != http.StatusOK || !strings.Contains(body, `"default"`) {
+		t.Errorf("/databases: got %d %q", code, body)
+	}
+	if code, body := get(rq.getTables("default")); code != http.StatusOK || strings.TrimSpace(body) != `["parking"]` {
+		t.Errorf("/tables: got %d %q", code, body)
+	}
+	if code, body := get(rq.getInputs("default", "taxi")); code != http.StatusNotFound {
+		t.Errorf("/inputs: got %d %q", code, body)
+	}
+	queries := []struct {
+		query  string
+		status int
+		output string
+	}{
+		{"SELECT COUNT(*) FROM taxi", http.StatusNotFound, ""},
+		{"SELECT COUNT(*) FROM parking", http.StatusOK, `{"count": 1023}`},
+		// globs only expand to the tables the tenant may access
+		{`SELECT COUNT(*) FROM TABLE_GLOB("[pt]a*")`, http.StatusOK, `{"count": 1023}`},
+		{`SELECT COUNT(*) FROM TABLE_PATTERN("ta.*")`, http.StatusNotFound, ""},
+		{`SELECT COUNT(*) FROM TABLE_GLOB("taxi")`, http.StatusNotFound, ""},
+	}
+	for _, q := range queries {
+		code, body := get(rq.getQueryJSON("default", q.query))
+		if code != q.status || (q.output != "" && !strings.Contains(body, q.output)) {
+			t.Errorf("%s: got %d %q", q.query, code, body)
+		}
+	}
+}
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) Bytes() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+func testAudit(t *testing.T, audit *lockedBuffer) {
+	d := json.NewDecoder(bytes.NewReader(audit.Bytes()))
+	ok, scanned := 0, 0
+	for {
+		var e auditEntry
+		err := d.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// requests that fail before the query
+		// is parsed have no query or tables
+		if e.TenantID != "test-tenant" || e.QueryID == "" || e.Client == "" || (e.Query != "" && len(e.Tables) == 0) {
+			t.Errorf("incomplete audit entry %+v", e)
+		}
+		if e.Status != statusOK {
+			continue
+		}
+		ok++
+		if e.BytesScanned > 0 {
+			scanned++
+		}
+		if strings.Contains(e.Query, "2A75") {
+			t.Errorf("unredacted query %q", e.Query)
+		}
+	}
+	if ok == 0 || scanned == 0 {
+		t.Errorf("%d successful queries, %d with bytes scanned", ok, scanned)
+	}
+}
+
+func testMetrics(t *testing.T, s *server) {
+	w := httptest.NewRecorder()
+	s.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics: %d", w.Code)
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("bad metrics line %q", line)
+		}
+		f, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metrics line %q: %s", line, err)
+		}
+		values[line[:i]] = f
+	}
+	ok := values[`sneller_queries_total{status="ok"}`]
+	if ok == 0 {
+		t.Error("no successful queries counted")
+	}
+	if n := values[`sneller_query_duration_seconds_bucket{status="ok",le="+Inf"}`]; n != ok {
+		t.Errorf("histogram count %g != %g queries", n, ok)
+	}
+	if values["sneller_bytes_scanned_total"] == 0 {
+		t.Error("no bytes scanned")
+	}
+	if n := values["sneller_tenant_processes"]; n != 1 {
+		t.Errorf("%g tenant processes", n)
+	}
+	if n := values["sneller_peers"]; n != 2 {
+		t.Errorf("%g peers", n)
+	}
+	if _, ok := values["sneller_cache_evictions_total"]; !ok {
+		t.Error("missing sneller_cache_evictions_total")
+	}
+}
+
+func testParams(t *testing.T, rq *requester) {
+	const (
+		query  = `SELECT Ticket FROM default.parking WHERE Route = ? AND IssueTime <= ?`
+		params = `["2A75", 1100]`
+		want   = `[{"Ticket": 1106506402},{"Ticket": 1106506413},{"Ticket": 1106506424}]`
+	)
+	run := func(r *http.Request, code int) string {
+		t.Helper()
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != code {
+			t.Fatalf("status %s (%s)", res.Status, got)
+		}
+		return string(got)
+	}
+
+	// parameters in the URL
+	r := rq.getQueryJSON("", query)
+	r.URL.RawQuery += "&params=" + url.QueryEscape(params)
+	if got := run(r, http.StatusOK); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// parameters in a JSON body
+	body := `{"query": ` + strconv.Quote(query) + `, "params": ` + params + `}`
+	r, err := http.NewRequest(http.MethodPost, rq.host+"/executeQuery", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer snellerd-test")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	if got := run(r, http.StatusOK); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// a parameter is never interpreted as query text
+	r = rq.getQueryJSON("", query)
+	r.URL.RawQuery += "&params=" + url.QueryEscape(`["2A75' OR '' = '", 1100]`)
+	if got := run(r, http.StatusOK); got != "[]" {
+		t.Errorf("got %q for injected parameter", got)
+	}
+
+	// missing and invalid parameters
+	r = rq.getQueryJSON("", query)
+	run(r, http.StatusBadRequest)
+	r = rq.getQueryJSON("", query)
+	r.URL.RawQuery += "&params=" + url.QueryEscape(`{"x": 1}`)
+	run(r, http.StatusBadRequest)
+}
+
+func (r *requester) explain(query string, analyze bool) *explainResult {
+	uri := "/explain?query=" + url.QueryEscape(query)
+	if analyze {
+		uri += "&analyze"
+	}
+	req := r.get(uri)
+	req.Header.Set("Authorization", "Bearer snellerd-test")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		r.t.Fatalf("explain: status %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		r.t.Errorf("explain: content type %q", ct)
+	}
+	out := new(explainResult)
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		r.t.Fatal(err)
+	}
+	return out
+}
+
+func testExplain(t *testing.T, rq *requester) {
+	const query = `SELECT COUNT(*) FROM default.parking WHERE Route = '2A75' AND IssueTime <= 1100`
+	res := rq.explain(query, false)
+	if res.Plan == "" || res.Trace == "" {
+		t.Fatalf("missing plan or trace: %+v", res)
+	}
+	if !strings.Contains(res.Plan, "UNION MAP") {
+		t.Errorf("expected a split plan:\n%s", res.Plan)
+	}
+	if len(res.Splits) == 0 || res.Blocks == 0 {
+		t.Errorf("missing split information: %+v", res)
+	}
+	if len(res.Ops) != 0 {
+		t.Error("got op statistics without analyze")
+	}
+
+	res = rq.explain(query, true)
+	if res.Error != "" {
+		t.Fatalf("explain analyze: %s", res.Error)
+	}
+	if len(res.Ops) == 0 {
+		t.Fatalf("no op statistics: %+v", res)
+	}
+	if res.QueryID == "" || res.BytesScanned == 0 {
+		t.Errorf("missing statistics: %+v", res)
+	}
+	last := res.Ops[len(res.Ops)-1]
+	if last.RowsOut != 1 {
+		t.Errorf("final op %q has %d rows out", last.Op, last.RowsOut)
+	}
+	if res.Ops[0].RowsOut == 0 {
+		t.Errorf("scan %q has no rows out", res.Ops[0].Op)
+	}
+	for i := range res.Ops {
+		if strings.HasPrefix(res.Ops[i].Op, "WHERE") && res.Ops[i].RowsOut != 3 {
+			t.Errorf("filter %q has %d rows out", res.Ops[i].Op, res.Ops[i].RowsOut)
+		}
+	}
+}
+
+func (r *requester) async(method, uri, accept string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, r.host+uri, body)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer snellerd-test")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return res
+}
+
+func (r *requester) asyncStatus(id string) (asyncStatus, int) {
+	res := r.async(http.MethodGet, "/queries/"+id, "", nil)
+	defer res.Body.Close()
+	var st asyncStatus
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	return st, res.StatusCode
+}
+
+func (r *requester) asyncResults(id, params, accept string) []byte {
+	res := r.async(http.MethodGet, "/queries/"+id+"/results"+params, accept, nil)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		r.t.Fatalf("results: %s %s", res.Status, body)
+	}
+	return body
+}
+
+func testAsync(t *testing.T, rq *requester, s *server) {
+	const query = `SELECT Ticket FROM default.parking WHERE Route = '2A75' AND IssueTime <= 1100 ORDER BY Ticket LIMIT 10`
+	res := rq.async(http.MethodPost, "/queries", "", strings.NewReader(query))
+	var st asyncStatus
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("submit: %s %s", res.Status, body)
+	}
+	err := json.Unmarshal(body, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc := res.Header.Get("Location"); loc != "/queries/"+st.QueryID {
+		t.Errorf("Location %q", loc)
+	}
+	id := st.QueryID
+	for start := time.Now(); st.State == asyncRunning; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for query")
+		}
+		time.Sleep(10 * time.Millisecond)
+		var code int
+		st, code = rq.asyncStatus(id)
+		if code != http.StatusOK {
+			t.Fatalf("status: %d", code)
+		}
+	}
+	if st.State != asyncDone || st.Rows != 3 || st.Expires == nil {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	all := strings.Split(strings.TrimSpace(string(rq.asyncResults(id, "", "application/x-ndjson"))), "\n")
+	if len(all) != 3 {
+		t.Fatalf("got %d rows: %q", len(all), all)
+	}
+	page := strings.TrimSpace(string(rq.asyncResults(id, "?offset=1&limit=1", "application/x-ndjson")))
+	if page != all[1] {
+		t.Errorf("page %q, want %q", page, all[1])
+	}
+	var arr []json.RawMessage
+	err = json.Unmarshal(rq.asyncResults(id, "?offset=2", "application/json"), &arr)
+	if err != nil || len(arr) != 1 {
+		t.Errorf("JSON page %v: %v", arr, err)
+	}
+	var js bytes.Buffer
+	_, err = ion.ToJSON(&js, bufio.NewReader(bytes.NewReader(rq.asyncResults(id, "?limit=2", ""))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(js.String()); got != all[0]+"\n"+all[1] {
+		t.Errorf("ion page %q", got)
+	}
+
+	// the status is persisted along with
+	// the results, so another server
+	// (or this one after a restart) can find it
+	s.async.remove(uuid.MustParse(id))
+	if st2, code := rq.asyncStatus(id); code != http.StatusOK || st2.Rows != 3 {
+		t.Errorf("stored status %+v (%d)", st2, code)
+	}
+
+	res = rq.async(http.MethodDelete, "/queries/"+id, "", nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: %s", res.Status)
+	}
+	if _, code := rq.asyncStatus(id); code != http.StatusNotFound {
+		t.Errorf("status after delete: %d", code)
+	}
+}
+
+func testResultCache(t *testing.T, rq *requester) {
+	const query = `SELECT Ticket, Location FROM default.parking WHERE Route = '2A75' AND IssueTime <= 1100 ORDER BY Ticket LIMIT 5`
+	run := func(accept string, nocache bool) (string, []byte) {
+		t.Helper()
+		req := rq.getQueryAccept("", query, accept)
+		req.Header.Set("Authorization", "Bearer snellerd-test")
+		req.Header.Set("TE", "trailers")
+		if nocache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s", res.Status, body)
+		}
+		if res.Trailer.Get("Server-Timing") == "" {
+			t.Error("no server timings")
+		}
+		return res.Header.Get("X-Sneller-Cache"), body
+	}
+	for _, accept := range []string{"application/json", "application/ion"} {
+		c0, body0 := run(accept, false)
+		c1, body1 := run(accept, false)
+		c2, body2 := run(accept, true)
+		if c0 != "miss" || c1 != "hit" || c2 != "" {
+			t.Errorf("%s: X-Sneller-Cache %q, %q, %q", accept, c0, c1, c2)
+		}
+		if accept == "application/ion" {
+			// the final status differs
+			body0, body1, body2 = trimStatus(t, body0), trimStatus(t, body1), trimStatus(t, body2)
+		}
+		if !bytes.Equal(body0, body1) || !bytes.Equal(body0, body2) {
+			t.Errorf("%s: cached result %q differs from %q", accept, body1, body0)
+		}
+	}
+}
+
+func testLimits(t *testing.T, rq *requester) {
+	const query = `SELECT Ticket FROM default.parking WHERE Route = '2A75' AND IssueTime <= 1100`
+	run := func(params string) (int, string) {
+		t.Helper()
+		req := rq.getQueryAccept("", query, "application/ion")
+		req.Header.Set("Authorization", "Bearer snellerd-test")
+		req.Header.Set("Cache-Control", "no-cache")
+		req.URL.RawQuery += "&" + params
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+	tcs := []struct {
+		params string
+		status int
+		text   string
+	}{
+		// rejected at plan time
+		{"max_scanned_bytes=1", http.StatusBadRequest, "query limit exceeded"},
+		{"max_rows=x", http.StatusBadRequest, "invalid max_rows"},
+		{"timeout=-1s", http.StatusBadRequest, "invalid timeout"},
+		// rejected during execution
+		{"max_rows=2", http.StatusOK, "query limit exceeded: more than 2 rows of output"},
+		{"max_output_bytes=10", http.StatusOK, "query limit exceeded: more than 10 bytes of output"},
+		{"max_rows=3&timeout=1m", http.StatusOK, "final_status"},
+	}
+	for i := range tcs {
+		status, body := run(tcs[i].params)
+		if status != tcs[i].status || !strings.Contains(body, tcs[i].text) {
+			t.Errorf("%s: got %d %q", tcs[i].params, status, body)
+		}
+	}
+}
+
+// trimStatus converts an ion response to
+// JSON without the final_status annotation
+func trimStatus(t *testing.T, body []byte) []byte {
+	var out bytes.Buffer
+	_, err := ion.ToJSON(&out, bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
 }
@@ -0,0 +1,795 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/db"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+	"github.com/SnellerInc/sneller/plan"
+	"github.com/SnellerInc/sneller/tenant"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+	"github.com/SnellerInc/sneller/usock"
+	"github.com/google/uuid"
+)
+
+// the results of asynchronous queries are
+// stored in the tenant's root filesystem as
+//
+//	results/<id>.ion  (the result rows)
+//	results/<id>.json (the asyncRecord)
+const asyncDir = "results"
+
+// defaultAsyncTTL is the default amount of time
+// that the results of asynchronous queries are kept
+const defaultAsyncTTL = 24 * time.Hour
+
+// asyncSweepInterval is the minimum amount of
+// time between sweeps of a tenant's stored results
+const asyncSweepInterval = time.Hour
+
+// minimum size of the parts
+// in which results are uploaded
+const minResultPart = 1024 * 1024
+
+const (
+	asyncRunning  = "running"
+	asyncDone     = "done"
+	asyncFailed   = "failed"
+	asyncCanceled = "canceled"
+)
+
+// asyncStatus is the status of an asynchronous query
+type asyncStatus struct {
+	QueryID      string     `json:"query_id"`
+	State        string     `json:"state"`
+	Error        string     `json:"error,omitempty"`
+	Submitted    time.Time  `json:"submitted"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Rows         int64      `json:"rows"`
+	Size         int64      `json:"size"`
+	BytesScanned int64      `json:"bytes_scanned"`
+	CacheHits    int64      `json:"cache_hits"`
+	CacheMisses  int64      `json:"cache_misses"`
+}
+
+func (a *asyncStatus) expired(now time.Time) bool {
+	return a.Expires != nil && now.After(*a.Expires)
+}
+
+// pageSize is the approximate number of bytes
+// of results between consecutive page marks
+const pageSize = 1024 * 1024
+
+// pageMark is a position in the results
+// at which the rows can be decoded without
+// reading any of the preceding data
+type pageMark struct {
+	Row    int64 `json:"row"`
+	Offset int64 `json:"offset"`
+}
+
+// asyncRecord is the form in which the
+// status of a query is stored alongside
+// its results
+type asyncRecord struct {
+	asyncStatus
+	Pages []pageMark `json:"pages,omitempty"`
+}
+
+// page returns the last mark in r.Pages
+// that precedes row, or the zero mark if
+// there is no such mark
+func (r *asyncRecord) page(row int64) pageMark {
+	i := sort.Search(len(r.Pages), func(i int) bool {
+		return r.Pages[i].Row > row
+	})
+	if i == 0 {
+		return pageMark{}
+	}
+	return r.Pages[i-1]
+}
+
+func resultsPath(id uuid.UUID) string {
+	return path.Join(asyncDir, id.String()+".ion")
+}
+
+func statusPath(id uuid.UUID) string {
+	return path.Join(asyncDir, id.String()+".json")
+}
+
+type asyncQuery struct {
+	tenant string
+	root   blockfmt.UploadFS
+	record asyncRecord
+}
+
+// asyncList tracks the asynchronous queries
+// submitted to this server until their results expire
+// and when the stored results of each tenant
+// were last swept for expired entries
+type asyncList struct {
+	lock    sync.Mutex
+	queries map[uuid.UUID]*asyncQuery
+	swept   map[string]time.Time
+}
+
+func (l *asyncList) add(id uuid.UUID, q *asyncQuery) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.queries == nil {
+		l.queries = make(map[uuid.UUID]*asyncQuery)
+	}
+	l.queries[id] = q
+}
+
+// get returns the status of the query with the
+// given id if it exists and belongs to tenant
+func (l *asyncList) get(id uuid.UUID, tenant string) (asyncRecord, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	q, ok := l.queries[id]
+	if !ok || q.tenant != tenant {
+		return asyncRecord{}, false
+	}
+	return q.record, true
+}
+
+func (l *asyncList) update(id uuid.UUID, fn func(r *asyncRecord)) asyncRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	q := l.queries[id]
+	fn(&q.record)
+	return q.record
+}
+
+// sweep reports whether the stored results
+// of tenant are due to be swept at now,
+// and if so records that they have been
+func (l *asyncList) sweep(tenant string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if last, ok := l.swept[tenant]; ok && now.Sub(last) < asyncSweepInterval {
+		return false
+	}
+	if l.swept == nil {
+		l.swept = make(map[string]time.Time)
+	}
+	l.swept[tenant] = now
+	return true
+}
+
+func (l *asyncList) remove(id uuid.UUID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.queries, id)
+}
+
+// rangeReader is satisfied by s3.File
+type rangeReader interface {
+	RangeReader(off, width int64) (io.ReadCloser, error)
+}
+
+// partWriter is an io.WriteCloser
+// that uploads its input in parts
+type partWriter struct {
+	up   blockfmt.Uploader
+	part int64
+	buf  []byte
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	min := p.up.MinPartSize()
+	if min < minResultPart {
+		min = minResultPart
+	}
+	if len(p.buf) >= min {
+		p.part++
+		if err := p.up.Upload(p.part, p.buf); err != nil {
+			return 0, err
+		}
+		p.buf = nil
+	}
+	return len(b), nil
+}
+
+func (p *partWriter) Close() error {
+	return p.up.Close(p.buf)
+}
+
+func (p *partWriter) abort() {
+	if ab, ok := p.up.(interface{ Abort() error }); ok {
+		ab.Abort()
+	}
+}
+
+// copyRows copies a stream of ion values from src
+// to dst and returns the number of rows copied
+// (that is, the number of values that are
+// not symbol tables or padding)
+//
+// Roughly every pageSize bytes, copyRows writes
+// the complete symbol table before the next row
+// and returns the position of that row as a pageMark,
+// so that later rows can be read without
+// reading everything that precedes them.
+func copyRows(dst io.Writer, src io.Reader) (int64, []pageMark, error) {
+	rd := bufio.NewReaderSize(src, 64*1024)
+	var st ion.Symtab
+	var marks []pageMark
+	var symbuf ion.Buffer
+	rows, written, last := int64(0), int64(0), int64(0)
+	write := func(b []byte) error {
+		n, err := dst.Write(b)
+		written += int64(n)
+		return err
+	}
+	var buf []byte
+	for {
+		t, size, err := ion.Peek(rd)
+		if err == io.EOF {
+			return rows, marks, nil
+		}
+		if err != nil {
+			return rows, marks, err
+		}
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return rows, marks, err
+		}
+		if t == ion.AnnotationType {
+			if _, err := st.Unmarshal(buf); err != nil {
+				return rows, marks, err
+			}
+		} else if t != ion.NullType || size == 1 {
+			if written-last >= pageSize {
+				last = written
+				marks = append(marks, pageMark{Row: rows, Offset: written})
+				symbuf.Reset()
+				st.Marshal(&symbuf, true)
+				if err := write(symbuf.Bytes()); err != nil {
+					return rows, marks, err
+				}
+			}
+			rows++
+		}
+		if err := write(buf); err != nil {
+			return rows, marks, err
+		}
+	}
+}
+
+// writePage copies rows [offset, offset+limit)
+// from the ion stream in src to dst, preceded by
+// the symbol table necessary to decode them.
+// A limit of zero means no limit.
+func writePage(dst io.Writer, src io.Reader, offset, limit int64) error {
+	rd := bufio.NewReaderSize(src, 64*1024)
+	var st ion.Symtab
+	var out ion.Buffer
+	// symtab is set when the symbol
+	// table needs to be written before
+	// the next row is written
+	symtab := true
+	row := int64(0)
+	flush := func() error {
+		_, err := dst.Write(out.Bytes())
+		out.Reset()
+		return err
+	}
+	var buf []byte
+	for limit == 0 || row < offset+limit {
+		t, size, err := ion.Peek(rd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return err
+		}
+		if t == ion.AnnotationType {
+			if _, err := st.Unmarshal(buf); err != nil {
+				return err
+			}
+			symtab = true
+			continue
+		}
+		if t == ion.NullType && size > 1 {
+			continue // padding
+		}
+		row++
+		if row <= offset {
+			continue
+		}
+		if symtab {
+			st.Marshal(&out, true)
+			symtab = false
+		}
+		out.UnsafeAppend(buf)
+		if len(out.Bytes()) >= 64*1024 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if symtab && row <= offset {
+		// no rows; just write the symbol table
+		// so that the output is valid ion
+		st.Marshal(&out, true)
+	}
+	return flush()
+}
+
+// asyncSubmitHandler handles POST /queries by
+// planning the query, starting it and returning
+// its status without waiting for it to complete
+//
+// example invocation:
+// curl -v -X POST -H 'Authorization: sneller' --data-raw 'SELECT * FROM nation' 'http://localhost:8000/queries?database=sf1'
+func (s *server) asyncSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	start := time.Now()
+	tenantCreds, err := s.getTenant(ctx, w, r)
+	if err != nil {
+		return
+	}
+	query, params, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	limits, err := s.queryLimits(tenantCreds.ID(), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defaultDatabase := r.URL.Query().Get("database")
+	parsedQuery, err := partiql.ParseWithParams(query, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	root, err := tenantCreds.Root()
+	if err != nil {
+		http.Error(w, "tenant ID disallowed", http.StatusForbidden)
+		s.logger.Printf("refusing query: %s", err)
+		return
+	}
+	out, ok := root.(blockfmt.UploadFS)
+	if !ok {
+		http.Error(w, "tenant storage cannot store query results", http.StatusNotImplemented)
+		return
+	}
+	queryID := uuid.New()
+	client, _ := remoteAddr(r)
+	audit := &auditEntry{
+		Time:     start,
+		TenantID: tenantCreds.ID(),
+		QueryID:  queryID.String(),
+		Client:   client,
+		Query:    parsedQuery.Redacted(),
+		Tables:   queryTables(parsedQuery),
+	}
+
+	var workerID tnproto.ID
+	hash := sha256.Sum256([]byte(tenantCreds.ID()))
+	copy(workerID[:], hash[:])
+
+	planEnv, err := environ(tenantCreds, defaultDatabase)
+	if err != nil {
+		http.Error(w, "tenant ID disallowed", http.StatusForbidden)
+		s.logger.Printf("refusing query: %s", err)
+		return
+	}
+	endPoints := s.peers.Get()
+	var tree *plan.Tree
+	if len(endPoints) == 0 {
+		tree, err = plan.New(parsedQuery, planEnv)
+	} else {
+		planSplitter := s.newSplitter(workerID, endPoints)
+		tree, err = plan.NewSplit(parsedQuery, planEnv, planSplitter)
+		if err == nil && !checkScan(w, planSplitter.maxscan, &limits) {
+			audit.Status = statusLimit
+			s.auditQuery(audit)
+			return
+		}
+	}
+	if err != nil {
+		audit.Status = statusError
+		s.auditQuery(audit)
+		s.planError(w, err)
+		return
+	}
+	tree.Limits = limits.plan()
+	audit.PlanHash, _ = planEnv.CacheValues()
+
+	q := &asyncQuery{
+		tenant: tenantCreds.ID(),
+		root:   out,
+		record: asyncRecord{
+			asyncStatus: asyncStatus{
+				QueryID:   queryID.String(),
+				State:     asyncRunning,
+				Submitted: start.UTC(),
+			},
+		},
+	}
+	// the query outlives the request, so it
+	// can only be canceled with DELETE /queries/{id}
+	qctx, cancel := withTimeout(context.Background(), &limits)
+	s.queries.add(queryID, tenantCreds.ID(), cancel)
+	s.async.add(queryID, q)
+	s.sweepAsync(tenantCreds.ID(), out)
+	go func() {
+		defer cancel()
+		defer s.queries.remove(queryID)
+		s.runAsync(qctx, queryID, q.root, workerID, tree, &limits, audit)
+	}()
+	s.logger.Printf("query ID %s submitted", queryID)
+	w.Header().Set("Location", "/queries/"+queryID.String())
+	writeResultResponse(w, http.StatusAccepted, &q.record.asyncStatus)
+}
+
+// runAsync runs an asynchronous query to completion
+// and stores its results and final status
+func (s *server) runAsync(ctx context.Context, id uuid.UUID, out blockfmt.UploadFS, workerID tnproto.ID, tree *plan.Tree, limits *queryLimits, audit *auditEntry) {
+	var stats plan.ExecStats
+	start := time.Now()
+	rows, size, pages, err := s.spool(ctx, out, resultsPath(id), workerID, tree, &stats)
+	if err == nil {
+		err = checkScanned(&stats, limits)
+	}
+	elapsed := time.Since(start)
+
+	state, status := asyncDone, statusOK
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	switch msg := limitError(err, limits, timedOut); {
+	case err == nil:
+	case msg != "":
+		state, status = asyncFailed, statusLimit
+		err = errors.New(msg)
+	case ctx.Err() != nil:
+		state, status = asyncCanceled, statusCanceled
+	case errors.Is(err, tenant.ErrOverloaded):
+		state, status = asyncFailed, statusOverloaded
+	default:
+		state, status = asyncFailed, statusError
+	}
+	if err != nil {
+		s.logger.Printf("query ID %s %q %s: %v", id, audit.Query, state, err)
+	} else {
+		s.logger.Printf("query id %s duration %s bytes %d hits %d misses %d rows %d",
+			id, elapsed, stats.BytesScanned, stats.CacheHits, stats.CacheMisses, rows)
+	}
+	s.metrics.query(status, elapsed, stats.BytesScanned, stats.CacheHits, stats.CacheMisses)
+	audit.Status = status
+	audit.Duration = elapsed.Seconds()
+	audit.BytesScanned = stats.BytesScanned
+	audit.CacheHits = stats.CacheHits
+	audit.CacheMisses = stats.CacheMisses
+	s.auditQuery(audit)
+
+	ttl := s.asyncTTL
+	if ttl == 0 {
+		ttl = defaultAsyncTTL
+	}
+	final := s.async.update(id, func(st *asyncRecord) {
+		now := time.Now().UTC()
+		expires := now.Add(ttl)
+		st.State = state
+		st.Finished = &now
+		st.Expires = &expires
+		st.Rows = rows
+		st.Size = size
+		st.BytesScanned = stats.BytesScanned
+		st.CacheHits = stats.CacheHits
+		st.CacheMisses = stats.CacheMisses
+		st.Pages = pages
+		if err != nil && state == asyncFailed {
+			st.Error = err.Error()
+		}
+	})
+	buf, _ := json.Marshal(&final)
+	if _, err := out.WriteFile(statusPath(id), buf); err != nil {
+		s.logger.Printf("query ID %s: storing status: %s", id, err)
+	}
+	time.AfterFunc(ttl, func() {
+		s.async.remove(id)
+		removeResults(out, id)
+	})
+}
+
+// spool executes tree and uploads
+// the results to name in out, returning
+// the number of rows and bytes uploaded
+// and the page marks within the results
+func (s *server) spool(ctx context.Context, out blockfmt.UploadFS, name string, workerID tnproto.ID, tree *plan.Tree, stats *plan.ExecStats) (int64, int64, []pageMark, error) {
+	here, there, err := usock.SocketPair()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer here.Close()
+	rc, err := s.manager.Do(workerID, tree, tnproto.OutputRaw, there)
+	there.Close()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	up, err := out.Create(name)
+	if err != nil {
+		rc.Close()
+		return 0, 0, nil, err
+	}
+	// wait for the final status concurrently
+	// with reading the query output
+	errc := make(chan error, 1)
+	go func() {
+		deadlined := setDeadline(rc, queryKillTimeout)
+		err := check(ctx, rc, stats)
+		if err != nil && deadlined && isTimeout(err) {
+			s.manager.Quit(workerID)
+		}
+		errc <- err
+	}()
+	pw := &partWriter{up: up}
+	rows, pages, err := copyRows(pw, here)
+	if err != nil {
+		// makes the tenant stop writing
+		here.Close()
+	}
+	if cerr := <-errc; cerr != nil {
+		err = cerr
+	}
+	if err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		pw.abort()
+		return 0, 0, nil, err
+	}
+	return rows, up.Size(), pages, nil
+}
+
+// removeResults removes the stored
+// results of the query with the given id
+func removeResults(root fs.FS, id uuid.UUID) error {
+	rfs, ok := root.(db.RemoveFS)
+	if !ok {
+		return fmt.Errorf("cannot remove results from %T", root)
+	}
+	err := rfs.Remove(resultsPath(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = rfs.Remove(statusPath(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sweepResults removes the stored results
+// of the queries in root that expired before now
+func sweepResults(root fs.FS, now time.Time) error {
+	list, err := fs.ReadDir(root, asyncDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for i := range list {
+		name := list[i].Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		buf, err := fs.ReadFile(root, statusPath(id))
+		if err != nil {
+			continue
+		}
+		var st asyncStatus
+		if json.Unmarshal(buf, &st) != nil || !st.expired(now) {
+			continue
+		}
+		if err := removeResults(root, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepAsync removes the expired results of
+// tenant from root in the background if they
+// have not been swept since this server started
+// or for at least asyncSweepInterval
+//
+// Results are removed when they expire by the
+// server that ran the query, but that does not
+// happen if the server is restarted before then.
+func (s *server) sweepAsync(tenant string, root fs.FS) {
+	now := time.Now()
+	if !s.async.sweep(tenant, now) {
+		return
+	}
+	go func() {
+		if err := sweepResults(root, now); err != nil {
+			s.logger.Printf("tenant %s: sweeping query results: %s", tenant, err)
+		}
+	}()
+}
+
+// asyncLookup returns the status of an asynchronous
+// query, either from this server or from the tenant's
+// storage (if it was submitted to another server or
+// before this server was restarted)
+func (s *server) asyncLookup(t db.Tenant, id uuid.UUID) (asyncRecord, fs.FS, bool) {
+	root, err := t.Root()
+	if err != nil {
+		return asyncRecord{}, nil, false
+	}
+	s.sweepAsync(t.ID(), root)
+	if st, ok := s.async.get(id, t.ID()); ok {
+		return st, root, true
+	}
+	buf, err := fs.ReadFile(root, statusPath(id))
+	if err != nil {
+		return asyncRecord{}, nil, false
+	}
+	var st asyncRecord
+	if json.Unmarshal(buf, &st) != nil || st.QueryID != id.String() {
+		return asyncRecord{}, nil, false
+	}
+	return st, root, true
+}
+
+// asyncStatusHandler handles GET /queries/{id}
+func (s *server) asyncStatusHandler(w http.ResponseWriter, t db.Tenant, id uuid.UUID) {
+	st, root, ok := s.asyncLookup(t, id)
+	if !ok {
+		http.Error(w, "no such query", http.StatusNotFound)
+		return
+	}
+	if st.expired(time.Now()) {
+		removeResults(root, id)
+		http.Error(w, "query results expired", http.StatusGone)
+		return
+	}
+	writeResultResponse(w, http.StatusOK, &st.asyncStatus)
+}
+
+// asyncResultsHandler handles GET /queries/{id}/results
+//
+// The optional offset and limit parameters select
+// a page of rows from the results.
+//
+// example invocation:
+// curl -v -H 'Authorization: sneller' -H 'Accept: application/x-ndjson' 'http://localhost:8000/queries/{id}/results?offset=100&limit=100'
+func (s *server) asyncResultsHandler(w http.ResponseWriter, r *http.Request, t db.Tenant, id uuid.UUID) {
+	var offset, limit int64
+	var err error
+	if str := r.URL.Query().Get("offset"); str != "" {
+		offset, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if str := r.URL.Query().Get("limit"); str != "" {
+		limit, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	var sep byte
+	accept := r.Header.Get("Accept")
+	switch accept {
+	case "", "*/*", "application/ion":
+		accept = "application/ion"
+	case "application/x-ndjson", "application/x-jsonlines":
+		sep = '\n'
+	case "application/json":
+		sep = ','
+	default:
+		http.Error(w, "invalid 'Accept' header", http.StatusBadRequest)
+		return
+	}
+
+	st, root, ok := s.asyncLookup(t, id)
+	if !ok {
+		http.Error(w, "no such query", http.StatusNotFound)
+		return
+	}
+	if st.expired(time.Now()) {
+		removeResults(root, id)
+		http.Error(w, "query results expired", http.StatusGone)
+		return
+	}
+	if st.State != asyncDone {
+		http.Error(w, fmt.Sprintf("query is %s", st.State), http.StatusConflict)
+		return
+	}
+	f, err := root.Open(resultsPath(id))
+	if err != nil {
+		s.logger.Printf("query ID %s: opening results: %s", id, err)
+		http.Error(w, "cannot read query results", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// start reading at the last page mark
+	// before the first requested row, if possible
+	var src io.Reader = f
+	if m := st.page(offset); m.Offset > 0 {
+		switch f := f.(type) {
+		case rangeReader:
+			rc, err := f.RangeReader(m.Offset, st.Size-m.Offset)
+			if err != nil {
+				s.logger.Printf("query ID %s: opening results: %s", id, err)
+				http.Error(w, "cannot read query results", http.StatusInternalServerError)
+				return
+			}
+			defer rc.Close()
+			src, offset = rc, offset-m.Row
+		case io.ReaderAt:
+			src, offset = io.NewSectionReader(f, m.Offset, st.Size-m.Offset), offset-m.Row
+		}
+	}
+	w.Header().Set("Content-Type", accept)
+	w.Header().Set("X-Sneller-Query-ID", id.String())
+	w.Header().Set("X-Sneller-Total-Rows", itoa(st.Rows))
+	w.WriteHeader(http.StatusOK)
+	if sep == 0 {
+		err = writePage(w, src, offset, limit)
+	} else {
+		jw := ion.NewJSONWriter(w, sep)
+		err = writePage(jw, src, offset, limit)
+		if err == nil {
+			err = jw.Close()
+		}
+	}
+	if err != nil {
+		s.logger.Printf("query ID %s: writing results: %s", id, err)
+	}
+}
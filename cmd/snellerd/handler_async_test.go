@@ -0,0 +1,114 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+
+	"github.com/google/uuid"
+)
+
+func TestCopyRowsPages(t *testing.T) {
+	// write enough rows for several pages,
+	// changing the symbol table part-way through
+	var src ion.Buffer
+	var st ion.Symtab
+	const rows = 200000
+	for i := 0; i < rows; i++ {
+		if i%50000 == 0 {
+			st.Intern("field" + itoa(int64(i)))
+			st.Marshal(&src, i == 0)
+		}
+		src.BeginStruct(-1)
+		src.BeginField(st.Intern("field0"))
+		src.WriteInt(int64(i))
+		src.BeginField(st.Intern("field" + itoa(int64(i/50000*50000))))
+		src.WriteString("xyzzy")
+		src.EndStruct()
+	}
+	var dst bytes.Buffer
+	n, marks, err := copyRows(&dst, bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != rows {
+		t.Fatalf("copied %d rows, want %d", n, rows)
+	}
+	if len(marks) < 2 {
+		t.Fatalf("only %d page marks for %d bytes", len(marks), dst.Len())
+	}
+	rec := asyncRecord{Pages: marks}
+	for _, offset := range []int64{0, 1, 60000, 123456, rows - 1} {
+		var want, got bytes.Buffer
+		if err := writePage(ion.NewJSONWriter(&want, '\n'), bytes.NewReader(dst.Bytes()), offset, 10); err != nil {
+			t.Fatal(err)
+		}
+		m := rec.page(offset)
+		if offset > 0 && m.Offset == 0 && offset >= marks[0].Row {
+			t.Fatalf("no page mark for row %d", offset)
+		}
+		err := writePage(ion.NewJSONWriter(&got, '\n'), bytes.NewReader(dst.Bytes()[m.Offset:]), offset-m.Row, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("offset %d from row %d: got %q, want %q", offset, m.Row, got.String(), want.String())
+		}
+	}
+}
+
+func TestSweepResults(t *testing.T) {
+	root := blockfmt.NewDirFS(t.TempDir())
+	now := time.Now()
+	store := func(expires time.Time) uuid.UUID {
+		id := uuid.New()
+		st := asyncRecord{asyncStatus: asyncStatus{
+			QueryID: id.String(),
+			State:   asyncDone,
+			Expires: &expires,
+		}}
+		buf, _ := json.Marshal(&st)
+		if _, err := root.WriteFile(statusPath(id), buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := root.WriteFile(resultsPath(id), []byte{0xe0, 0x01, 0x00, 0xea}); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	expired := store(now.Add(-time.Minute))
+	live := store(now.Add(time.Hour))
+	if err := sweepResults(root, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{resultsPath(expired), statusPath(expired)} {
+		if _, err := fs.Stat(root, p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected it to be removed; got %v", p, err)
+		}
+	}
+	for _, p := range []string{resultsPath(live), statusPath(live)} {
+		if _, err := fs.Stat(root, p); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+}
@@ -45,6 +45,9 @@ func (s *server) databasesHandler(w http.ResponseWriter, r *http.Request) {
 
 	out := make([]database, 0)
 	for i := range res {
+		if !allowDatabase(tenant, res[i]) {
+			continue
+		}
 		if pattern == "" || matchPattern(res[i], pattern) {
 			out = append(out, database{
 				Name: res[i],
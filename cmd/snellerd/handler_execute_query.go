@@ -15,12 +15,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net"
 	"net/http"
 	"strconv"
@@ -81,24 +85,27 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	authElapsed := time.Since(start)
 
-	var query []byte
-	switch r.Method {
-	case http.MethodGet, http.MethodHead:
-		str := r.URL.Query().Get("query")
-		if str == "" {
-			http.Error(w, "no query parameter", http.StatusBadRequest)
-			return
-		}
-		query = []byte(str)
+	// every request from an authenticated tenant
+	// is audited, whether or not the query runs
+	queryID := uuid.New()
+	client, _ := remoteAddr(r)
+	audit := &auditEntry{
+		Time:     start,
+		TenantID: tenantCreds.ID(),
+		QueryID:  queryID.String(),
+		Client:   client,
+		Status:   statusError,
+	}
+	defer s.auditQuery(audit)
 
-	case http.MethodPost:
-		// restrict the size of the query text to something reasonable
-		body := http.MaxBytesReader(w, r.Body, 128*1024*1024)
-		query, err = io.ReadAll(body)
-		if err != nil {
-			http.Error(w, "cannot read query", http.StatusBadRequest)
-			return
-		}
+	query, params, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	limits, err := s.queryLimits(tenantCreds.ID(), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Determine the output format
@@ -116,6 +123,18 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		encodingFormat = tnproto.OutputChunkedIon
 	case "application/json":
 		encodingFormat = tnproto.OutputChunkedJSONArray
+	case "text/csv":
+		if explicitJSON {
+			http.Error(w, fmt.Sprintf("can't request JSON and explicitly accept %q", acceptHeader), http.StatusBadRequest)
+			return
+		}
+		encodingFormat = tnproto.OutputChunkedCSV
+	case "application/vnd.apache.arrow.stream":
+		if explicitJSON {
+			http.Error(w, fmt.Sprintf("can't request JSON and explicitly accept %q", acceptHeader), http.StatusBadRequest)
+			return
+		}
+		encodingFormat = tnproto.OutputChunkedArrow
 	case "", "*/*":
 		if explicitJSON {
 			encodingFormat = tnproto.OutputChunkedJSON
@@ -131,14 +150,15 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defaultDatabase := r.URL.Query().Get("database")
-	parsedQuery, err := partiql.Parse(query)
+	parsedQuery, err := partiql.ParseWithParams(query, params)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	normalized := parsedQuery.Text()
-	redacted := parsedQuery.Text()
-	queryID := uuid.New()
+	redacted := parsedQuery.Redacted()
+	audit.Query = redacted
+	audit.Tables = queryTables(parsedQuery)
 
 	var workerID tnproto.ID
 	hash := sha256.Sum256([]byte(tenantCreds.ID()))
@@ -146,6 +166,7 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	planEnv, err := environ(tenantCreds, defaultDatabase)
 	if err != nil {
+		audit.Status = statusDenied
 		http.Error(w, "tenant ID disallowed", http.StatusForbidden)
 		s.logger.Printf("refusing query: %s", err)
 		return
@@ -163,21 +184,39 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("X-Sneller-Max-Scanned-Bytes", itoa(planSplitter.maxscan))
 			w.Header().Set("X-Sneller-Total-Table-Bytes", itoa(planSplitter.total))
 		}
+		if err == nil && !checkScan(w, planSplitter.maxscan, &limits) {
+			audit.Status = statusLimit
+			return
+		}
 	}
 	if err != nil {
 		s.planError(w, err)
 		return
 	}
+	// the tabular formats need the columns
+	// before the first row is written
+	if (encodingFormat == tnproto.OutputChunkedCSV || encodingFormat == tnproto.OutputChunkedArrow) && len(tree.OutputType) == 0 {
+		http.Error(w, fmt.Sprintf("%s output requires a query with known columns; list the columns instead of using SELECT *", acceptHeader), http.StatusBadRequest)
+		return
+	}
+	tree.Limits = limits.plan()
 	s.logger.Printf("query id %s auth %s planning %s", queryID, authElapsed, time.Since(start))
 
 	planHash, newestBlobTime := planEnv.CacheValues()
+	audit.PlanHash = planHash
 
 	// hash the tenant/query/plan/format to an eTag
+	// (the parameters are part of the normalized query)
 	hasher := sha256.New()
 	hasher.Write([]byte(tenantCreds.ID()))
 	io.WriteString(hasher, normalized)
 	hasher.Write(planHash)
 	hasher.Write([]byte{byte(encodingFormat)})
+	if limits.MaxRows > 0 || limits.MaxOutput > 0 {
+		// a result is only valid for
+		// output limits it satisfies
+		fmt.Fprintf(hasher, "%d/%d", limits.MaxRows, limits.MaxOutput)
+	}
 	eTag := `"` + base64.RawStdEncoding.EncodeToString(hasher.Sum(nil)) + `"`
 
 	// Add the ETag to the response
@@ -193,6 +232,7 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 			for _, matchEtag := range strings.Split(ifNoneMatch, ",") {
 				matchEtag = strings.TrimSpace(matchEtag)
 				if eTag == matchEtag {
+					audit.Status = statusNotModified
 					w.WriteHeader(http.StatusNotModified)
 					return
 				}
@@ -208,6 +248,7 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 				}
 
 				if !newestBlobTime.After(ifModifiedSinceTime) {
+					audit.Status = statusNotModified
 					w.WriteHeader(http.StatusNotModified)
 					return
 				}
@@ -218,6 +259,7 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", acceptHeader)
 	w.Header().Add("X-Sneller-Query-ID", queryID.String())
 	if r.Method == http.MethodHead {
+		audit.Status = statusOK
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -231,9 +273,83 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		req:   r,
 		res:   w,
 	}
+	// the query is canceled when the client
+	// disconnects or when it is explicitly
+	// canceled with DELETE /queries/{id}
+	qctx, cancel := withTimeout(ctx, &limits)
+	defer cancel()
+	s.queries.add(queryID, tenantCreds.ID(), cancel)
+	defer s.queries.remove(queryID)
+
+	var stats plan.ExecStats
 	startrun := time.Now()
-	rc, err := s.manager.Do(workerID, tree, encodingFormat, conn)
+	finish := func(status string) {
+		elapsed := time.Since(startrun)
+		s.metrics.query(status, elapsed, stats.BytesScanned, stats.CacheHits, stats.CacheMisses)
+		audit.Status = status
+		audit.Duration = elapsed.Seconds()
+		audit.BytesScanned = stats.BytesScanned
+		audit.CacheHits = stats.CacheHits
+		audit.CacheMisses = stats.CacheMisses
+	}
+
+	// identical queries are served from the
+	// result cache while the ETag (which includes
+	// the plan hash) is unchanged
+	cacheable := s.results != nil && !contains(r.Header.Values("Cache-Control"), "no-cache")
+	if cacheable {
+		if data, ok := s.results.get(eTag); ok {
+			audit.Cached = true
+			w.Header().Set("X-Sneller-Cache", "hit")
+			raw, err := conn.raw()
+			if err == nil {
+				_, err = raw.Write(data)
+			}
+			if err != nil {
+				finish(statusError)
+				s.logger.Printf("query ID %s writing cached result: %v", queryID, err)
+				return
+			}
+			finish(statusOK)
+			if sendTrailer {
+				setTiming(w, time.Since(startrun), &stats)
+			}
+			if encodingFormat == tnproto.OutputChunkedIon {
+				writeStatus(w, &stats)
+			}
+			s.logger.Printf("query id %s served from result cache", queryID)
+			return
+		}
+		w.Header().Set("X-Sneller-Cache", "miss")
+	}
+	var into net.Conn = conn
+	var tee *resultTee
+	if cacheable {
+		// capture the output on its way to the client
+		tee, err = newResultTee(s.results.maxEntry(), cancel)
+		if err != nil {
+			s.logger.Printf("query ID %s: not caching result: %s", queryID, err)
+			tee = nil
+		} else {
+			into = tee.there
+		}
+	}
+	rc, err := s.manager.Do(workerID, tree, encodingFormat, into)
+	if tee != nil {
+		var dst io.Writer
+		if err == nil {
+			if raw, herr := conn.raw(); herr == nil {
+				dst = raw
+			}
+		}
+		tee.start(dst)
+	}
 	if err != nil {
+		if errors.Is(err, tenant.ErrOverloaded) {
+			finish(statusOverloaded)
+		} else {
+			finish(statusError)
+		}
 		if !conn.hijacked {
 			// didn't call w.WriteHeader() yet;
 			// we can write a plaintext error
@@ -256,13 +372,38 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.logger.Printf("query ID %s plan transfer took %s", queryID, time.Since(startrun))
-	var stats plan.ExecStats
 	deadlined := setDeadline(rc, queryKillTimeout)
-	err = tenant.Check(rc, &stats)
+	err = check(qctx, rc, &stats)
+	if err == nil {
+		err = checkScanned(&stats, &limits)
+	}
+	if tee != nil {
+		// wait for all of the output to be
+		// written before the final status
+		data, ok := tee.wait()
+		if err == nil && ok {
+			s.results.put(eTag, tenantCreds.ID(), data)
+		}
+	}
 	if err != nil {
 		if sendTrailer {
 			setError(w)
 		}
+		timedOut := errors.Is(qctx.Err(), context.DeadlineExceeded)
+		if msg := limitError(err, &limits, timedOut); msg != "" {
+			finish(statusLimit)
+			if encodingFormat == tnproto.OutputChunkedIon {
+				writeError(w, msg)
+			}
+			s.logger.Printf("query ID %s %q: %s", queryID, redacted, msg)
+			return
+		}
+		if qctx.Err() != nil {
+			finish(statusCanceled)
+			s.logger.Printf("query ID %s %q canceled", queryID, redacted)
+			return
+		}
+		finish(statusError)
 		s.logger.Printf("query ID %s %q execution failed (check): %v", queryID, redacted, err)
 		if deadlined && isTimeout(err) {
 			s.logger.Printf("query ID %s killing tenant ID %s due to timeout", queryID, workerID)
@@ -271,6 +412,7 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	elapsed := time.Since(startrun)
+	finish(statusOK)
 	if sendTrailer {
 		setTiming(w, elapsed, &stats)
 	}
@@ -281,6 +423,105 @@ func (s *server) executeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		queryID, elapsed, stats.BytesScanned, stats.CacheHits, stats.CacheMisses)
 }
 
+// readQuery reads the query text and its parameters,
+// writing an error response if they are missing or invalid
+//
+// The query text is the query parameter or the request
+// body, and the parameters (if any) are a JSON array in
+// the params parameter. A JSON request body is instead
+// an object with "query" and "params" fields.
+func readQuery(w http.ResponseWriter, r *http.Request) ([]byte, []expr.Constant, bool) {
+	var query, params []byte
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		str := r.URL.Query().Get("query")
+		if str == "" {
+			http.Error(w, "no query parameter", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		query = []byte(str)
+		params = []byte(r.URL.Query().Get("params"))
+	case http.MethodPost:
+		// restrict the size of the query text to something reasonable
+		body := http.MaxBytesReader(w, r.Body, 128*1024*1024)
+		text, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, "cannot read query", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		query = text
+		params = []byte(r.URL.Query().Get("params"))
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+			var req struct {
+				Query  string          `json:"query"`
+				Params json.RawMessage `json:"params"`
+			}
+			if err := json.Unmarshal(text, &req); err != nil || req.Query == "" {
+				http.Error(w, "invalid JSON query request", http.StatusBadRequest)
+				return nil, nil, false
+			}
+			query, params = []byte(req.Query), req.Params
+		}
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	if len(params) == 0 {
+		return query, nil, true
+	}
+	lst, err := decodeParams(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return query, lst, true
+}
+
+// decodeParams decodes a JSON array of
+// query parameters; like JSON input data,
+// strings that are timestamps are timestamps
+func decodeParams(text []byte) ([]expr.Constant, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(text, &raw); err != nil {
+		return nil, fmt.Errorf("params must be a JSON array: %w", err)
+	}
+	var st ion.Symtab
+	out := make([]expr.Constant, len(raw))
+	for i := range raw {
+		d, err := ion.FromJSON(&st, json.NewDecoder(bytes.NewReader(raw[i])))
+		if err != nil {
+			return nil, fmt.Errorf("parameter %d: %w", i+1, err)
+		}
+		if _, ok := d.(ion.UntypedNull); ok {
+			out[i] = expr.Null{}
+			continue
+		}
+		c, ok := expr.AsConstant(d)
+		if !ok {
+			return nil, fmt.Errorf("parameter %d: unsupported value %s", i+1, raw[i])
+		}
+		out[i] = c
+	}
+	return out, nil
+}
+
+// check is tenant.Check, except that the query
+// is canceled if ctx is canceled first
+func check(ctx context.Context, rc io.ReadCloser, stats *plan.ExecStats) error {
+	// closing the error pipe early
+	// tells the tenant to stop the query
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rc.Close()
+		case <-done:
+		}
+	}()
+	return tenant.Check(rc, stats)
+}
+
 // satisfied by net.Conn and friends
 type readDeadliner interface {
 	SetReadDeadline(time.Time) error
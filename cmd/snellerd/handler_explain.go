@@ -0,0 +1,236 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/plan"
+	"github.com/SnellerInc/sneller/plan/pir"
+	"github.com/SnellerInc/sneller/tenant"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+	"github.com/google/uuid"
+)
+
+// explainResult is the response to /explain
+type explainResult struct {
+	Query string `json:"query"`
+	// Trace is the textual representation
+	// of the query IR, and Plan is the
+	// textual representation of the plan
+	Trace string `json:"trace"`
+	Plan  string `json:"plan"`
+
+	// split plans only
+	TotalBytes      int64          `json:"total_bytes,omitempty"`
+	MaxScannedBytes int64          `json:"max_scanned_bytes,omitempty"`
+	Blocks          int            `json:"blocks,omitempty"`
+	PrunedBlocks    int            `json:"pruned_blocks,omitempty"`
+	Splits          []explainSplit `json:"splits,omitempty"`
+
+	// analyze only
+	QueryID      string      `json:"query_id,omitempty"`
+	Elapsed      string      `json:"elapsed,omitempty"`
+	BytesScanned int64       `json:"bytes_scanned,omitempty"`
+	CacheHits    int64       `json:"cache_hits,omitempty"`
+	CacheMisses  int64       `json:"cache_misses,omitempty"`
+	Ops          []explainOp `json:"ops,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+type explainSplit struct {
+	Peer            string `json:"peer"`
+	Blobs           int    `json:"blobs"`
+	MaxScannedBytes int64  `json:"max_scanned_bytes"`
+}
+
+type explainOp struct {
+	Tree    int    `json:"tree"`
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	RowsIn  int64  `json:"rows_in"`
+	RowsOut int64  `json:"rows_out"`
+	Time    string `json:"time"`
+}
+
+func (e *explainResult) split(s *splitter) {
+	e.TotalBytes = s.total
+	e.MaxScannedBytes = s.maxscan
+	e.Blocks = s.blocks
+	e.PrunedBlocks = s.pruned
+	for i := range s.assigned {
+		if s.assigned[i].blobs == 0 {
+			continue
+		}
+		e.Splits = append(e.Splits, explainSplit{
+			Peer:            s.peers[i].String(),
+			Blobs:           s.assigned[i].blobs,
+			MaxScannedBytes: s.assigned[i].scan,
+		})
+	}
+}
+
+func (e *explainResult) analyze(stats *plan.ExecStats, elapsed time.Duration) {
+	e.Elapsed = elapsed.String()
+	e.BytesScanned = stats.BytesScanned
+	e.CacheHits = stats.CacheHits
+	e.CacheMisses = stats.CacheMisses
+	for i := range stats.Ops {
+		o := &stats.Ops[i]
+		e.Ops = append(e.Ops, explainOp{
+			Tree:    o.Tree,
+			Index:   o.Index,
+			Op:      o.Op,
+			RowsIn:  o.RowsIn,
+			RowsOut: o.RowsOut,
+			Time:    o.Time.String(),
+		})
+	}
+}
+
+// explainHandler returns the plan for a query
+// as JSON rather than executing it.
+// If the "analyze" parameter is present,
+// the query is also executed (with its results
+// discarded) and the response includes the
+// statistics for each op in the plan.
+func (s *server) explainHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tenantCreds, err := s.getTenant(ctx, w, r)
+	if err != nil {
+		return
+	}
+	query, params, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	analyze := r.URL.Query().Has("analyze")
+	defaultDatabase := r.URL.Query().Get("database")
+	parsedQuery, err := partiql.ParseWithParams(query, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := &explainResult{Query: parsedQuery.Text()}
+
+	var workerID tnproto.ID
+	hash := sha256.Sum256([]byte(tenantCreds.ID()))
+	copy(workerID[:], hash[:])
+
+	planEnv, err := environ(tenantCreds, defaultDatabase)
+	if err != nil {
+		http.Error(w, "tenant ID disallowed", http.StatusForbidden)
+		s.logger.Printf("refusing query: %s", err)
+		return
+	}
+	// planning modifies the query,
+	// so the trace is built from a copy
+	traceQuery, err := partiql.ParseWithParams(query, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the textual plan includes the policies
+	// applied to the query, which the tenant
+	// should not be able to see
+	restricted, err := plan.ApplyPolicies(traceQuery, planEnv)
+	if err != nil {
+		s.planError(w, err)
+		return
+	}
+	if restricted {
+		http.Error(w, "cannot explain a query on a table with an access policy", http.StatusForbidden)
+		return
+	}
+	trace, err := pir.Build(traceQuery, planEnv)
+	if err != nil {
+		s.planError(w, err)
+		return
+	}
+	endPoints := s.peers.Get()
+	var tree *plan.Tree
+	if len(endPoints) == 0 {
+		tree, err = plan.New(parsedQuery, planEnv)
+	} else {
+		planSplitter := s.newSplitter(workerID, endPoints)
+		tree, err = plan.NewSplit(parsedQuery, planEnv, planSplitter)
+		if err == nil {
+			res.split(planSplitter)
+			trace, err = pir.Split(trace)
+		}
+	}
+	if err != nil {
+		s.planError(w, err)
+		return
+	}
+	res.Trace = trace.String()
+	res.Plan = tree.String()
+	if !analyze {
+		writeResultResponse(w, http.StatusOK, res)
+		return
+	}
+
+	queryID := uuid.New()
+	res.QueryID = queryID.String()
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("X-Sneller-Query-ID", queryID.String())
+	qctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.queries.add(queryID, tenantCreds.ID(), cancel)
+	defer s.queries.remove(queryID)
+
+	conn := &delayedHijack{
+		laddr: s.bound,
+		req:   r,
+		res:   w,
+	}
+	start := time.Now()
+	rc, err := s.manager.Do(workerID, tree, tnproto.OutputAnalyze, conn)
+	if err != nil {
+		s.logger.Printf("query ID %s %q explain failed (do): %v", queryID, res.Query, err)
+		if !conn.hijacked {
+			code := http.StatusInternalServerError
+			if errors.Is(err, tenant.ErrOverloaded) {
+				code = http.StatusTooManyRequests
+			}
+			http.Error(w, "error dispatching query", code)
+			return
+		}
+		res.Error = "error dispatching query"
+	} else {
+		var stats plan.ExecStats
+		setDeadline(rc, queryKillTimeout)
+		err = check(qctx, rc, &stats)
+		if err != nil {
+			s.logger.Printf("query ID %s %q explain failed (check): %v", queryID, res.Query, err)
+			res.Error = err.Error()
+		} else {
+			res.analyze(&stats, time.Since(start))
+		}
+	}
+	// the response header has already been written
+	// (see delayedHijack), so just write the body
+	body, err := json.Marshal(res)
+	if err != nil {
+		panic("unable to serialize HTTP response")
+	}
+	w.Write(body)
+}
@@ -53,6 +53,10 @@ func (s *server) inputsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no table", http.StatusBadRequest)
 		return
 	}
+	if !allowTable(tenant, databaseName, tableName) {
+		http.Error(w, "no such table", http.StatusNotFound)
+		return
+	}
 	start := r.URL.Query().Get("start")
 	max := -1
 	maxtext := r.URL.Query().Get("max")
@@ -0,0 +1,116 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// queryList tracks the in-flight queries
+// so that they can be canceled by ID
+type queryList struct {
+	lock sync.Mutex
+	live map[uuid.UUID]*liveQuery
+}
+
+type liveQuery struct {
+	tenant string
+	cancel context.CancelFunc
+}
+
+func (q *queryList) add(id uuid.UUID, tenant string, cancel context.CancelFunc) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.live == nil {
+		q.live = make(map[uuid.UUID]*liveQuery)
+	}
+	q.live[id] = &liveQuery{tenant: tenant, cancel: cancel}
+}
+
+func (q *queryList) remove(id uuid.UUID) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.live, id)
+}
+
+// cancel cancels the query with the given id
+// if it exists and belongs to the given tenant
+func (q *queryList) cancel(id uuid.UUID, tenant string) bool {
+	q.lock.Lock()
+	lq, ok := q.live[id]
+	q.lock.Unlock()
+	if !ok || lq.tenant != tenant {
+		return false
+	}
+	lq.cancel()
+	return true
+}
+
+// queriesHandler handles requests for /queries/{id}:
+//
+//	GET /queries/{id}           returns the status of an asynchronous query
+//	GET /queries/{id}/results   returns the results of an asynchronous query
+//	DELETE /queries/{id}        cancels a query (by X-Sneller-Query-ID)
+//	                            or deletes the results of an asynchronous query
+func (s *server) queriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tenant, err := s.getTenant(ctx, w, r)
+	if err != nil {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/queries/")
+	results := strings.HasSuffix(rest, "/results")
+	rest = strings.TrimSuffix(rest, "/results")
+	id, err := uuid.Parse(rest)
+	if err != nil {
+		http.Error(w, "invalid query ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && results:
+		s.asyncResultsHandler(w, r, tenant, id)
+		return
+	case r.Method == http.MethodGet:
+		s.asyncStatusHandler(w, tenant, id)
+		return
+	case results:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// queries belonging to other tenants
+	// are indistinguishable from missing ones
+	if s.queries.cancel(id, tenant.ID()) {
+		s.logger.Printf("query ID %s canceled by request", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, root, ok := s.asyncLookup(tenant, id); ok {
+		s.async.remove(id)
+		if err := removeResults(root, id); err != nil {
+			s.logger.Printf("query ID %s: removing results: %s", id, err)
+			http.Error(w, "cannot remove query results", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("query ID %s results deleted by request", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "no such query", http.StatusNotFound)
+}
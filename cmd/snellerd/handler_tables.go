@@ -37,6 +37,11 @@ func (s *server) tablesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !allowDatabase(tenant, databaseName) {
+		http.Error(w, "no such database", http.StatusNotFound)
+		return
+	}
+
 	pattern := r.URL.Query().Get("pattern")
 	e, err := environ(tenant, databaseName)
 	if err != nil {
@@ -56,6 +61,9 @@ func (s *server) tablesHandler(w http.ResponseWriter, r *http.Request) {
 
 	out := make([]string, 0)
 	for i := range tables {
+		if !allowTable(tenant, databaseName, tables[i]) {
+			continue
+		}
 		if pattern == "" || matchPattern(tables[i], pattern) {
 			out = append(out, tables[i])
 		}
@@ -0,0 +1,327 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/blob"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/plan"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+	"github.com/SnellerInc/sneller/usock"
+)
+
+// warmStatus is the response to /warmup
+type warmStatus struct {
+	Running bool `json:"running"`
+	// Blobs and Bytes are the number and
+	// compressed size of the objects warmed
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// Until is the newest modification
+	// time of the objects warmed; the next
+	// warm-up of the table starts after it
+	Until       time.Time  `json:"until"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	CacheHits   int64      `json:"cache_hits"`
+	CacheMisses int64      `json:"cache_misses"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// warmups tracks the warm-ups started
+// by this server, by tenant and table
+type warmups struct {
+	lock   sync.Mutex
+	status map[string]*warmStatus
+
+	// totals for /metrics
+	blobs, bytes int64
+}
+
+func warmKey(tenant, dbname, table string) string {
+	return tenant + "/" + dbname + "/" + table
+}
+
+// start registers a new warm-up of key,
+// returning false if one is already running;
+// the previous warm-up's Until is returned
+// so that the new one can start after it
+func (w *warmups) start(key string, st *warmStatus) (date.Time, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.status == nil {
+		w.status = make(map[string]*warmStatus)
+	}
+	var until date.Time
+	if prev := w.status[key]; prev != nil {
+		if prev.Running {
+			return until, false
+		}
+		until = date.FromTime(prev.Until)
+	}
+	w.status[key] = st
+	return until, true
+}
+
+// update calls fn with the lock held
+func (w *warmups) update(fn func()) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fn()
+}
+
+func (w *warmups) get(key string) (warmStatus, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	st := w.status[key]
+	if st == nil {
+		return warmStatus{}, false
+	}
+	return *st, true
+}
+
+func (w *warmups) totals() (blobs, bytes int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.blobs, w.bytes
+}
+
+// warmEnv is a plan.Env in which
+// every table is the same handle
+type warmEnv struct {
+	handle plan.TableHandle
+}
+
+func (w *warmEnv) Stat(_, _ expr.Node) (plan.TableHandle, error) {
+	return w.handle, nil
+}
+
+// warmupHandler reads the objects that have
+// been added to a table since the last warm-up
+// (or since the "since" parameter) so that they
+// are cached by the peers that own them under
+// the split placement before they are queried.
+//
+// POST starts a warm-up in the background,
+// and GET returns the status of the last one.
+func (s *server) warmupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tenantCreds, err := s.getTenant(ctx, w, r)
+	if err != nil {
+		return
+	}
+	dbname := r.URL.Query().Get("database")
+	if dbname == "" {
+		http.Error(w, "no database", http.StatusBadRequest)
+		return
+	}
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		http.Error(w, "no table", http.StatusBadRequest)
+		return
+	}
+	if !allowTable(tenantCreds, dbname, table) {
+		http.Error(w, "no such table", http.StatusNotFound)
+		return
+	}
+	key := warmKey(tenantCreds.ID(), dbname, table)
+	if r.Method == http.MethodGet {
+		st, ok := s.warmups.get(key)
+		if !ok {
+			http.Error(w, "no warm-up", http.StatusNotFound)
+			return
+		}
+		writeResultResponse(w, http.StatusOK, &st)
+		return
+	}
+	var since date.Time
+	var explicit bool
+	if text := r.URL.Query().Get("since"); text != "" {
+		t, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			http.Error(w, "parsing since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since, explicit = date.FromTime(t), true
+	}
+
+	planEnv, err := environ(tenantCreds, dbname)
+	if err != nil {
+		http.Error(w, "tenant ID disallowed", http.StatusForbidden)
+		s.logger.Printf("refusing warm-up: %s", err)
+		return
+	}
+	handle, err := planEnv.Stat(&expr.Path{First: table}, nil)
+	if err != nil {
+		s.planError(w, err)
+		return
+	}
+	fh := handle.(*filterHandle)
+
+	st := &warmStatus{Running: true, Started: time.Now().UTC()}
+	prev, ok := s.warmups.start(key, st)
+	if !ok {
+		http.Error(w, "warm-up already running", http.StatusConflict)
+		return
+	}
+	if !explicit {
+		since = prev
+	}
+	var blobs []blob.Interface
+	var size int64
+	until := since
+	for _, b := range fh.blobs.Contents {
+		info, err := b.Stat()
+		if err != nil {
+			s.warmDone(st, prev, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !info.LastModified.After(since) {
+			continue
+		}
+		blobs = append(blobs, b)
+		size += info.Size
+		if info.LastModified.After(until) {
+			until = info.LastModified
+		}
+	}
+	if prev.After(until) {
+		until = prev
+	}
+	if len(blobs) == 0 {
+		s.warmDone(st, until, nil)
+	}
+	var status warmStatus
+	s.warmups.update(func() {
+		st.Blobs = len(blobs)
+		st.Bytes = size
+		st.Until = until.Time().UTC()
+		status = *st
+	})
+	if len(blobs) == 0 {
+		writeResultResponse(w, http.StatusOK, &status)
+		return
+	}
+
+	var workerID tnproto.ID
+	hash := sha256.Sum256([]byte(tenantCreds.ID()))
+	copy(workerID[:], hash[:])
+	go s.warm(key, workerID, blobs, st, prev)
+	s.logger.Printf("warming %d objects (%d bytes) of %s.%s", status.Blobs, status.Bytes, dbname, table)
+	writeResultResponse(w, http.StatusAccepted, &status)
+}
+
+// warmDone marks st as finished; until
+// is where the next warm-up should start
+func (s *server) warmDone(st *warmStatus, until date.Time, err error) {
+	s.warmups.update(func() {
+		now := time.Now().UTC()
+		st.Running = false
+		st.Finished = &now
+		st.Until = until.Time().UTC()
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+}
+
+// warm reads blobs in batches of at most
+// s.warmBudget bytes, waiting between batches
+// so that the average rate stays within the budget;
+// if it fails, the next warm-up starts from prev
+func (s *server) warm(key string, workerID tnproto.ID, blobs []blob.Interface, st *warmStatus, prev date.Time) {
+	var err error
+	for len(blobs) > 0 && err == nil {
+		n, size := 0, int64(0)
+		for n < len(blobs) {
+			info, _ := blobs[n].Stat()
+			if n > 0 && s.warmBudget > 0 && size+info.Size > s.warmBudget {
+				break
+			}
+			size += info.Size
+			n++
+		}
+		start := time.Now()
+		var stats plan.ExecStats
+		err = s.warmBatch(workerID, blobs[:n], &stats)
+		blobs = blobs[n:]
+		s.warmups.update(func() {
+			st.CacheHits += stats.CacheHits
+			st.CacheMisses += stats.CacheMisses
+			if err == nil {
+				s.warmups.blobs += int64(n)
+				s.warmups.bytes += size
+			}
+		})
+		if s.warmBudget > 0 && len(blobs) > 0 {
+			wait := time.Duration(float64(size) / float64(s.warmBudget) * float64(time.Second))
+			time.Sleep(time.Until(start.Add(wait)))
+		}
+	}
+	until := date.FromTime(st.Until)
+	if err != nil {
+		s.logger.Printf("warming %s: %s", key, err)
+		until = prev
+	}
+	s.warmDone(st, until, err)
+}
+
+// warmBatch reads blobs on the peers
+// that own them, discarding the output
+func (s *server) warmBatch(workerID tnproto.ID, blobs []blob.Interface, stats *plan.ExecStats) error {
+	query, err := partiql.Parse([]byte("SELECT COUNT(*) FROM warm"))
+	if err != nil {
+		return err
+	}
+	env := &warmEnv{handle: &filterHandle{blobs: &blob.List{Contents: blobs}}}
+	var tree *plan.Tree
+	if endPoints := s.peers.Get(); len(endPoints) == 0 {
+		tree, err = plan.New(query, env)
+	} else {
+		tree, err = plan.NewSplit(query, env, s.newSplitter(workerID, endPoints))
+	}
+	if err != nil {
+		return err
+	}
+	here, there, err := usock.SocketPair()
+	if err != nil {
+		return err
+	}
+	defer here.Close()
+	rc, err := s.manager.Do(workerID, tree, tnproto.OutputRaw, there)
+	there.Close()
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- check(context.Background(), rc, stats)
+	}()
+	_, err = io.Copy(io.Discard, here)
+	if cerr := <-errc; cerr != nil {
+		err = cerr
+	}
+	return err
+}
@@ -27,17 +27,20 @@ import (
 	"github.com/SnellerInc/sneller/db"
 )
 
+// remoteAddr returns the real address of the client,
+// and whether or not the request was forwarded
+func remoteAddr(r *http.Request) (string, bool) {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		parts := strings.Split(forwardedFor, ",")
+		return strings.TrimSpace(parts[len(parts)-1]), true
+	}
+	return r.RemoteAddr, false
+}
+
 func (s *server) handle(handler func(http.ResponseWriter, *http.Request), methods ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		// obtain the real address
-		remoteAddress := r.RemoteAddr
-		forwarded := false
-		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-			parts := strings.Split(forwardedFor, ",")
-			remoteAddress = strings.TrimSpace(parts[len(parts)-1])
-			forwarded = true
-		}
+		remoteAddress, forwarded := remoteAddr(r)
 		// unforwarded requests to "/"
 		// are just ELB heartbeats;
 		// don't log these, as they spam the logs
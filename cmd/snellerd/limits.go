@@ -0,0 +1,188 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/SnellerInc/sneller/plan"
+)
+
+// queryLimits are the resource limits
+// for a single query; zero means unlimited
+type queryLimits struct {
+	MaxScanned int64    `json:"max_scanned_bytes,omitempty"`
+	MaxRows    int64    `json:"max_rows,omitempty"`
+	MaxOutput  int64    `json:"max_output_bytes,omitempty"`
+	Timeout    duration `json:"timeout,omitempty"`
+}
+
+// duration is a time.Duration that
+// is a string like "30s" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(buf []byte) error {
+	var str string
+	if err := json.Unmarshal(buf, &str); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// tighten lowers each limit in l
+// to the corresponding limit in o
+func (l *queryLimits) tighten(o *queryLimits) {
+	lower := func(dst *int64, v int64) {
+		if v > 0 && (*dst == 0 || v < *dst) {
+			*dst = v
+		}
+	}
+	lower(&l.MaxScanned, o.MaxScanned)
+	lower(&l.MaxRows, o.MaxRows)
+	lower(&l.MaxOutput, o.MaxOutput)
+	lower((*int64)(&l.Timeout), int64(o.Timeout))
+}
+
+func (l *queryLimits) plan() plan.Limits {
+	return plan.Limits{
+		MaxScanned: l.MaxScanned,
+		MaxRows:    l.MaxRows,
+		MaxOutput:  l.MaxOutput,
+	}
+}
+
+// limitsFromRequest reads the limits requested
+// with the max_scanned_bytes, max_rows,
+// max_output_bytes and timeout query parameters
+func limitsFromRequest(r *http.Request) (queryLimits, error) {
+	var l queryLimits
+	q := r.URL.Query()
+	ints := []struct {
+		name string
+		dst  *int64
+	}{
+		{"max_scanned_bytes", &l.MaxScanned},
+		{"max_rows", &l.MaxRows},
+		{"max_output_bytes", &l.MaxOutput},
+	}
+	for i := range ints {
+		str := q.Get(ints[i].name)
+		if str == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || v <= 0 {
+			return l, fmt.Errorf("invalid %s %q", ints[i].name, str)
+		}
+		*ints[i].dst = v
+	}
+	if str := q.Get("timeout"); str != "" {
+		v, err := time.ParseDuration(str)
+		if err != nil || v <= 0 {
+			return l, fmt.Errorf("invalid timeout %q", str)
+		}
+		l.Timeout = duration(v)
+	}
+	return l, nil
+}
+
+// queryLimits returns the limits for a query
+// from the given tenant; the limits requested
+// by the client can only lower those of the tenant
+func (s *server) queryLimits(tenantID string, r *http.Request) (queryLimits, error) {
+	l, ok := s.tenantLimits[tenantID]
+	if !ok {
+		l = s.limits
+	}
+	req, err := limitsFromRequest(r)
+	if err != nil {
+		return l, err
+	}
+	l.tighten(&req)
+	return l, nil
+}
+
+// loadLimits reads a JSON object mapping
+// tenant IDs to their query limits
+func loadLimits(file string) (map[string]queryLimits, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]queryLimits
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return out, nil
+}
+
+// limitError returns the error text for
+// a query that exceeded one of its limits,
+// or the empty string if err is not such an error
+func limitError(err error, l *queryLimits, timedOut bool) string {
+	if timedOut {
+		return fmt.Sprintf("query limit exceeded: ran longer than %s", time.Duration(l.Timeout))
+	}
+	if err == nil {
+		return ""
+	}
+	return plan.LimitText(err.Error())
+}
+
+// checkScan writes an error response and returns
+// false if a query that may scan maxscan bytes
+// (according to the splitter) is not allowed
+func checkScan(w http.ResponseWriter, maxscan int64, l *queryLimits) bool {
+	if l.MaxScanned == 0 || maxscan <= l.MaxScanned {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("query limit exceeded: may scan up to %d bytes (limit %d)", maxscan, l.MaxScanned), http.StatusBadRequest)
+	return false
+}
+
+// checkScanned returns an error if a query
+// that completed scanned more than the limit;
+// each peer enforces the limit separately,
+// so together they may scan more
+func checkScanned(stats *plan.ExecStats, l *queryLimits) error {
+	if l.MaxScanned > 0 && stats.BytesScanned > l.MaxScanned {
+		return &plan.LimitError{What: "bytes scanned", Limit: l.MaxScanned}
+	}
+	return nil
+}
+
+// withTimeout returns a cancelable child of
+// ctx that expires after the query timeout
+func withTimeout(ctx context.Context, l *queryLimits) (context.Context, context.CancelFunc) {
+	if l.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(l.Timeout))
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryLimits(t *testing.T) {
+	s := &server{
+		limits: queryLimits{MaxScanned: 1000, Timeout: duration(time.Minute)},
+		tenantLimits: map[string]queryLimits{
+			"big": {MaxRows: 100},
+		},
+	}
+	tcs := []struct {
+		tenant, query string
+		want          queryLimits
+	}{
+		{"any", "", s.limits},
+		{"any", "max_scanned_bytes=2000&timeout=1s", queryLimits{MaxScanned: 1000, Timeout: duration(time.Second)}},
+		{"any", "max_output_bytes=10", queryLimits{MaxScanned: 1000, MaxOutput: 10, Timeout: duration(time.Minute)}},
+		{"big", "", queryLimits{MaxRows: 100}},
+		{"big", "max_rows=1000&max_scanned_bytes=5", queryLimits{MaxRows: 100, MaxScanned: 5}},
+	}
+	for i := range tcs {
+		r := httptest.NewRequest("GET", "/executeQuery?"+tcs[i].query, nil)
+		got, err := s.queryLimits(tcs[i].tenant, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tcs[i].want {
+			t.Errorf("%s %q: got %+v, want %+v", tcs[i].tenant, tcs[i].query, got, tcs[i].want)
+		}
+	}
+}
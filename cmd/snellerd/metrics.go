@@ -0,0 +1,158 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// query statuses reported by the metrics
+const (
+	statusOK         = "ok"
+	statusError      = "error"
+	statusCanceled   = "canceled"
+	statusOverloaded = "overloaded"
+	statusLimit      = "limit"
+)
+
+// latencyBuckets are the upper bounds, in seconds,
+// of the query latency histogram buckets
+var latencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30, 60, 300,
+}
+
+// histogram is a cumulative histogram
+// with latencyBuckets as its buckets
+type histogram struct {
+	counts []uint64 // per-bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i := range latencyBuckets {
+		if v <= latencyBuckets[i] {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics collects server statistics
+// for the /metrics endpoint
+type metrics struct {
+	lock    sync.Mutex
+	latency map[string]*histogram // by status
+
+	scanned, hits, misses uint64
+}
+
+// query records the completion of a query
+// with the given status
+func (m *metrics) query(status string, elapsed time.Duration, scanned, hits, misses int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.latency == nil {
+		m.latency = make(map[string]*histogram)
+	}
+	h := m.latency[status]
+	if h == nil {
+		h = new(histogram)
+		m.latency[status] = h
+	}
+	h.observe(elapsed.Seconds())
+	m.scanned += uint64(scanned)
+	m.hits += uint64(hits)
+	m.misses += uint64(misses)
+}
+
+func fmtfloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes the metrics in the
+// Prometheus text exposition format
+func (m *metrics) write(w *bufio.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	statuses := make([]string, 0, len(m.latency))
+	for k := range m.latency {
+		statuses = append(statuses, k)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprintf(w, "# HELP sneller_queries_total Number of queries executed, by status.\n")
+	fmt.Fprintf(w, "# TYPE sneller_queries_total counter\n")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "sneller_queries_total{status=%q} %d\n", s, m.latency[s].count)
+	}
+	fmt.Fprintf(w, "# HELP sneller_query_duration_seconds Query execution latency, by status.\n")
+	fmt.Fprintf(w, "# TYPE sneller_query_duration_seconds histogram\n")
+	for _, s := range statuses {
+		h := m.latency[s]
+		total := uint64(0)
+		for i := range latencyBuckets {
+			total += h.counts[i]
+			fmt.Fprintf(w, "sneller_query_duration_seconds_bucket{status=%q,le=%q} %d\n", s, fmtfloat(latencyBuckets[i]), total)
+		}
+		fmt.Fprintf(w, "sneller_query_duration_seconds_bucket{status=%q,le=\"+Inf\"} %d\n", s, h.count)
+		fmt.Fprintf(w, "sneller_query_duration_seconds_sum{status=%q} %s\n", s, fmtfloat(h.sum))
+		fmt.Fprintf(w, "sneller_query_duration_seconds_count{status=%q} %d\n", s, h.count)
+	}
+	metric(w, "counter", "sneller_bytes_scanned_total", "Number of bytes scanned by queries.", int64(m.scanned))
+	metric(w, "counter", "sneller_cache_hits_total", "Number of block cache hits.", int64(m.hits))
+	metric(w, "counter", "sneller_cache_misses_total", "Number of block cache misses.", int64(m.misses))
+}
+
+// metric writes a single unlabeled metric
+func metric(w *bufio.Writer, typ, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+}
+
+// example invocation:
+// curl -v 'http://localhost:9001/metrics'
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	s.metrics.write(bw)
+	if m := s.tenants(); m != nil {
+		metric(bw, "gauge", "sneller_tenant_processes", "Number of live tenant processes.", int64(m.Live()))
+		files, bytes := m.Evicted()
+		metric(bw, "counter", "sneller_cache_evictions_total", "Number of cache files evicted.", files)
+		metric(bw, "counter", "sneller_cache_evicted_bytes_total", "Number of cache bytes evicted.", bytes)
+	}
+	if s.results != nil {
+		hits, misses := s.results.stats()
+		metric(bw, "counter", "sneller_result_cache_hits_total", "Number of queries served from the result cache.", int64(hits))
+		metric(bw, "counter", "sneller_result_cache_misses_total", "Number of queries not found in the result cache.", int64(misses))
+	}
+	blobs, bytes := s.warmups.totals()
+	metric(bw, "counter", "sneller_warmup_objects_total", "Number of objects read by cache warm-ups.", blobs)
+	metric(bw, "counter", "sneller_warmup_bytes_total", "Number of bytes read by cache warm-ups.", bytes)
+	metric(bw, "gauge", "sneller_peers", "Number of peers available for split queries.", int64(len(s.peers.Get())))
+	bw.Flush()
+}
@@ -23,7 +23,6 @@ import (
 	"net"
 	"os/exec"
 	"strconv"
-	"sync/atomic"
 	"time"
 )
 
@@ -41,55 +40,33 @@ func (n noPeers) Get() []*net.TCPAddr                                     { retu
 func (n noPeers) Start(time.Duration, func(string, ...interface{})) error { return nil }
 func (n noPeers) Stop()                                                   {}
 
+// weightedPeers is implemented by a peerlist
+// that knows the relative capacity of its peers
+type weightedPeers interface {
+	// Weight returns the weight of a peer
+	// returned by Get; the default is 1
+	Weight(addr *net.TCPAddr) float64
+}
+
+// peerCmd is a peerSource that runs
+// a command that prints peerJSON
 type peerCmd struct {
-	cmd    []string
-	recent atomic.Value
-	ticker *time.Ticker
-	stop   chan struct{}
+	cmd []string
 }
 
 type peerDesc struct {
 	Addr string `json:"addr"`
+	// Weight is the relative capacity of
+	// the peer; zero means the default of 1
+	Weight float64 `json:"weight,omitempty"`
 }
 
 type peerJSON struct {
 	Peers []peerDesc `json:"peers"`
 }
 
-func (p *peerCmd) Start(interval time.Duration, logf func(f string, args ...interface{})) error {
-	err := p.run()
-	if err != nil {
-		return err
-	}
-	p.ticker = time.NewTicker(interval)
-	p.stop = make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-p.ticker.C:
-				err := p.run()
-				if err != nil {
-					logf("getting peers: %s", err)
-				}
-			case <-p.stop:
-				return
-			}
-		}
-	}()
-	return nil
-}
-
-func (p *peerCmd) Stop() {
-	p.ticker.Stop()
-	close(p.stop)
-}
-
-func (p *peerCmd) Get() []*net.TCPAddr {
-	return p.recent.Load().([]*net.TCPAddr)
-}
-
-func (p *peerCmd) run() error {
-	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+func (p *peerCmd) peers(ctx context.Context) ([]peerDesc, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, p.cmd[0], p.cmd[1:]...)
@@ -102,42 +79,56 @@ func (p *peerCmd) run() error {
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
 			cmd.Process.Kill()
-			return fmt.Errorf("peer command timed-out (killed): %s", stderr.String())
+			return nil, fmt.Errorf("peer command timed-out (killed): %s", stderr.String())
 		}
 
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
-			return fmt.Errorf("running peer exited with code %d: %s", exitErr.ProcessState.ExitCode(), stderr.String())
+			return nil, fmt.Errorf("running peer exited with code %d: %s", exitErr.ProcessState.ExitCode(), stderr.String())
 		}
 
-		return fmt.Errorf("failed running command %q: %s", p.cmd[0], err)
+		return nil, fmt.Errorf("failed running command %q: %s", p.cmd[0], err)
 	}
 
 	var ret peerJSON
 	err = json.Unmarshal(stdout.Bytes(), &ret)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	lst := make([]*net.TCPAddr, 0, len(ret.Peers))
-	for i := range ret.Peers {
-		addr := ret.Peers[i].Addr
+	return ret.Peers, nil
+}
+
+// parsePeers parses the addresses of peers,
+// returning the addresses and the weights of
+// peers that do not have the default weight
+func parsePeers(peers []peerDesc) ([]*net.TCPAddr, map[string]float64, error) {
+	lst := make([]*net.TCPAddr, 0, len(peers))
+	weights := make(map[string]float64)
+	for i := range peers {
+		addr := peers[i].Addr
 		host, port, err := net.SplitHostPort(addr)
 		if err != nil {
-			return fmt.Errorf("couldn't parse peer %d: %w", i, err)
+			return nil, nil, fmt.Errorf("couldn't parse peer %d: %w", i, err)
 		}
 		portnum, err := strconv.Atoi(port)
 		if err != nil {
-			return fmt.Errorf("couldn't parse peer %d port number: %w", i, err)
+			return nil, nil, fmt.Errorf("couldn't parse peer %d port number: %w", i, err)
 		}
 		ip := net.ParseIP(host)
 		if len(ip) == 0 {
-			return fmt.Errorf("couldn't parse peer %d IP: %w", i, err)
+			return nil, nil, fmt.Errorf("couldn't parse peer %d IP %q", i, host)
+		}
+		if w := peers[i].Weight; w < 0 {
+			return nil, nil, fmt.Errorf("peer %d has negative weight %g", i, w)
 		}
-		lst = append(lst, &net.TCPAddr{
+		tcp := &net.TCPAddr{
 			IP:   ip,
 			Port: portnum,
-		})
+		}
+		if peers[i].Weight > 0 {
+			weights[tcp.String()] = peers[i].Weight
+		}
+		lst = append(lst, tcp)
 	}
-	p.recent.Store(lst)
-	return nil
+	return lst, weights, nil
 }
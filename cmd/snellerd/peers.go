@@ -0,0 +1,471 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a peerSource produces the current list of peers
+type peerSource interface {
+	peers(ctx context.Context) ([]peerDesc, error)
+}
+
+// a peerWatcher is a peerSource that can
+// report changes to the list of peers
+// as they happen rather than when polled
+type peerWatcher interface {
+	peerSource
+	// watch calls changed whenever the list of
+	// peers may have changed, until ctx is
+	// canceled or the watch fails
+	watch(ctx context.Context, changed func()) error
+}
+
+// parsePeerSource parses a peer discovery specification:
+//
+//	file:///path/to/peers.json  (peerJSON, reloaded when it changes)
+//	dns://name:port             (A/AAAA records of name)
+//	srv://_service._tcp.name    (SRV records of name)
+//	k8s://namespace/service:port (EndpointSlices of a Kubernetes service)
+func parsePeerSource(spec string) (peerSource, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return &peerFile{path: u.Path}, nil
+	case "dns":
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("peers %q: %w", spec, err)
+		}
+		portnum, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("peers %q: bad port %q", spec, port)
+		}
+		return &dnsPeers{name: host, port: portnum}, nil
+	case "srv":
+		return &dnsPeers{name: u.Host, srv: true}, nil
+	case "k8s":
+		svc, port, err := net.SplitHostPort(strings.TrimPrefix(u.Path, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("peers %q: %w", spec, err)
+		}
+		portnum, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("peers %q: bad port %q", spec, port)
+		}
+		if u.Host == "" || svc == "" {
+			return nil, fmt.Errorf("peers %q: expected k8s://namespace/service:port", spec)
+		}
+		return inCluster(u.Host, svc, portnum)
+	}
+	return nil, fmt.Errorf("peers %q: unknown scheme %q", spec, u.Scheme)
+}
+
+// peerPoller is a peerlist that periodically
+// polls a peerSource for the list of peers
+type peerPoller struct {
+	src peerSource
+	// health, if non-nil, is used
+	// to drop unresponsive peers
+	health *healthCheck
+
+	recent  atomic.Value // []*net.TCPAddr
+	weights atomic.Value // map[string]float64
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (p *peerPoller) Start(interval time.Duration, logf func(f string, args ...interface{})) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.update(ctx); err != nil {
+		cancel()
+		return err
+	}
+	p.cancel = cancel
+	changed := make(chan struct{}, 1)
+	if w, ok := p.src.(peerWatcher); ok {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			notify := func() {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+			for ctx.Err() == nil {
+				err := w.watch(ctx, notify)
+				if err != nil && ctx.Err() == nil {
+					logf("watching peers: %s", err)
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+			if err := p.update(ctx); err != nil && ctx.Err() == nil {
+				logf("getting peers: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *peerPoller) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+}
+
+func (p *peerPoller) Get() []*net.TCPAddr {
+	lst, _ := p.recent.Load().([]*net.TCPAddr)
+	return lst
+}
+
+func (p *peerPoller) Weight(addr *net.TCPAddr) float64 {
+	weights, _ := p.weights.Load().(map[string]float64)
+	if w, ok := weights[addr.String()]; ok {
+		return w
+	}
+	return 1
+}
+
+func (p *peerPoller) update(ctx context.Context) error {
+	descs, err := p.src.peers(ctx)
+	if err != nil {
+		return err
+	}
+	lst, weights, err := parsePeers(descs)
+	if err != nil {
+		return err
+	}
+	if p.health != nil {
+		lst = p.health.filter(ctx, lst)
+	}
+	p.weights.Store(weights)
+	p.recent.Store(lst)
+	return nil
+}
+
+// healthCheck drops peers that do not
+// respond to GET /ping on their HTTP port
+type healthCheck struct {
+	port    int
+	timeout time.Duration
+	client  http.Client
+}
+
+func (h *healthCheck) ok(ctx context.Context, addr *net.TCPAddr) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	u := "http://" + net.JoinHostPort(addr.IP.String(), strconv.Itoa(h.port)) + "/ping"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 512))
+	return res.StatusCode == http.StatusOK
+}
+
+// filter returns the peers in lst
+// that pass the health check
+func (h *healthCheck) filter(ctx context.Context, lst []*net.TCPAddr) []*net.TCPAddr {
+	ok := make([]bool, len(lst))
+	var wg sync.WaitGroup
+	wg.Add(len(lst))
+	for i := range lst {
+		go func(i int) {
+			defer wg.Done()
+			ok[i] = h.ok(ctx, lst[i])
+		}(i)
+	}
+	wg.Wait()
+	out := lst[:0:0]
+	for i := range lst {
+		if ok[i] {
+			out = append(out, lst[i])
+		}
+	}
+	return out
+}
+
+// peerFile is a peerSource that reads
+// peerJSON from a file, so changes to
+// the file take effect when it is polled
+type peerFile struct {
+	path string
+}
+
+func (p *peerFile) peers(ctx context.Context) ([]peerDesc, error) {
+	buf, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var ret peerJSON
+	if err := json.Unmarshal(buf, &ret); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.path, err)
+	}
+	return ret.Peers, nil
+}
+
+// dnsPeers is a peerSource that looks
+// up the A/AAAA records of name (with
+// the given port) or the SRV records
+// of name (with the ports and weights
+// of the records)
+type dnsPeers struct {
+	name     string
+	port     int
+	srv      bool
+	resolver *net.Resolver // nil means net.DefaultResolver
+}
+
+func (d *dnsPeers) lookup(ctx context.Context, host string, port int, weight float64, dst []peerDesc) ([]peerDesc, error) {
+	r := d.resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ips {
+		dst = append(dst, peerDesc{
+			Addr:   net.JoinHostPort(ips[i].IP.String(), strconv.Itoa(port)),
+			Weight: weight,
+		})
+	}
+	return dst, nil
+}
+
+func (d *dnsPeers) peers(ctx context.Context) ([]peerDesc, error) {
+	var out []peerDesc
+	var err error
+	if !d.srv {
+		out, err = d.lookup(ctx, d.name, d.port, 0, nil)
+	} else {
+		r := d.resolver
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		var srvs []*net.SRV
+		_, srvs, err = r.LookupSRV(ctx, "", "", d.name)
+		for i := 0; err == nil && i < len(srvs); i++ {
+			out, err = d.lookup(ctx, srvs[i].Target, int(srvs[i].Port), float64(srvs[i].Weight), out)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out, nil
+}
+
+const (
+	serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sWatchTime   = 5 * time.Minute
+)
+
+// k8sPeers is a peerSource that lists (and watches)
+// the EndpointSlices of a Kubernetes service
+type k8sPeers struct {
+	api       string // API server URL
+	tokenFile string // bearer token, re-read for each request
+	client    *http.Client
+
+	namespace, service string
+	port               int
+
+	// version is the resourceVersion
+	// of the most recent list
+	version atomic.Value
+}
+
+// inCluster returns a k8sPeers that uses
+// the in-cluster configuration of a pod
+func inCluster(namespace, service string, port int) (*k8sPeers, error) {
+	host, hport := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || hport == "" {
+		return nil, fmt.Errorf("k8s peers: not running in a Kubernetes cluster")
+	}
+	ca, err := os.ReadFile(serviceAccount + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("k8s peers: no certificates in %s/ca.crt", serviceAccount)
+	}
+	return &k8sPeers{
+		api:       "https://" + net.JoinHostPort(host, hport),
+		tokenFile: serviceAccount + "/token",
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		namespace: namespace,
+		service:   service,
+		port:      port,
+	}, nil
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+func (k *k8sPeers) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+k.service)
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		k.api, url.PathEscape(k.namespace), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("k8s peers: %s: %s", res.Status, body)
+	}
+	return res, nil
+}
+
+func (k *k8sPeers) peers(ctx context.Context) ([]peerDesc, error) {
+	res, err := k.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var lst endpointSliceList
+	if err := json.NewDecoder(res.Body).Decode(&lst); err != nil {
+		return nil, fmt.Errorf("k8s peers: %w", err)
+	}
+	k.version.Store(lst.Metadata.ResourceVersion)
+	var out []peerDesc
+	seen := make(map[string]bool)
+	for i := range lst.Items {
+		for _, ep := range lst.Items[i].Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				hp := net.JoinHostPort(addr, strconv.Itoa(k.port))
+				if !seen[hp] {
+					seen[hp] = true
+					out = append(out, peerDesc{Addr: hp})
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out, nil
+}
+
+func (k *k8sPeers) watch(ctx context.Context, changed func()) error {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("timeoutSeconds", strconv.Itoa(int(k8sWatchTime/time.Second)))
+	if v, _ := k.version.Load().(string); v != "" {
+		query.Set("resourceVersion", v)
+	}
+	res, err := k.get(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	d := json.NewDecoder(res.Body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := d.Decode(&event); err != nil {
+			if err == io.EOF {
+				// the server ended the watch
+				return nil
+			}
+			return err
+		}
+		if event.Type == "ERROR" {
+			// usually an expired resourceVersion;
+			// the next list will refresh it
+			changed()
+			return fmt.Errorf("k8s peers: watch error event")
+		}
+		changed()
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addrs(lst []*net.TCPAddr) []string {
+	out := make([]string, len(lst))
+	for i := range lst {
+		out[i] = lst[i].String()
+	}
+	return out
+}
+
+// waitPeers waits for p.Get() to return want
+func waitPeers(t *testing.T, p *peerPoller, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := addrs(p.Get())
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got peers %v, want %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPeerFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "peers.json")
+	write := func(peers ...peerDesc) {
+		buf, err := json.Marshal(&peerJSON{Peers: peers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write + rename so the poller
+		// never sees a partial file
+		tmp := name + ".tmp"
+		if err := os.WriteFile(tmp, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(peerDesc{Addr: "127.0.0.1:9000"}, peerDesc{Addr: "127.0.0.2:9000", Weight: 2})
+
+	src, err := parsePeerSource("file://" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peerPoller{src: src}
+	if err := p.Start(10*time.Millisecond, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	waitPeers(t, p, "127.0.0.1:9000", "127.0.0.2:9000")
+	if w := p.Weight(p.Get()[1]); w != 2 {
+		t.Errorf("weight %g, want 2", w)
+	}
+
+	write(peerDesc{Addr: "127.0.0.3:9000"})
+	waitPeers(t, p, "127.0.0.3:9000")
+}
+
+// dnsServer is a minimal DNS server
+// that answers A and SRV queries
+type dnsServer struct {
+	conn net.PacketConn
+	a    map[string][]net.IP
+	srv  map[string][]net.SRV
+}
+
+func (d *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if out := d.answer(buf[:n]); out != nil {
+			d.conn.WriteTo(out, addr)
+		}
+	}
+}
+
+func appendName(dst []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+	return append(dst, 0)
+}
+
+func be16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
+
+func (d *dnsServer) answer(msg []byte) []byte {
+	if len(msg) < 12 {
+		return nil
+	}
+	// parse the (single) question
+	var labels []string
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		end := i + 1 + int(msg[i])
+		if end > len(msg) {
+			return nil
+		}
+		labels = append(labels, string(msg[i+1:end]))
+		i = end
+	}
+	i++
+	if i+4 > len(msg) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(msg[i:])
+	question := msg[12 : i+4]
+
+	var answers [][]byte
+	rr := func(typ uint16, rdata []byte) []byte {
+		out := []byte{0xc0, 12} // pointer to the question name
+		out = be16(out, typ)
+		out = be16(out, 1)
+		out = be16(be16(out, 0), 60)
+		out = be16(out, uint16(len(rdata)))
+		return append(out, rdata...)
+	}
+	switch qtype {
+	case 1: // A
+		for _, ip := range d.a[name] {
+			answers = append(answers, rr(1, ip.To4()))
+		}
+	case 33: // SRV
+		for _, s := range d.srv[name] {
+			var rdata []byte
+			rdata = be16(rdata, s.Priority)
+			rdata = be16(rdata, s.Weight)
+			rdata = be16(rdata, s.Port)
+			answers = append(answers, rr(33, appendName(rdata, s.Target)))
+		}
+	}
+	out := append([]byte{}, msg[:2]...) // id
+	out = append(out, 0x81, 0x80)       // response, recursion desired + available
+	out = append(out, 0, 1)             // one question
+	out = be16(out, uint16(len(answers)))
+	out = append(out, 0, 0, 0, 0)
+	out = append(out, question...)
+	for _, a := range answers {
+		out = append(out, a...)
+	}
+	return out
+}
+
+func TestPeerDNS(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &dnsServer{
+		conn: conn,
+		a: map[string][]net.IP{
+			"peers.test.": {net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)},
+			"big.test.":   {net.IPv4(10, 0, 1, 1)},
+			"small.test.": {net.IPv4(10, 0, 1, 2)},
+		},
+		srv: map[string][]net.SRV{
+			"_sneller._tcp.peers.test.": {
+				{Target: "big.test.", Port: 9000, Weight: 30},
+				{Target: "small.test.", Port: 9001, Weight: 10},
+			},
+		},
+	}
+	go srv.serve()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+
+	src, err := parsePeerSource("dns://peers.test.:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.(*dnsPeers).resolver = resolver
+	p := &peerPoller{src: src}
+	if err := p.Start(time.Minute, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	waitPeers(t, p, "10.0.0.1:9000", "10.0.0.2:9000")
+
+	src, err = parsePeerSource("srv://_sneller._tcp.peers.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.(*dnsPeers).resolver = resolver
+	p = &peerPoller{src: src}
+	if err := p.Start(time.Minute, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	waitPeers(t, p, "10.0.1.1:9000", "10.0.1.2:9001")
+	lst := p.Get()
+	if w := p.Weight(lst[0]); w != 30 {
+		t.Errorf("weight of %s is %g", lst[0], w)
+	}
+	if w := p.Weight(lst[1]); w != 10 {
+		t.Errorf("weight of %s is %g", lst[1], w)
+	}
+}
+
+func TestPeerKubernetes(t *testing.T) {
+	ready := []string{"10.1.0.1", "10.1.0.2"}
+	update := make(chan []string)
+	var current []string = ready
+
+	slices := func(addrs []string) string {
+		var eps []string
+		for i, a := range addrs {
+			eps = append(eps, fmt.Sprintf(`{"addresses":[%q],"conditions":{"ready":true}}`, a))
+			if i == 0 {
+				// not-ready endpoints should be ignored
+				eps = append(eps, `{"addresses":["10.1.9.9"],"conditions":{"ready":false}}`)
+			}
+		}
+		return `[{"endpoints":[` + strings.Join(eps, ",") + `]}]`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices" {
+			http.NotFound(w, r)
+			return
+		}
+		if sel := r.URL.Query().Get("labelSelector"); sel != "kubernetes.io/service-name=sneller" {
+			http.Error(w, "bad selector "+sel, http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":%s}`, slices(current))
+			return
+		}
+		if v := r.URL.Query().Get("resourceVersion"); v != "1" {
+			http.Error(w, "bad resourceVersion "+v, http.StatusBadRequest)
+			return
+		}
+		select {
+		case lst := <-update:
+			current = lst
+			fmt.Fprintf(w, `{"type":"MODIFIED","object":{}}`+"\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &peerPoller{
+		src: &k8sPeers{
+			api:       srv.URL,
+			tokenFile: token,
+			client:    srv.Client(),
+			namespace: "ns",
+			service:   "sneller",
+			port:      9000,
+		},
+	}
+	// use a long interval so that only
+	// the watch can trigger an update
+	if err := p.Start(time.Hour, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	waitPeers(t, p, "10.1.0.1:9000", "10.1.0.2:9000")
+	update <- []string{"10.1.0.3"}
+	waitPeers(t, p, "10.1.0.3:9000")
+}
+
+func TestPeerHealth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.Write([]byte("pong"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	var portnum int
+	fmt.Sscan(port, &portnum)
+
+	// the test server only listens on 127.0.0.1,
+	// so 127.0.0.2 is unresponsive
+	p := &peerPoller{
+		src:    &peerCmd{cmd: []string{"echo", `{"peers":[{"addr":"127.0.0.1:9000"},{"addr":"127.0.0.2:9000"}]}`}},
+		health: &healthCheck{port: portnum, timeout: time.Second},
+	}
+	if err := p.Start(time.Minute, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	waitPeers(t, p, "127.0.0.1:9000")
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often peerTLS checks for
+// changes to its files
+const tlsCheckInterval = 10 * time.Second
+
+// peerTLS holds the certificate, key and CA
+// used for mutual TLS between peers and
+// reloads them when the files change
+type peerTLS struct {
+	certFile, keyFile, caFile string
+
+	lock    sync.Mutex
+	checked time.Time
+	mtimes  [3]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newPeerTLS(cert, key, ca string) (*peerTLS, error) {
+	p := &peerTLS{certFile: cert, keyFile: key, caFile: ca}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *peerTLS) stat() (mtimes [3]time.Time, err error) {
+	for i, name := range []string{p.certFile, p.keyFile, p.caFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return mtimes, err
+		}
+		mtimes[i] = info.ModTime()
+	}
+	return mtimes, nil
+}
+
+// load (re-)reads the files; p.lock
+// should be held unless p is new
+func (p *peerTLS) load() error {
+	mtimes, err := p.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+	ca, err := os.ReadFile(p.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("%s: no certificates found", p.caFile)
+	}
+	p.cert, p.pool, p.mtimes = &cert, pool, mtimes
+	p.checked = time.Now()
+	return nil
+}
+
+// current returns the current certificate
+// and CA pool, reloading them first if
+// any of the files have changed
+func (p *peerTLS) current() (*tls.Certificate, *x509.CertPool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if time.Since(p.checked) >= tlsCheckInterval {
+		p.checked = time.Now()
+		// if the files are being replaced,
+		// keep using the old ones until
+		// they can be loaded successfully
+		if mtimes, err := p.stat(); err == nil && mtimes != p.mtimes {
+			p.load()
+		}
+	}
+	return p.cert, p.pool
+}
+
+// verify checks that the peer certificate
+// chains to the current CA; peers are addressed
+// by IP, so their host names are not checked
+func (p *peerTLS) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+	_, pool := p.current()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// serverConfig returns the configuration
+// for the peer listener, which requires
+// clients to present a valid certificate
+func (p *peerTLS) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := p.current()
+			return cert, nil
+		},
+		VerifyConnection: p.verify,
+	}
+}
+
+// clientConfig returns the configuration
+// for connections to peers
+func (p *peerTLS) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// verification is performed by
+		// p.verify against the current CA
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := p.current()
+			return cert, nil
+		},
+		VerifyConnection: p.verify,
+	}
+}
+
+// loadPeerKey reads the key used to
+// sign requests sent to peers
+func loadPeerKey(name string) ([]byte, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(buf)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("%s: key must be at least 16 bytes", name)
+	}
+	return key, nil
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/tenant"
+)
+
+// writeCerts writes a fresh CA and a certificate
+// and key signed by it into dir
+func writeCerts(t *testing.T, dir string) (cert, key, ca string) {
+	writePEM := func(name, typ string, der []byte) string {
+		name = filepath.Join(dir, name)
+		buf := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := os.WriteFile(name, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "peer CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca = writePEM("ca.crt", "CERTIFICATE", der)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, leaf, parent, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = writePEM("peer.crt", "CERTIFICATE", der)
+	der, err = x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = writePEM("peer.key", "PRIVATE KEY", der)
+	return cert, key, ca
+}
+
+func TestPeerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key, ca := writeCerts(t, dir)
+	p, err := newPeerTLS(cert, key, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := p.current()
+	state := func(c *tls.Certificate) tls.ConnectionState {
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	}
+	if err := p.verify(state(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate everything; the old certificate
+	// should no longer be accepted once the
+	// new files have been picked up
+	other := t.TempDir()
+	writeCerts(t, other)
+	for _, name := range []string{"ca.crt", "peer.crt", "peer.key"} {
+		if err := os.Rename(filepath.Join(other, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, _ := p.current(); c != old {
+		t.Fatal("reloaded before the check interval elapsed")
+	}
+	p.lock.Lock()
+	p.checked = time.Time{}
+	p.mtimes = [3]time.Time{}
+	p.lock.Unlock()
+	now, _ := p.current()
+	if now == old {
+		t.Fatal("certificate was not reloaded")
+	}
+	if err := p.verify(state(now)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verify(state(old)); err == nil {
+		t.Fatal("certificate from the old CA still accepted")
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (c *countingListener) Accept() (net.Conn, error) {
+	conn, err := c.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&c.accepted, 1)
+	}
+	return conn, err
+}
+
+// test that split queries work when peers
+// use mutual TLS and signed requests
+func TestSplitTLS(t *testing.T) {
+	tt := testdirEnviron(t)
+	cert, key, ca := writeCerts(t, t.TempDir())
+	ptls, err := newPeerTLS(cert, key, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef")
+	peersock0 := listen(t)
+	peersock1 := &countingListener{Listener: listen(t)}
+	var peerlog tsbuf
+	mk := func(logger *tsbuf) *server {
+		s := &server{
+			logger:    testlogger(t),
+			sandbox:   tenant.CanSandbox(),
+			cachedir:  t.TempDir(),
+			tenantcmd: []string{"./snellerd-test-binary", "worker", "-rc", cert, "-rk", key, "-ra", ca},
+			splitSize: 16 * 1024,
+			peers:     makePeers(t, peersock0.Addr().(*net.TCPAddr), peersock1.Addr().(*net.TCPAddr)),
+			auth:      testAuth{tt},
+			peerTLS:   ptls,
+			peerKey:   secret,
+		}
+		if logger != nil {
+			s.logger.SetOutput(logger)
+		}
+		if err := s.peers.Start(time.Second, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s, peer := mk(nil), mk(&peerlog)
+	httpsock := listen(t)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	s.aboutToServe = (&wg).Done
+	peer.aboutToServe = (&wg).Done
+	go s.Serve(httpsock, peersock0)
+	go peer.Serve(listen(t), peersock1)
+	wg.Wait()
+	defer s.Close()
+	defer peer.Close()
+
+	rq := &requester{
+		t:    t,
+		host: "http://" + httpsock.Addr().String(),
+	}
+	res, err := http.DefaultClient.Do(rq.getQuery("", "SELECT COUNT(*) FROM default.taxi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", res.Status)
+	}
+	var buf bytes.Buffer
+	_, err = ion.ToJSON(&buf, bufio.NewReader(res.Body))
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(buf.String()); got != `{"count": 8560}` {
+		t.Errorf("got %s", got)
+	}
+	if atomic.LoadInt32(&peersock1.accepted) == 0 {
+		t.Error("the peer was never used")
+	}
+	peerlog.Lock()
+	defer peerlog.Unlock()
+	if peerlog.Len() > 0 {
+		t.Errorf("peer errors: %s", peerlog.String())
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/SnellerInc/sneller/usock"
+)
+
+// resultCache is a bounded LRU cache
+// of query output, keyed on the query ETag
+// (which covers the tenant, the normalized query,
+// the plan hash and the output format).
+//
+// Entries are stored in memory, and entries
+// that are evicted from memory are moved
+// to disk if Dir is set and there is space.
+type resultCache struct {
+	// Memory and Disk are the maximum number of
+	// bytes of results stored in memory and on disk
+	Memory, Disk int64
+	// Dir is the directory in which
+	// results are stored on disk
+	Dir string
+	// Tenant is the maximum number of bytes
+	// of results stored for any one tenant;
+	// zero means there is no per-tenant limit
+	Tenant int64
+
+	lock      sync.Mutex
+	entries   map[string]*list.Element
+	lru       list.List // of *resultEntry; most recent first
+	mem, disk int64
+	usage     map[string]int64 // by tenant
+
+	hits, misses uint64
+}
+
+type resultEntry struct {
+	key, tenant string
+	size        int64
+	data        []byte // nil if on disk
+}
+
+// maxEntry returns the maximum size of one entry
+func (c *resultCache) maxEntry() int64 {
+	max := c.Memory
+	if c.Dir != "" && c.Disk > max {
+		max = c.Disk
+	}
+	max /= 4
+	if c.Tenant > 0 && c.Tenant < max {
+		max = c.Tenant
+	}
+	return max
+}
+
+func (c *resultCache) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(h[:]))
+}
+
+// clean removes the results left
+// in c.Dir by a previous process
+func (c *resultCache) clean() error {
+	ents, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	for i := range ents {
+		name := ents[i].Name()
+		if _, err := hex.DecodeString(name); err == nil && len(name) == 2*sha256.Size {
+			os.Remove(filepath.Join(c.Dir, name))
+		}
+	}
+	return nil
+}
+
+// get returns the cached output for key
+func (c *resultCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := elem.Value.(*resultEntry)
+	data := e.data
+	if data == nil {
+		var err error
+		data, err = os.ReadFile(c.path(key))
+		if err != nil || int64(len(data)) != e.size {
+			c.remove(elem)
+			c.misses++
+			return nil, false
+		}
+	}
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return data, true
+}
+
+// put adds the output for key,
+// evicting older entries as necessary
+func (c *resultCache) put(key, tenant string, data []byte) {
+	size := int64(len(data))
+	if size > c.maxEntry() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.usage = make(map[string]int64)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	e := &resultEntry{key: key, tenant: tenant, size: size, data: data}
+	c.entries[key] = c.lru.PushFront(e)
+	c.mem += size
+	c.usage[tenant] += size
+	c.shrink(tenant)
+}
+
+// shrink evicts entries until
+// the cache is within its limits
+func (c *resultCache) shrink(tenant string) {
+	if c.Tenant > 0 {
+		for elem := c.lru.Back(); elem != nil && c.usage[tenant] > c.Tenant; {
+			prev := elem.Prev()
+			if elem.Value.(*resultEntry).tenant == tenant {
+				c.remove(elem)
+			}
+			elem = prev
+		}
+	}
+	for elem := c.lru.Back(); elem != nil && c.mem > c.Memory; {
+		prev := elem.Prev()
+		if e := elem.Value.(*resultEntry); e.data != nil {
+			if !c.spill(e) {
+				c.remove(elem)
+			}
+		}
+		elem = prev
+	}
+	for elem := c.lru.Back(); elem != nil && c.disk > c.Disk; {
+		prev := elem.Prev()
+		if elem.Value.(*resultEntry).data == nil {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// spill moves an entry from memory to disk
+func (c *resultCache) spill(e *resultEntry) bool {
+	if c.Dir == "" || e.size > c.Disk {
+		return false
+	}
+	if err := os.WriteFile(c.path(e.key), e.data, 0600); err != nil {
+		return false
+	}
+	e.data = nil
+	c.mem -= e.size
+	c.disk += e.size
+	return true
+}
+
+func (c *resultCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*resultEntry)
+	delete(c.entries, e.key)
+	c.usage[e.tenant] -= e.size
+	if c.usage[e.tenant] == 0 {
+		delete(c.usage, e.tenant)
+	}
+	if e.data != nil {
+		c.mem -= e.size
+	} else {
+		c.disk -= e.size
+		os.Remove(c.path(e.key))
+	}
+}
+
+// stats returns the number of
+// cache hits and misses
+func (c *resultCache) stats() (hits, misses uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
+}
+
+// resultTee passes query output through
+// a socket pair so that it can be captured
+// on its way to the client
+type resultTee struct {
+	here, there *net.UnixConn
+	limit       int64
+	abort       func()
+	done        chan struct{}
+	data        []byte
+	ok          bool
+}
+
+func newResultTee(limit int64, abort func()) (*resultTee, error) {
+	here, there, err := usock.SocketPair()
+	if err != nil {
+		return nil, err
+	}
+	return &resultTee{here: here, there: there, limit: limit, abort: abort}, nil
+}
+
+// start closes the tenant's end of the socket
+// pair and, if dst is non-nil, starts copying
+// the output to dst
+func (t *resultTee) start(dst io.Writer) {
+	t.there.Close()
+	if dst == nil {
+		t.here.Close()
+		return
+	}
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		defer t.here.Close()
+		t.ok = true
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := t.here.Read(buf)
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					// the client is gone
+					t.ok = false
+					t.abort()
+					return
+				}
+				if t.ok && int64(len(t.data)+n) <= t.limit {
+					t.data = append(t.data, buf[:n]...)
+				} else {
+					t.ok, t.data = false, nil
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.ok = false
+				return
+			}
+		}
+	}()
+}
+
+// wait waits for the output to be copied
+// and returns all of it, or false if it
+// was too large or could not be copied
+func (t *resultTee) wait() ([]byte, bool) {
+	if t.done == nil {
+		return nil, false
+	}
+	<-t.done
+	return t.data, t.ok
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestResultCache(t *testing.T) {
+	dir := t.TempDir()
+	c := &resultCache{
+		Memory: 200,
+		Disk:   200,
+		Dir:    dir,
+		Tenant: 300,
+	}
+	val := func(b byte) []byte { return bytes.Repeat([]byte{b}, 50) }
+	check := func(key string, want []byte) {
+		t.Helper()
+		got, ok := c.get(key)
+		if want == nil {
+			if ok {
+				t.Errorf("%s: unexpected hit", key)
+			}
+			return
+		}
+		if !ok || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q (%v)", key, got, ok)
+		}
+	}
+	for i, key := range []string{"a", "b", "c", "d"} {
+		c.put(key, "t0", val(byte('a'+i)))
+	}
+	if c.mem != 200 || c.disk != 0 {
+		t.Fatalf("mem %d disk %d", c.mem, c.disk)
+	}
+	check("a", val('a')) // a is now the most recent
+	// e pushes b onto disk
+	c.put("e", "t0", val('e'))
+	if c.mem != 200 || c.disk != 50 {
+		t.Fatalf("mem %d disk %d", c.mem, c.disk)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 1 {
+		t.Fatalf("%d files on disk", len(ents))
+	}
+	check("b", val('b'))
+	// f pushes c onto disk, and then the
+	// tenant quota evicts the least recently
+	// used entry (c) to make room for g
+	c.put("f", "t0", val('f'))
+	c.put("g", "t0", val('g'))
+	check("c", nil)
+	check("d", val('d'))
+	check("b", val('b'))
+	if c.usage["t0"] != 300 {
+		t.Errorf("usage %d", c.usage["t0"])
+	}
+	// other tenants are not affected by the quota
+	c.put("h", "t1", val('h'))
+	check("h", val('h'))
+	if c.usage["t0"] != 300 || c.usage["t1"] != 50 {
+		t.Errorf("usage %v", c.usage)
+	}
+	// entries larger than a quarter
+	// of the cache are not cached
+	c.put("big", "t1", bytes.Repeat([]byte{'x'}, 51))
+	check("big", nil)
+	hits, misses := c.stats()
+	if hits != 5 || misses != 2 {
+		t.Errorf("%d hits, %d misses", hits, misses)
+	}
+}
@@ -16,16 +16,23 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/SnellerInc/sneller/auth"
 	"github.com/SnellerInc/sneller/tenant"
+	"github.com/SnellerInc/sneller/tenant/dcache"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
 )
 
 func runDaemon(args []string) {
@@ -33,7 +40,42 @@ func runDaemon(args []string) {
 	authEndpoint := daemonCmd.String("a", "", "authorization specification (file://, http://, https://, empty uses environment)")
 	daemonEndpoint := daemonCmd.String("e", "127.0.0.1:8000", "endpoint to listen on (REST API)")
 	remoteEndpoint := daemonCmd.String("r", "127.0.0.1:9000", "endpoint to listen on for remote requests (inter-node)")
+	metricsEndpoint := daemonCmd.String("m", "127.0.0.1:9001", "endpoint to listen on for metrics (internal)")
+	auditLog := daemonCmd.String("l", "", "file to which to append the query audit log (- for stdout)")
+	resultsTTL := daemonCmd.Duration("t", defaultAsyncTTL, "how long to keep the results of asynchronous queries")
+	cacheMem := daemonCmd.Int64("c", 0, "bytes of memory used for the query result cache (0 disables the cache)")
+	cacheDir := daemonCmd.String("cd", "", "directory in which to store query results evicted from memory")
+	cacheDisk := daemonCmd.Int64("cs", 0, "bytes of disk used for the query result cache")
+	cacheTenant := daemonCmd.Int64("ct", 0, "maximum bytes of cached query results per tenant (0 is unlimited)")
+	tenantQueries := daemonCmd.Int("qc", 0, "maximum concurrent queries per tenant (0 is unlimited)")
+	nodeQueries := daemonCmd.Int("qn", 0, "maximum concurrent queries on this node (0 is unlimited)")
+	queueSize := daemonCmd.Int("qw", 0, "maximum queries waiting for a slot per tenant")
+	queueTimeout := daemonCmd.Duration("qt", 0, "how long a query may wait for a slot before being rejected")
+	tenantMem := daemonCmd.Int64("qm", 0, "advisory (GOMEMLIMIT) memory limit in bytes for each tenant process (0 is unlimited)")
+	dcacheMem := daemonCmd.Int64("dm", 0, "bytes of memory used by each tenant to cache hot table data (0 disables the memory tier)")
+	dcachePolicy := daemonCmd.String("dp", "lru", "table data cache eviction policy (lru, slru or tinylfu)")
+	dcacheMax := daemonCmd.Int64("dx", 0, "maximum size in bytes of a cached table data segment (0 is unlimited)")
+	dcacheMin := daemonCmd.Int("da", 0, "number of recent accesses of table data before it is cached on disk")
+	warmBudget := daemonCmd.Int64("wb", 0, "maximum bytes per second read by cache warm-ups (0 is unlimited)")
+	isolate := daemonCmd.Bool("ns", false, "sandbox tenant processes with namespaces and seccomp instead of bwrap(1)")
+	cgroupDir := daemonCmd.String("ng", "", "cgroup v2 directory in which to create a cgroup for each tenant process (implies -ns)")
+	cgroupMem := daemonCmd.Int64("nm", 0, "memory.max in bytes of each tenant process (0 is unlimited)")
+	cgroupCPU := daemonCmd.Int("nw", 0, "cpu.weight of each tenant process (0 is the default)")
+	cgroupPids := daemonCmd.Int("np", 0, "pids.max of each tenant process (0 is unlimited)")
+	weightsFile := daemonCmd.String("qf", "", "JSON file mapping tenant IDs to scheduling weights")
+	maxScanned := daemonCmd.Int64("ls", 0, "maximum bytes scanned per query (0 is unlimited)")
+	maxRows := daemonCmd.Int64("lr", 0, "maximum rows of output per query (0 is unlimited)")
+	maxOutput := daemonCmd.Int64("lo", 0, "maximum bytes of output per query (0 is unlimited)")
+	maxTime := daemonCmd.Duration("lt", 0, "maximum runtime per query (0 is unlimited)")
+	limitsFile := daemonCmd.String("lf", "", "JSON file mapping tenant IDs to their query limits")
+	speculate := daemonCmd.Float64("sp", 0, "re-execute split queries on peers that take this many times longer than the median (0 disables)")
 	peerExec := daemonCmd.String("x", "", "command to exec for fetching peers")
+	peerSpec := daemonCmd.String("p", "", "built-in peer discovery (file:///path, dns://name:port, srv://name or k8s://namespace/service:port)")
+	peerHealth := daemonCmd.Int("ph", 0, "HTTP port used to health-check peers via /ping (0 disables)")
+	peerCert := daemonCmd.String("rc", "", "certificate file for mutual TLS between peers")
+	peerKey := daemonCmd.String("rk", "", "private key file for mutual TLS between peers")
+	peerCA := daemonCmd.String("ra", "", "CA certificate file used to verify peers")
+	peerSecret := daemonCmd.String("rs", "", "file containing the shared key used to sign requests to peers")
 	if daemonCmd.Parse(args) != nil {
 		os.Exit(1)
 	}
@@ -44,15 +86,107 @@ func runDaemon(args []string) {
 	}
 
 	server := &server{
-		logger:    log.New(os.Stderr, "", log.Lshortfile),
-		sandbox:   tenant.CanSandbox(),
-		tenantcmd: []string{exe, "worker"},
-		peers:     noPeers{},
+		logger:     log.New(os.Stderr, "", log.Lshortfile),
+		sandbox:    tenant.CanSandbox(),
+		tenantcmd:  []string{exe, "worker"},
+		peers:      noPeers{},
+		asyncTTL:   *resultsTTL,
+		speculate:  *speculate,
+		warmBudget: *warmBudget,
+		limits: queryLimits{
+			MaxScanned: *maxScanned,
+			MaxRows:    *maxRows,
+			MaxOutput:  *maxOutput,
+			Timeout:    duration(*maxTime),
+		},
 	}
+	if *limitsFile != "" {
+		server.tenantLimits, err = loadLimits(*limitsFile)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+	}
+	if *tenantQueries > 0 || *nodeQueries > 0 {
+		server.tenantopts = append(server.tenantopts,
+			tenant.WithConcurrency(*tenantQueries, *nodeQueries),
+			tenant.WithQueue(*queueSize, *queueTimeout))
+	}
+	if *tenantMem > 0 {
+		server.tenantopts = append(server.tenantopts, tenant.WithMemoryLimit(*tenantMem))
+	}
+	if (*cgroupMem > 0 || *cgroupCPU > 0 || *cgroupPids > 0) && *cgroupDir == "" {
+		server.logger.Fatal("-nm, -nw and -np require -ng")
+	}
+	if *isolate || *cgroupDir != "" {
+		if !tenant.CanIsolate() {
+			server.logger.Fatal("-ns: unable to create namespaces for tenant processes")
+		}
+		// bwrap(1) isn't used
+		server.sandbox = false
+		server.logger.Println("native sandboxing enabled")
+		server.tenantopts = append(server.tenantopts, tenant.WithIsolation(&tenant.Isolation{
+			Cgroup:    *cgroupDir,
+			Memory:    *cgroupMem,
+			CPUWeight: *cgroupCPU,
+			Pids:      *cgroupPids,
+			Seccomp:   true,
+		}))
+	}
+	policy, err := parseCachePolicy(*dcachePolicy)
+	if err != nil {
+		server.logger.Fatal(err)
+	}
+	if policy != dcache.LRU {
+		server.tenantopts = append(server.tenantopts, tenant.WithEvictionPolicy(tenant.EvictSLRU))
+	}
+	server.tenantcmd = append(server.tenantcmd,
+		"-dm", strconv.FormatInt(*dcacheMem, 10),
+		"-dp", *dcachePolicy,
+		"-dx", strconv.FormatInt(*dcacheMax, 10),
+		"-da", strconv.Itoa(*dcacheMin))
+	if *weightsFile != "" {
+		weights, err := loadWeights(*weightsFile)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+		server.tenantopts = append(server.tenantopts, tenant.WithWeights(weights))
+	}
+	if *peerCert != "" || *peerKey != "" || *peerCA != "" {
+		if *peerCert == "" || *peerKey == "" || *peerCA == "" {
+			server.logger.Fatal("-rc, -rk and -ra must be used together")
+		}
+		server.peerTLS, err = newPeerTLS(*peerCert, *peerKey, *peerCA)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+		// tenant processes connect to peers,
+		// so they need the same credentials
+		server.tenantcmd = append(server.tenantcmd,
+			"-rc", *peerCert, "-rk", *peerKey, "-ra", *peerCA)
+	}
+	if *peerSecret != "" {
+		server.peerKey, err = loadPeerKey(*peerSecret)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+	}
+	var src peerSource
 	if *peerExec != "" {
-		server.peers = &peerCmd{
+		src = &peerCmd{
 			cmd: strings.Fields(*peerExec),
 		}
+	} else if *peerSpec != "" {
+		src, err = parsePeerSource(*peerSpec)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+	}
+	if src != nil {
+		poller := &peerPoller{src: src}
+		if *peerHealth > 0 {
+			poller.health = &healthCheck{port: *peerHealth, timeout: 2 * time.Second}
+		}
+		server.peers = poller
 	}
 	err = server.peers.Start(5*time.Second, server.logger.Printf)
 	if err != nil {
@@ -70,6 +204,37 @@ func runDaemon(args []string) {
 	}
 	server.auth = provider
 
+	if *cacheMem > 0 {
+		server.results = &resultCache{
+			Memory: *cacheMem,
+			Disk:   *cacheDisk,
+			Dir:    *cacheDir,
+			Tenant: *cacheTenant,
+		}
+		if *cacheDir != "" {
+			err := os.MkdirAll(*cacheDir, 0700)
+			if err == nil {
+				err = server.results.clean()
+			}
+			if err != nil {
+				server.logger.Fatal(err)
+			}
+		}
+	}
+
+	switch *auditLog {
+	case "":
+	case "-":
+		server.audit = newAuditLog(os.Stdout)
+	default:
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+		defer f.Close()
+		server.audit = newAuditLog(f)
+	}
+
 	httpl, err := net.Listen("tcp", *daemonEndpoint)
 	if err != nil {
 		server.logger.Fatal(err)
@@ -82,6 +247,14 @@ func runDaemon(args []string) {
 		}
 	}
 
+	var metricsl net.Listener
+	if *metricsEndpoint != "" {
+		metricsl, err = net.Listen("tcp", *metricsEndpoint)
+		if err != nil {
+			server.logger.Fatal(err)
+		}
+	}
+
 	if dir := os.Getenv("CACHEDIR"); dir != "" {
 		server.cachedir = dir
 	} else {
@@ -99,6 +272,15 @@ func runDaemon(args []string) {
 		}
 	}()
 
+	if metricsl != nil {
+		go func() {
+			err := server.ServeMetrics(metricsl)
+			if err != nil && err != http.ErrServerClosed {
+				server.logger.Fatal(err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
@@ -115,3 +297,33 @@ func runDaemon(args []string) {
 	// Doesn't block if no connections, but will otherwise wait until the timeout deadline
 	server.Shutdown(ctx)
 }
+
+// loadWeights reads a JSON object mapping
+// tenant IDs to scheduling weights; tenants
+// that are not listed have a weight of 1
+func loadWeights(file string) (func(tnproto.ID) int, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var byName map[string]int
+	if err := json.Unmarshal(buf, &byName); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	weights := make(map[tnproto.ID]int, len(byName))
+	for name, w := range byName {
+		if w <= 0 {
+			return nil, fmt.Errorf("%s: invalid weight %d for tenant %q", file, w, name)
+		}
+		var id tnproto.ID
+		hash := sha256.Sum256([]byte(name))
+		copy(id[:], hash[:])
+		weights[id] = w
+	}
+	return func(id tnproto.ID) int {
+		if w, ok := weights[id]; ok {
+			return w
+		}
+		return 1
+	}, nil
+}
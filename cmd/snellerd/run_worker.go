@@ -38,6 +38,19 @@ import (
 // size of a request in bytes exceeds this limit.
 var cacheLimit = memTotal / 2
 
+// parseCachePolicy parses the -dp flag
+func parseCachePolicy(s string) (dcache.Policy, error) {
+	switch s {
+	case "lru":
+		return dcache.LRU, nil
+	case "slru":
+		return dcache.SLRU, nil
+	case "tinylfu":
+		return dcache.TinyLFU, nil
+	}
+	return 0, fmt.Errorf("unknown cache eviction policy %q", s)
+}
+
 func nfds() int {
 	d, _ := os.ReadDir("/proc/self/fd")
 	return len(d) - 1
@@ -50,6 +63,13 @@ func runWorker(args []string) {
 	workerTenant := workerCmd.String("t", "", "tenant identifier")
 	workerControlSocket := workerCmd.Int("c", -1, "control socket")
 	eventfd := workerCmd.Int("e", -1, "eventfd")
+	peerCert := workerCmd.String("rc", "", "certificate file for mutual TLS between peers")
+	peerKey := workerCmd.String("rk", "", "private key file for mutual TLS between peers")
+	peerCA := workerCmd.String("ra", "", "CA certificate file used to verify peers")
+	cacheMem := workerCmd.Int64("dm", 0, "bytes of memory used to cache hot table data")
+	cachePolicy := workerCmd.String("dp", "lru", "table data cache eviction policy")
+	cacheMax := workerCmd.Int64("dx", 0, "maximum size in bytes of a cached table data segment")
+	cacheMin := workerCmd.Int("da", 0, "number of recent accesses of table data before it is cached on disk")
 	if workerCmd.Parse(args) != nil {
 		os.Exit(1)
 	}
@@ -64,6 +84,13 @@ func runWorker(args []string) {
 		panic("no eventfd passed")
 	}
 	logger := log.New(os.Stderr, "tid:"+*workerTenant+" ", 0)
+	if *peerCert != "" {
+		p, err := newPeerTLS(*peerCert, *peerKey, *peerCA)
+		if err != nil {
+			logger.Fatalf("loading peer TLS configuration: %s", err)
+		}
+		tnproto.SetClientTLS(p.clientConfig())
+	}
 
 	// capture vm errors associated with this tenant
 	vm.Errorf = logger.Printf
@@ -100,7 +127,14 @@ func runWorker(args []string) {
 		if err != nil || !info.IsDir() {
 			logger.Printf("ignoring invalid cache dir %s", cachedir)
 		} else {
-			env.cache = dcache.New(cachedir, env.post)
+			policy, err := parseCachePolicy(*cachePolicy)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			env.cache = dcache.New(cachedir, env.post,
+				dcache.WithMemory(*cacheMem, policy),
+				dcache.WithMaxEntrySize(*cacheMax),
+				dcache.WithMinAccesses(*cacheMin))
 			env.cache.Logger = logger
 		}
 	}
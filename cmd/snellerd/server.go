@@ -16,9 +16,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -39,12 +41,18 @@ type contextKey struct {
 var rawConnKey = &contextKey{key: "rawConn"}
 
 type server struct {
-	logger  *log.Logger
+	logger *log.Logger
+
+	// lock guards manager, which is
+	// set by Serve and cleared by Shutdown
+	lock    sync.Mutex
 	manager *tenant.Manager
 
 	sandbox   bool
 	cachedir  string
 	tenantcmd []string
+	// additional options for the tenant manager
+	tenantopts []tenant.Option
 
 	peers peerlist
 	auth  auth.Provider
@@ -56,6 +64,16 @@ type server struct {
 	// split size used to configure the splitter,
 	// can be left 0 to use the default
 	splitSize int64
+	// speculate configures speculative execution
+	// of split queries (see plan.UnionMap.Speculate)
+	speculate float64
+
+	// peerTLS, if non-nil, secures the tenant
+	// remote socket with mutual TLS, and peerKey,
+	// if non-nil, is used to sign and verify
+	// the requests sent over it
+	peerTLS *peerTLS
+	peerKey []byte
 
 	// when started, the http server
 	srv http.Server
@@ -69,21 +87,61 @@ type server struct {
 	// if the end point errors out
 	stale atomic.Value
 
+	// queries in flight, by query ID
+	queries queryList
+
+	// query statistics and the
+	// internal server for /metrics
+	metrics metrics
+	msrv    http.Server
+
+	// audit, if non-nil, receives
+	// an entry for each query
+	audit *auditLog
+
+	// asynchronous queries, by query ID,
+	// and how long to keep their results
+	// (defaultAsyncTTL if zero)
+	async    asyncList
+	asyncTTL time.Duration
+
+	// results, if non-nil, caches query output
+	results *resultCache
+
+	// cache warm-ups, by tenant and table,
+	// and the maximum number of bytes per
+	// second they read (zero is unlimited)
+	warmups    warmups
+	warmBudget int64
+
+	// limits are the default query limits,
+	// and tenantLimits replace them for
+	// particular tenant IDs
+	limits       queryLimits
+	tenantLimits map[string]queryLimits
+
 	// hack to avoid data races in testing
 	aboutToServe func()
 }
 
 func (s *server) Close() error {
-	s.manager.Stop()
+	if m := s.tenants(); m != nil {
+		m.Stop()
+	}
 	s.peers.Stop()
 	s.srv.Close()
+	s.msrv.Close()
 	return nil
 }
 
 func (s *server) Shutdown(ctx context.Context) error {
-	if s.manager != nil {
-		s.manager.Stop()
-		s.manager = nil
+	s.msrv.Shutdown(ctx)
+	s.lock.Lock()
+	m := s.manager
+	s.manager = nil
+	s.lock.Unlock()
+	if m != nil {
+		m.Stop()
 	}
 	return s.srv.Shutdown(ctx)
 }
@@ -93,22 +151,37 @@ func (s *server) handler() *http.ServeMux {
 	r.HandleFunc("/", s.handle(s.versionHandler, http.MethodGet))
 	r.HandleFunc("/ping", s.handle(s.pingHandler, http.MethodGet))
 	r.HandleFunc("/executeQuery", s.handle(s.executeQueryHandler, http.MethodHead, http.MethodGet, http.MethodPost))
+	r.HandleFunc("/explain", s.handle(s.explainHandler, http.MethodGet, http.MethodPost))
 	r.HandleFunc("/databases", s.handle(s.databasesHandler, http.MethodGet))
 	r.HandleFunc("/tables", s.handle(s.tablesHandler, http.MethodGet))
 	r.HandleFunc("/inputs", s.handle(s.inputsHandler, http.MethodGet))
+	r.HandleFunc("/warmup", s.handle(s.warmupHandler, http.MethodGet, http.MethodPost))
+	r.HandleFunc("/queries", s.handle(s.asyncSubmitHandler, http.MethodPost))
+	r.HandleFunc("/queries/", s.handle(s.queriesHandler, http.MethodGet, http.MethodDelete))
 	return r
 }
 
 func (s *server) Serve(httpsock, tenantsock net.Listener) error {
-	s.manager = tenant.NewManager(s.tenantcmd,
+	remote := tenantsock
+	if remote != nil && s.peerTLS != nil {
+		remote = tls.NewListener(remote, s.peerTLS.serverConfig())
+	}
+	opts := append([]tenant.Option{
 		tenant.WithLogger(s.logger),
-		tenant.WithRemote(tenantsock),
-	)
-	s.manager.Sandbox = s.sandbox
-	s.manager.CacheDir = s.cachedir
+		tenant.WithRemote(remote),
+	}, s.tenantopts...)
+	if s.peerKey != nil {
+		opts = append(opts, tenant.WithRemoteKey(s.peerKey))
+	}
+	m := tenant.NewManager(s.tenantcmd, opts...)
+	m.Sandbox = s.sandbox
+	m.CacheDir = s.cachedir
+	s.lock.Lock()
+	s.manager = m
+	s.lock.Unlock()
 	if tenantsock != nil {
 		go func() {
-			if err := s.manager.Serve(); err != nil {
+			if err := m.Serve(); err != nil {
 				s.logger.Fatal(err)
 			}
 		}()
@@ -126,3 +199,20 @@ func (s *server) Serve(httpsock, tenantsock net.Listener) error {
 	}
 	return s.srv.Serve(httpsock)
 }
+
+// ServeMetrics serves the /metrics endpoint on l,
+// which should be an internal (non-public) listener.
+// tenants returns the tenant manager,
+// or nil if the server has been shut down
+func (s *server) tenants() *tenant.Manager {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.manager
+}
+
+func (s *server) ServeMetrics(l net.Listener) error {
+	r := http.NewServeMux()
+	r.HandleFunc("/metrics", s.metricsHandler)
+	s.msrv.Handler = r
+	return s.msrv.Serve(l)
+}
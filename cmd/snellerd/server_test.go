@@ -15,21 +15,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/SnellerInc/sneller/tenant"
 )
 
 // testPeers is a wrapper around the
-// "production" peerCmd implementation
+// "production" peerPoller implementation
 // that writes a static list to a file
 // and makes the command implementation
 // just "cat <file>"
 type testPeers struct {
-	peerCmd
+	peerPoller
 	tt   *testing.T
 	list []*net.TCPAddr
 }
@@ -55,6 +60,30 @@ func (t *testPeers) Start(interval time.Duration, logf func(string, ...interface
 	if err != nil {
 		t.tt.Fatal(err)
 	}
-	t.cmd = []string{"cat", name}
-	return t.peerCmd.Start(interval, logf)
+	t.src = &peerCmd{cmd: []string{"cat", name}}
+	return t.peerPoller.Start(interval, logf)
+}
+
+func TestMetricsShutdown(t *testing.T) {
+	s := &server{
+		logger:  testlogger(t),
+		manager: tenant.NewManager([]string{"/bin/false"}),
+		peers:   noPeers{},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w := httptest.NewRecorder()
+			s.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("/metrics: %d", w.Code)
+				return
+			}
+		}
+	}()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
 }
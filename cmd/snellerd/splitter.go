@@ -16,7 +16,9 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net"
+	"time"
 
 	"github.com/SnellerInc/sneller/expr"
 	"github.com/SnellerInc/sneller/expr/blob"
@@ -28,16 +30,52 @@ import (
 
 const defaultSplitSize = int64(100 * 1024 * 1024)
 
+// peerTokenTTL is how long the tokens
+// that authorize requests to peers are valid
+const peerTokenTTL = time.Hour
+
 type splitter struct {
 	SplitSize int64
 	workerID  tnproto.ID
 	peers     []*net.TCPAddr
 	selfAddr  string
 
+	// weights are the relative capacities
+	// of peers, indexed like peers, and keys
+	// are the per-peer hash keys used to
+	// place blobs by rendezvous hashing
+	weights []float64
+	keys    []uint64
+
+	// speculate is returned by Speculate
+	speculate float64
+
+	// token authorizes requests sent
+	// to peers on behalf of workerID
+	token tnproto.Token
+
 	// compute total size of input blobs
 	// and the maximum # of bytes scanned after
 	// sparse indexing has been applied
 	total, maxscan int64
+
+	// blocks is the number of blocks in
+	// the compressed input blobs, and pruned
+	// is the number of those blocks that
+	// were excluded by sparse indexing
+	blocks, pruned int
+
+	// assigned is the work assigned
+	// to each peer, indexed like peers
+	assigned []assignment
+}
+
+// assignment is the number of blobs
+// and the maximum # of bytes scanned
+// that a splitter assigned to a peer
+type assignment struct {
+	blobs int
+	scan  int64
 }
 
 func (s *server) newSplitter(workerID tnproto.ID, peers []*net.TCPAddr) *splitter {
@@ -45,10 +83,24 @@ func (s *server) newSplitter(workerID tnproto.ID, peers []*net.TCPAddr) *splitte
 		SplitSize: s.splitSize,
 		workerID:  workerID,
 		peers:     peers,
+		speculate: s.speculate,
 	}
 	if s.remote != nil {
 		split.selfAddr = s.remote.String()
 	}
+	if s.peerKey != nil {
+		split.token = tnproto.Sign(s.peerKey, workerID, time.Now().Add(peerTokenTTL))
+	}
+	wp, _ := s.peers.(weightedPeers)
+	split.weights = make([]float64, len(peers))
+	split.keys = make([]uint64, len(peers))
+	for i := range peers {
+		split.weights[i] = 1
+		if wp != nil {
+			split.weights[i] = wp.Weight(peers[i])
+		}
+		split.keys[i] = siphash.Hash(key0, key1, []byte(peers[i].String()))
+	}
 	return split
 }
 
@@ -70,13 +122,18 @@ func (s *splitter) Split(table expr.Node, handle plan.TableHandle) (plan.Subtabl
 	for i := range splits {
 		splits[i].tp = s.transport(i)
 	}
-	insert := func(b blob.Interface) error {
+	if s.assigned == nil {
+		s.assigned = make([]assignment, len(s.peers))
+	}
+	insert := func(b blob.Interface, scan int64) error {
 		i, err := s.partition(b)
 		if err != nil {
 			return err
 		}
 		splits[i].blobs = append(splits[i].blobs, len(blobs))
 		blobs = append(blobs, b)
+		s.assigned[i].blobs++
+		s.assigned[i].scan += scan
 		return nil
 	}
 	for _, b := range fh.blobs.Contents {
@@ -88,7 +145,7 @@ func (s *splitter) Split(table expr.Node, handle plan.TableHandle) (plan.Subtabl
 		if !ok {
 			// we can only really do interesting
 			// splitting stuff with blob.Compressed
-			if err := insert(b); err != nil {
+			if err := insert(b, stat.Size); err != nil {
 				return nil, err
 			}
 			s.total += stat.Size
@@ -101,14 +158,17 @@ func (s *splitter) Split(table expr.Node, handle plan.TableHandle) (plan.Subtabl
 			return nil, err
 		}
 		for i := range sub {
+			blocks := sub[i].EndBlock - sub[i].StartBlock
+			s.blocks += blocks
 			// only insert blobs that satisfy
 			// the predicate pushdown conditions
 			scan := maxscan(&sub[i], flt)
 			if scan == 0 {
+				s.pruned += blocks
 				continue
 			}
 			s.maxscan += scan
-			if err := insert(&sub[i]); err != nil {
+			if err := insert(&sub[i], scan); err != nil {
 				return nil, err
 			}
 		}
@@ -128,6 +188,9 @@ func (s *splitter) Split(table expr.Node, handle plan.TableHandle) (plan.Subtabl
 	}, nil
 }
 
+// Speculate implements plan.Speculator
+func (s *splitter) Speculate() float64 { return s.speculate }
+
 // compact compacts splits so that any splits with no
 // blobs are removed from the list.
 func compact(splits []split) []split {
@@ -155,22 +218,44 @@ func maxscan(pc *blob.CompressedPart, f filter) (scan int64) {
 	return scan
 }
 
+// just two fixed random values
+const (
+	key0 = uint64(0x5d1ec810)
+	key1 = uint64(0xfebed702)
+)
+
 // partition returns the index of the peer which should
 // handle the specified blob.
+//
+// Blobs are placed by weighted rendezvous hashing:
+// each peer scores the blob using a hash keyed by
+// the peer address, and the highest score wins.
+// Adding or removing a peer only moves the blobs
+// that it wins or won, so the contents of the caches
+// on the other peers remain useful.
 func (s *splitter) partition(b blob.Interface) (int, error) {
 	info, err := b.Stat()
 	if err != nil {
 		return 0, err
 	}
+	best, bestScore := 0, math.Inf(-1)
+	for i := range s.peers {
+		score := rendezvous(siphash.Hash(s.keys[i], key1, []byte(info.ETag)), s.weights[i])
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best, nil
+}
 
-	// just two fixed random values
-	key0 := uint64(0x5d1ec810)
-	key1 := uint64(0xfebed702)
-
-	hash := siphash.Hash(key0, key1, []byte(info.ETag))
-	maxUint64 := ^uint64(0)
-	idx := hash / (maxUint64 / uint64(len(s.peers)))
-	return int(idx), nil
+// rendezvous returns the score of a peer with
+// the given weight for a key that hashes to h;
+// the probability that a peer has the highest
+// score is proportional to its weight
+func rendezvous(h uint64, weight float64) float64 {
+	// map h to a uniform value in (0, 1)
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
 }
 
 func (s *splitter) transport(i int) plan.Transport {
@@ -182,6 +267,7 @@ func (s *splitter) transport(i int) plan.Transport {
 		Tenant: s.workerID,
 		Net:    "tcp",
 		Addr:   nodeID,
+		Token:  s.token,
 	}
 }
 
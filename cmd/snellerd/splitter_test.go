@@ -15,12 +15,14 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -31,6 +33,7 @@ import (
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/ion/blockfmt"
 	"github.com/SnellerInc/sneller/plan"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
 )
 
 func init() {
@@ -58,7 +61,7 @@ func decodeFakeTransport(st *ion.Symtab, buf []byte) (plan.Transport, error) {
 	return nil, errors.New("no transport field")
 }
 
-func (t fakeTransport) Exec(*plan.Tree, plan.TableRewrite, io.Writer, *plan.ExecStats) error {
+func (t fakeTransport) Exec(context.Context, *plan.Tree, plan.TableRewrite, io.Writer, *plan.ExecStats) error {
 	panic("fake transport cannot exec")
 }
 
@@ -265,3 +268,72 @@ func subsequaln(n int, s1, s2 *subtables) error {
 	}
 	return nil
 }
+
+// weightedList is a static weighted peerlist
+type weightedList struct {
+	noPeers
+	weights map[string]float64
+}
+
+func (w *weightedList) Weight(addr *net.TCPAddr) float64 {
+	if v, ok := w.weights[addr.String()]; ok {
+		return v
+	}
+	return 1
+}
+
+func TestPartition(t *testing.T) {
+	addrs := make([]*net.TCPAddr, 5)
+	for i := range addrs {
+		addrs[i] = &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 9000}
+	}
+	blobs := make([]blob.Interface, 10000)
+	for i := range blobs {
+		hash := md5.Sum([]byte(fmt.Sprintf("s3://bucket/blob-%d", i)))
+		blobs[i] = &blob.URL{Info: blob.Info{ETag: hex.EncodeToString(hash[:])}}
+	}
+	place := func(s *server, peers []*net.TCPAddr) ([]string, map[string]int) {
+		split := s.newSplitter(tnproto.ID{}, peers)
+		out := make([]string, len(blobs))
+		count := make(map[string]int)
+		for i := range blobs {
+			j, err := split.partition(blobs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[i] = peers[j].String()
+			count[out[i]]++
+		}
+		return out, count
+	}
+	s := &server{peers: noPeers{}}
+	before, _ := place(s, addrs[:4])
+	after, count := place(s, addrs)
+	// only blobs placed on the new peer
+	// should have moved
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != addrs[4].String() {
+				t.Fatalf("blob %d moved from %s to %s", i, before[i], after[i])
+			}
+		}
+	}
+	if moved < 1500 || moved > 2500 {
+		t.Errorf("%d of %d blobs moved", moved, len(blobs))
+	}
+	for addr, n := range count {
+		if n < 1500 || n > 2500 {
+			t.Errorf("%s has %d of %d blobs", addr, n, len(blobs))
+		}
+	}
+
+	// a peer with weight 4 should get
+	// half of the blobs across 5 peers
+	s.peers = &weightedList{weights: map[string]float64{addrs[0].String(): 4}}
+	_, count = place(s, addrs)
+	if n := count[addrs[0].String()]; n < 4500 || n > 5500 {
+		t.Errorf("weighted peer has %d of %d blobs", n, len(blobs))
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+func TestSyncCluster(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&text, "{\"row\": %d, \"tenant\": \"t%03d\"}\n", i, rand.Intn(100))
+	}
+	err = os.WriteFile(filepath.Join(tmpdir, "a-prefix", "data.json"), text.Bytes(), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:    "clustered",
+		Inputs:  []Input{{Pattern: "file://a-prefix/*.json"}},
+		Cluster: []string{"tenant"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	b := Builder{
+		Align:         1024,
+		RangeMultiple: 4,
+		ClusterWindow: 1 << 30,
+		Logf:          t.Logf,
+	}
+	err = b.Sync(owner, "default", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := OpenIndex(dfs, "default", "clustered", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != 1 {
+		t.Fatalf("expected 1 packed object; got %d", len(idx.Inline))
+	}
+	rows := 0
+	last := ""
+	for _, d := range readRows(t, dfs, &idx.Inline[0]) {
+		rows++
+		tenant := string(d.FieldByName("tenant").Value.(ion.String))
+		if tenant < last {
+			t.Fatalf("row %d: tenant %q after %q", rows, tenant, last)
+		}
+		last = tenant
+	}
+	if rows != 2000 {
+		t.Fatalf("got %d rows; expected 2000", rows)
+	}
+}
+
+func TestSyncClusterRanges(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "t042"
+	matching := 0
+	var text bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		tenant := fmt.Sprintf("t%03d", rand.Intn(100))
+		if tenant == want {
+			matching++
+		}
+		fmt.Fprintf(&text, "{\"row\": %d, \"tenant\": \"%s\"}\n", i, tenant)
+	}
+	err = os.WriteFile(filepath.Join(tmpdir, "a-prefix", "data.json"), text.Bytes(), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:          "clustered",
+		Inputs:        []Input{{Pattern: "file://a-prefix/*.json"}},
+		Cluster:       []string{"tenant"},
+		ClusterWindow: 1 << 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	b := Builder{
+		Align:         1024,
+		RangeMultiple: 4,
+		Logf:          t.Logf,
+	}
+	err = b.Sync(owner, "default", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := OpenIndex(dfs, "default", "clustered", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != 1 {
+		t.Fatalf("expected 1 packed object; got %d", len(idx.Inline))
+	}
+	desc := &idx.Inline[0]
+	blocks := desc.Trailer.Blocks
+	if len(blocks) < 2 {
+		t.Fatalf("expected multiple blocks; got %d", len(blocks))
+	}
+	// every block should have a range for
+	// the cluster key that covers its rows
+	var keep []int
+	for i := range blocks {
+		var min, max ion.String
+		found := false
+		for _, r := range blocks[i].Ranges {
+			if len(r.Path()) == 1 && r.Path()[0] == "tenant" {
+				min, _ = r.Min().(ion.String)
+				max, _ = r.Max().(ion.String)
+				found = true
+			}
+		}
+		if !found || min == "" || max == "" {
+			t.Fatalf("block %d: no string range for tenant in %v", i, blocks[i].Ranges)
+		}
+		for _, d := range readBlocks(t, dfs, desc, i, i+1) {
+			tenant := d.FieldByName("tenant").Value.(ion.String)
+			if tenant < min || tenant > max {
+				t.Fatalf("block %d: tenant %q outside range [%q, %q]", i, tenant, min, max)
+			}
+		}
+		if want >= min && want <= max {
+			keep = append(keep, i)
+		}
+	}
+	// a scan for tenant = want should only
+	// have to read a few of the blocks
+	if len(keep) == 0 || len(keep) >= len(blocks)/2 {
+		t.Fatalf("filter kept %d of %d blocks", len(keep), len(blocks))
+	}
+	rows := 0
+	for _, i := range keep {
+		for _, d := range readBlocks(t, dfs, desc, i, i+1) {
+			if d.FieldByName("tenant").Value.(ion.String) == want {
+				rows++
+			}
+		}
+	}
+	if rows != matching {
+		t.Fatalf("found %d rows for %s in %d blocks; expected %d", rows, want, len(keep), matching)
+	}
+}
+
+// readRows reads all of the records in a packed object
+func readRows(t *testing.T, dfs *DirFS, desc *blockfmt.Descriptor) []*ion.Struct {
+	return readBlocks(t, dfs, desc, 0, len(desc.Trailer.Blocks))
+}
+
+// readBlocks reads the records in blocks [start, end)
+// of a packed object
+func readBlocks(t *testing.T, dfs *DirFS, desc *blockfmt.Descriptor, start, end int) []*ion.Struct {
+	t.Helper()
+	buf, err := fs.ReadFile(dfs, desc.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := desc.Trailer.Slice(start, end)
+	var dst bytes.Buffer
+	dec := blockfmt.Decoder{}
+	dec.Set(trailer, len(trailer.Blocks))
+	_, err = dec.CopyBytes(&dst, buf[trailer.Blocks[0].Offset:trailer.Offset])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st ion.Symtab
+	var out []*ion.Struct
+	buf = dst.Bytes()
+	for len(buf) > 0 {
+		var d ion.Datum
+		d, buf, err = ion.ReadDatum(&st, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := d.(*ion.Struct); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
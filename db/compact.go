@@ -0,0 +1,447 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+// DefaultMaxCompactBytes is the default
+// maximum number of (compressed) bytes
+// of packed objects that are rewritten
+// in one call to Builder.Compact.
+const DefaultMaxCompactBytes = 10 * giga
+
+// A CompactionPolicy decides which of the
+// packed objects in a table should be
+// merged together by Builder.Compact.
+type CompactionPolicy interface {
+	// Compact returns groups of descriptors
+	// from lst, where each group should be
+	// merged into a single new object.
+	// The sum of the sizes of all the returned
+	// descriptors should not exceed budget bytes.
+	// Groups must not share descriptors.
+	Compact(lst []blockfmt.Descriptor, budget int64) [][]blockfmt.Descriptor
+}
+
+// SizeTiered is a CompactionPolicy that
+// groups objects into tiers of similar size
+// and merges the objects in a tier once
+// the tier has accumulated enough objects.
+type SizeTiered struct {
+	// MinSize is the size of the smallest tier.
+	// Objects smaller than MinSize all belong
+	// to the first tier. If MinSize is zero,
+	// then DefaultMinMerge is used.
+	MinSize int64
+	// Ratio is the ratio between the sizes
+	// of successive tiers. If Ratio is less than
+	// or equal to one, then 4 is used.
+	Ratio float64
+	// MinObjects is the minimum number of
+	// objects in a tier for the tier to be merged.
+	// If MinObjects is less than two, then 4 is used.
+	MinObjects int
+	// MaxSize is the size above which
+	// objects are never merged.
+	// If MaxSize is zero, then no limit is applied.
+	MaxSize int64
+}
+
+func (s *SizeTiered) minSize() int64 {
+	if s.MinSize > 0 {
+		return s.MinSize
+	}
+	return DefaultMinMerge
+}
+
+func (s *SizeTiered) ratio() float64 {
+	if s.Ratio > 1 {
+		return s.Ratio
+	}
+	return 4
+}
+
+func minObjects(n int) int {
+	if n < 2 {
+		return 4
+	}
+	return n
+}
+
+func (s *SizeTiered) tier(size int64) int {
+	min := s.minSize()
+	if size <= min {
+		return 0
+	}
+	return 1 + int(math.Log(float64(size)/float64(min))/math.Log(s.ratio()))
+}
+
+// Compact implements CompactionPolicy.Compact
+func (s *SizeTiered) Compact(lst []blockfmt.Descriptor, budget int64) [][]blockfmt.Descriptor {
+	tiers := make(map[int][]blockfmt.Descriptor)
+	var order []int
+	for i := range lst {
+		if lst[i].Size == 0 || (s.MaxSize > 0 && lst[i].Size >= s.MaxSize) {
+			continue
+		}
+		t := s.tier(lst[i].Size)
+		if _, ok := tiers[t]; !ok {
+			order = append(order, t)
+		}
+		tiers[t] = append(tiers[t], lst[i])
+	}
+	// smallest tiers first; they are the
+	// cheapest to merge and the most numerous
+	sort.Ints(order)
+	groups := make([][]blockfmt.Descriptor, 0, len(order))
+	for _, t := range order {
+		groups = append(groups, tiers[t])
+	}
+	return pickGroups(groups, minObjects(s.MinObjects), budget)
+}
+
+// TimeWindow is a CompactionPolicy that
+// buckets objects into fixed-size windows
+// of time based on the maximum value of
+// a timestamp field within each object, and
+// then merges objects within the same window.
+// Objects without a range for the timestamp
+// field are left alone.
+type TimeWindow struct {
+	// Path is the path to the timestamp field.
+	Path []string
+	// Window is the width of each window.
+	// If Window is zero, then one day is used.
+	Window time.Duration
+	// MinObjects is the minimum number of objects
+	// in a window for the window to be merged.
+	// If MinObjects is less than two, then 4 is used.
+	MinObjects int
+	// MaxSize is the size above which
+	// objects are never merged.
+	// If MaxSize is zero, then no limit is applied.
+	MaxSize int64
+}
+
+func (w *TimeWindow) window() time.Duration {
+	if w.Window > 0 {
+		return w.Window
+	}
+	return 24 * time.Hour
+}
+
+// Compact implements CompactionPolicy.Compact
+func (w *TimeWindow) Compact(lst []blockfmt.Descriptor, budget int64) [][]blockfmt.Descriptor {
+	windows := make(map[int64][]blockfmt.Descriptor)
+	var order []int64
+	for i := range lst {
+		if lst[i].Size == 0 || (w.MaxSize > 0 && lst[i].Size >= w.MaxSize) {
+			continue
+		}
+		_, max, ok := timeRange(&lst[i], w.Path)
+		if !ok {
+			continue
+		}
+		win := max.UnixNano() / int64(w.window())
+		if _, ok := windows[win]; !ok {
+			order = append(order, win)
+		}
+		windows[win] = append(windows[win], lst[i])
+	}
+	// oldest windows first; they are the
+	// least likely to receive new data
+	sort.Slice(order, func(i, j int) bool {
+		return order[i] < order[j]
+	})
+	groups := make([][]blockfmt.Descriptor, 0, len(order))
+	for _, win := range order {
+		groups = append(groups, windows[win])
+	}
+	return pickGroups(groups, minObjects(w.MinObjects), budget)
+}
+
+// timeRange returns the union of the time
+// ranges for path across all blocks in desc
+func timeRange(desc *blockfmt.Descriptor, path []string) (min, max date.Time, ok bool) {
+	if desc.Trailer == nil {
+		return
+	}
+	for i := range desc.Trailer.Blocks {
+		for _, r := range desc.Trailer.Blocks[i].Ranges {
+			tr, isTime := r.(*blockfmt.TimeRange)
+			if !isTime || !equalPath(tr.Path(), path) {
+				continue
+			}
+			if !ok || tr.MinTime().Before(min) {
+				min = tr.MinTime()
+			}
+			if !ok || tr.MaxTime().After(max) {
+				max = tr.MaxTime()
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pickGroups selects the groups with at least
+// min objects, trimming groups to fit within budget
+func pickGroups(groups [][]blockfmt.Descriptor, min int, budget int64) [][]blockfmt.Descriptor {
+	var out [][]blockfmt.Descriptor
+	for _, g := range groups {
+		if len(g) < min {
+			continue
+		}
+		var size int64
+		n := 0
+		for n < len(g) && size+g[n].Size <= budget {
+			size += g[n].Size
+			n++
+		}
+		if n < 2 {
+			break
+		}
+		out = append(out, g[:n])
+		budget -= size
+	}
+	return out
+}
+
+func (b *Builder) compaction() CompactionPolicy {
+	if b.Compaction != nil {
+		return b.Compaction
+	}
+	return &SizeTiered{MinSize: b.minMergeSize()}
+}
+
+func (b *Builder) maxCompactBytes() int64 {
+	if b.MaxCompactBytes > 0 {
+		return b.MaxCompactBytes
+	}
+	return DefaultMaxCompactBytes
+}
+
+// Compact merges existing packed objects
+// in a table according to b.Compaction,
+// rewriting at most b.MaxCompactBytes of
+// packed objects. Compact does not ingest
+// any new input objects. The objects that
+// have been merged are left to be removed
+// by garbage collection.
+//
+// If the table Definition has a RetentionPolicy,
+// then Compact also removes objects that only
+// contain expired rows, and it rewrites objects
+// that contain some expired rows without those rows.
+//
+// Compact returns the number of packed objects
+// that were merged into new objects or removed.
+// If the table is currently being scanned
+// (see Builder.Scan), then Compact returns ErrBuildAgain.
+// Compact also returns ErrBuildAgain without updating
+// the index if the index was written (for example,
+// by Sync or Append) while Compact was running.
+// Since the check is not atomic with the write of the
+// new index, ingestion that runs at the same time as
+// Compact can still lose an update in a narrow window.
+func (b *Builder) Compact(who Tenant, db, table string) (int, error) {
+	st, err := b.open(db, table, who)
+	if err != nil {
+		return 0, err
+	}
+	// the ETag is read before the index so that
+	// any later write to the index is detected
+	etag, err := st.indexETag()
+	if err != nil {
+		return 0, err
+	}
+	idx, err := st.index()
+	if err != nil {
+		return 0, err
+	}
+	if idx.Scanning {
+		return 0, ErrBuildAgain
+	}
+	st.preciseGC(idx)
+	ret, err := st.retention()
+	if err != nil {
+		return 0, err
+	}
+	dropped, err := st.expire(idx, ret, true)
+	if err != nil {
+		return 0, err
+	}
+	budget := b.maxCompactBytes()
+	groups := b.compaction().Compact(idx.Inline, budget)
+	if ret != nil {
+		groups = append(groups, partialGroups(idx.Inline, groups, ret, budget)...)
+	}
+	if len(groups) == 0 && dropped == 0 {
+		b.logf("table %s/%s: nothing to compact", db, table)
+		return 0, nil
+	}
+	var keep func(ion.Datum) bool
+	if ret != nil {
+		keep = ret.keep
+	}
+	merged := dropped
+	for _, g := range groups {
+		desc, err := st.merge(g, keep)
+		if err != nil {
+			return merged, err
+		}
+		st.replace(idx, g, desc)
+		merged += len(g)
+	}
+	// don't overwrite objects added to the
+	// index by a concurrent Sync or Append
+	err = st.checkIndex(etag)
+	if err != nil {
+		return 0, err
+	}
+	idx.Created = date.Now().Truncate(time.Microsecond)
+	err = st.flush(idx)
+	if err == nil {
+		err = st.runGC(idx)
+	}
+	return merged, err
+}
+
+// partialGroups returns single-object groups
+// for the objects in lst that contain some expired
+// rows and are not already part of groups,
+// up to the remainder of budget
+func partialGroups(lst []blockfmt.Descriptor, groups [][]blockfmt.Descriptor, r *retainer, budget int64) [][]blockfmt.Descriptor {
+	taken := make(map[string]bool)
+	for _, g := range groups {
+		for i := range g {
+			taken[g[i].Path] = true
+			budget -= g[i].Size
+		}
+	}
+	var out [][]blockfmt.Descriptor
+	for i := range lst {
+		if taken[lst[i].Path] || !r.partial(&lst[i]) {
+			continue
+		}
+		if lst[i].Size > budget {
+			break
+		}
+		budget -= lst[i].Size
+		out = append(out, lst[i:i+1])
+	}
+	return out
+}
+
+// merge writes the contents of lst into a new packed object,
+// omitting rows for which keep returns false (if keep is non-nil)
+func (st *tableState) merge(lst []blockfmt.Descriptor, keep func(ion.Datum) bool) (*blockfmt.Descriptor, error) {
+	inputs := make([]blockfmt.Input, 0, len(lst))
+	closeAll := func() {
+		for i := range inputs {
+			inputs[i].R.Close()
+		}
+	}
+	for i := range lst {
+		if lst[i].Trailer == nil {
+			closeAll()
+			return nil, fmt.Errorf("merging %s: missing trailer", lst[i].Path)
+		}
+		rd, err := st.openPacked(&lst[i])
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		st.conf.logf("table %s: merging %s", st.table, lst[i].Path)
+		f := blockfmt.PackedFormat(lst[i].Trailer)
+		if keep != nil {
+			f = blockfmt.FilterPackedFormat(lst[i].Trailer, keep)
+		}
+		inputs = append(inputs, blockfmt.Input{
+			Path: lst[i].Path,
+			ETag: lst[i].ETag,
+			Size: lst[i].Size,
+			R:    rd,
+			F:    f,
+		})
+	}
+	c, err := st.converter(inputs)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return st.run(c)
+}
+
+// replace replaces the descriptors in old with
+// desc in idx.Inline, taking the position of the
+// first replaced descriptor, and quarantines the
+// old objects for garbage collection
+//
+// if desc does not contain any data (because
+// every row was filtered out), then desc is
+// quarantined rather than inserted
+func (st *tableState) replace(idx *blockfmt.Index, old []blockfmt.Descriptor, desc *blockfmt.Descriptor) {
+	remove := make(map[string]bool, len(old))
+	for i := range old {
+		remove[old[i].Path] = true
+	}
+	expiry := date.Now().Add(st.conf.GCMinimumAge)
+	inserted := false
+	if len(desc.Trailer.Blocks) == 0 {
+		idx.ToDelete = append(idx.ToDelete, blockfmt.Quarantined{
+			Path:   desc.Path,
+			Expiry: expiry,
+		})
+		inserted = true
+	}
+	out := idx.Inline[:0]
+	for i := range idx.Inline {
+		if !remove[idx.Inline[i].Path] {
+			out = append(out, idx.Inline[i])
+			continue
+		}
+		idx.ToDelete = append(idx.ToDelete, blockfmt.Quarantined{
+			Path:   idx.Inline[i].Path,
+			Expiry: expiry,
+		})
+		if !inserted {
+			out = append(out, *desc)
+			inserted = true
+		}
+	}
+	idx.Inline = out
+}
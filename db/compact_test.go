@@ -0,0 +1,311 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+func descSizes(groups [][]blockfmt.Descriptor) [][]int64 {
+	var out [][]int64
+	for _, g := range groups {
+		var sizes []int64
+		for i := range g {
+			sizes = append(sizes, g[i].Size)
+		}
+		out = append(out, sizes)
+	}
+	return out
+}
+
+func TestSizeTiered(t *testing.T) {
+	const min = 1000
+	descs := func(sizes ...int64) []blockfmt.Descriptor {
+		out := make([]blockfmt.Descriptor, len(sizes))
+		for i := range out {
+			out[i].Path = fmt.Sprintf("packed-%d", i)
+			out[i].Size = sizes[i]
+		}
+		return out
+	}
+	cases := []struct {
+		policy SizeTiered
+		in     []int64
+		budget int64
+		want   [][]int64
+	}{
+		{
+			// not enough objects in any tier
+			policy: SizeTiered{MinSize: min, Ratio: 2, MinObjects: 3},
+			in:     []int64{100, 200, 3000, 5000},
+			budget: 1 << 30,
+		},
+		{
+			policy: SizeTiered{MinSize: min, Ratio: 2, MinObjects: 3},
+			in:     []int64{100, 3000, 200, 5000, 300, 3500},
+			budget: 1 << 30,
+			want:   [][]int64{{100, 200, 300}},
+		},
+		{
+			policy: SizeTiered{MinSize: min, Ratio: 2, MinObjects: 2},
+			in:     []int64{100, 2500, 200, 2600, 100000},
+			budget: 1 << 30,
+			want:   [][]int64{{100, 200}, {2500, 2600}},
+		},
+		{
+			// budget trims the second tier
+			policy: SizeTiered{MinSize: min, Ratio: 2, MinObjects: 2},
+			in:     []int64{100, 2500, 200, 2600, 2700},
+			budget: 300 + 2500 + 2600,
+			want:   [][]int64{{100, 200}, {2500, 2600}},
+		},
+		{
+			// objects above MaxSize are left alone
+			policy: SizeTiered{MinSize: min, Ratio: 2, MinObjects: 2, MaxSize: 2550},
+			in:     []int64{100, 2500, 200, 2600},
+			budget: 1 << 30,
+			want:   [][]int64{{100, 200}},
+		},
+	}
+	for i := range cases {
+		got := descSizes(cases[i].policy.Compact(descs(cases[i].in...), cases[i].budget))
+		if !reflect.DeepEqual(got, cases[i].want) {
+			t.Errorf("case %d: got %v; want %v", i, got, cases[i].want)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	path := []string{"timestamp"}
+	base := date.Date(2022, 6, 1, 0, 0, 0, 0)
+	desc := func(size int64, hours int) blockfmt.Descriptor {
+		var d blockfmt.Descriptor
+		d.Size = size
+		tm := ion.Timestamp(base.Add(time.Duration(hours) * time.Hour))
+		d.Trailer = &blockfmt.Trailer{
+			Blocks: []blockfmt.Blockdesc{{
+				Ranges: []blockfmt.Range{blockfmt.NewRange(path, tm, tm)},
+			}},
+		}
+		return d
+	}
+	policy := TimeWindow{Path: path, Window: 24 * time.Hour, MinObjects: 2}
+	lst := []blockfmt.Descriptor{
+		desc(1, 49),
+		desc(2, 1),
+		desc(3, 25),
+		desc(4, 2),
+		desc(5, 26),
+		{ObjectInfo: blockfmt.ObjectInfo{Size: 6}}, // no trailer
+	}
+	got := descSizes(policy.Compact(lst, 1<<30))
+	want := [][]int64{{2, 4}, {3, 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	owner := newTenant(dfs)
+	b := Builder{
+		Align: 1024,
+		// don't merge on append
+		MinMergeSize: 1,
+		Compaction: &SizeTiered{
+			MinSize:    1024 * 1024,
+			MinObjects: 3,
+		},
+		Logf:         t.Logf,
+		GCLikelihood: 1,
+	}
+	const objects = 4
+	for i := 0; i < objects; i++ {
+		var text strings.Builder
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&text, "{\"object\": %d, \"row\": %d}\n", i, j)
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "compact", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := OpenIndex(dfs, "default", "compact", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != objects {
+		t.Fatalf("expected %d objects; got %d", objects, len(idx.Inline))
+	}
+
+	n, err := b.Compact(owner, "default", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != objects {
+		t.Errorf("merged %d objects; expected %d", n, objects)
+	}
+	idx, err = OpenIndex(dfs, "default", "compact", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != 1 {
+		t.Fatalf("expected 1 object after compaction; got %d", len(idx.Inline))
+	}
+	if len(idx.ToDelete) != objects {
+		t.Errorf("expected %d objects to delete; got %d", objects, len(idx.ToDelete))
+	}
+	rows := readRows(t, dfs, &idx.Inline[0])
+	if len(rows) != objects*100 {
+		t.Errorf("got %d rows; expected %d", len(rows), objects*100)
+	}
+	checkContents(t, idx, dfs)
+
+	// a second pass has nothing to do
+	n, err = b.Compact(owner, "default", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("second compaction merged %d objects", n)
+	}
+}
+
+// hookFS calls hook the first time
+// an object is created
+type hookFS struct {
+	*DirFS
+	hook func()
+}
+
+func (h *hookFS) Create(p string) (blockfmt.Uploader, error) {
+	if h.hook != nil {
+		hook := h.hook
+		h.hook = nil
+		hook()
+	}
+	return h.DirFS.Create(p)
+}
+
+// hookTenant is a tenant that
+// uses a hookFS as its root
+type hookTenant struct {
+	*testTenant
+	root *hookFS
+}
+
+func (h *hookTenant) Root() (InputFS, error) { return h.root, nil }
+
+// an Append that happens while Compact is
+// rewriting objects should not be lost
+func TestCompactConcurrentAppend(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	owner := newTenant(dfs)
+	b := Builder{
+		Align: 1024,
+		// don't merge on append
+		MinMergeSize: 1,
+		Compaction: &SizeTiered{
+			MinSize:    1024 * 1024,
+			MinObjects: 3,
+		},
+		Logf: t.Logf,
+	}
+	appendFile := func(i int) {
+		var text strings.Builder
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&text, "{\"object\": %d, \"row\": %d}\n", i, j)
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "compact", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	const objects = 4
+	for i := 0; i < objects; i++ {
+		appendFile(i)
+	}
+	who := &hookTenant{
+		testTenant: owner,
+		root: &hookFS{
+			DirFS: dfs,
+			hook:  func() { appendFile(objects) },
+		},
+	}
+	_, err = b.Compact(who, "default", "compact")
+	if !errors.Is(err, ErrBuildAgain) {
+		t.Fatalf("got error %v; expected ErrBuildAgain", err)
+	}
+	idx, err := OpenIndex(dfs, "default", "compact", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != objects+1 {
+		t.Fatalf("expected %d objects; got %d", objects+1, len(idx.Inline))
+	}
+	// compacting again picks up every object
+	n, err := b.Compact(owner, "default", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != objects+1 {
+		t.Errorf("merged %d objects; expected %d", n, objects+1)
+	}
+}
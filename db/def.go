@@ -23,6 +23,7 @@ import (
 	"path"
 
 	"github.com/SnellerInc/sneller/fsutil"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
 
 	"sigs.k8s.io/yaml"
 )
@@ -58,6 +59,45 @@ type Definition struct {
 	Name string `json:"name"`
 	// Inputs is the list of inputs that comprise the table.
 	Inputs []Input `json:"input"`
+	// Cluster, if non-empty, is a list of
+	// dotted paths (i.e. "meta.tenant") by which
+	// rows are sorted as they are written, so that
+	// the per-block ranges for those paths are narrow.
+	// Rows are sorted within windows of data rather
+	// than across the whole table; see ClusterWindow.
+	Cluster []string `json:"cluster,omitempty"`
+	// ClusterWindow, if non-zero, is the total
+	// number of decompressed bytes that are
+	// buffered for sorting when Cluster is set.
+	// It overrides Builder.ClusterWindow.
+	ClusterWindow int `json:"cluster_window,omitempty"`
+	// Retention, if non-nil, is the policy
+	// that determines when old data is
+	// removed from the table.
+	// See Builder.Compact.
+	Retention *RetentionPolicy `json:"retention_policy,omitempty"`
+	// Policies are named access policies
+	// for the table. The credentials of a tenant
+	// determine which of the policies apply
+	// to its queries; see auth.Policy.Roles.
+	Policies map[string]*AccessPolicy `json:"policies,omitempty"`
+}
+
+// clusterPaths returns the parsed list of
+// paths in s.Cluster
+func (s *Definition) clusterPaths() ([][]string, error) {
+	if len(s.Cluster) == 0 {
+		return nil, nil
+	}
+	out := make([][]string, len(s.Cluster))
+	for i := range s.Cluster {
+		p, err := blockfmt.ParseClusterPath(s.Cluster[i])
+		if err != nil {
+			return nil, fmt.Errorf("definition %q: %w", s.Name, err)
+		}
+		out[i] = p
+	}
+	return out, nil
 }
 
 func drop(lst []fsutil.NamedFile) {
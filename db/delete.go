@@ -0,0 +1,695 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+// Delete removes every row matching pred from a table.
+//
+// Only the packed objects that may contain matching
+// rows according to their range metadata are read,
+// and only the objects that actually contain matching
+// rows are rewritten. The index is updated to point
+// to the rewritten objects, and the original objects
+// are left to be removed by garbage collection.
+//
+// The predicate may consist of comparisons between
+// paths and constants, IN, IS [NOT] NULL/MISSING/TRUE/FALSE,
+// and AND, OR, and NOT. Rows for which pred evaluates
+// to NULL or MISSING are not removed.
+//
+// Delete returns the number of rows that were removed.
+// If the table is currently being scanned
+// (see Builder.Scan), then Delete returns ErrBuildAgain.
+// Like Compact, Delete also returns ErrBuildAgain without
+// updating the index if the index was written while
+// Delete was running.
+func (b *Builder) Delete(who Tenant, db, table string, pred expr.Node) (int64, error) {
+	m, err := compileMatcher(pred)
+	if err != nil {
+		return 0, err
+	}
+	st, err := b.open(db, table, who)
+	if err != nil {
+		return 0, err
+	}
+	etag, err := st.indexETag()
+	if err != nil {
+		return 0, err
+	}
+	idx, err := st.index()
+	if err != nil {
+		return 0, err
+	}
+	if idx.Scanning {
+		return 0, ErrBuildAgain
+	}
+	st.preciseGC(idx)
+	e := eraser{st: st, idx: idx, m: m}
+	// inline objects are processed first, since
+	// indirect moves the objects it has already
+	// scanned into idx.Inline
+	err = e.inline()
+	if err != nil {
+		return 0, err
+	}
+	err = e.indirect()
+	if err != nil {
+		return 0, err
+	}
+	if e.written == 0 {
+		b.logf("table %s/%s: no rows to delete", db, table)
+		return 0, nil
+	}
+	// don't overwrite objects added to the
+	// index by a concurrent Sync or Append
+	err = st.checkIndex(etag)
+	if err != nil {
+		return 0, err
+	}
+	idx.Created = date.Now().Truncate(time.Microsecond)
+	err = st.flush(idx)
+	if err == nil {
+		err = st.runGC(idx)
+	}
+	return e.deleted, err
+}
+
+// eraser holds the state for Builder.Delete
+type eraser struct {
+	st      *tableState
+	idx     *blockfmt.Index
+	m       *matcher
+	deleted int64 // rows removed
+	written int   // objects written
+}
+
+// matches scans desc and returns true
+// if any row matches the predicate
+func (e *eraser) matches(desc *blockfmt.Descriptor) (bool, error) {
+	if desc.Trailer == nil {
+		return false, fmt.Errorf("deleting from %s: missing trailer", desc.Path)
+	}
+	rd, err := e.st.openPacked(desc)
+	if err != nil {
+		return false, err
+	}
+	defer rd.Close()
+	found := false
+	err = blockfmt.ScanPacked(rd, desc.Trailer, func(row ion.Datum) bool {
+		found = e.m.eval(row) == truthy
+		return !found
+	})
+	return found, err
+}
+
+// erase rewrites desc without the matching rows;
+// it returns the new descriptor or nil if no rows
+// in desc matched the predicate
+func (e *eraser) erase(desc *blockfmt.Descriptor) (*blockfmt.Descriptor, error) {
+	// only objects that contain matching
+	// rows are rewritten
+	ok, err := e.matches(desc)
+	if !ok || err != nil {
+		return nil, err
+	}
+	n := int64(0)
+	keep := func(row ion.Datum) bool {
+		if e.m.eval(row) == truthy {
+			atomic.AddInt64(&n, 1)
+			return false
+		}
+		return true
+	}
+	out, err := e.st.merge([]blockfmt.Descriptor{*desc}, keep)
+	if err != nil {
+		return nil, err
+	}
+	e.written++
+	e.st.conf.logf("table %s: deleted %d rows from %s", e.st.table, n, desc.Path)
+	e.deleted += n
+	return out, nil
+}
+
+func (e *eraser) quarantine(p string) {
+	e.idx.ToDelete = append(e.idx.ToDelete, blockfmt.Quarantined{
+		Path:   p,
+		Expiry: date.Now().Add(e.st.conf.GCMinimumAge),
+	})
+}
+
+// inline rewrites the matching objects in idx.Inline
+func (e *eraser) inline() error {
+	var candidates []blockfmt.Descriptor
+	for i := range e.idx.Inline {
+		if e.m.mayMatch(&e.idx.Inline[i]) {
+			candidates = append(candidates, e.idx.Inline[i])
+		}
+	}
+	for i := range candidates {
+		desc, err := e.erase(&candidates[i])
+		if err != nil {
+			return err
+		}
+		if desc != nil {
+			e.st.replace(e.idx, candidates[i:i+1], desc)
+		}
+	}
+	return nil
+}
+
+// indirect rewrites the matching objects
+// referenced by idx.Indirect
+//
+// refs containing rewritten objects are removed
+// from the indirect tree and their descriptors
+// are moved to the front of idx.Inline; the next
+// call to SyncOutputs will move them back into
+// the indirect tree
+func (e *eraser) indirect() error {
+	var pulled []blockfmt.Descriptor
+	refs := e.idx.Indirect.Refs[:0]
+	for i := range e.idx.Indirect.Refs {
+		ref := e.idx.Indirect.Refs[i]
+		if !e.m.ranges(ref.Ranges) {
+			refs = append(refs, ref)
+			continue
+		}
+		tree := blockfmt.IndirectTree{Refs: []blockfmt.IndirectRef{ref}}
+		descs, err := tree.Search(e.st.ofs, nil)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for j := range descs {
+			if !e.m.mayMatch(&descs[j]) {
+				continue
+			}
+			desc, err := e.erase(&descs[j])
+			if err != nil {
+				return err
+			}
+			if desc != nil {
+				e.quarantine(descs[j].Path)
+				descs[j] = *desc
+				changed = true
+			}
+		}
+		if !changed {
+			refs = append(refs, ref)
+			continue
+		}
+		e.quarantine(ref.Path)
+		for j := range descs {
+			// drop objects that are now empty
+			if len(descs[j].Trailer.Blocks) == 0 {
+				e.quarantine(descs[j].Path)
+				continue
+			}
+			pulled = append(pulled, descs[j])
+		}
+	}
+	e.idx.Indirect.Refs = refs
+	if len(pulled) > 0 {
+		e.idx.Inline = append(pulled, e.idx.Inline...)
+	}
+	return nil
+}
+
+// truth is a three-valued logic value
+type truth int8
+
+const (
+	falsy   truth = -1
+	unknown truth = 0
+	truthy  truth = 1
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return truthy
+	}
+	return falsy
+}
+
+// matcher evaluates a predicate against rows
+// and against the range metadata of blocks
+type matcher struct {
+	eval func(row ion.Datum) truth
+	// ranges returns false if no row within
+	// the given ranges can match the predicate
+	ranges func(r []blockfmt.Range) bool
+}
+
+// mayMatch returns true if any of the
+// blocks in desc may contain matching rows
+func (m *matcher) mayMatch(desc *blockfmt.Descriptor) bool {
+	if desc.Trailer == nil {
+		return true
+	}
+	for i := range desc.Trailer.Blocks {
+		if m.ranges(desc.Trailer.Blocks[i].Ranges) {
+			return true
+		}
+	}
+	return false
+}
+
+func unsupported(e expr.Node) error {
+	return fmt.Errorf("delete: unsupported expression %s", expr.ToString(e))
+}
+
+func compileMatcher(e expr.Node) (*matcher, error) {
+	if e == nil {
+		return nil, fmt.Errorf("delete: missing predicate")
+	}
+	eval, err := compileTruth(e)
+	if err != nil {
+		return nil, err
+	}
+	return &matcher{eval: eval, ranges: compileRanges(e)}, nil
+}
+
+func compileTruth(e expr.Node) (func(ion.Datum) truth, error) {
+	switch e := e.(type) {
+	case expr.Bool:
+		t := truthOf(bool(e))
+		return func(ion.Datum) truth { return t }, nil
+	case *expr.Not:
+		inner, err := compileTruth(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(row ion.Datum) truth { return -inner(row) }, nil
+	case *expr.Logical:
+		return compileLogical(e)
+	case *expr.Comparison:
+		return compileComparison(e)
+	case *expr.Member:
+		arg, err := compileValue(e.Arg)
+		if err != nil {
+			return nil, err
+		}
+		set := make([]ion.Datum, len(e.Values))
+		for i := range e.Values {
+			set[i] = e.Values[i].Datum()
+		}
+		return func(row ion.Datum) truth {
+			v, ok := arg(row)
+			if !ok || isNull(v) {
+				return unknown
+			}
+			for i := range set {
+				if c, ok := compareValues(v, set[i]); ok && c == 0 {
+					return truthy
+				}
+			}
+			return falsy
+		}, nil
+	case *expr.IsKey:
+		return compileIs(e)
+	case *expr.Builtin:
+		if e.Func == expr.Before && len(e.Args) >= 2 {
+			return compileTruth(before(e.Args))
+		}
+	}
+	return nil, unsupported(e)
+}
+
+// before rewrites BEFORE(a, b, ...) as a < b AND b < ...
+func before(args []expr.Node) expr.Node {
+	var out expr.Node
+	for i := 1; i < len(args); i++ {
+		c := &expr.Comparison{Op: expr.Less, Left: args[i-1], Right: args[i]}
+		if out == nil {
+			out = c
+		} else {
+			out = &expr.Logical{Op: expr.OpAnd, Left: out, Right: c}
+		}
+	}
+	return out
+}
+
+func compileLogical(e *expr.Logical) (func(ion.Datum) truth, error) {
+	left, err := compileTruth(e.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := compileTruth(e.Right)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case expr.OpAnd:
+		return func(row ion.Datum) truth {
+			l := left(row)
+			if l == falsy {
+				return falsy
+			}
+			if r := right(row); r < l {
+				return r
+			}
+			return l
+		}, nil
+	case expr.OpOr:
+		return func(row ion.Datum) truth {
+			l := left(row)
+			if l == truthy {
+				return truthy
+			}
+			if r := right(row); r > l {
+				return r
+			}
+			return l
+		}, nil
+	case expr.OpXor, expr.OpXnor:
+		xnor := e.Op == expr.OpXnor
+		return func(row ion.Datum) truth {
+			l, r := left(row), right(row)
+			if l == unknown || r == unknown {
+				return unknown
+			}
+			return truthOf((l == r) == xnor)
+		}, nil
+	}
+	return nil, unsupported(e)
+}
+
+func compileComparison(e *expr.Comparison) (func(ion.Datum) truth, error) {
+	var test func(c int) bool
+	switch e.Op {
+	case expr.Equals:
+		test = func(c int) bool { return c == 0 }
+	case expr.NotEquals:
+		test = func(c int) bool { return c != 0 }
+	case expr.Less:
+		test = func(c int) bool { return c < 0 }
+	case expr.LessEquals:
+		test = func(c int) bool { return c <= 0 }
+	case expr.Greater:
+		test = func(c int) bool { return c > 0 }
+	case expr.GreaterEquals:
+		test = func(c int) bool { return c >= 0 }
+	default:
+		return nil, unsupported(e)
+	}
+	left, err := compileValue(e.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := compileValue(e.Right)
+	if err != nil {
+		return nil, err
+	}
+	return func(row ion.Datum) truth {
+		l, ok := left(row)
+		if !ok || isNull(l) {
+			return unknown
+		}
+		r, ok := right(row)
+		if !ok || isNull(r) {
+			return unknown
+		}
+		c, ok := compareValues(l, r)
+		if !ok {
+			return unknown
+		}
+		return truthOf(test(c))
+	}, nil
+}
+
+func compileIs(e *expr.IsKey) (func(ion.Datum) truth, error) {
+	arg, err := compileValue(e.Expr)
+	if err != nil {
+		return nil, err
+	}
+	var test func(v ion.Datum, ok bool) bool
+	switch e.Key {
+	case expr.IsNull, expr.IsNotNull:
+		test = func(v ion.Datum, ok bool) bool { return !ok || isNull(v) }
+	case expr.IsMissing, expr.IsNotMissing:
+		test = func(v ion.Datum, ok bool) bool { return !ok }
+	case expr.IsTrue, expr.IsNotTrue:
+		test = func(v ion.Datum, ok bool) bool { return ok && v == ion.Bool(true) }
+	case expr.IsFalse, expr.IsNotFalse:
+		test = func(v ion.Datum, ok bool) bool { return ok && v == ion.Bool(false) }
+	default:
+		return nil, unsupported(e)
+	}
+	negate := e.Key == expr.IsNotNull || e.Key == expr.IsNotMissing ||
+		e.Key == expr.IsNotTrue || e.Key == expr.IsNotFalse
+	return func(row ion.Datum) truth {
+		v, ok := arg(row)
+		return truthOf(test(v, ok) != negate)
+	}, nil
+}
+
+// compileValue compiles a path or a constant;
+// the returned function returns false if the
+// value is MISSING
+func compileValue(e expr.Node) (func(ion.Datum) (ion.Datum, bool), error) {
+	switch e := e.(type) {
+	case expr.Constant:
+		d := e.Datum()
+		return func(ion.Datum) (ion.Datum, bool) { return d, true }, nil
+	case *expr.Path:
+		return func(row ion.Datum) (ion.Datum, bool) {
+			return lookup(row, e)
+		}, nil
+	}
+	return nil, unsupported(e)
+}
+
+func lookup(row ion.Datum, p *expr.Path) (ion.Datum, bool) {
+	v, ok := field(row, p.First)
+	for rest := p.Rest; ok && rest != nil; {
+		switch r := rest.(type) {
+		case *expr.Dot:
+			v, ok = field(v, r.Field)
+			rest = r.Rest
+		case *expr.LiteralIndex:
+			lst, isList := v.(ion.List)
+			ok = isList && r.Field >= 0 && r.Field < len(lst)
+			if ok {
+				v = lst[r.Field]
+			}
+			rest = r.Rest
+		default:
+			return nil, false
+		}
+	}
+	return v, ok
+}
+
+func field(d ion.Datum, name string) (ion.Datum, bool) {
+	s, ok := d.(*ion.Struct)
+	if !ok {
+		return nil, false
+	}
+	f := s.FieldByName(name)
+	if f == nil {
+		return nil, false
+	}
+	return f.Value, true
+}
+
+func isNull(d ion.Datum) bool {
+	_, ok := d.(ion.UntypedNull)
+	return ok
+}
+
+// compareValues compares two datums of comparable
+// types; it returns false if they cannot be compared
+func compareValues(a, b ion.Datum) (int, bool) {
+	switch a := a.(type) {
+	case ion.String:
+		if b, ok := b.(ion.String); ok {
+			return strings.Compare(string(a), string(b)), true
+		}
+	case ion.Bool:
+		if b, ok := b.(ion.Bool); ok {
+			if a == b {
+				return 0, true
+			}
+			if !a {
+				return -1, true
+			}
+			return 1, true
+		}
+	case ion.Timestamp:
+		if b, ok := b.(ion.Timestamp); ok {
+			return compareTimes(date.Time(a), date.Time(b)), true
+		}
+	default:
+		x, okx := toRat(a)
+		y, oky := toRat(b)
+		if okx && oky {
+			return x.Cmp(y), true
+		}
+	}
+	return 0, false
+}
+
+func compareTimes(a, b date.Time) int {
+	if a.Before(b) {
+		return -1
+	}
+	if a.After(b) {
+		return 1
+	}
+	return 0
+}
+
+func toRat(d ion.Datum) (*big.Rat, bool) {
+	r := new(big.Rat)
+	switch d := d.(type) {
+	case ion.Int:
+		return r.SetInt64(int64(d)), true
+	case ion.Uint:
+		return r.SetUint64(uint64(d)), true
+	case ion.Float:
+		// NaN and Inf are not comparable
+		if r.SetFloat64(float64(d)) == nil {
+			return nil, false
+		}
+		return r, true
+	case *ion.BigInt:
+		return r.SetInt((*big.Int)(d)), true
+	case *ion.BigNum:
+		return r.Set((*big.Rat)(d)), true
+	}
+	return nil, false
+}
+
+func anyRange([]blockfmt.Range) bool { return true }
+
+// compileRanges compiles e into a function that
+// determines whether rows constrained by a set
+// of ranges could possibly match e; comparisons
+// and IN between paths and constants are considered
+func compileRanges(e expr.Node) func([]blockfmt.Range) bool {
+	switch e := e.(type) {
+	case expr.Bool:
+		if !e {
+			return func([]blockfmt.Range) bool { return false }
+		}
+	case *expr.Logical:
+		left, right := compileRanges(e.Left), compileRanges(e.Right)
+		switch e.Op {
+		case expr.OpAnd:
+			return func(r []blockfmt.Range) bool { return left(r) && right(r) }
+		case expr.OpOr:
+			return func(r []blockfmt.Range) bool { return left(r) || right(r) }
+		}
+	case *expr.Builtin:
+		if e.Func == expr.Before && len(e.Args) >= 2 {
+			return compileRanges(before(e.Args))
+		}
+	case *expr.Comparison:
+		op := e.Op
+		p, ok := e.Left.(*expr.Path)
+		c, ok2 := e.Right.(expr.Constant)
+		if !ok || !ok2 {
+			p, ok = e.Right.(*expr.Path)
+			c, ok2 = e.Left.(expr.Constant)
+			op = op.Flip()
+		}
+		if !ok || !ok2 {
+			break
+		}
+		v := c.Datum()
+		return func(r []blockfmt.Range) bool {
+			rng := rangeFor(r, p)
+			return rng == nil || overlaps(op, v, rng)
+		}
+	case *expr.Member:
+		p, ok := e.Arg.(*expr.Path)
+		if !ok {
+			break
+		}
+		set := make([]ion.Datum, len(e.Values))
+		for i := range e.Values {
+			set[i] = e.Values[i].Datum()
+		}
+		return func(r []blockfmt.Range) bool {
+			rng := rangeFor(r, p)
+			if rng == nil {
+				return true
+			}
+			for i := range set {
+				if overlaps(expr.Equals, set[i], rng) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return anyRange
+}
+
+// overlaps returns false if no value
+// within rng can satisfy (value op v)
+func overlaps(op expr.CmpOp, v ion.Datum, rng blockfmt.Range) bool {
+	cmin, ok := compareValues(rng.Min(), v)
+	if !ok {
+		return true
+	}
+	cmax, ok := compareValues(rng.Max(), v)
+	if !ok {
+		return true
+	}
+	switch op {
+	case expr.Equals:
+		return cmin <= 0 && cmax >= 0
+	case expr.Less:
+		return cmin < 0
+	case expr.LessEquals:
+		return cmin <= 0
+	case expr.Greater:
+		return cmax > 0
+	case expr.GreaterEquals:
+		return cmax >= 0
+	}
+	return true
+}
+
+func rangeFor(ranges []blockfmt.Range, p *expr.Path) blockfmt.Range {
+	path := []string{p.First}
+	for rest := p.Rest; rest != nil; {
+		d, ok := rest.(*expr.Dot)
+		if !ok {
+			return nil
+		}
+		path = append(path, d.Field)
+		rest = d.Rest
+	}
+	for _, r := range ranges {
+		if equalPath(r.Path(), path) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+func parseWhere(t *testing.T, text string) expr.Node {
+	t.Helper()
+	q, err := partiql.Parse([]byte("SELECT * FROM t WHERE " + text))
+	if err != nil {
+		t.Fatalf("parsing %q: %s", text, err)
+	}
+	return q.Body.(*expr.Select).Where
+}
+
+func TestMatcher(t *testing.T) {
+	row := &ion.Struct{Fields: []ion.Field{
+		{Label: "user", Value: ion.String("bob")},
+		{Label: "age", Value: ion.Uint(30)},
+		{Label: "score", Value: ion.Float(1.5)},
+		{Label: "deleted", Value: ion.Bool(false)},
+		{Label: "gone", Value: ion.UntypedNull{}},
+		{Label: "inner", Value: &ion.Struct{Fields: []ion.Field{
+			{Label: "tags", Value: ion.List{ion.String("x"), ion.String("y")}},
+		}}},
+	}}
+	cases := []struct {
+		text string
+		want truth
+	}{
+		{"user = 'bob'", truthy},
+		{"user <> 'bob'", falsy},
+		{"'bob' = user", truthy},
+		{"age = 30", truthy},
+		{"age >= 30 AND age < 31", truthy},
+		{"age > 30", falsy},
+		{"score < 2", truthy},
+		{"age BETWEEN 1 AND 10", falsy},
+		{"user IN ('alice', 'bob')", truthy},
+		{"user IN ('alice', 'carol')", falsy},
+		{"inner.tags[1] = 'y'", truthy},
+		{"deleted IS FALSE", truthy},
+		{"gone IS NULL", truthy},
+		{"nope IS MISSING", truthy},
+		{"user IS NOT MISSING", truthy},
+		// comparisons with MISSING or NULL are unknown
+		{"nope = 'bob'", unknown},
+		{"gone = 'bob'", unknown},
+		{"NOT (nope = 'bob')", unknown},
+		{"nope = 'bob' OR user = 'bob'", truthy},
+		{"nope = 'bob' AND user = 'alice'", falsy},
+		// incomparable types are unknown
+		{"user = 3", unknown},
+	}
+	for i := range cases {
+		m, err := compileMatcher(parseWhere(t, cases[i].text))
+		if err != nil {
+			t.Errorf("%q: %s", cases[i].text, err)
+			continue
+		}
+		if got := m.eval(row); got != cases[i].want {
+			t.Errorf("%q: got %d want %d", cases[i].text, got, cases[i].want)
+		}
+	}
+
+	_, err := compileMatcher(parseWhere(t, "user LIKE 'b%'"))
+	if err == nil {
+		t.Error("expected LIKE to be rejected")
+	}
+}
+
+func TestMatcherRanges(t *testing.T) {
+	ranges := []blockfmt.Range{
+		blockfmt.NewRange([]string{"row"}, ion.Int(10), ion.Int(20)),
+		blockfmt.NewRange([]string{"inner", "user"}, ion.String("bob"), ion.String("dave")),
+		blockfmt.NewRange([]string{"timestamp"},
+			ion.Timestamp(date.Date(2022, 6, 1, 0, 0, 0, 0)),
+			ion.Timestamp(date.Date(2022, 6, 2, 0, 0, 0, 0))),
+	}
+	cases := []struct {
+		text string
+		want bool
+	}{
+		{"row = 15", true},
+		{"row = 25", false},
+		{"row < 10", false},
+		{"row <= 10", true},
+		{"30 < row", false},
+		{"row >= 20.5", false},
+		{"row IN (1, 2, 3)", false},
+		{"row IN (1, 12)", true},
+		{"inner.user = 'carol'", true},
+		{"inner.user = 'alice'", false},
+		{"inner.user > 'eve'", false},
+		{"timestamp > `2022-06-03T00:00:00Z`", false},
+		{"timestamp < `2022-06-01T12:00:00Z`", true},
+		{"row = 25 OR inner.user = 'carol'", true},
+		{"row = 15 AND inner.user = 'alice'", false},
+		// no range for other paths
+		{"other = 25", true},
+		// incomparable types may match
+		{"row = 'x'", true},
+	}
+	for i := range cases {
+		m, err := compileMatcher(parseWhere(t, cases[i].text))
+		if err != nil {
+			t.Errorf("%q: %s", cases[i].text, err)
+			continue
+		}
+		if got := m.ranges(ranges); got != cases[i].want {
+			t.Errorf("%q: got %v want %v", cases[i].text, got, cases[i].want)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	owner := newTenant(dfs)
+	b := Builder{
+		Align: 1024,
+		// don't merge on append
+		MinMergeSize: 1,
+		Logf:         t.Logf,
+	}
+	users := []string{"alice", "bob", "carol"}
+	// each object covers a different day
+	const objects = 3
+	for i := 0; i < objects; i++ {
+		var text strings.Builder
+		for j := 0; j < 30; j++ {
+			user := users[j%len(users)]
+			if i == 2 {
+				// bob is not present in the last object
+				user = "carol"
+			}
+			fmt.Fprintf(&text, "{\"user\": %q, \"row\": %d, \"timestamp\": \"2022-06-0%dT%02d:00:00Z\"}\n", user, j, i+1, j%24)
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "erase", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() *blockfmt.Index {
+		idx, err := OpenIndex(dfs, "default", "erase", owner.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	before := open()
+	if len(before.Inline) != objects {
+		t.Fatalf("expected %d objects; got %d", objects, len(before.Inline))
+	}
+
+	// the first object is excluded by its time range,
+	// and the last object doesn't contain any matching rows
+	n, err := b.Delete(owner, "default", "erase",
+		parseWhere(t, "user = 'bob' AND timestamp >= `2022-06-02T00:00:00Z`"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("deleted %d rows; expected 10", n)
+	}
+	idx := open()
+	if len(idx.Inline) != objects {
+		t.Fatalf("expected %d objects; got %d", objects, len(idx.Inline))
+	}
+	if idx.Inline[0].Path != before.Inline[0].Path {
+		t.Error("first object was rewritten")
+	}
+	if idx.Inline[1].Path == before.Inline[1].Path {
+		t.Error("second object was not rewritten")
+	}
+	if idx.Inline[2].Path != before.Inline[2].Path {
+		t.Error("last object was rewritten")
+	}
+	// only the replaced object is quarantined;
+	// the last object is scanned but not rewritten
+	if len(idx.ToDelete) != len(before.ToDelete)+1 {
+		t.Errorf("expected 1 new object in ToDelete; got %d", len(idx.ToDelete)-len(before.ToDelete))
+	}
+	checkContents(t, idx, dfs)
+
+	// delete bob everywhere
+	n, err = b.Delete(owner, "default", "erase", parseWhere(t, "user = 'bob'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("deleted %d rows; expected 10", n)
+	}
+	idx = open()
+	total := 0
+	for i := range idx.Inline {
+		for _, row := range readRows(t, dfs, &idx.Inline[i]) {
+			total++
+			if string(row.FieldByName("user").Value.(ion.String)) == "bob" {
+				t.Errorf("found deleted row in %s", idx.Inline[i].Path)
+			}
+		}
+	}
+	if total != objects*30-20 {
+		t.Errorf("%d rows remaining; expected %d", total, objects*30-20)
+	}
+
+	// deleting everything drops the objects
+	_, err = b.Delete(owner, "default", "erase", parseWhere(t, "row >= 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = open()
+	if len(idx.Inline) != 0 {
+		t.Errorf("%d objects remaining", len(idx.Inline))
+	}
+}
+
+// an Append that happens while Delete is
+// rewriting objects should not be lost
+func TestDeleteConcurrentAppend(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	owner := newTenant(dfs)
+	b := Builder{
+		Align: 1024,
+		// don't merge on append
+		MinMergeSize: 1,
+		Logf:         t.Logf,
+	}
+	appendFile := func(i int) {
+		var text strings.Builder
+		for j := 0; j < 30; j++ {
+			fmt.Fprintf(&text, "{\"user\": %q, \"row\": %d}\n", []string{"alice", "bob"}[j%2], j)
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "erase", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendFile(0)
+	who := &hookTenant{
+		testTenant: owner,
+		root: &hookFS{
+			DirFS: dfs,
+			hook:  func() { appendFile(1) },
+		},
+	}
+	_, err = b.Delete(who, "default", "erase", parseWhere(t, "user = 'bob'"))
+	if !errors.Is(err, ErrBuildAgain) {
+		t.Fatalf("got error %v; expected ErrBuildAgain", err)
+	}
+	idx, err := OpenIndex(dfs, "default", "erase", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Inline) != 2 {
+		t.Fatalf("expected 2 objects; got %d", len(idx.Inline))
+	}
+	// deleting again removes bob from both objects
+	n, err := b.Delete(owner, "default", "erase", parseWhere(t, "user = 'bob'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 30 {
+		t.Errorf("deleted %d rows; expected 30", n)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+)
+
+// DirQueue is a Queue that watches a directory
+// (typically within a DirFS) for new or modified
+// files by listing it periodically.
+//
+// Every file in the directory is produced once
+// when the queue starts; files that have already
+// been ingested are skipped by Builder.Append.
+// A file that fails to be ingested (other than with
+// StatusTryAgain) is skipped until it is modified.
+// The top-level "db" directory, which contains
+// the output of the builder, is never watched.
+type DirQueue struct {
+	// Root is the filesystem to watch.
+	Root InputFS
+	// Dir is the directory within Root
+	// that is watched recursively.
+	// If Dir is empty, then all of Root is watched.
+	Dir string
+	// Interval is the polling interval.
+	// If Interval is zero, then the directory
+	// is listed once per second.
+	Interval time.Duration
+	// Logf, if non-nil, is used to
+	// log errors that cannot be returned.
+	Logf func(f string, args ...interface{})
+
+	// seen is the size and modification time of
+	// each file that has been produced by Next
+	seen    map[string]dirStamp
+	pending []QueueItem
+
+	once sync.Once
+	done chan struct{}
+}
+
+type dirStamp struct {
+	size    int64
+	modtime time.Time
+}
+
+type dirItem struct {
+	name, path, etag string
+}
+
+func (d *dirItem) Path() string { return d.path }
+func (d *dirItem) ETag() string { return d.etag }
+
+func (d *DirQueue) init() {
+	d.once.Do(func() {
+		d.done = make(chan struct{})
+		d.seen = make(map[string]dirStamp)
+	})
+}
+
+func (d *DirQueue) interval() time.Duration {
+	if d.Interval > 0 {
+		return d.Interval
+	}
+	return time.Second
+}
+
+func (d *DirQueue) logf(f string, args ...interface{}) {
+	if d.Logf != nil {
+		d.Logf(f, args...)
+	}
+}
+
+// Close causes pending and future
+// calls to Next to return io.EOF.
+func (d *DirQueue) Close() error {
+	d.init()
+	close(d.done)
+	return nil
+}
+
+// scan lists the directory and queues
+// every file that is new or has changed
+func (d *DirQueue) scan() error {
+	dir := d.Dir
+	if dir == "" {
+		dir = "."
+	}
+	prefix := d.Root.Prefix()
+	return fs.WalkDir(d.Root, dir, func(p string, ent fs.DirEntry, err error) error {
+		if err != nil {
+			// files may be removed while we walk
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ent.IsDir() {
+			if p == "db" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !ent.Type().IsRegular() {
+			return nil
+		}
+		info, err := ent.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		stamp := dirStamp{size: info.Size(), modtime: info.ModTime()}
+		if old, ok := d.seen[p]; ok && old == stamp {
+			return nil
+		}
+		etag, err := d.Root.ETag(p, info)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		d.seen[p] = stamp
+		d.pending = append(d.pending, &dirItem{
+			name: p,
+			path: prefix + path.Clean(p),
+			etag: etag,
+		})
+		return nil
+	})
+}
+
+// Next implements Queue.Next
+func (d *DirQueue) Next(pause time.Duration) (QueueItem, error) {
+	d.init()
+	var timeout <-chan time.Time
+	if pause >= 0 {
+		t := time.NewTimer(pause)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for len(d.pending) == 0 {
+		select {
+		case <-d.done:
+			return nil, io.EOF
+		default:
+		}
+		err := d.scan()
+		if err != nil {
+			if pause >= 0 {
+				return nil, err
+			}
+			d.logf("scanning %s: %s", d.Dir, err)
+		}
+		if len(d.pending) > 0 {
+			break
+		}
+		select {
+		case <-d.done:
+			return nil, io.EOF
+		case <-timeout:
+			return nil, nil
+		case <-time.After(d.interval()):
+		}
+	}
+	item := d.pending[0]
+	d.pending = d.pending[1:]
+	return item, nil
+}
+
+// Finalize implements Queue.Finalize
+func (d *DirQueue) Finalize(item QueueItem, status QueueStatus) {
+	switch status {
+	case StatusOK:
+	case StatusTryAgain:
+		d.pending = append(d.pending, item)
+	default:
+		// the file stays in d.seen, so it is
+		// not produced again until it changes;
+		// retrying a file that can't be ingested
+		// would fail the same way every time
+		d.logf("skipping %s until it is modified (status %d)", item.Path(), status)
+	}
+}
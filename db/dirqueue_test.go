@@ -0,0 +1,167 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirQueue(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:   "watched",
+		Inputs: []Input{{Pattern: "file://a-prefix/*.json"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	q := &DirQueue{
+		Root:     dfs,
+		Dir:      "a-prefix",
+		Interval: 10 * time.Millisecond,
+		Logf:     t.Logf,
+	}
+	r := &QueueRunner{
+		Owner:         owner,
+		Conf:          Builder{Align: 1024, Logf: t.Logf},
+		Logf:          t.Logf,
+		BatchSize:     10,
+		BatchInterval: 10 * time.Millisecond,
+	}
+	final := make(chan error, 1)
+	go func() {
+		final <- r.Run(q)
+	}()
+	defer func() {
+		q.Close()
+		if err := <-final; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	write := func(name, text string) {
+		err := os.WriteFile(filepath.Join(tmpdir, "a-prefix", name), []byte(text), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// wait until the index contains want inputs
+	wait := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			idx, err := OpenIndex(dfs, "default", "watched", owner.Key())
+			if err == nil {
+				idx.Inputs.Backing = dfs
+				n := 0
+				idx.Inputs.Walk("", func(name, etag string, id int) bool {
+					if id >= 0 {
+						n++
+					}
+					return true
+				})
+				if n == want {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d inputs", want)
+	}
+
+	write("file0.json", `{"x": 0}`)
+	write("ignored.txt", `not json`)
+	wait(1)
+	write("file1.json", `{"x": 1}`)
+	write("file2.json", `{"x": 2}`)
+	wait(3)
+
+	idx, err := OpenIndex(dfs, "default", "watched", owner.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, err := idx.Indirect.Search(dfs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs = append(descs, idx.Inline...)
+	rows := 0
+	for i := range descs {
+		rows += len(readRows(t, dfs, &descs[i]))
+	}
+	if rows != 3 {
+		t.Errorf("got %d rows; expected 3", rows)
+	}
+}
+
+func TestDirQueueFinalize(t *testing.T) {
+	tmpdir := t.TempDir()
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	q := &DirQueue{
+		Root:     dfs,
+		Interval: time.Millisecond,
+		Logf:     t.Logf,
+	}
+	defer q.Close()
+	write := func(text string) {
+		err := os.WriteFile(filepath.Join(tmpdir, "file.json"), []byte(text), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() QueueItem {
+		t.Helper()
+		item, err := q.Next(20 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	write(`{"x": 0}`)
+	item := next()
+	if item == nil {
+		t.Fatal("file not produced")
+	}
+	q.Finalize(item, StatusTryAgain)
+	if item = next(); item == nil {
+		t.Fatal("file not retried after StatusTryAgain")
+	}
+	// a failed file is not retried...
+	q.Finalize(item, StatusWriteError)
+	if item = next(); item != nil {
+		t.Fatalf("file %s retried after StatusWriteError", item.Path())
+	}
+	// ...until it changes
+	write(`{"x": 10}`)
+	if item = next(); item == nil {
+		t.Fatal("modified file not produced")
+	}
+	q.Finalize(item, StatusOK)
+	if item = next(); item != nil {
+		t.Fatalf("file %s produced again", item.Path())
+	}
+}
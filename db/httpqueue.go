@@ -0,0 +1,205 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultMaxNotificationSize is the default
+// maximum size of a request body accepted by HTTPQueue.
+const DefaultMaxNotificationSize = 1024 * 1024
+
+// HTTPQueue is a Queue that receives S3 event
+// notifications (optionally wrapped in an SNS
+// notification) through HTTP POST requests.
+// HTTPQueue implements http.Handler.
+//
+// Each request is answered once every object
+// it references has been processed. The response
+// status is 200 if every object was ingested
+// successfully, or 503 if the request should be retried.
+type HTTPQueue struct {
+	// Token is the bearer token that requests
+	// must present in the Authorization header.
+	// If Token is empty, every request is rejected
+	// unless Unauthenticated is set.
+	Token string
+	// Unauthenticated, if set, allows requests
+	// without a token when Token is empty.
+	Unauthenticated bool
+	// MaxBody is the maximum size of a request body.
+	// If MaxBody is zero, then DefaultMaxNotificationSize is used.
+	MaxBody int64
+	// Logf, if non-nil, is used to log
+	// notifications that cannot be parsed.
+	Logf func(f string, args ...interface{})
+
+	once  sync.Once
+	items chan *httpItem
+	done  chan struct{}
+}
+
+// httpRequest tracks the items
+// produced by one HTTP request
+type httpRequest struct {
+	lock   sync.Mutex
+	items  int
+	status QueueStatus
+	done   chan struct{}
+}
+
+type httpItem struct {
+	s3Item
+	req *httpRequest
+}
+
+func (h *HTTPQueue) init() {
+	h.once.Do(func() {
+		h.items = make(chan *httpItem)
+		h.done = make(chan struct{})
+	})
+}
+
+func (h *HTTPQueue) logf(f string, args ...interface{}) {
+	if h.Logf != nil {
+		h.Logf(f, args...)
+	}
+}
+
+func (h *HTTPQueue) maxBody() int64 {
+	if h.MaxBody > 0 {
+		return h.MaxBody
+	}
+	return DefaultMaxNotificationSize
+}
+
+// Close causes pending and future calls
+// to Next to return io.EOF and causes
+// new requests to be rejected.
+func (h *HTTPQueue) Close() error {
+	h.init()
+	close(h.done)
+	return nil
+}
+
+func (h *HTTPQueue) authorized(r *http.Request) bool {
+	if h.Token == "" {
+		return h.Unauthenticated
+	}
+	want := "Bearer " + h.Token
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func retryLater(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "try again later", http.StatusServiceUnavailable)
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP
+func (h *HTTPQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.init()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, h.maxBody()+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > h.maxBody() {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	lst, err := parseS3Event(body)
+	if err != nil {
+		h.logf("rejecting notification: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lst) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	req := &httpRequest{items: len(lst), done: make(chan struct{})}
+	for i := range lst {
+		item := &httpItem{s3Item: lst[i], req: req}
+		select {
+		case h.items <- item:
+		case <-h.done:
+			// items that were already queued will still
+			// be processed, but the sender has to retry
+			retryLater(w)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	select {
+	case <-req.done:
+	case <-h.done:
+		retryLater(w)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if req.status != StatusOK {
+		retryLater(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Next implements Queue.Next
+func (h *HTTPQueue) Next(pause time.Duration) (QueueItem, error) {
+	h.init()
+	var timeout <-chan time.Time
+	if pause >= 0 {
+		t := time.NewTimer(pause)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case item := <-h.items:
+		return item, nil
+	case <-h.done:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, nil
+	}
+}
+
+// Finalize implements Queue.Finalize
+func (h *HTTPQueue) Finalize(item QueueItem, status QueueStatus) {
+	req := item.(*httpItem).req
+	req.lock.Lock()
+	defer req.lock.Unlock()
+	req.status = req.status.Merge(status)
+	req.items--
+	if req.items == 0 {
+		close(req.done)
+	}
+}
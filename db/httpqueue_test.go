@@ -0,0 +1,128 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPQueue(t *testing.T) {
+	q := &HTTPQueue{Token: "secret", Logf: t.Logf}
+	srv := httptest.NewServer(q)
+	defer srv.Close()
+
+	// consume items in the background, failing
+	// every item that names a "bad" object
+	consumed := make(chan string, 10)
+	go func() {
+		for {
+			item, err := q.Next(-1)
+			if err == io.EOF {
+				close(consumed)
+				return
+			}
+			status := QueueStatus(StatusOK)
+			if strings.Contains(item.Path(), "bad") {
+				status = StatusWriteError
+			}
+			consumed <- item.Path()
+			q.Finalize(item, status)
+		}
+	}()
+
+	post := func(token, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := post("wrong", s3EventBody("bucket", "a.json")); code != http.StatusUnauthorized {
+		t.Errorf("bad token: got status %d", code)
+	}
+	if code := post("secret", "{"); code != http.StatusBadRequest {
+		t.Errorf("bad body: got status %d", code)
+	}
+	if code := post("secret", s3EventBody("bucket", "a.json", "b.json")); code != http.StatusOK {
+		t.Errorf("got status %d", code)
+	}
+	if code := post("secret", s3EventBody("bucket", "c.json", "bad.json")); code != http.StatusServiceUnavailable {
+		t.Errorf("failed item: got status %d", code)
+	}
+	res, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d", res.StatusCode)
+	}
+
+	q.Close()
+	var got []string
+	for p := range consumed {
+		got = append(got, p)
+	}
+	want := []string{"s3://bucket/a.json", "s3://bucket/b.json", "s3://bucket/c.json", "s3://bucket/bad.json"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("consumed %v; want %v", got, want)
+	}
+
+	// Next must time out when nothing is available
+	q = &HTTPQueue{}
+	item, err := q.Next(time.Millisecond)
+	if item != nil || err != nil {
+		t.Errorf("got %v, %v", item, err)
+	}
+}
+
+func TestHTTPQueueNoToken(t *testing.T) {
+	body := s3EventBody("bucket", "a.json")
+	serve := func(q *HTTPQueue) int {
+		w := httptest.NewRecorder()
+		q.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return w.Code
+	}
+	// without a token, requests are rejected...
+	if code := serve(&HTTPQueue{}); code != http.StatusUnauthorized {
+		t.Errorf("no token: got status %d", code)
+	}
+	// ...unless unauthenticated requests are allowed
+	q := &HTTPQueue{Unauthenticated: true}
+	go func() {
+		item, err := q.Next(-1)
+		if err == nil {
+			q.Finalize(item, StatusOK)
+		}
+	}()
+	if code := serve(q); code != http.StatusOK {
+		t.Errorf("unauthenticated: got status %d", code)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+// AccessPolicy is a row filter and a set of
+// column masks that apply to the queries of
+// a tenant against a table.
+type AccessPolicy struct {
+	// Filter, if non-empty, is a PartiQL
+	// predicate that rows must satisfy to be
+	// visible (i.e. "region = 'eu'").
+	Filter string `json:"filter,omitempty"`
+	// Mask maps dotted paths to PartiQL
+	// expressions that replace their values
+	// (i.e. "customer.email": "HASH('salt', customer.email)").
+	// Paths in the expressions refer to the
+	// unmasked values.
+	Mask map[string]string `json:"mask,omitempty"`
+}
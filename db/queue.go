@@ -118,6 +118,11 @@ type QueueRunner struct {
 	// the backing filesystem.
 	IOErrDelay time.Duration
 
+	// OnUpdate, if non-nil, is called after
+	// new inputs have been successfully added
+	// to the index of a table.
+	OnUpdate func(db, table string)
+
 	// scratch space for processing batches
 	inputs   []QueueItem
 	status   []QueueStatus
@@ -215,6 +220,9 @@ func (q *QueueRunner) runTable(db string, def *Definition) {
 	err := q.filter(&q.Conf, def)
 	if err == nil && len(q.filtered) > 0 {
 		err = q.Conf.Append(q.Owner, db, def.Name, q.filtered)
+		if err == nil && q.OnUpdate != nil {
+			q.OnUpdate(db, def.Name)
+		}
 	}
 	if err != nil {
 		q.logf("updating %s.%s: %s", db, def.Name, err)
@@ -245,6 +245,14 @@ func testQueue(t *testing.T, batchsize int, scan bool) {
 		},
 	}))
 
+	var updlock sync.Mutex
+	updated := make(map[string]bool)
+	r.OnUpdate = func(db, table string) {
+		updlock.Lock()
+		defer updlock.Unlock()
+		updated[db+"/"+table] = true
+	}
+
 	owner := newTenant(dfs)
 	r.Owner = owner
 	r.Conf = Builder{
@@ -266,6 +274,11 @@ func testQueue(t *testing.T, batchsize int, scan bool) {
 	push("aabb/file0.json", "abcdefg")
 
 	queued.Wait()
+	updlock.Lock()
+	if !updated["db0/narrow"] || !updated["db1/wide"] {
+		t.Errorf("OnUpdate called for %v", updated)
+	}
+	updlock.Unlock()
 
 	checkIndex := func(db, table string, want map[string]bool) {
 		idx, err := OpenIndex(dfs, "db0", "narrow", owner.Key())
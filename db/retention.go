@@ -0,0 +1,248 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+// RetentionPolicy describes how long
+// the data in a table is kept.
+type RetentionPolicy struct {
+	// Field is the dotted path to the
+	// timestamp field that determines
+	// the age of each row.
+	Field string `json:"field"`
+	// ValidFor is how long rows are kept,
+	// relative to the value of Field.
+	// ValidFor is either a Go duration
+	// (i.e. "72h") or a number of days (i.e. "30d").
+	ValidFor string `json:"valid_for"`
+}
+
+// ParseValidFor parses a RetentionPolicy.ValidFor string.
+func ParseValidFor(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int64
+		n, err = strconv.ParseInt(days, 10, 64)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid retention period %q", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("retention period %q must be positive", s)
+	}
+	return d, nil
+}
+
+// retainer applies a RetentionPolicy
+// at a particular point in time
+type retainer struct {
+	path   []string
+	cutoff date.Time
+}
+
+func (r *RetentionPolicy) at(now date.Time) (*retainer, error) {
+	p, err := blockfmt.ParseClusterPath(r.Field)
+	if err != nil {
+		return nil, fmt.Errorf("retention policy: %w", err)
+	}
+	d, err := ParseValidFor(r.ValidFor)
+	if err != nil {
+		return nil, err
+	}
+	return &retainer{path: p, cutoff: now.Add(-d)}, nil
+}
+
+// retention returns the retainer for the table,
+// or nil if the table has no retention policy
+func (st *tableState) retention() (*retainer, error) {
+	def, err := st.def()
+	if err != nil {
+		// a table without a definition
+		// does not have a retention policy
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if def.Retention == nil {
+		return nil, nil
+	}
+	return def.Retention.at(date.Now())
+}
+
+// blockRange returns the time range for r.path
+// within ranges
+func (r *retainer) blockRange(ranges []blockfmt.Range) (*blockfmt.TimeRange, bool) {
+	for _, rng := range ranges {
+		tr, ok := rng.(*blockfmt.TimeRange)
+		if ok && equalPath(tr.Path(), r.path) {
+			return tr, true
+		}
+	}
+	return nil, false
+}
+
+// expired returns true if every block in
+// desc contains only expired rows
+func (r *retainer) expired(desc *blockfmt.Descriptor) bool {
+	if desc.Trailer == nil || len(desc.Trailer.Blocks) == 0 {
+		return false
+	}
+	for i := range desc.Trailer.Blocks {
+		tr, ok := r.blockRange(desc.Trailer.Blocks[i].Ranges)
+		if !ok || !tr.MaxTime().Before(r.cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// partial returns true if any of the
+// blocks in desc may contain expired rows
+func (r *retainer) partial(desc *blockfmt.Descriptor) bool {
+	if desc.Trailer == nil {
+		return false
+	}
+	for i := range desc.Trailer.Blocks {
+		tr, ok := r.blockRange(desc.Trailer.Blocks[i].Ranges)
+		if ok && tr.MinTime().Before(r.cutoff) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep returns false for rows that have expired
+func (r *retainer) keep(row ion.Datum) bool {
+	v := row
+	for _, name := range r.path {
+		s, ok := v.(*ion.Struct)
+		if !ok {
+			return true
+		}
+		f := s.FieldByName(name)
+		if f == nil {
+			return true
+		}
+		v = f.Value
+	}
+	ts, ok := v.(ion.Timestamp)
+	return !ok || !date.Time(ts).Before(r.cutoff)
+}
+
+// expire removes the objects in idx
+// that only contain expired rows and
+// queues them for garbage collection.
+// It returns the number of objects removed.
+//
+// If pull is true, indirect refs containing expired
+// rows are removed from the indirect tree, and the objects
+// they reference that have not completely expired
+// are moved to the front of idx.Inline so that
+// partialGroups can rewrite them; the next call
+// to SyncOutputs moves them back into the indirect tree.
+// If pull is false, an indirect ref is only removed
+// when every object it references has expired,
+// so that the indirect tree isn't rewritten
+// on every call to Sync.
+func (st *tableState) expire(idx *blockfmt.Index, r *retainer, pull bool) (int, error) {
+	if r == nil {
+		return 0, nil
+	}
+	expiry := date.Now().Add(st.conf.GCMinimumAge)
+	queue := func(p string) {
+		idx.ToDelete = append(idx.ToDelete, blockfmt.Quarantined{
+			Path:   p,
+			Expiry: expiry,
+		})
+	}
+	quarantine := func(p string) {
+		st.conf.logf("table %s: dropping expired object %s", st.table, p)
+		queue(p)
+	}
+	dropped := 0
+	inline := idx.Inline[:0]
+	for i := range idx.Inline {
+		if r.expired(&idx.Inline[i]) {
+			quarantine(idx.Inline[i].Path)
+			dropped++
+			continue
+		}
+		inline = append(inline, idx.Inline[i])
+	}
+	idx.Inline = inline
+
+	var pulled []blockfmt.Descriptor
+	refs := idx.Indirect.Refs[:0]
+	for i := range idx.Indirect.Refs {
+		ref := &idx.Indirect.Refs[i]
+		tr, ok := r.blockRange(ref.Ranges)
+		if !ok || !tr.MinTime().Before(r.cutoff) ||
+			(!pull && !tr.MaxTime().Before(r.cutoff)) {
+			refs = append(refs, *ref)
+			continue
+		}
+		tree := blockfmt.IndirectTree{Refs: []blockfmt.IndirectRef{*ref}}
+		descs, err := tree.Search(st.ofs, nil)
+		if err != nil {
+			return dropped, err
+		}
+		if !pull && !allExpired(r, descs) {
+			// objects without ranges for the
+			// retention field can't be expired here
+			refs = append(refs, *ref)
+			continue
+		}
+		queue(ref.Path)
+		for j := range descs {
+			if r.expired(&descs[j]) {
+				quarantine(descs[j].Path)
+				dropped++
+				continue
+			}
+			pulled = append(pulled, descs[j])
+		}
+	}
+	idx.Indirect.Refs = refs
+	if len(pulled) > 0 {
+		idx.Inline = append(pulled, idx.Inline...)
+	}
+	return dropped, nil
+}
+
+func allExpired(r *retainer, descs []blockfmt.Descriptor) bool {
+	for i := range descs {
+		if !r.expired(&descs[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,373 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/ion/blockfmt"
+)
+
+func TestParseValidFor(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"30d", 30 * 24 * time.Hour, true},
+		{"72h", 72 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"d", 0, false},
+		{"thirty days", 0, false},
+	}
+	for i := range cases {
+		got, err := ParseValidFor(cases[i].in)
+		if (err == nil) != cases[i].ok {
+			t.Errorf("%q: unexpected error %v", cases[i].in, err)
+			continue
+		}
+		if got != cases[i].want {
+			t.Errorf("%q: got %s want %s", cases[i].in, got, cases[i].want)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:   "retained",
+		Inputs: []Input{{Pattern: "file://a-prefix/*.json"}},
+		Retention: &RetentionPolicy{
+			Field:    "meta.timestamp",
+			ValidFor: "30d",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	b := Builder{
+		Align: 1024,
+		// don't merge on append
+		MinMergeSize: 1,
+		// don't merge during compaction
+		Compaction: &SizeTiered{MinObjects: 100},
+		Logf:       t.Logf,
+	}
+
+	now := date.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+	format := func(tm date.Time) string {
+		return tm.Time().Format(time.RFC3339)
+	}
+	write := func(name string, times ...date.Time) {
+		var text strings.Builder
+		for i := range times {
+			fmt.Fprintf(&text, "{\"row\": %d, \"meta\": {\"timestamp\": %q}}\n", i, format(times[i]))
+		}
+		err := os.WriteFile(filepath.Join(tmpdir, "a-prefix", name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, "a-prefix/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "retained", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() *blockfmt.Index {
+		idx, err := OpenIndex(dfs, "default", "retained", owner.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+
+	// entirely expired data is dropped on ingest
+	write("old.json", old, old, old)
+	idx := open()
+	if len(idx.Inline) != 0 {
+		t.Fatalf("expected expired object to be dropped; have %d objects", len(idx.Inline))
+	}
+	if len(idx.ToDelete) != 1 {
+		t.Fatalf("expected 1 object in ToDelete; got %d", len(idx.ToDelete))
+	}
+
+	write("mixed.json", old, recent, old, recent)
+	write("recent.json", recent, recent)
+	idx = open()
+	if len(idx.Inline) != 2 {
+		t.Fatalf("expected 2 objects; got %d", len(idx.Inline))
+	}
+
+	// compaction should rewrite the
+	// partially-expired object
+	n, err := b.Compact(owner, "default", "retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("compacted %d objects; expected 1", n)
+	}
+	idx = open()
+	if len(idx.Inline) != 2 {
+		t.Fatalf("expected 2 objects; got %d", len(idx.Inline))
+	}
+	total := 0
+	for i := range idx.Inline {
+		for _, row := range readRows(t, dfs, &idx.Inline[i]) {
+			total++
+			meta := row.FieldByName("meta").Value.(*ion.Struct)
+			ts := date.Time(meta.FieldByName("timestamp").Value.(ion.Timestamp))
+			if ts.Before(now.Add(-30 * 24 * time.Hour)) {
+				t.Errorf("found expired row at %s", ts)
+			}
+		}
+	}
+	if total != 4 {
+		t.Errorf("expected 4 rows to remain; got %d", total)
+	}
+	checkContents(t, idx, dfs)
+
+	// nothing left to do
+	n, err = b.Compact(owner, "default", "retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("second compaction touched %d objects", n)
+	}
+}
+
+func TestRetentionIndirect(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:   "retained",
+		Inputs: []Input{{Pattern: "file://a-prefix/*.json"}},
+		Retention: &RetentionPolicy{
+			Field:    "meta.timestamp",
+			ValidFor: "30d",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	b := Builder{
+		Align:        1024,
+		MinMergeSize: 1,
+		Compaction:   &SizeTiered{MinObjects: 100},
+		// move every object into the indirect tree
+		MaxInlineBytes: 1,
+		Logf:           t.Logf,
+	}
+
+	now := date.Now()
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+	for i, times := range [][]date.Time{
+		{recent, recent},
+		{old, recent, old, recent},
+		{recent, recent, recent},
+	} {
+		var text strings.Builder
+		for j := range times {
+			fmt.Fprintf(&text, "{\"row\": %d, \"meta\": {\"timestamp\": %q}}\n", j, times[j].Time().Format(time.RFC3339))
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "retained", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() *blockfmt.Index {
+		idx, err := OpenIndex(dfs, "default", "retained", owner.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	// all returns the rows of every object in idx
+	all := func(idx *blockfmt.Index) []*ion.Struct {
+		descs, err := idx.Indirect.Search(dfs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs = append(descs, idx.Inline...)
+		var rows []*ion.Struct
+		for i := range descs {
+			rows = append(rows, readRows(t, dfs, &descs[i])...)
+		}
+		return rows
+	}
+	idx := open()
+	if idx.Indirect.Objects() == 0 {
+		t.Fatal("expected objects in the indirect tree")
+	}
+	if n := len(all(idx)); n != 9 {
+		t.Fatalf("expected 9 rows; got %d", n)
+	}
+
+	n, err := b.Compact(owner, "default", "retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("compacted %d objects; expected 1", n)
+	}
+	idx = open()
+	rows := all(idx)
+	for _, row := range rows {
+		meta := row.FieldByName("meta").Value.(*ion.Struct)
+		ts := date.Time(meta.FieldByName("timestamp").Value.(ion.Timestamp))
+		if ts.Before(cutoff) {
+			t.Errorf("found expired row at %s", ts)
+		}
+	}
+	if len(rows) != 7 {
+		t.Errorf("expected 7 rows to remain; got %d", len(rows))
+	}
+
+	n, err = b.Compact(owner, "default", "retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("second compaction touched %d objects", n)
+	}
+}
+
+// Sync should not rewrite indirect refs
+// that only contain some expired rows;
+// that is left to Compact
+func TestRetentionSyncKeepsRefs(t *testing.T) {
+	checkFiles(t)
+	tmpdir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpdir, "a-prefix"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfs := NewDirFS(tmpdir)
+	defer dfs.Close()
+	dfs.Log = t.Logf
+	err = WriteDefinition(dfs, "default", &Definition{
+		Name:   "retained",
+		Inputs: []Input{{Pattern: "file://a-prefix/*.json"}},
+		Retention: &RetentionPolicy{
+			Field:    "meta.timestamp",
+			ValidFor: "30d",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newTenant(dfs)
+	b := Builder{
+		Align:        1024,
+		MinMergeSize: 1,
+		Compaction:   &SizeTiered{MinObjects: 100},
+		// move every object into the indirect tree
+		MaxInlineBytes: 1,
+		Logf:           t.Logf,
+	}
+
+	now := date.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+	appendFile := func(i int, times ...date.Time) {
+		var text strings.Builder
+		for j := range times {
+			fmt.Fprintf(&text, "{\"row\": %d, \"meta\": {\"timestamp\": %q}}\n", j, times[j].Time().Format(time.RFC3339))
+		}
+		name := fmt.Sprintf("a-prefix/file%d.json", i)
+		err := os.WriteFile(filepath.Join(tmpdir, name), []byte(text.String()), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lst, err := blockfmt.CollectGlob(dfs, nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Append(owner, "default", "retained", lst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs := func() []blockfmt.IndirectRef {
+		idx, err := OpenIndex(dfs, "default", "retained", owner.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx.Indirect.Refs
+	}
+	appendFile(0, old, recent, old, recent)
+	before := refs()
+	if len(before) == 0 {
+		t.Fatal("expected refs in the indirect tree")
+	}
+	// keep new objects inline so that
+	// only expiry could modify the refs
+	b.MaxInlineBytes = 1 << 30
+	for i := 1; i <= 2; i++ {
+		appendFile(i, recent)
+		after := refs()
+		if len(after) != len(before) {
+			t.Fatalf("sync %d: %d refs -> %d refs", i, len(before), len(after))
+		}
+		for j := range after {
+			if after[j].Path != before[j].Path {
+				t.Fatalf("sync %d: ref %d changed from %s to %s", i, j, before[j].Path, after[j].Path)
+			}
+		}
+	}
+}
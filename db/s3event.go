@@ -0,0 +1,98 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// s3Item is a QueueItem produced
+// from an S3 event notification
+type s3Item struct {
+	path, etag string
+}
+
+func (s *s3Item) Path() string { return s.path }
+func (s *s3Item) ETag() string { return s.etag }
+
+// s3Event is the subset of an S3 event
+// notification that we care about
+type s3Event struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		EventName   string `json:"eventName"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsEnvelope is the wrapper around
+// a message delivered through SNS
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// parseS3Event parses the body of an S3 event
+// notification and returns the objects that were
+// created; notifications delivered through SNS
+// are unwrapped automatically
+//
+// events other than ObjectCreated:* (including
+// the s3:TestEvent sent when notifications are
+// configured) are ignored
+func parseS3Event(body []byte) ([]s3Item, error) {
+	var env snsEnvelope
+	if json.Unmarshal(body, &env) == nil && env.Type == "Notification" {
+		body = []byte(env.Message)
+	}
+	var ev s3Event
+	err := json.Unmarshal(body, &ev)
+	if err != nil {
+		return nil, fmt.Errorf("parsing S3 event: %w", err)
+	}
+	var out []s3Item
+	for i := range ev.Records {
+		r := &ev.Records[i]
+		if r.EventSource != "aws:s3" || !strings.HasPrefix(r.EventName, "ObjectCreated:") {
+			continue
+		}
+		// keys are form-encoded in notifications
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("parsing S3 event: bad key %q", r.S3.Object.Key)
+		}
+		if r.S3.Bucket.Name == "" || key == "" {
+			return nil, fmt.Errorf("parsing S3 event: missing bucket or key")
+		}
+		out = append(out, s3Item{
+			path: "s3://" + r.S3.Bucket.Name + "/" + key,
+			// ETags from GetObject are quoted,
+			// but ETags in notifications are not
+			etag: "\"" + r.S3.Object.ETag + "\"",
+		})
+	}
+	return out, nil
+}
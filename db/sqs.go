@@ -0,0 +1,274 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/aws"
+)
+
+// SQSQueue is a Queue that reads S3 event
+// notifications from an SQS queue (or any
+// service that implements the SQS query API).
+//
+// Messages are deleted from the queue once
+// every object they reference has been
+// ingested successfully. Messages that should
+// be retried immediately are made visible again;
+// other failed messages become visible again once
+// their visibility timeout expires.
+type SQSQueue struct {
+	// Key is the key used to sign requests.
+	Key *aws.SigningKey
+	// QueueURL is the URL of the queue.
+	QueueURL string
+	// Client is the HTTP client used to
+	// make requests. If Client is nil,
+	// then http.DefaultClient is used.
+	Client *http.Client
+	// VisibilityTimeout is the visibility
+	// timeout applied to received messages.
+	// If VisibilityTimeout is zero, then
+	// the queue's default visibility timeout is used.
+	VisibilityTimeout time.Duration
+	// Logf, if non-nil, is used to
+	// log errors that cannot be returned.
+	Logf func(f string, args ...interface{})
+
+	pending []*sqsItem
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// sqsMaxWait is the maximum long-polling
+// wait time supported by SQS
+const sqsMaxWait = 20 * time.Second
+
+type sqsMessage struct {
+	receipt string
+	items   int
+	status  QueueStatus
+}
+
+type sqsItem struct {
+	s3Item
+	msg *sqsMessage
+}
+
+type sqsReceiveResponse struct {
+	Messages []struct {
+		ReceiptHandle string `xml:"ReceiptHandle"`
+		Body          string `xml:"Body"`
+	} `xml:"ReceiveMessageResult>Message"`
+}
+
+type sqsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (s *SQSQueue) init() {
+	s.once.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	})
+}
+
+func (s *SQSQueue) logf(f string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(f, args...)
+	}
+}
+
+// Close causes pending and future
+// calls to Next to return io.EOF.
+func (s *SQSQueue) Close() error {
+	s.init()
+	s.cancel()
+	return nil
+}
+
+func (s *SQSQueue) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// call performs an SQS API action
+// and decodes the response into out
+func (s *SQSQueue) call(ctx context.Context, action string, args url.Values, out interface{}) error {
+	args.Set("Action", action)
+	args.Set("Version", "2012-11-05")
+	u, err := url.Parse(s.QueueURL)
+	if err != nil {
+		return err
+	}
+	// the query parameters are sent in
+	// the URL so that the (empty) body does
+	// not need to be hashed for signing;
+	// Encode sorts the parameters, which
+	// SignV4 requires
+	u.RawQuery = args.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.Key != nil {
+		s.Key.SignV4(req, nil)
+	}
+	res, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e sqsErrorResponse
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			return fmt.Errorf("sqs %s: %s: %s", action, e.Code, e.Message)
+		}
+		return fmt.Errorf("sqs %s: %s", action, res.Status)
+	}
+	if out != nil {
+		return xml.Unmarshal(body, out)
+	}
+	return nil
+}
+
+// receive performs one ReceiveMessage call,
+// waiting for up to wait for messages to arrive
+func (s *SQSQueue) receive(wait time.Duration) error {
+	args := url.Values{}
+	args.Set("MaxNumberOfMessages", "10")
+	args.Set("WaitTimeSeconds", strconv.Itoa(int(wait/time.Second)))
+	if s.VisibilityTimeout > 0 {
+		args.Set("VisibilityTimeout", strconv.Itoa(int(s.VisibilityTimeout/time.Second)))
+	}
+	var res sqsReceiveResponse
+	err := s.call(s.ctx, "ReceiveMessage", args, &res)
+	if err != nil {
+		return err
+	}
+	for i := range res.Messages {
+		msg := &sqsMessage{receipt: res.Messages[i].ReceiptHandle}
+		items, err := parseS3Event([]byte(res.Messages[i].Body))
+		if err != nil {
+			// this message will never be
+			// processed successfully
+			s.logf("sqs: dropping message: %s", err)
+		}
+		if len(items) == 0 {
+			s.finish(msg)
+			continue
+		}
+		msg.items = len(items)
+		for j := range items {
+			s.pending = append(s.pending, &sqsItem{s3Item: items[j], msg: msg})
+		}
+	}
+	return nil
+}
+
+// Next implements Queue.Next
+func (s *SQSQueue) Next(pause time.Duration) (QueueItem, error) {
+	s.init()
+	var deadline time.Time
+	if pause >= 0 {
+		deadline = time.Now().Add(pause)
+	}
+	for len(s.pending) == 0 {
+		wait := sqsMaxWait
+		if pause >= 0 {
+			wait = time.Until(deadline)
+			if wait < time.Second {
+				// SQS only supports whole seconds,
+				// so just check for messages that
+				// are already available
+				wait = 0
+			}
+			if wait > sqsMaxWait {
+				wait = sqsMaxWait
+			}
+		}
+		err := s.receive(wait)
+		if s.ctx.Err() != nil {
+			return nil, io.EOF
+		}
+		if err != nil {
+			if pause >= 0 {
+				return nil, err
+			}
+			// keep trying when blocking
+			s.logf("%s", err)
+			select {
+			case <-s.ctx.Done():
+				return nil, io.EOF
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if pause >= 0 && len(s.pending) == 0 {
+			return nil, nil
+		}
+	}
+	item := s.pending[0]
+	s.pending = s.pending[1:]
+	return item, nil
+}
+
+// Finalize implements Queue.Finalize
+func (s *SQSQueue) Finalize(item QueueItem, status QueueStatus) {
+	msg := item.(*sqsItem).msg
+	msg.status = msg.status.Merge(status)
+	msg.items--
+	if msg.items <= 0 {
+		s.finish(msg)
+	}
+}
+
+// finish deletes or releases a message
+// once all of its items have been finalized
+func (s *SQSQueue) finish(msg *sqsMessage) {
+	args := url.Values{}
+	args.Set("ReceiptHandle", msg.receipt)
+	var err error
+	switch msg.status {
+	case StatusOK:
+		err = s.call(context.Background(), "DeleteMessage", args, nil)
+	case StatusTryAgain:
+		args.Set("VisibilityTimeout", "0")
+		err = s.call(context.Background(), "ChangeMessageVisibility", args, nil)
+	default:
+		// leave the message invisible until
+		// its visibility timeout expires
+	}
+	if err != nil {
+		s.logf("%s", err)
+	}
+}
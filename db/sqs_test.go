@@ -0,0 +1,233 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/aws"
+)
+
+func s3EventBody(bucket string, keys ...string) string {
+	type obj struct {
+		Key  string `json:"key"`
+		ETag string `json:"eTag"`
+	}
+	type rec struct {
+		EventSource string `json:"eventSource"`
+		EventName   string `json:"eventName"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object obj `json:"object"`
+		} `json:"s3"`
+	}
+	var ev struct {
+		Records []rec `json:"Records"`
+	}
+	for i := range keys {
+		var r rec
+		r.EventSource = "aws:s3"
+		r.EventName = "ObjectCreated:Put"
+		r.S3.Bucket.Name = bucket
+		r.S3.Object = obj{Key: keys[i], ETag: "etag-" + keys[i]}
+		ev.Records = append(ev.Records, r)
+	}
+	buf, _ := json.Marshal(&ev)
+	return string(buf)
+}
+
+func TestParseS3Event(t *testing.T) {
+	body := s3EventBody("bucket", "a/b+c%3D.json", "x.json")
+	want := []s3Item{
+		{path: "s3://bucket/a/b c=.json", etag: `"etag-a/b+c%3D.json"`},
+		{path: "s3://bucket/x.json", etag: `"etag-x.json"`},
+	}
+	got, err := parseS3Event([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	// same thing wrapped in SNS
+	env, _ := json.Marshal(&snsEnvelope{Type: "Notification", Message: body})
+	got, err = parseS3Event(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SNS: got %v want %v", got, want)
+	}
+	// test events are ignored
+	got, err = parseS3Event([]byte(`{"Service":"Amazon S3","Event":"s3:TestEvent"}`))
+	if err != nil || len(got) != 0 {
+		t.Errorf("test event: got %v, %v", got, err)
+	}
+	_, err = parseS3Event([]byte(`not json`))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// fakeSQS is a minimal stand-in for
+// the SQS query API
+type fakeSQS struct {
+	lock      sync.Mutex
+	visible   map[string]string // receipt -> body
+	inflight  map[string]string
+	deleted   []string
+	released  []string
+	receipts  int
+	sawSigned bool
+}
+
+func (f *fakeSQS) push(body string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.receipts++
+	f.visible[fmt.Sprintf("receipt-%d", f.receipts)] = body
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Header.Get("Authorization") != "" {
+		f.sawSigned = true
+	}
+	q := r.URL.Query()
+	type message struct {
+		ReceiptHandle string `xml:"ReceiptHandle"`
+		Body          string `xml:"Body"`
+	}
+	switch q.Get("Action") {
+	case "ReceiveMessage":
+		var res struct {
+			XMLName  xml.Name  `xml:"ReceiveMessageResponse"`
+			Messages []message `xml:"ReceiveMessageResult>Message"`
+		}
+		for receipt, body := range f.visible {
+			res.Messages = append(res.Messages, message{receipt, body})
+			f.inflight[receipt] = body
+			delete(f.visible, receipt)
+		}
+		buf, _ := xml.Marshal(&res)
+		w.Write(buf)
+	case "DeleteMessage":
+		receipt := q.Get("ReceiptHandle")
+		if _, ok := f.inflight[receipt]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<ErrorResponse><Error><Code>ReceiptHandleIsInvalid</Code><Message>bad receipt</Message></Error></ErrorResponse>`)
+			return
+		}
+		delete(f.inflight, receipt)
+		f.deleted = append(f.deleted, receipt)
+		io.WriteString(w, `<DeleteMessageResponse/>`)
+	case "ChangeMessageVisibility":
+		receipt := q.Get("ReceiptHandle")
+		if q.Get("VisibilityTimeout") == "0" {
+			f.visible[receipt] = f.inflight[receipt]
+			delete(f.inflight, receipt)
+			f.released = append(f.released, receipt)
+		}
+		io.WriteString(w, `<ChangeMessageVisibilityResponse/>`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestSQSQueue(t *testing.T) {
+	fake := &fakeSQS{
+		visible:  make(map[string]string),
+		inflight: make(map[string]string),
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	q := &SQSQueue{
+		Key:      aws.DeriveKey("", "access", "secret", "us-east-1", "sqs"),
+		QueueURL: srv.URL + "/123456789012/notifications",
+		Client:   srv.Client(),
+		Logf:     t.Logf,
+	}
+	defer q.Close()
+
+	// nothing in the queue
+	item, err := q.Next(0)
+	if err != nil || item != nil {
+		t.Fatalf("empty queue: got %v, %v", item, err)
+	}
+
+	fake.push(s3EventBody("bucket", "a.json", "b.json"))
+	fake.push(`{"Service":"Amazon S3","Event":"s3:TestEvent"}`)
+	first, err := q.Next(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.Next(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]bool{first.Path(): true, second.Path(): true}
+	if !paths["s3://bucket/a.json"] || !paths["s3://bucket/b.json"] {
+		t.Fatalf("unexpected items %v", paths)
+	}
+	if !fake.sawSigned {
+		t.Error("requests were not signed")
+	}
+	// the test event should have been deleted immediately
+	if len(fake.deleted) != 1 {
+		t.Fatalf("expected 1 deleted message; got %v", fake.deleted)
+	}
+
+	// a message should only be released when
+	// all of its items are finalized, and it
+	// should be retried if any of them fail
+	q.Finalize(first, StatusOK)
+	if len(fake.released) != 0 || len(fake.deleted) != 1 {
+		t.Fatal("message finalized early")
+	}
+	q.Finalize(second, StatusTryAgain)
+	if len(fake.released) != 1 {
+		t.Fatalf("expected message to be released; got %v", fake.released)
+	}
+
+	// the message comes back and succeeds
+	for i := 0; i < 2; i++ {
+		item, err := q.Next(time.Second)
+		if err != nil || item == nil {
+			t.Fatalf("retry: got %v, %v", item, err)
+		}
+		q.Finalize(item, StatusOK)
+	}
+	if len(fake.deleted) != 2 {
+		t.Errorf("expected 2 deleted messages; got %v", fake.deleted)
+	}
+
+	q.Close()
+	_, err = q.Next(-1)
+	if err != io.EOF {
+		t.Errorf("Next after Close: got %v", err)
+	}
+}
@@ -81,6 +81,23 @@ type Builder struct {
 	// size of objects. If MinMergeSize is zero,
 	// then DefaultMinMerge is used.
 	MinMergeSize int
+	// Compaction is the policy used by Compact
+	// to decide which packed objects to merge.
+	// If Compaction is nil, then a SizeTiered
+	// policy starting at MinMergeSize is used.
+	Compaction CompactionPolicy
+	// MaxCompactBytes is the maximum number
+	// of bytes of packed objects rewritten by
+	// one call to Compact. If MaxCompactBytes is zero,
+	// then DefaultMaxCompactBytes is used.
+	MaxCompactBytes int64
+	// ClusterWindow is the total number of
+	// decompressed bytes of data that are buffered
+	// for sorting for tables that have Definition.Cluster
+	// set and no Definition.ClusterWindow.
+	// If ClusterWindow is zero, then the
+	// blockfmt.Converter default is used.
+	ClusterWindow int
 	// Force forces a full index rebuild
 	// even when the input appears to be up-to-date.
 	Force bool
@@ -171,6 +188,8 @@ type tableState struct {
 	owner     Tenant
 	ofs       OutputFS
 	db, table string
+
+	definition *Definition // cached by def()
 }
 
 func (b *Builder) open(db, table string, owner Tenant) (*tableState, error) {
@@ -195,8 +214,62 @@ func (st *tableState) index() (*blockfmt.Index, error) {
 	return OpenIndex(st.ofs, st.db, st.table, st.owner.Key())
 }
 
+// indexETag returns the ETag of the current index
+// so that an update that reads and then rewrites
+// the index can detect (with checkIndex) whether
+// the index was written in the meantime
+func (st *tableState) indexETag() (string, error) {
+	idp := IndexPath(st.db, st.table)
+	info, err := fs.Stat(st.ofs, idp)
+	if err != nil {
+		return "", err
+	}
+	return st.ofs.ETag(idp, info)
+}
+
+// checkIndex returns ErrBuildAgain if the index
+// no longer has the given ETag
+func (st *tableState) checkIndex(etag string) error {
+	cur, err := st.indexETag()
+	if err != nil {
+		return err
+	}
+	if cur != etag {
+		st.conf.logf("table %s: index changed during update", st.table)
+		return ErrBuildAgain
+	}
+	return nil
+}
+
 func (st *tableState) def() (*Definition, error) {
-	return OpenDefinition(st.ofs, st.db, st.table)
+	if st.definition == nil {
+		def, err := OpenDefinition(st.ofs, st.db, st.table)
+		if err != nil {
+			return nil, err
+		}
+		st.definition = def
+	}
+	return st.definition, nil
+}
+
+// cluster returns the list of paths
+// by which new output should be clustered
+// and the size of the cluster window;
+// a table without a definition is not clustered
+func (st *tableState) cluster() ([][]string, int, error) {
+	window := st.conf.ClusterWindow
+	def, err := st.def()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, window, nil
+		}
+		return nil, 0, err
+	}
+	if def.ClusterWindow > 0 {
+		window = def.ClusterWindow
+	}
+	paths, err := def.clusterPaths()
+	return paths, window, err
 }
 
 var (
@@ -620,53 +693,98 @@ func (st *tableState) flush(idx *blockfmt.Index) error {
 	return err
 }
 
-func (st *tableState) force(idx *blockfmt.Index, prepend *blockfmt.Descriptor, lst []blockfmt.Input) error {
-	c := blockfmt.Converter{
-		Inputs:    lst,
-		Align:     st.conf.align(),
-		FlushMeta: st.conf.flushMeta(),
-		Comp:      "zstd",
+// converter returns a blockfmt.Converter
+// configured for writing output into the table
+func (st *tableState) converter(lst []blockfmt.Input) (*blockfmt.Converter, error) {
+	cluster, window, err := st.cluster()
+	if err != nil {
+		return nil, err
 	}
+	return &blockfmt.Converter{
+		Inputs:        lst,
+		Align:         st.conf.align(),
+		FlushMeta:     st.conf.flushMeta(),
+		Comp:          "zstd",
+		Cluster:       cluster,
+		ClusterWindow: window,
+	}, nil
+}
 
-	if prepend != nil {
-		f, err := st.ofs.Open(prepend.Path)
-		if err != nil {
-			return fmt.Errorf("opening %s for re-ingest: %w", prepend.Path, err)
-		}
-		info, err := f.Stat()
-		if err != nil {
-			return fmt.Errorf("stat-ing re-ingest descriptor: %w", err)
-		}
-		etag, err := st.ofs.ETag(prepend.Path, info)
-		if err != nil {
-			return fmt.Errorf("getting ETag: %w", err)
-		}
-		if etag != prepend.ETag {
-			return fmt.Errorf("ETag has changed: %s -> %s", prepend.ETag, etag)
-		}
-		tr := prepend.Trailer
-		c.Prepend.R = &readCloser{Reader: io.LimitReader(f, tr.Offset), Closer: f}
-		c.Prepend.Trailer = tr
+// openPacked opens a packed object for re-ingestion,
+// taking care to check that it has not changed
+// since it was written into the index
+func (st *tableState) openPacked(desc *blockfmt.Descriptor) (io.ReadCloser, error) {
+	f, err := st.ofs.Open(desc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s for re-ingest: %w", desc.Path, err)
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat-ing re-ingest descriptor: %w", err)
+	}
+	etag, err := st.ofs.ETag(desc.Path, info)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("getting ETag: %w", err)
+	}
+	if etag != desc.ETag {
+		f.Close()
+		return nil, fmt.Errorf("ETag has changed: %s -> %s", desc.ETag, etag)
+	}
+	return &readCloser{Reader: io.LimitReader(f, desc.Trailer.Offset), Closer: f}, nil
+}
 
+// run runs c into a new packed object
+// in the table and returns its descriptor
+func (st *tableState) run(c *blockfmt.Converter) (*blockfmt.Descriptor, error) {
 	name := "packed-" + uuid() + ".ion.zst"
 	fp := path.Join("db", st.db, st.table, name)
 	out, err := st.ofs.Create(fp)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.Output = out
 	err = c.Run()
 	if err != nil {
 		abort(out)
-		st.updateFailed(idx == nil, c.Inputs)
-		return fmt.Errorf("db.Builder: running blockfmt.Converter: %w", err)
+		return nil, fmt.Errorf("db.Builder: running blockfmt.Converter: %w", err)
 	}
 	etag, lastmod, err := getInfo(st.ofs, fp, out)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	st.conf.logf("table %s: wrote object %s ETag %s", st.table, fp, etag)
+	return &blockfmt.Descriptor{
+		ObjectInfo: blockfmt.ObjectInfo{
+			Path:         fp,
+			LastModified: date.FromTime(lastmod),
+			ETag:         etag,
+			Format:       blockfmt.Version,
+			Size:         out.Size(),
+		},
+		Trailer: c.Trailer(),
+	}, nil
+}
+
+func (st *tableState) force(idx *blockfmt.Index, prepend *blockfmt.Descriptor, lst []blockfmt.Input) error {
+	c, err := st.converter(lst)
+	if err != nil {
+		return err
+	}
+	if prepend != nil {
+		r, err := st.openPacked(prepend)
+		if err != nil {
+			return err
+		}
+		c.Prepend.R = r
+		c.Prepend.Trailer = prepend.Trailer
+	}
+	desc, err := st.run(c)
+	if err != nil {
+		st.updateFailed(idx == nil, c.Inputs)
+		return err
+	}
 	buildtime := date.Now().Truncate(time.Microsecond)
 	if idx == nil {
 		idx = new(blockfmt.Index)
@@ -676,16 +794,15 @@ func (st *tableState) force(idx *blockfmt.Index, prepend *blockfmt.Descriptor, l
 	}
 	idx.Algo = "zstd"
 	idx.Created = buildtime
-	idx.Inline = append(idx.Inline, blockfmt.Descriptor{
-		ObjectInfo: blockfmt.ObjectInfo{
-			Path:         fp,
-			LastModified: date.FromTime(lastmod),
-			ETag:         etag,
-			Format:       blockfmt.Version,
-			Size:         out.Size(),
-		},
-		Trailer: c.Trailer(),
-	})
+	idx.Inline = append(idx.Inline, *desc)
+	ret, err := st.retention()
+	if err != nil {
+		return err
+	}
+	_, err = st.expire(idx, ret, false)
+	if err != nil {
+		return err
+	}
 	err = st.flush(idx)
 	if err == nil {
 		err = st.runGC(idx)
@@ -194,6 +194,8 @@ const (
 
 	ObjectSize // SIZE(x)
 
+	Hash // HASH(x, ...)
+
 	TableGlob
 	TablePattern
 
@@ -306,6 +308,7 @@ var name2Builtin = map[string]BuiltinOp{
 	"TO_UNIX_EPOCH":            DateToUnixEpoch,
 	"TO_UNIX_MICRO":            DateToUnixMicro,
 	"SIZE":                     ObjectSize,
+	"HASH":                     Hash,
 	"TABLE_GLOB":               TableGlob,
 	"TABLE_PATTERN":            TablePattern,
 }
@@ -782,6 +785,13 @@ func nodeTypeName(node Node) string {
 	return fmt.Sprintf("%T", node)
 }
 
+func checkHash(h Hint, args []Node) error {
+	if len(args) == 0 {
+		return mismatch(len(args), 1)
+	}
+	return nil
+}
+
 func checkObjectSize(h Hint, args []Node) error {
 	if len(args) != 1 {
 		return errsyntaxf("SIZE expects one argument, but found %d", len(args))
@@ -936,6 +946,7 @@ var builtinInfo = [maxBuiltin]binfo{
 	GeoGridIndex: {check: fixedArgs(FloatType, FloatType, IntegerType), ret: IntegerType | MissingType},
 
 	ObjectSize: {check: checkObjectSize, ret: NumericType | MissingType, simplify: simplifyObjectSize},
+	Hash:       {check: checkHash, ret: IntegerType | MissingType},
 
 	InSubquery:        {check: checkInSubquery, private: true, ret: LogicalType},
 	HashLookup:        {check: checkHashLookup, private: true, ret: AnyType},
@@ -45,6 +45,18 @@ type scanner struct {
 	// we are not in keyword context
 	notkw bool
 
+	// params are the values bound to
+	// placeholders; positional is the number
+	// of '?' placeholders lexed so far, and
+	// numbered is set once a '$n' placeholder
+	// has been lexed
+	params     []expr.Constant
+	positional int
+	numbered   bool
+
+	// prev is the previous token returned by Lex
+	prev int
+
 	// value of UTCNOW(); populated lazily
 	// (we need every instance of UTCNOW()
 	// to produce the same time exactly,
@@ -115,6 +127,12 @@ func isspace(x byte) bool {
 }
 
 func (s *scanner) Lex(l *yySymType) int {
+	t := s.lex(l)
+	s.prev = t
+	return t
+}
+
+func (s *scanner) lex(l *yySymType) int {
 	if s.err != nil || s.pos >= len(s.from) {
 		return eof
 	}
@@ -133,6 +151,12 @@ func (s *scanner) Lex(l *yySymType) int {
 		return s.lexQuotedIdent(l)
 	case '`':
 		return s.lexIon(l)
+	case '?':
+		return s.lexParam(l)
+	case '$':
+		if isdigit(s.peekat(1)) {
+			return s.lexParam(l)
+		}
 	}
 	// NOTE: isident() accepts isdigit(),
 	// but due to the check above, we always
@@ -406,6 +430,69 @@ func (s *scanner) lexIon(l *yySymType) int {
 	return ION
 }
 
+// lexParam lexes a '?' or '$n' placeholder
+// as a literal holding the bound parameter
+func (s *scanner) lexParam(l *yySymType) int {
+	startpos := s.pos
+	var i int
+	if s.from[s.pos] == '?' {
+		s.pos++
+		i = s.positional
+		s.positional++
+	} else {
+		s.pos++
+		for s.pos < len(s.from) && isdigit(s.from[s.pos]) {
+			s.pos++
+		}
+		n, err := strconv.Atoi(string(s.from[startpos+1 : s.pos]))
+		if err != nil || n < 1 {
+			s.err = fmt.Errorf("pos %d: invalid placeholder %q", startpos, s.from[startpos:s.pos])
+			return ERROR
+		}
+		i = n - 1
+		s.numbered = true
+	}
+	if s.numbered && s.positional > 0 {
+		s.err = fmt.Errorf("pos %d: cannot mix '?' and '$n' placeholders", startpos)
+		return ERROR
+	}
+	if i >= len(s.params) {
+		s.err = fmt.Errorf("pos %d: no parameter for placeholder %d", startpos, i+1)
+		return ERROR
+	}
+	// the same parameter may be referenced
+	// more than once, so give each reference
+	// its own copy of composite values
+	c, ok := expr.AsConstant(s.params[i].Datum())
+	if !ok {
+		c = s.params[i]
+	}
+	l.expr = c
+	s.notkw = false
+	if s.prev == LIMIT || s.prev == OFFSET {
+		n, err := -1, error(nil)
+		switch c.(type) {
+		case expr.Integer, expr.Float, *expr.Rational:
+			n, err = toint(c)
+		}
+		if err != nil || n < 0 {
+			s.err = fmt.Errorf("pos %d: parameter %d (%s) is not a non-negative integer", startpos, i+1, expr.ToString(c))
+			return ERROR
+		}
+	}
+	// numbers are lexed as numbers so that
+	// they can be used for e.g. LIMIT, and strings
+	// as strings so that they can be used for LIKE
+	switch c := c.(type) {
+	case expr.Integer, expr.Float, *expr.Rational:
+		return NUMBER
+	case expr.String:
+		l.str = string(c)
+		return STRING
+	}
+	return ION
+}
+
 func toint(e expr.Node) (int, error) {
 	if i, ok := e.(expr.Integer); ok {
 		return int(i), nil
@@ -45,7 +45,25 @@ func dropParser(p *yyParserImpl) {
 // and returns the result, or an error if one
 // is encountered.
 func Parse(in []byte) (*expr.Query, error) {
-	s := &scanner{from: in}
+	return parse(&scanner{from: in})
+}
+
+// ParseWithParams is identical to Parse, except
+// that the query may contain placeholders that are
+// replaced with the corresponding constants in params.
+// A placeholder is either '?', which refers to the
+// parameter following the one referred to by the
+// previous '?', or '$n', which refers to the n-th
+// parameter (starting at 1). The two forms of
+// placeholder cannot be mixed in one query.
+//
+// Parameters are substituted as literals,
+// so they are never interpreted as query text.
+func ParseWithParams(in []byte, params []expr.Constant) (*expr.Query, error) {
+	return parse(&scanner{from: in, params: params})
+}
+
+func parse(s *scanner) (*expr.Query, error) {
 	p := newParser()
 	ret := p.Parse(s)
 	dropParser(p)
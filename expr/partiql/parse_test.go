@@ -296,3 +296,122 @@ func testEquivalence(t *testing.T, e expr.Node) {
 		t.Errorf("output: %s", res)
 	}
 }
+
+func TestParseWithParams(t *testing.T) {
+	params := []expr.Constant{
+		expr.Integer(3),
+		expr.String("it's; DROP TABLE foo"),
+		&expr.List{Values: []expr.Constant{expr.Integer(1), expr.Integer(2)}},
+		expr.Null{},
+	}
+	tests := []struct {
+		from, to string
+	}{
+		{
+			"SELECT * FROM foo WHERE x = ? AND y = ?",
+			"SELECT * FROM foo WHERE x = 3 AND y = 'it\\'s; DROP TABLE foo'",
+		},
+		{
+			"SELECT * FROM foo WHERE y = $2 OR z = $2 LIMIT $1",
+			"SELECT * FROM foo WHERE y = 'it\\'s; DROP TABLE foo' OR z = 'it\\'s; DROP TABLE foo' LIMIT 3",
+		},
+		{
+			"SELECT $3 AS lst, $4 AS n FROM foo",
+			"SELECT [1, 2] AS lst, NULL AS n FROM foo",
+		},
+		{
+			// no placeholders
+			"SELECT x FROM foo",
+			"SELECT x FROM foo",
+		},
+	}
+	for i := range tests {
+		e, err := ParseWithParams([]byte(tests[i].from), params)
+		if err != nil {
+			t.Errorf("case %q: %s", tests[i].from, err)
+			continue
+		}
+		if got := e.Text(); got != tests[i].to {
+			t.Errorf("case %q: normalized to %q", tests[i].from, got)
+		}
+		testEquivalence(t, e.Body)
+	}
+
+	bad := []string{
+		// mixed forms
+		"SELECT * FROM foo WHERE x = ? AND y = $1",
+		"SELECT * FROM foo WHERE x = $1 AND y = ?",
+		// out of range
+		"SELECT * FROM foo WHERE x = $5",
+		"SELECT * FROM foo WHERE x = $0",
+		"SELECT ?, ?, ?, ?, ? FROM foo",
+	}
+	for i := range bad {
+		_, err := ParseWithParams([]byte(bad[i]), params)
+		if err == nil {
+			t.Errorf("case %q: err == nil?", bad[i])
+		}
+	}
+	// placeholders without parameters
+	_, err := Parse([]byte("SELECT * FROM foo WHERE x = ?"))
+	if err == nil {
+		t.Error("placeholder without parameters: err == nil?")
+	}
+}
+
+func TestParseParamsLikeLimit(t *testing.T) {
+	params := []expr.Constant{
+		expr.String("%@example.com"),
+		expr.Integer(10),
+	}
+	// each query should parse the same
+	// as the query with the literal values
+	tests := []struct {
+		from, to string
+	}{
+		{
+			"SELECT * FROM foo WHERE email LIKE ? LIMIT ?",
+			"SELECT * FROM foo WHERE email LIKE '%@example.com' LIMIT 10",
+		},
+		{
+			"SELECT * FROM foo WHERE email ILIKE $1 LIMIT $2 OFFSET $2",
+			"SELECT * FROM foo WHERE email ILIKE '%@example.com' LIMIT 10 OFFSET 10",
+		},
+		{
+			"SELECT * FROM foo WHERE email NOT LIKE $1",
+			"SELECT * FROM foo WHERE email NOT LIKE '%@example.com'",
+		},
+	}
+	for i := range tests {
+		e, err := ParseWithParams([]byte(tests[i].from), params)
+		if err != nil {
+			t.Errorf("case %q: %s", tests[i].from, err)
+			continue
+		}
+		want, err := Parse([]byte(tests[i].to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.Text(); got != want.Text() {
+			t.Errorf("case %q: normalized to %q, want %q", tests[i].from, got, want.Text())
+		}
+	}
+
+	bad := [][]expr.Constant{
+		{expr.Integer(-5)},
+		{expr.Float(2.5)},
+		{expr.String("10")},
+		{expr.Null{}},
+	}
+	for i := range bad {
+		for _, q := range []string{
+			"SELECT * FROM foo LIMIT ?",
+			"SELECT * FROM foo LIMIT 10 OFFSET ?",
+		} {
+			_, err := ParseWithParams([]byte(q), bad[i])
+			if err == nil {
+				t.Errorf("case %q with %s: err == nil?", q, expr.ToString(bad[i][0]))
+			}
+		}
+	}
+}
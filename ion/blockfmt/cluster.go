@@ -0,0 +1,332 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package blockfmt
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// DefaultClusterRanges is the default number
+// of metadata ranges (see Converter.FlushMeta)
+// worth of data that is sorted at once when
+// Converter.Cluster is set.
+const DefaultClusterRanges = 8
+
+// ParseClusterPath splits a dotted path
+// (i.e. "a.b.c") into its components.
+func ParseClusterPath(p string) ([]string, error) {
+	if p == "" {
+		return nil, fmt.Errorf("empty cluster path")
+	}
+	parts := strings.Split(p, ".")
+	for i := range parts {
+		if parts[i] == "" {
+			return nil, fmt.Errorf("invalid cluster path %q", p)
+		}
+	}
+	return parts, nil
+}
+
+// clusterWriter sits between two ion.Chunkers:
+// the first chunker writes aligned blocks into
+// the clusterWriter, which buffers the records
+// until the first chunker flushes its ranges,
+// at which point the buffered records are sorted
+// by their cluster keys and written into the
+// second chunker, which produces the real output.
+type clusterWriter struct {
+	keys [][]string
+	out  *ion.Chunker
+
+	insyms ion.Symtab  // current input symbol table
+	cur    *ion.Symtab // snapshot of insyms
+	recs   []clusterRec
+
+	// time range paths reported by the
+	// input chunker, which are forwarded
+	// to out.WalkTimeRanges
+	paths [][]string
+
+	outsyms ion.Symtab
+	outbuf  ion.Buffer
+	tmp     ion.Buffer
+}
+
+type clusterRec struct {
+	key  []ion.Datum
+	st   *ion.Symtab
+	body []byte
+}
+
+func (w *clusterWriter) Write(block []byte) (int, error) {
+	n := len(block)
+	block = append([]byte(nil), block...)
+	var err error
+	for len(block) > 0 {
+		if ion.IsBVM(block) || ion.TypeOf(block) == ion.AnnotationType {
+			block, err = w.insyms.Unmarshal(block)
+			if err != nil {
+				return 0, err
+			}
+			w.cur = nil
+			continue
+		}
+		size := ion.SizeOf(block)
+		if size <= 0 || size > len(block) {
+			return 0, fmt.Errorf("clusterWriter: object size %d out of range [:%d]", size, len(block))
+		}
+		if ion.TypeOf(block) == ion.StructType {
+			if w.cur == nil {
+				w.cur = new(ion.Symtab)
+				w.insyms.CloneInto(w.cur)
+			}
+			body := block[:size]
+			d, _, err := ion.ReadDatum(w.cur, body)
+			if err != nil {
+				return 0, err
+			}
+			w.recs = append(w.recs, clusterRec{
+				key:  w.extract(d),
+				st:   w.cur,
+				body: body,
+			})
+		}
+		block = block[size:]
+	}
+	return n, nil
+}
+
+func (w *clusterWriter) extract(d ion.Datum) []ion.Datum {
+	out := make([]ion.Datum, len(w.keys))
+	for i := range w.keys {
+		v := d
+		for _, name := range w.keys[i] {
+			s, ok := v.(*ion.Struct)
+			if !ok {
+				v = nil
+				break
+			}
+			f := s.FieldByName(name)
+			if f == nil {
+				v = nil
+				break
+			}
+			v = f.Value
+		}
+		// symbol IDs aren't comparable across
+		// symbol tables, so compare their text
+		if sym, ok := v.(ion.Symbol); ok {
+			v = ion.String(w.cur.Get(sym))
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// SetMinMax implements the interface that
+// ion.Chunker uses to report ranges; we
+// only track the paths so that they can be
+// re-computed by the output chunker after sorting.
+func (w *clusterWriter) SetMinMax(path []string, min, max ion.Datum) {
+	for i := range w.paths {
+		if equalPath(w.paths[i], path) {
+			return
+		}
+	}
+	w.paths = append(w.paths, append([]string(nil), path...))
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush is called by the input chunker
+// each time it has flushed a range of data,
+// which is when we sort and emit everything buffered.
+func (w *clusterWriter) Flush() error {
+	if len(w.recs) == 0 {
+		return nil
+	}
+	if len(w.paths) != len(w.out.WalkTimeRanges) {
+		w.out.WalkTimeRanges = w.paths
+	}
+	sort.SliceStable(w.recs, func(i, j int) bool {
+		return compareKeys(w.recs[i].key, w.recs[j].key) < 0
+	})
+	for i := range w.recs {
+		d, _, err := ion.ReadDatum(w.recs[i].st, w.recs[i].body)
+		if err != nil {
+			return err
+		}
+		d = resymbolize(d, w.recs[i].st, &w.outsyms)
+		d.Encode(&w.outbuf, &w.outsyms)
+		// release the memory as we go
+		w.recs[i] = clusterRec{}
+		if w.outbuf.Size() >= w.out.Align {
+			if err := w.emit(); err != nil {
+				return err
+			}
+		}
+	}
+	w.recs = w.recs[:0]
+	return w.emit()
+}
+
+// emit writes the buffered output records,
+// prefixed with the current output symbol table,
+// into the output chunker
+func (w *clusterWriter) emit() error {
+	if w.outbuf.Size() == 0 {
+		return nil
+	}
+	w.tmp.Reset()
+	w.outsyms.Marshal(&w.tmp, true)
+	w.tmp.UnsafeAppend(w.outbuf.Bytes())
+	w.outbuf.Reset()
+	_, err := w.out.Write(w.tmp.Bytes())
+	return err
+}
+
+// resymbolize translates symbol values in d
+// from the symbol table 'from' into 'to'
+// (struct field labels are already resolved
+// to strings by ion.ReadDatum)
+func resymbolize(d ion.Datum, from, to *ion.Symtab) ion.Datum {
+	switch d := d.(type) {
+	case ion.Symbol:
+		return to.Intern(from.Get(d))
+	case *ion.Struct:
+		for i := range d.Fields {
+			d.Fields[i].Value = resymbolize(d.Fields[i].Value, from, to)
+		}
+	case *ion.Annotation:
+		for i := range d.Fields {
+			d.Fields[i].Value = resymbolize(d.Fields[i].Value, from, to)
+		}
+	case ion.List:
+		for i := range d {
+			d[i] = resymbolize(d[i], from, to)
+		}
+	}
+	return d
+}
+
+func compareKeys(a, b []ion.Datum) int {
+	for i := range a {
+		if c := compareDatum(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// rank orders datums of different types;
+// missing values and nulls sort first
+func rank(d ion.Datum) int {
+	switch d.(type) {
+	case nil, ion.UntypedNull:
+		return 0
+	case ion.Bool:
+		return 1
+	case ion.Int, ion.Uint, ion.Float, *ion.BigInt, *ion.BigNum:
+		return 2
+	case ion.Timestamp:
+		return 3
+	case ion.String:
+		return 4
+	default:
+		return 5
+	}
+}
+
+func toRat(d ion.Datum) *big.Rat {
+	r := new(big.Rat)
+	switch d := d.(type) {
+	case ion.Int:
+		r.SetInt64(int64(d))
+	case ion.Uint:
+		r.SetUint64(uint64(d))
+	case ion.Float:
+		if r.SetFloat64(float64(d)) == nil {
+			// NaN or Inf; pick something stable
+			return new(big.Rat)
+		}
+	case *ion.BigInt:
+		r.SetInt((*big.Int)(d))
+	case *ion.BigNum:
+		r.Set((*big.Rat)(d))
+	}
+	return r
+}
+
+func compareDatum(a, b ion.Datum) int {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case ion.Bool:
+		x, y := bool(a), bool(b.(ion.Bool))
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case ion.Timestamp:
+		x, y := date.Time(a), date.Time(b.(ion.Timestamp))
+		if x.Before(y) {
+			return -1
+		}
+		if x.After(y) {
+			return 1
+		}
+		return 0
+	case ion.String:
+		return strings.Compare(string(a), string(b.(ion.String)))
+	}
+	if ra == 2 {
+		// integers are by far the most common case
+		if x, ok := a.(ion.Int); ok {
+			if y, ok := b.(ion.Int); ok {
+				switch {
+				case x < y:
+					return -1
+				case x > y:
+					return 1
+				}
+				return 0
+			}
+		}
+		return toRat(a).Cmp(toRat(b))
+	}
+	// anything else is considered equal
+	return 0
+}
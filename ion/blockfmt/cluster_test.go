@@ -0,0 +1,120 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package blockfmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+func TestConvertCluster(t *testing.T) {
+	const rows = 5000
+	var text strings.Builder
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&text, "{\"row\": %d, \"meta\": {\"tenant\": \"tenant-%03d\"}}\n", i, rand.Intn(500))
+	}
+	path, err := ParseClusterPath("meta.tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out BufferUploader
+	align := 4096
+	out.PartSize = 2 * align
+	c := Converter{
+		Output: &out,
+		Comp:   "zstd",
+		Inputs: []Input{{
+			R: io.NopCloser(strings.NewReader(text.String())),
+			F: SuffixToFormat[".json"](),
+		}},
+		Align:     align,
+		FlushMeta: 4 * align,
+		Cluster:   [][]string{path},
+		// sort everything at once
+		ClusterWindow: 1 << 30,
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, &out)
+
+	var dst bytes.Buffer
+	r := bytes.NewReader(out.Bytes())
+	dec := Decoder{}
+	dec.Set(c.Trailer(), len(c.Trailer().Blocks))
+	_, err = dec.Copy(&dst, io.LimitReader(r, c.Trailer().Offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st ion.Symtab
+	buf := dst.Bytes()
+	seen := make(map[uint64]bool)
+	last := ""
+	for len(buf) > 0 {
+		var d ion.Datum
+		d, buf, err = ion.ReadDatum(&st, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, ok := d.(*ion.Struct)
+		if !ok {
+			continue
+		}
+		row := s.FieldByName("row").Value.(ion.Uint)
+		seen[uint64(row)] = true
+		meta := s.FieldByName("meta").Value.(*ion.Struct)
+		tenant := string(meta.FieldByName("tenant").Value.(ion.String))
+		if tenant < last {
+			t.Fatalf("row %d: %q < %q", row, tenant, last)
+		}
+		last = tenant
+	}
+	if len(seen) != rows {
+		t.Fatalf("got %d rows back; expected %d", len(seen), rows)
+	}
+}
+
+func TestCompareDatum(t *testing.T) {
+	ordered := []ion.Datum{
+		nil,
+		ion.Bool(false),
+		ion.Bool(true),
+		ion.Int(-5),
+		ion.Float(1.5),
+		ion.Uint(2),
+		ion.String("a"),
+		ion.String("b"),
+	}
+	for i := range ordered {
+		for j := range ordered {
+			got := compareDatum(ordered[i], ordered[j])
+			switch {
+			case i < j && got >= 0:
+				t.Errorf("compare(%v, %v) = %d", ordered[i], ordered[j], got)
+			case i > j && got <= 0:
+				t.Errorf("compare(%v, %v) = %d", ordered[i], ordered[j], got)
+			case i == j && got != 0:
+				t.Errorf("compare(%v, %v) = %d", ordered[i], ordered[j], got)
+			}
+		}
+	}
+}
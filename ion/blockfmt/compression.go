@@ -77,7 +77,7 @@ type CompressionWriter struct {
 }
 
 type futureRange struct {
-	buffered []*TimeRange
+	buffered []Range
 }
 
 type minMaxer interface {
@@ -89,17 +89,13 @@ var _ minMaxer = &futureRange{}
 // SetMinMax Sets the `min` and `max` values for the next ION chunk.
 // This method should only be called once for each path.
 func (f *futureRange) SetMinMax(path []string, min, max ion.Datum) {
-	ts, ok := NewRange(path, min, max).(*TimeRange)
-	if !ok {
-		return // only supporting timestamp ranges right now
-	}
-	f.buffered = append(f.buffered, ts)
+	f.buffered = append(f.buffered, NewRange(path, min, max))
 }
 
 func (f *futureRange) pop() []Range {
 	ret := f.buffered
 	f.buffered = nil
-	return toRanges(ret)
+	return ret
 }
 
 func (w *CompressionWriter) target() int {
@@ -112,10 +108,13 @@ func (w *CompressionWriter) target() int {
 	return w.TargetSize
 }
 
+// toTimeRanges returns the time ranges in lst
 func toTimeRanges(lst []Range) []*TimeRange {
-	out := make([]*TimeRange, len(lst))
-	for i := range out {
-		out[i] = lst[i].(*TimeRange)
+	out := make([]*TimeRange, 0, len(lst))
+	for i := range lst {
+		if tr, ok := lst[i].(*TimeRange); ok {
+			out = append(out, tr)
+		}
 	}
 	return out
 }
@@ -140,6 +140,148 @@ func UnsafeION() RowFormat {
 	return ionConverter{}
 }
 
+type packedConverter struct {
+	trailer *Trailer
+	keep    func(row ion.Datum) bool
+}
+
+func (p *packedConverter) Name() string { return "packed" }
+
+func (p *packedConverter) Convert(r io.Reader, dst *ion.Chunker) error {
+	dst.WalkTimeRanges = collectRanges(p.trailer)
+	d := Decoder{}
+	d.Set(p.trailer, len(p.trailer.Blocks))
+	var w io.Writer = dst
+	if p.keep != nil {
+		w = &filterWriter{dst: dst, keep: p.keep}
+	}
+	_, err := d.Copy(w, r)
+	dst.WalkTimeRanges = nil
+	return err
+}
+
+func (p *packedConverter) UseHints(schema []byte) error {
+	return nil
+}
+
+// PackedFormat returns a RowFormat that
+// re-ingests data that has already been
+// written by a Converter, where t is the
+// Trailer of the packed object.
+// The reader passed to Convert should
+// produce the bytes of the object up to t.Offset.
+//
+// PackedFormat is useful for merging
+// existing packed objects together.
+func PackedFormat(t *Trailer) RowFormat {
+	return &packedConverter{trailer: t}
+}
+
+// FilterPackedFormat works like PackedFormat,
+// but it only re-ingests the rows for which
+// keep returns true. Symbols within the rows
+// passed to keep are replaced with strings.
+func FilterPackedFormat(t *Trailer, keep func(row ion.Datum) bool) RowFormat {
+	return &packedConverter{trailer: t, keep: keep}
+}
+
+// errStopScan stops ScanPacked early
+var errStopScan = errors.New("stop scan")
+
+// ScanPacked reads the rows of a packed object
+// (see PackedFormat) from r and calls fn on each of
+// them until fn returns false. Symbols within the rows
+// passed to fn are replaced with strings.
+func ScanPacked(r io.Reader, t *Trailer, fn func(row ion.Datum) bool) error {
+	d := Decoder{}
+	d.Set(t, len(t.Blocks))
+	stop := false
+	w := &filterWriter{dst: io.Discard, keep: func(row ion.Datum) bool {
+		if !stop {
+			stop = !fn(row)
+		}
+		return false
+	}}
+	_, err := d.Copy(writerFunc(func(block []byte) (int, error) {
+		if stop {
+			return 0, errStopScan
+		}
+		return w.Write(block)
+	}), r)
+	if errors.Is(err, errStopScan) {
+		err = nil
+	}
+	return err
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (w writerFunc) Write(p []byte) (int, error) { return w(p) }
+
+// filterWriter accepts decompressed blocks
+// and forwards only the rows accepted by keep
+type filterWriter struct {
+	dst  io.Writer
+	keep func(row ion.Datum) bool
+	st   ion.Symtab
+	buf  []byte
+}
+
+func (f *filterWriter) Write(block []byte) (int, error) {
+	n := len(block)
+	rest := block
+	var err error
+	if ion.IsBVM(rest) || ion.TypeOf(rest) == ion.AnnotationType {
+		rest, err = f.st.Unmarshal(rest)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// preserve the symbol table, if any
+	f.buf = append(f.buf[:0], block[:len(block)-len(rest)]...)
+	for len(rest) > 0 {
+		size := ion.SizeOf(rest)
+		if size <= 0 || size > len(rest) {
+			return 0, fmt.Errorf("filterWriter: object size %d out of range [:%d]", size, len(rest))
+		}
+		if ion.TypeOf(rest) == ion.StructType {
+			d, _, err := ion.ReadDatum(&f.st, rest[:size])
+			if err != nil {
+				return 0, err
+			}
+			if f.keep(unsymbolize(d, &f.st)) {
+				f.buf = append(f.buf, rest[:size]...)
+			}
+		}
+		rest = rest[size:]
+	}
+	if len(f.buf) > 0 {
+		_, err = f.dst.Write(f.buf)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// unsymbolize replaces the symbols in d
+// with their text from st
+func unsymbolize(d ion.Datum, st *ion.Symtab) ion.Datum {
+	switch d := d.(type) {
+	case ion.Symbol:
+		return ion.String(st.Get(d))
+	case *ion.Struct:
+		for i := range d.Fields {
+			d.Fields[i].Value = unsymbolize(d.Fields[i].Value, st)
+		}
+	case ion.List:
+		for i := range d {
+			d[i] = unsymbolize(d[i], st)
+		}
+	}
+	return d
+}
+
 // SuffixToFormat is a list of known
 // filename suffixes that correspond
 // to known constructors for RowFormat
@@ -209,6 +351,22 @@ type Converter struct {
 	// DisablePrefetch, if true, disables
 	// prefetching of inputs.
 	DisablePrefetch bool
+	// Cluster, if non-empty, is the list of
+	// paths by which the output rows are sorted
+	// before they are written, so that the
+	// ranges for those paths are narrower.
+	// Rows are sorted in windows of ClusterWindow
+	// bytes rather than across the whole output.
+	Cluster [][]string
+	// ClusterWindow is the total number of
+	// decompressed bytes that are buffered for
+	// sorting when Cluster is set. The window is
+	// shared by the parallel output streams, so
+	// Parallel is reduced as necessary to give each
+	// stream a window of at least FlushMeta bytes.
+	// If ClusterWindow is zero, then
+	// DefaultClusterRanges*FlushMeta is used.
+	ClusterWindow int
 
 	// trailer built by the writer. This is only
 	// set if the object was written successfully.
@@ -288,12 +446,8 @@ func (c *Converter) runSingle() error {
 		// half the target size
 		MinChunksPerBlock: c.FlushMeta / (c.Align * 2),
 	}
-	cn := ion.Chunker{
-		W:          w,
-		Align:      w.InputAlign,
-		RangeAlign: c.FlushMeta,
-	}
-	err := c.runPrepend(&cn)
+	cn := c.chunker(w, w.InputAlign, c.clusterWindow())
+	err := c.runPrepend(cn)
 	if err != nil {
 		return err
 	}
@@ -330,7 +484,7 @@ func (c *Converter) runSingle() error {
 			next++
 		}
 
-		err := c.Inputs[i].F.Convert(c.Inputs[i].R, &cn)
+		err := c.Inputs[i].F.Convert(c.Inputs[i].R, cn)
 		err2 := c.Inputs[i].R.Close()
 		if err == nil {
 			err = err2
@@ -351,7 +505,7 @@ func (c *Converter) runSingle() error {
 			return err
 		}
 	}
-	err = cn.Flush()
+	err = flushChunker(cn)
 	if err != nil {
 		return err
 	}
@@ -360,6 +514,53 @@ func (c *Converter) runSingle() error {
 	return err
 }
 
+func (c *Converter) clusterWindow() int {
+	if c.ClusterWindow > 0 {
+		return c.ClusterWindow
+	}
+	return DefaultClusterRanges * c.FlushMeta
+}
+
+// chunker returns the chunker that
+// input data should be written into;
+// if c.Cluster is set, then the returned
+// chunker sorts windows of data before
+// writing it to w
+func (c *Converter) chunker(w io.Writer, align, window int) *ion.Chunker {
+	cn := &ion.Chunker{
+		W:          w,
+		Align:      align,
+		RangeAlign: c.FlushMeta,
+	}
+	if len(c.Cluster) == 0 {
+		return cn
+	}
+	// record ranges for the cluster keys
+	// so that queries can skip blocks
+	cn.WalkRanges = c.Cluster
+	return &ion.Chunker{
+		W: &clusterWriter{
+			keys: c.Cluster,
+			out:  cn,
+		},
+		Align:      align,
+		RangeAlign: window,
+	}
+}
+
+// flushChunker flushes a chunker
+// returned by Converter.chunker
+func flushChunker(cn *ion.Chunker) error {
+	err := cn.Flush()
+	if err != nil {
+		return err
+	}
+	if cw, ok := cn.W.(*clusterWriter); ok {
+		return cw.out.Flush()
+	}
+	return nil
+}
+
 func (c *Converter) runPrepend(cn *ion.Chunker) error {
 	if c.Prepend.R == nil {
 		return nil
@@ -391,6 +592,18 @@ func (c *Converter) runMulti() error {
 	if p <= 0 {
 		p = runtime.GOMAXPROCS(0)
 	}
+	window := c.clusterWindow()
+	if len(c.Cluster) > 0 && c.FlushMeta > 0 {
+		// each stream buffers its share of
+		// the window, so limit the number of
+		// streams to keep the total bounded
+		if max := window / c.FlushMeta; p > max {
+			p = max
+		}
+		if p < 1 {
+			p = 1
+		}
+	}
 	startc := make(chan *Input, p)
 	readyc := startc
 	if p >= len(c.Inputs) {
@@ -402,6 +615,7 @@ func (c *Converter) runMulti() error {
 		}
 		readyc = doPrefetch(startc, max, wantInflight)
 	}
+	window /= p
 	errs := make(chan error, p)
 	consume := func(in chan *Input) {
 		for in := range in {
@@ -418,20 +632,16 @@ func (c *Converter) runMulti() error {
 			// if we encounter an error,
 			// drain the queue and close each item
 			defer consume(startc)
-			cn := ion.Chunker{
-				W:          wc,
-				Align:      w.InputAlign,
-				RangeAlign: c.FlushMeta,
-			}
+			cn := c.chunker(wc, w.InputAlign, window)
 			if i == 0 {
-				err := c.runPrepend(&cn)
+				err := c.runPrepend(cn)
 				if err != nil {
 					errs <- fmt.Errorf("prepend: %w", err)
 					return
 				}
 			}
 			for in := range startc {
-				err := in.F.Convert(in.R, &cn)
+				err := in.F.Convert(in.R, cn)
 				err2 := in.R.Close()
 				if err == nil {
 					err = err2
@@ -442,7 +652,7 @@ func (c *Converter) runMulti() error {
 					return
 				}
 			}
-			err := cn.Flush()
+			err := flushChunker(cn)
 			if err != nil {
 				errs <- err
 				return
@@ -155,11 +155,48 @@ func union(a, b []*TimeRange) []*TimeRange {
 
 func (b *Blockdesc) merge(from *Blockdesc) {
 	b.Chunks += from.Chunks
+	datums := datumUnion(b.Ranges, from.Ranges)
 	b.Ranges = toRanges(
 		union(
 			toTimeRanges(b.Ranges),
 			toTimeRanges(from.Ranges),
 		))
+	b.Ranges = append(b.Ranges, datums...)
+}
+
+// datumUnion returns the union of the non-timestamp
+// ranges that are present in both a and b;
+// a path that has a range in only one of a or b
+// (or ranges of incomparable types) has no range
+// in the result
+func datumUnion(a, b []Range) []Range {
+	var out []Range
+	for i := range a {
+		ar, ok := a[i].(*datumRange)
+		if !ok {
+			continue
+		}
+		for j := range b {
+			br, ok := b[j].(*datumRange)
+			if !ok || !slices.Equal(ar.path, br.path) {
+				continue
+			}
+			r := rank(ar.min)
+			if rank(ar.max) != r || rank(br.min) != r || rank(br.max) != r {
+				break
+			}
+			min, max := ar.min, ar.max
+			if compareDatum(br.min, min) < 0 {
+				min = br.min
+			}
+			if compareDatum(br.max, max) > 0 {
+				max = br.max
+			}
+			out = append(out, &datumRange{path: ar.path, min: min, max: max})
+			break
+		}
+	}
+	return out
 }
 
 func collectRanges(t *Trailer) [][]string {
@@ -215,6 +215,72 @@ func TestChunkerRange(t *testing.T) {
 	}
 }
 
+func TestChunkerValueRanges(t *testing.T) {
+	rows := []struct {
+		tenant, n, mixed ion.Datum
+	}{
+		{ion.String("c"), ion.Int(3), ion.String("x")},
+		{ion.String("a"), ion.Int(-5), ion.String("y")},
+		{ion.UntypedNull{}, ion.Uint(10), ion.Int(1)},
+		{ion.String("d"), ion.Int(0), ion.String("z")},
+	}
+	var st ion.Symtab
+	var body ion.Buffer
+	for i := range rows {
+		s := &ion.Struct{
+			Fields: []ion.Field{
+				{Label: "tenant", Value: rows[i].tenant},
+				{Label: "n", Value: rows[i].n},
+				{Label: "mixed", Value: rows[i].mixed},
+			},
+		}
+		s.Encode(&body, &st)
+	}
+	var buf ion.Buffer
+	st.Marshal(&buf, true)
+	buf.UnsafeAppend(body.Bytes())
+
+	rw := new(rangeWriter)
+	c := &ion.Chunker{
+		W:          rw,
+		Align:      1024,
+		WalkRanges: [][]string{{"tenant"}, {"n"}, {"mixed"}},
+	}
+	_, err := c.Write(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rw.allRanges) != 1 {
+		t.Fatalf("got %d chunks of ranges", len(rw.allRanges))
+	}
+	got := make(map[string]ranges)
+	for _, r := range rw.allRanges[0] {
+		got[strings.Join(r.path, ".")] = r
+	}
+	want := map[string][2]ion.Datum{
+		"tenant": {ion.String("a"), ion.String("d")},
+		"n":      {ion.Int(-5), ion.Uint(10)},
+	}
+	for p, mm := range want {
+		r, ok := got[p]
+		if !ok {
+			t.Errorf("no range for %s", p)
+			continue
+		}
+		if !reflect.DeepEqual(r.min, mm[0]) || !reflect.DeepEqual(r.max, mm[1]) {
+			t.Errorf("range for %s: got [%v, %v], want [%v, %v]", p, r.min, r.max, mm[0], mm[1])
+		}
+	}
+	// strings and integers are not comparable
+	if r, ok := got["mixed"]; ok {
+		t.Errorf("unexpected range for mixed: [%v, %v]", r.min, r.max)
+	}
+}
+
 func TestChunkerSnapshot(t *testing.T) {
 	rw := new(rangeWriter)
 	c := &ion.Chunker{
@@ -71,6 +71,14 @@ type Chunker struct {
 	WalkTimeRanges [][]string
 	// symbolized WalkTimeRanges
 	rangeSyms [][]Symbol
+	// WalkRanges is the list of paths for which
+	// the ranges of integer, string, and timestamp
+	// values are automatically scanned during
+	// Chunker.Write. A path that takes any other
+	// (non-null) value within a chunk has no range.
+	WalkRanges [][]string
+	// symbolized WalkRanges
+	valueSyms [][]Symbol
 
 	tmpbuf  Buffer // scratch buffer
 	lastoff int    // last committed object offset
@@ -216,6 +224,7 @@ func (c *Chunker) flushRanges() error {
 	c.tmpID = 0
 	c.flushID = 0
 	c.rangeSyms = c.rangeSyms[:0]
+	c.valueSyms = c.valueSyms[:0]
 	if mm, ok := c.W.(minMaxSetter); ok {
 		for _, p := range c.Ranges.paths {
 			r := c.Ranges.m[p]
@@ -475,6 +484,7 @@ func (c *Chunker) resetPrepare() error {
 	c.lastoff = 0
 	c.lastst = 0
 	c.rangeSyms = c.rangeSyms[:0]
+	c.valueSyms = c.valueSyms[:0]
 	return nil
 }
 
@@ -527,6 +537,7 @@ func (c *Chunker) Write(block []byte) (int, error) {
 			c.Symbols = newsyms
 			// new symbols mean the range symbols are stale
 			c.rangeSyms = c.rangeSyms[:0]
+			c.valueSyms = c.valueSyms[:0]
 		}
 	} else if TypeOf(block) == AnnotationType {
 		block, err = c.Symbols.Unmarshal(block)
@@ -535,6 +546,7 @@ func (c *Chunker) Write(block []byte) (int, error) {
 		}
 		// new symbols mean the range symbols are stale
 		c.rangeSyms = c.rangeSyms[:0]
+		c.valueSyms = c.valueSyms[:0]
 	}
 	for len(block) > 0 {
 		size := SizeOf(block)
@@ -547,6 +559,7 @@ func (c *Chunker) Write(block []byte) (int, error) {
 			rec := block[:size]
 			c.Buffer.UnsafeAppend(rec)
 			c.walkTimeRanges(rec)
+			c.walkValueRanges(rec)
 			err = c.Commit()
 			if err != nil {
 				return 0, err
@@ -573,39 +586,43 @@ func pathLess(left, right []Symbol) bool {
 	return len(left) < len(right)
 }
 
-func (c *Chunker) walkTimeRanges(rec []byte) {
-	const badSymbol = Symbol(0xffffffff)
-	if len(c.WalkTimeRanges) == 0 {
-		return
-	}
-	// rebuild rangeSyms
-	if len(c.rangeSyms) == 0 {
-		nranges := len(c.WalkTimeRanges)
-		c.rangeSyms = slices.Grow(c.rangeSyms, nranges)[:nranges]
-		for i := range c.WalkTimeRanges {
-			path := c.WalkTimeRanges[i]
-			sl := c.rangeSyms[i][:0]
-			for j := range path {
-				// we must use Symbolize instead of Intern
-				// to ensure that this process doesn't add
-				// new entries to the symbol table
-				sym, ok := c.Symbols.Symbolize(path[j])
-				if !ok {
-					sym = badSymbol
-				}
-				sl = append(sl, sym)
+// symbolize converts paths into lists of symbols,
+// reusing the storage in dst, and sorts the result
+// so that the paths can be searched in symbol order
+func (c *Chunker) symbolize(paths [][]string, dst [][]Symbol) [][]Symbol {
+	n := len(paths)
+	dst = slices.Grow(dst[:0], n)[:n]
+	for i := range paths {
+		path := paths[i]
+		sl := dst[i][:0]
+		for j := range path {
+			// we must use Symbolize instead of Intern
+			// to ensure that this process doesn't add
+			// new entries to the symbol table
+			sym, ok := c.Symbols.Symbolize(path[j])
+			if !ok {
+				sym = badSymbol
 			}
-			c.rangeSyms[i] = sl
+			sl = append(sl, sym)
 		}
-		// produce ranges to search in symbol order
-		slices.SortFunc(c.rangeSyms, pathLess)
+		dst[i] = sl
 	}
+	slices.SortFunc(dst, pathLess)
+	return dst
+}
+
+const badSymbol = Symbol(0xffffffff)
+
+// walkPaths visits each path in syms (which must
+// be sorted) that is present in rec; values selects
+// visitValue instead of visitTime
+func (c *Chunker) walkPaths(rec []byte, syms [][]Symbol, values bool) {
 	body, _ := Contents(rec)
-	for i := range c.rangeSyms {
+	for i := range syms {
 		if len(body) == 0 {
 			return
 		}
-		lst := c.rangeSyms[i]
+		lst := syms[i]
 		first := lst[0]
 		if first == badSymbol {
 			break
@@ -631,10 +648,77 @@ func (c *Chunker) walkTimeRanges(rec []byte) {
 				break
 			}
 		}
-		if len(val) > 0 && TypeOf(val) == TimestampType {
-			c.addTime(lst, val)
+		if len(val) == 0 {
+			continue
+		}
+		if values {
+			c.visitValue(lst, val)
+		} else {
+			c.visitTime(lst, val)
+		}
+	}
+}
+
+func (c *Chunker) walkTimeRanges(rec []byte) {
+	if len(c.WalkTimeRanges) == 0 {
+		return
+	}
+	// rebuild rangeSyms
+	// (also when WalkTimeRanges has changed length)
+	if len(c.rangeSyms) != len(c.WalkTimeRanges) {
+		c.rangeSyms = c.symbolize(c.WalkTimeRanges, c.rangeSyms)
+	}
+	c.walkPaths(rec, c.rangeSyms, false)
+}
+
+func (c *Chunker) visitTime(lst []Symbol, val []byte) {
+	if TypeOf(val) == TimestampType {
+		c.addTime(lst, val)
+	}
+}
+
+func (c *Chunker) walkValueRanges(rec []byte) {
+	if len(c.WalkRanges) == 0 {
+		return
+	}
+	if len(c.valueSyms) != len(c.WalkRanges) {
+		c.valueSyms = c.symbolize(c.WalkRanges, c.valueSyms)
+	}
+	c.walkPaths(rec, c.valueSyms, true)
+}
+
+func (c *Chunker) visitValue(lst []Symbol, val []byte) {
+	// nulls (typed or untyped) never satisfy
+	// a comparison, so they don't have to be
+	// part of the range
+	if TypeOf(val) == NullType || val[0]&0x0f == 0x0f {
+		return
+	}
+	// d remains nil (which makes the range unusable)
+	// for values that can't be represented by the range
+	var d Datum
+	switch TypeOf(val) {
+	case TimestampType:
+		c.addTime(lst, val)
+		return
+	case IntType:
+		if i, _, err := ReadInt(val); err == nil {
+			d = Int(i)
+		}
+	case UintType:
+		if u, _, err := ReadUint(val); err == nil {
+			d = Uint(u)
+		}
+	case StringType:
+		if s, _, err := ReadString(val); err == nil {
+			d = String(s)
+		}
+	case SymbolType:
+		if sym, _, err := ReadSymbol(val); err == nil {
+			d = String(c.Symbols.Get(sym))
 		}
 	}
+	c.Ranges.AddDatum(c.symbuf(lst), d)
 }
 
 // seek through a record body and produce
@@ -674,13 +758,17 @@ func (c *Chunker) addTime(lst []Symbol, val []byte) {
 	if err != nil {
 		return
 	}
+	c.Ranges.AddTime(c.symbuf(lst), tm)
+}
+
+func (c *Chunker) symbuf(lst []Symbol) Symbuf {
 	var sb Symbuf
 	sb.Prepare(len(lst))
 	for i := range lst {
-		if lst[i] == Symbol(0xffffffff) {
-			panic("bad AddTime call")
+		if lst[i] == badSymbol {
+			panic("bad range path")
 		}
 		sb.Push(lst[i])
 	}
-	c.Ranges.AddTime(sb, tm)
+	return sb
 }
@@ -16,6 +16,7 @@ package ion
 
 import (
 	"encoding/binary"
+	"strings"
 
 	"github.com/SnellerInc/sneller/date"
 )
@@ -60,6 +61,8 @@ func (rs *Ranges) AddTime(p Symbuf, t date.Time) {
 		switch r := r.(type) {
 		case *timeRange:
 			r.add(t)
+		case *valueRange:
+			r.add(Timestamp(t))
 		}
 		return
 	}
@@ -69,6 +72,30 @@ func (rs *Ranges) AddTime(p Symbuf, t date.Time) {
 	rs.m[k] = r
 }
 
+// AddDatum adds an integer or string value to
+// the range tracker. A nil value, or a value that
+// is not comparable with the other values at the
+// same path, means that the path has no range
+// for the current chunk.
+func (rs *Ranges) AddDatum(p Symbuf, d Datum) {
+	if rs.m == nil {
+		rs.m = make(map[symstr]dataRange)
+	} else if r := rs.m[symstr(p)]; r != nil {
+		switch r := r.(type) {
+		case *timeRange:
+			r.mixed()
+		case *valueRange:
+			r.add(d)
+		}
+		return
+	}
+	k := symstr(p)
+	r := &valueRange{}
+	r.add(d)
+	rs.paths = append(rs.paths, k)
+	rs.m[k] = r
+}
+
 // commit is called after each object is added to
 // commit any uncommitted range values.
 func (rs *Ranges) commit() {
@@ -126,6 +153,8 @@ type timeRange struct {
 	hasRange   bool
 	pending    date.Time // uncommitted value
 	hasPending bool
+	// set when a non-timestamp value was added
+	bad, pendingBad bool
 }
 
 func newTimeRange(t date.Time) *timeRange {
@@ -136,13 +165,17 @@ func newTimeRange(t date.Time) *timeRange {
 }
 
 func (r *timeRange) ranges() (min, max Datum, ok bool) {
-	if r.hasRange {
+	if r.hasRange && !r.bad {
 		return Timestamp(r.min), Timestamp(r.max), true
 	}
 	return nil, nil, false
 }
 
 func (r *timeRange) commit() {
+	if r.pendingBad {
+		r.bad = true
+		r.pendingBad = false
+	}
 	if !r.hasPending {
 		return
 	}
@@ -160,7 +193,8 @@ func (r *timeRange) commit() {
 
 func (r *timeRange) flush() bool {
 	r.hasRange = false
-	return r.hasPending
+	r.bad = false
+	return r.hasPending || r.pendingBad
 }
 
 func (r *timeRange) add(t date.Time) {
@@ -168,6 +202,117 @@ func (r *timeRange) add(t date.Time) {
 	r.hasPending = true
 }
 
+func (r *timeRange) mixed() {
+	r.pendingBad = true
+}
+
+// valueRange is the range of a path
+// that holds integer or string values
+type valueRange struct {
+	min, max   Datum // committed range
+	pending    Datum // uncommitted value
+	hasPending bool
+	// set when a value that is not comparable
+	// with the rest of the range was added
+	bad, pendingBad bool
+}
+
+func (r *valueRange) ranges() (min, max Datum, ok bool) {
+	if r.min != nil && !r.bad {
+		return r.min, r.max, true
+	}
+	return nil, nil, false
+}
+
+func (r *valueRange) commit() {
+	if r.pendingBad {
+		r.bad = true
+		r.pendingBad = false
+	}
+	if !r.hasPending {
+		return
+	}
+	r.hasPending = false
+	if r.bad {
+		return
+	}
+	if r.min == nil {
+		r.min = r.pending
+		r.max = r.pending
+		return
+	}
+	lo, ok := compareValues(r.pending, r.min)
+	if !ok {
+		r.bad = true
+		return
+	}
+	hi, _ := compareValues(r.pending, r.max)
+	if lo < 0 {
+		r.min = r.pending
+	}
+	if hi > 0 {
+		r.max = r.pending
+	}
+}
+
+func (r *valueRange) flush() bool {
+	r.min, r.max = nil, nil
+	r.bad = false
+	return r.hasPending || r.pendingBad
+}
+
+func (r *valueRange) add(d Datum) {
+	switch d.(type) {
+	case Int, Uint, String:
+		r.pending = d
+		r.hasPending = true
+	default:
+		r.pendingBad = true
+	}
+}
+
+// compareValues compares two integer or string
+// values, or returns false if they are not comparable
+func compareValues(a, b Datum) (int, bool) {
+	switch a := a.(type) {
+	case Int:
+		switch b := b.(type) {
+		case Int:
+			return cmp3(a < b, a > b), true
+		case Uint:
+			if a < 0 {
+				return -1, true
+			}
+			return cmp3(Uint(a) < b, Uint(a) > b), true
+		}
+	case Uint:
+		switch b := b.(type) {
+		case Uint:
+			return cmp3(a < b, a > b), true
+		case Int:
+			if b < 0 {
+				return 1, true
+			}
+			return cmp3(a < Uint(b), a > Uint(b)), true
+		}
+	case String:
+		if b, ok := b.(String); ok {
+			return strings.Compare(string(a), string(b)), true
+		}
+	}
+	return 0, false
+}
+
+func cmp3(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
 // Symbuf is an encoded list of symtab indices.
 type Symbuf []byte
 
@@ -16,6 +16,7 @@ package ion
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -387,6 +388,16 @@ func ToJSON(w io.Writer, r *bufio.Reader) (int, error) {
 	return n, nil
 }
 
+// WriteJSON writes the ion datum at the beginning
+// of buf to w as JSON, using st to resolve symbols,
+// and returns the remaining bytes of buf.
+// The translation rules are the same as those of ToJSON.
+func WriteJSON(st *Symtab, w *bytes.Buffer, buf []byte) ([]byte, error) {
+	var s scratch
+	_, rest, err := toJSON(st, w, buf, &s)
+	return rest, err
+}
+
 // JSONWriter is an io.WriteCloser
 // that performs inline translation
 // of chunks of ion data into JSON objects.
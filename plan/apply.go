@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -63,12 +64,12 @@ func cannotCompile(e expr.Node) bool {
 	return o
 }
 
-func (a *Apply) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (a *Apply) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	app, err := vm.Apply(a.Funcs, dst)
 	if err != nil {
 		return err
 	}
-	return a.From.exec(app, parallel, stats)
+	return execOp(ctx, a.From, app, parallel, stats)
 }
 
 func (a *Apply) String() string {
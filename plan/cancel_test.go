@@ -0,0 +1,151 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/vm"
+)
+
+// endlessEnv produces a table that
+// never runs out of rows
+type endlessEnv struct {
+	chunk  []byte
+	opened chan struct{}
+	once   sync.Once
+}
+
+func (e *endlessEnv) Stat(_, _ expr.Node) (TableHandle, error) { return e, nil }
+
+func (e *endlessEnv) DecodeHandle(*ion.Symtab, []byte) (TableHandle, error) { return e, nil }
+
+func (e *endlessEnv) Encode(dst *ion.Buffer, st *ion.Symtab) error {
+	dst.WriteNull()
+	return nil
+}
+
+func (e *endlessEnv) Open() (vm.Table, error) { return e, nil }
+
+func (e *endlessEnv) Chunks() int { return -1 }
+
+func (e *endlessEnv) WriteChunks(dst vm.QuerySink, parallel int) error {
+	w, err := dst.Open()
+	if err != nil {
+		return err
+	}
+	e.once.Do(func() { close(e.opened) })
+	for {
+		_, err := w.Write(e.chunk)
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+}
+
+func newEndless() *endlessEnv {
+	var st ion.Symtab
+	var body ion.Buffer
+	for i := 0; i < 100; i++ {
+		body.BeginStruct(-1)
+		body.BeginField(st.Intern("x"))
+		body.WriteInt(int64(i))
+		body.EndStruct()
+	}
+	var buf ion.Buffer
+	st.Marshal(&buf, true)
+	buf.UnsafeAppend(body.Bytes())
+	return &endlessEnv{chunk: buf.Bytes(), opened: make(chan struct{})}
+}
+
+func endlessTree(t *testing.T, env Env) *Tree {
+	s, err := partiql.Parse([]byte(`SELECT COUNT(*) FROM endless`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := New(s, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestExecCancel(t *testing.T) {
+	env := newEndless()
+	tree := endlessTree(t, env)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		var stats ExecStats
+		errc <- ExecContext(ctx, tree, io.Discard, &stats)
+	}()
+	<-env.opened
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("query was not canceled")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	env := newEndless()
+	tree := endlessTree(t, env)
+	remote, local := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(remote, env)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		var stats ExecStats
+		cl := Client{Pipe: local}
+		errc <- cl.Exec(ctx, tree, nil, io.Discard, &stats)
+	}()
+	<-env.opened
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client was not canceled")
+	}
+	// the server should notice that the
+	// client hung up and stop the query
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server query was not canceled")
+	}
+}
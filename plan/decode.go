@@ -81,6 +81,18 @@ func Decode(d Decoder, st *ion.Symtab, buf []byte) (*Tree, error) {
 			if err != nil {
 				return nil, err
 			}
+		case "output":
+			out.OutputType, err = decodeResults(st, inner)
+			if err != nil {
+				return nil, err
+			}
+			inner = inner[ion.SizeOf(inner):]
+		case "limits":
+			err = out.Limits.decode(st, inner)
+			if err != nil {
+				return nil, fmt.Errorf("plan.Decode: %w", err)
+			}
+			inner = inner[ion.SizeOf(inner):]
 		case "children":
 			err = unpackList(inner, func(field []byte) error {
 				tt, err := Decode(d, st, field)
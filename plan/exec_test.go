@@ -17,6 +17,7 @@ package plan
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -232,7 +233,8 @@ func rowcount(t *testing.T, buf []byte) int {
 
 // partial produces a partial schema
 // from pairs of identifiers and type sets, i.e.
-//   partial("x", expr.UnsignedType, ...)
+//
+//	partial("x", expr.UnsignedType, ...)
 //
 // any references that are not part of the
 // schema are returned as AnyType rather than
@@ -1395,7 +1397,7 @@ func testRemoteEquivalent(t *testing.T, tree *Tree,
 
 	var stats ExecStats
 	c := Client{Pipe: funkyPipe{local}}
-	err := c.Exec(tree, nil, &buf, &stats)
+	err := c.Exec(context.Background(), tree, nil, &buf, &stats)
 	if err != nil {
 		t.Errorf("local error: %s", err)
 	}
@@ -1410,7 +1412,7 @@ func testRemoteEquivalent(t *testing.T, tree *Tree,
 	if remoteerr != nil {
 		t.Errorf("remote error: %s", remoteerr)
 	}
-	if stats != *wantstat {
+	if !reflect.DeepEqual(&stats, wantstat) {
 		t.Errorf("got stats %#v", &stats)
 		t.Errorf("wanted stats %#v", wantstat)
 	}
@@ -1480,7 +1482,7 @@ func testSplitEquivalent(t *testing.T, text string, e *testenv, expected []strin
 			t.Errorf("want: %#v", want)
 		}
 	}
-	if stat != *wantstat {
+	if !reflect.DeepEqual(&stat, wantstat) {
 		t.Errorf("got stats %#v", &stat)
 		t.Errorf("wanted stats %#v", wantstat)
 	}
@@ -1505,6 +1507,9 @@ func testPlanSerialize(t *testing.T, tree *Tree, env *testenv) {
 		t.Errorf("input : %s", str0)
 		t.Errorf("output: %s", str1)
 	}
+	if !reflect.DeepEqual(tree.OutputType, tree2.OutputType) {
+		t.Errorf("output type %v became %v", tree.OutputType, tree2.OutputType)
+	}
 }
 
 // test that server errors are correctly
@@ -1539,7 +1544,7 @@ func TestServerError(t *testing.T) {
 	cl := Client{Pipe: local}
 	var out bytes.Buffer
 	var stats ExecStats
-	err = cl.Exec(tree, nil, &out, &stats)
+	err = cl.Exec(context.Background(), tree, nil, &out, &stats)
 	if err == nil {
 		t.Fatal("no failure message?")
 	}
@@ -1554,7 +1559,7 @@ func TestServerError(t *testing.T) {
 	// the session is still ok
 	env.mustfail = ""
 	stats = ExecStats{}
-	err = cl.Exec(tree, nil, &out, &stats)
+	err = cl.Exec(context.Background(), tree, nil, &out, &stats)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"github.com/SnellerInc/sneller/expr"
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/vm"
@@ -37,9 +38,9 @@ func (f *Filter) rewrite(rw expr.Rewriter) {
 	f.Expr = expr.Rewrite(rw, f.Expr)
 }
 
-func (f *Filter) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (f *Filter) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	push(f.Expr, f.From)
-	return f.From.exec(vm.NewFilter(f.Expr, dst), parallel, stats)
+	return execOp(ctx, f.From, vm.NewFilter(f.Expr, dst), parallel, stats)
 }
 
 func (f *Filter) encode(dst *ion.Buffer, st *ion.Symtab) error {
@@ -0,0 +1,191 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// Limits are resource limits for the
+// execution of a query. A zero field
+// means that there is no limit.
+type Limits struct {
+	// MaxScanned is the maximum number
+	// of bytes that the query may scan.
+	MaxScanned int64
+	// MaxRows is the maximum number
+	// of rows that the query may output.
+	MaxRows int64
+	// MaxOutput is the maximum number of
+	// bytes of ion that the query may output.
+	MaxOutput int64
+}
+
+// IsZero returns true if l imposes no limits.
+func (l *Limits) IsZero() bool {
+	return l.MaxScanned == 0 && l.MaxRows == 0 && l.MaxOutput == 0
+}
+
+// LimitError is the error returned when
+// the execution of a query exceeds one
+// of its Limits.
+type LimitError struct {
+	// What is the name of the limit,
+	// e.g. "bytes scanned"
+	What string
+	// Limit is the value of the limit.
+	Limit int64
+}
+
+// limitPrefix begins the text of every LimitError
+const limitPrefix = "query limit exceeded: "
+
+func (l *LimitError) Error() string {
+	return fmt.Sprintf("%smore than %d %s", limitPrefix, l.Limit, l.What)
+}
+
+// LimitText returns the text of the LimitError
+// in the error text (which may wrap it), or the
+// empty string if there is no such error. Errors
+// from remote query execution only preserve
+// their text, so this is the only way of
+// recognizing them.
+func LimitText(text string) string {
+	if i := strings.Index(text, limitPrefix); i >= 0 {
+		return text[i:]
+	}
+	return ""
+}
+
+func (l *Limits) encode(dst *ion.Buffer, st *ion.Symtab) {
+	dst.BeginStruct(-1)
+	if l.MaxScanned != 0 {
+		dst.BeginField(st.Intern("max_scanned"))
+		dst.WriteInt(l.MaxScanned)
+	}
+	if l.MaxRows != 0 {
+		dst.BeginField(st.Intern("max_rows"))
+		dst.WriteInt(l.MaxRows)
+	}
+	if l.MaxOutput != 0 {
+		dst.BeginField(st.Intern("max_output"))
+		dst.WriteInt(l.MaxOutput)
+	}
+	dst.EndStruct()
+}
+
+func (l *Limits) decode(st *ion.Symtab, buf []byte) error {
+	if ion.TypeOf(buf) != ion.StructType {
+		return fmt.Errorf("plan.Decode: expected limits to be a struct; found %s", ion.TypeOf(buf))
+	}
+	inner, _ := ion.Contents(buf)
+	var sym ion.Symbol
+	var err error
+	for len(inner) > 0 {
+		sym, inner, err = ion.ReadLabel(inner)
+		if err != nil {
+			return err
+		}
+		var dst *int64
+		switch st.Get(sym) {
+		case "max_scanned":
+			dst = &l.MaxScanned
+		case "max_rows":
+			dst = &l.MaxRows
+		case "max_output":
+			dst = &l.MaxOutput
+		default:
+			inner = inner[ion.SizeOf(inner):]
+			continue
+		}
+		*dst, inner, err = ion.ReadInt(inner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanBudget is the number of bytes
+// that may still be scanned by the
+// query executing in a context
+type scanBudget struct {
+	max, used int64
+}
+
+type scanBudgetKey struct{}
+
+func withScanLimit(ctx context.Context, max int64) context.Context {
+	return context.WithValue(ctx, scanBudgetKey{}, &scanBudget{max: max})
+}
+
+func scanLimit(ctx context.Context) *scanBudget {
+	b, _ := ctx.Value(scanBudgetKey{}).(*scanBudget)
+	return b
+}
+
+// use accounts for n bytes scanned and returns
+// a LimitError if the budget is exhausted
+func (b *scanBudget) use(n int64) error {
+	if atomic.AddInt64(&b.used, n) > b.max {
+		return &LimitError{What: "bytes scanned", Limit: b.max}
+	}
+	return nil
+}
+
+// outputLimiter enforces Limits.MaxRows
+// and Limits.MaxOutput on the output of
+// a query; the caller serializes calls
+// to Write
+type outputLimiter struct {
+	dst           io.Writer
+	lim           *Limits
+	rows, written int64
+}
+
+func (o *outputLimiter) Write(p []byte) (int, error) {
+	o.written += int64(len(p))
+	if o.lim.MaxOutput > 0 && o.written > o.lim.MaxOutput {
+		return 0, &LimitError{What: "bytes of output", Limit: o.lim.MaxOutput}
+	}
+	if o.lim.MaxRows > 0 {
+		// each write is a sequence of complete rows,
+		// possibly preceded by symbol tables and padding
+		for rest := p; len(rest) > 0; {
+			if ion.IsBVM(rest) {
+				rest = rest[4:]
+				continue
+			}
+			size := ion.SizeOf(rest)
+			if size <= 0 || size > len(rest) {
+				break
+			}
+			if ion.TypeOf(rest) == ion.StructType {
+				o.rows++
+			}
+			rest = rest[size:]
+		}
+		if o.rows > o.lim.MaxRows {
+			return 0, &LimitError{What: "rows of output", Limit: o.lim.MaxRows}
+		}
+	}
+	return o.dst.Write(p)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+func TestLimits(t *testing.T) {
+	env := newEndless()
+	run := func(query string, lim Limits) error {
+		s, err := partiql.Parse([]byte(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := New(s, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Limits = lim
+		var stats ExecStats
+		return Exec(tree, io.Discard, &stats)
+	}
+	tcs := []struct {
+		query string
+		lim   Limits
+		what  string
+	}{
+		{`SELECT COUNT(*) FROM endless`, Limits{MaxScanned: 1 << 20}, "bytes scanned"},
+		{`SELECT x FROM endless`, Limits{MaxRows: 150}, "rows of output"},
+		{`SELECT x FROM endless`, Limits{MaxOutput: 1 << 16}, "bytes of output"},
+	}
+	for i := range tcs {
+		err := run(tcs[i].query, tcs[i].lim)
+		var le *LimitError
+		if !errors.As(err, &le) {
+			t.Fatalf("%s: expected a LimitError; got %v", tcs[i].query, err)
+		}
+		if le.What != tcs[i].what {
+			t.Errorf("%s: limit %q exceeded; expected %q", tcs[i].query, le.What, tcs[i].what)
+		}
+		wrapped := fmt.Errorf("plan.Client: %w", err)
+		if text := LimitText(wrapped.Error()); text != err.Error() {
+			t.Errorf("LimitText(%q) = %q", wrapped.Error(), text)
+		}
+	}
+}
+
+func TestLimitsEncode(t *testing.T) {
+	env := newEndless()
+	tree := endlessTree(t, env)
+	tree.Limits = Limits{MaxScanned: 1000, MaxRows: 10}
+	var st ion.Symtab
+	var buf ion.Buffer
+	if err := tree.Encode(&buf, &st); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode(env, &st, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Limits, tree.Limits) {
+		t.Fatalf("got limits %+v, expected %+v", out.Limits, tree.Limits)
+	}
+}
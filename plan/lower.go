@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/plan/pir"
 	"github.com/SnellerInc/sneller/vm"
 )
@@ -240,11 +241,15 @@ func lowerUnionMap(in *pir.UnionMap, env Env, split Splitter) (Op, error) {
 	if tbls.Len() == 0 {
 		return NoOutput{}, nil
 	}
-	return &UnionMap{
+	um := &UnionMap{
 		Nonterminal: Nonterminal{From: sub},
 		Orig:        in.Inner.Table,
 		Sub:         tbls,
-	}, nil
+	}
+	if sp, ok := split.(Speculator); ok {
+		um.Speculate = sp.Speculate()
+	}
+	return um, nil
 }
 
 // doSplit calls s.Split(tbl, th) with special handling
@@ -380,7 +385,23 @@ func toTree(in *pir.Trace, env Env, split Splitter) (*Tree, error) {
 }
 
 // New creates a new Tree from raw query AST.
+//
+// If env implements Policer, the policies
+// of the referenced tables are applied to q
+// before it is planned.
 func New(q *expr.Query, env Env) (*Tree, error) {
+	applied, err := ApplyPolicies(q, env)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTree(q, env)
+	if err != nil && applied {
+		err = redactPolicyError(err)
+	}
+	return t, err
+}
+
+func newTree(q *expr.Query, env Env) (*Tree, error) {
 	bld, err := pir.Build(q, env)
 	if err != nil {
 		return nil, err
@@ -390,6 +411,18 @@ func New(q *expr.Query, env Env) (*Tree, error) {
 
 // NewSplit creates a new Tree from raw query AST.
 func NewSplit(q *expr.Query, env Env, split Splitter) (*Tree, error) {
+	applied, err := ApplyPolicies(q, env)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newSplitTree(q, env, split)
+	if err != nil && applied {
+		err = redactPolicyError(err)
+	}
+	return t, err
+}
+
+func newSplitTree(q *expr.Query, env Env, split Splitter) (*Tree, error) {
 	b, err := pir.Build(q, env)
 	if err != nil {
 		return nil, err
@@ -400,3 +433,41 @@ func NewSplit(q *expr.Query, env Env, split Splitter) (*Tree, error) {
 	}
 	return toTree(reduce, env, split)
 }
+
+func (r ResultSet) encode(dst *ion.Buffer, st *ion.Symtab) {
+	dst.BeginList(-1)
+	for i := range r {
+		dst.BeginStruct(-1)
+		dst.BeginField(st.Intern("name"))
+		dst.WriteString(r[i].Name)
+		dst.BeginField(st.Intern("type"))
+		dst.WriteUint(uint64(r[i].Type))
+		dst.EndStruct()
+	}
+	dst.EndList()
+}
+
+func decodeResults(st *ion.Symtab, buf []byte) (ResultSet, error) {
+	var out ResultSet
+	err := unpackList(buf, func(item []byte) error {
+		var r Result
+		_, err := ion.UnpackStruct(st, item, func(name string, field []byte) error {
+			var err error
+			switch name {
+			case "name":
+				r.Name, _, err = ion.ReadString(field)
+			case "type":
+				var u uint64
+				u, _, err = ion.ReadUint(field)
+				r.Type = expr.TypeSet(u)
+			}
+			return err
+		})
+		out = append(out, r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("plan.Decode: decoding output: %w", err)
+	}
+	return out, nil
+}
@@ -173,12 +173,28 @@ type TableLister interface {
 	ListTables(db string) ([]string, error)
 }
 
+// TableAuthorizer is an interface a TableLister
+// can optionally implement to restrict the tables
+// that TABLE_GLOB and TABLE_PATTERN expressions
+// may expand to. Tables that are not allowed
+// are treated as if they did not exist.
+type TableAuthorizer interface {
+	// AllowTable returns whether the table
+	// may be accessed. The db argument is
+	// the same one passed to ListTables.
+	AllowTable(db, table string) bool
+}
+
 func statGlob(tl TableLister, e *expr.Builtin, flt expr.Node) (TableHandle, error) {
 	db, m, err := compileGlob(e)
 	if err != nil {
 		return nil, err
 	}
+	ta, _ := tl.(TableAuthorizer)
 	if m, ok := m.(literalMatcher); ok {
+		if ta != nil && !ta.AllowTable(db, string(m)) {
+			return nil, fs.ErrNotExist
+		}
 		return statTable(tl, db, string(m), flt)
 	}
 	list, err := tl.ListTables(db)
@@ -190,6 +206,9 @@ func statGlob(tl TableLister, e *expr.Builtin, flt expr.Node) (TableHandle, erro
 		if !m.MatchString(list[i]) {
 			continue
 		}
+		if ta != nil && !ta.AllowTable(db, list[i]) {
+			continue
+		}
 		th, err := statTable(tl, db, list[i], flt)
 		if errors.Is(err, fs.ErrNotExist) {
 			continue
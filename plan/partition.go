@@ -16,6 +16,7 @@ package plan
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -186,6 +187,16 @@ type Splitter interface {
 	Split(expr.Node, TableHandle) (Subtables, error)
 }
 
+// Speculator is an optional interface
+// implemented by a Splitter to enable
+// speculative execution of subqueries.
+// See UnionMap.Speculate.
+type Speculator interface {
+	// Speculate returns the value
+	// for UnionMap.Speculate.
+	Speculate() float64
+}
+
 type frame uint32
 
 type framekind uint32
@@ -206,6 +217,11 @@ const (
 	framedata // output query data
 	frameerr  // query encountered an error
 	framefin  // no more query data
+
+	// client-to-server frame identical
+	// to framestart, except that the
+	// query is traced (see ExecStats.Trace)
+	frametrace
 )
 
 func (f frame) kind() framekind {
@@ -323,7 +339,7 @@ func (s *server) serve() error {
 			}
 			return err
 		}
-		if f.kind() != framestart {
+		if f.kind() != framestart && f.kind() != frametrace {
 			s.senderr("unexpected frame")
 			return fmt.Errorf("received unexpected frame %x", f)
 		}
@@ -332,18 +348,43 @@ func (s *server) serve() error {
 			s.senderr(err.Error())
 			return fmt.Errorf("reading start frame: %w", err)
 		}
-		err = s.runQuery(buf)
+		ctx, cancel := context.WithCancel(context.Background())
+		hangup := s.watch(cancel)
+		err = s.runQuery(ctx, buf, f.kind() == frametrace)
 		if err != nil {
 			s.senderr(err.Error())
 			// note: we don't close the connection here;
 			// we let the client tear down the connection
 		}
+		// the client doesn't send anything until
+		// it has received the result of the query,
+		// so we can just wait for the next frame here
+		<-hangup
+		cancel()
 		if s.writeFail {
 			return nil
 		}
 	}
 }
 
+// watch calls cancel if the client hangs up
+// while a query is running; the returned channel
+// is closed once the next frame or EOF is available
+//
+// Client.Exec closes the connection when its
+// context is canceled, so this is how cancellation
+// propagates from the client to the server.
+func (s *server) watch(cancel func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.rd.Peek(framesize); err != nil {
+			cancel()
+		}
+	}()
+	return done
+}
+
 // Write implements io.Writer (passed to Exec);
 func (s *server) Write(buf []byte) (int, error) {
 	if len(buf) > maxframe {
@@ -404,7 +445,7 @@ func (s *server) fin(stat *ExecStats) error {
 	return err
 }
 
-func (s *server) runQuery(buf []byte) error {
+func (s *server) runQuery(ctx context.Context, buf []byte, trace bool) error {
 	s.st.Reset()
 	var err error
 	var t *Tree
@@ -417,8 +458,8 @@ func (s *server) runQuery(buf []byte) error {
 	if err != nil {
 		return err
 	}
-	var stat ExecStats
-	err = Exec(t, s, &stat)
+	stat := ExecStats{Trace: trace}
+	err = ExecContext(ctx, t, s, &stat)
 	if err != nil {
 		return err
 	}
@@ -431,7 +472,6 @@ func (s *server) runQuery(buf []byte) error {
 // A Client can be constructed simply by
 // declaring a zero-value Client and then
 // assigning the Pipe field to the desired connection.
-//
 type Client struct {
 	// Pipe is the connection to the
 	// remote query environment.
@@ -462,17 +502,40 @@ type TableRewrite func(*expr.Table, TableHandle) (*expr.Table, TableHandle)
 // Exec executes a query across the client connection.
 // Exec implements Transport.Exec.
 //
+// If ctx is canceled before the query completes,
+// Exec closes c.Pipe, which causes the remote
+// query to be canceled as well.
+//
 // Exec is *not* safe to call from multiple goroutines
 // simultaneously.
-func (c *Client) Exec(t *Tree, rw TableRewrite, dst io.Writer, stat *ExecStats) error {
+func (c *Client) Exec(ctx context.Context, t *Tree, rw TableRewrite, dst io.Writer, stat *ExecStats) error {
 	c.st.Reset()
 	c.iob.Reset()
 	c.valid = 0
-	err := c.send(t, rw)
-	if err != nil {
-		return err
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func(pipe io.Closer) {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				pipe.Close()
+			case <-stop:
+			}
+		}(c.Pipe)
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+	err := c.send(t, rw, stat.Trace)
+	if err == nil {
+		err = c.copyout(dst, stat)
+	}
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("plan.Client.Exec: %w", ctx.Err())
 	}
-	return c.copyout(dst, stat)
+	return err
 }
 
 // Close closes c.Pipe
@@ -480,7 +543,7 @@ func (c *Client) Close() error {
 	return c.Pipe.Close()
 }
 
-func (c *Client) send(t *Tree, rw TableRewrite) error {
+func (c *Client) send(t *Tree, rw TableRewrite, trace bool) error {
 	err := t.EncodePart(&c.iob, &c.st, rw)
 	if err != nil {
 		return fmt.Errorf("plan.Client.Exec: encoding plan: %w", err)
@@ -496,7 +559,11 @@ func (c *Client) send(t *Tree, rw TableRewrite) error {
 	}
 	first := c.iob.Bytes()[stpos:]
 	second := c.iob.Bytes()[:stpos]
-	mkframe(framestart, c.iob.Size()-framesize).put(first)
+	kind := framestart
+	if trace {
+		kind = frametrace
+	}
+	mkframe(kind, c.iob.Size()-framesize).put(first)
 	_, err = c.Pipe.Write(first)
 	if err != nil {
 		return err
@@ -581,9 +648,17 @@ func (c *Client) queryerr(size int) error {
 	if err != nil {
 		return err
 	}
-	return errors.New(bld.String())
+	return remoteError(bld.String())
 }
 
+// remoteError is an error produced by
+// executing a query on the remote end
+// (as opposed to an error communicating
+// with the remote end)
+type remoteError string
+
+func (r remoteError) Error() string { return string(r) }
+
 func (c *Client) decodestat(stat *ExecStats, size int) error {
 	var tmp ExecStats
 	buf, err := c.buffer(size)
@@ -595,6 +670,7 @@ func (c *Client) decodestat(stat *ExecStats, size int) error {
 		return err
 	}
 	stat.atomicAdd(&tmp)
+	stat.addOps(tmp.Ops)
 	return nil
 }
 
@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync/atomic"
@@ -46,7 +47,7 @@ type Op interface {
 
 	// exec executes the op into 'dst'
 	// using the given parallelism
-	exec(dst vm.QuerySink, parallel int, stat *ExecStats) error
+	exec(ctx context.Context, dst vm.QuerySink, parallel int, stat *ExecStats) error
 
 	// encode should write the op as an ion structure
 	// to 'dst'; the first field of the structure
@@ -207,12 +208,12 @@ func (s *SimpleAggregate) String() string {
 	return "AGGREGATE " + s.Outputs.String()
 }
 
-func (s *SimpleAggregate) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (s *SimpleAggregate) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	a, err := vm.NewAggregate(s.Outputs, dst)
 	if err != nil {
 		return err
 	}
-	return s.From.exec(a, parallel, stats)
+	return execOp(ctx, s.From, a, parallel, stats)
 }
 
 func settype(name string, dst *ion.Buffer, st *ion.Symtab) {
@@ -259,7 +260,7 @@ func (l *Leaf) rewrite(rw expr.Rewriter) {
 	l.Expr.Expr = expr.Rewrite(rw, l.Expr.Expr)
 }
 
-func (l *Leaf) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (l *Leaf) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	if l.Handle == nil {
 		panic("nope!")
 	}
@@ -267,7 +268,7 @@ func (l *Leaf) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	if err != nil {
 		return err
 	}
-	tr := track(dst)
+	tr := track(ctx, dst)
 	err = tbl.WriteChunks(tr, parallel)
 	err2 := dst.Close()
 	if err == nil {
@@ -342,7 +343,7 @@ func (n NoOutput) setinput(o Op) {
 	panic("NoOutput: cannot setinput()")
 }
 
-func (n NoOutput) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (n NoOutput) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	w, err := dst.Open()
 	if err != nil {
 		return err
@@ -385,7 +386,7 @@ func (n DummyOutput) setinput(o Op) {
 	panic("DummyOutput: cannot setinput()")
 }
 
-func (n DummyOutput) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (n DummyOutput) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	w, err := dst.Open()
 	if err != nil {
 		return err
@@ -433,8 +434,8 @@ func (l *Limit) String() string {
 	return fmt.Sprintf("LIMIT %d", l.Num)
 }
 
-func (l *Limit) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
-	return l.From.exec(vm.NewLimit(l.Num, dst), parallel, stats)
+func (l *Limit) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
+	return execOp(ctx, l.From, vm.NewLimit(l.Num, dst), parallel, stats)
 }
 
 func (l *Limit) encode(dst *ion.Buffer, st *ion.Symtab) error {
@@ -475,9 +476,9 @@ func (c *CountStar) String() string {
 	return "COUNT(*) AS " + c.name()
 }
 
-func (c *CountStar) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (c *CountStar) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	var qs vm.Count
-	err := c.From.exec(&qs, parallel, stats)
+	err := execOp(ctx, c.From, &qs, parallel, stats)
 	if err != nil {
 		return err
 	}
@@ -659,7 +660,7 @@ func (h *HashAggregate) setfield(d Decoder, name string, st *ion.Symtab, buf []b
 	return nil
 }
 
-func (h *HashAggregate) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (h *HashAggregate) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	ha, err := vm.NewHashAggregate(h.Agg, h.By, dst)
 	if err != nil {
 		return err
@@ -676,7 +677,7 @@ func (h *HashAggregate) exec(dst vm.QuerySink, parallel int, stats *ExecStats) e
 		}
 	}
 
-	return h.From.exec(ha, parallel, stats)
+	return execOp(ctx, h.From, ha, parallel, stats)
 }
 
 // OrderByColumn represents a single column and its sorting settings in an ORDER BY clause.
@@ -732,7 +733,7 @@ func (o *OrderBy) String() string {
 	return s
 }
 
-func (o *OrderBy) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (o *OrderBy) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	writer, err := dst.Open()
 	if err != nil {
 		return err
@@ -771,7 +772,7 @@ func (o *OrderBy) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
 
 	sorter := vm.NewOrder(writer, orderBy, limit, parallel)
 
-	return o.From.exec(sorter, parallel, stats)
+	return execOp(ctx, o.From, sorter, parallel, stats)
 }
 
 func (o *OrderBy) encode(dst *ion.Buffer, st *ion.Symtab) error {
@@ -856,7 +857,7 @@ func (d *Distinct) rewrite(rw expr.Rewriter) {
 	}
 }
 
-func (d *Distinct) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (d *Distinct) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	df, err := vm.NewDistinct(d.Fields, dst)
 	if err != nil {
 		return err
@@ -864,7 +865,7 @@ func (d *Distinct) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error
 	if d.Limit > 0 {
 		df.Limit(d.Limit)
 	}
-	return d.From.exec(df, parallel, stats)
+	return execOp(ctx, d.From, df, parallel, stats)
 }
 
 func (d *Distinct) encode(dst *ion.Buffer, st *ion.Symtab) error {
@@ -969,6 +970,14 @@ func (t *Tree) EncodePart(dst *ion.Buffer, st *ion.Symtab, rw TableRewrite) erro
 		}
 		dst.EndList()
 	}
+	if len(t.OutputType) > 0 {
+		dst.BeginField(st.Intern("output"))
+		t.OutputType.encode(dst, st)
+	}
+	if !t.Limits.IsZero() {
+		dst.BeginField(st.Intern("limits"))
+		t.Limits.encode(dst, st)
+	}
 	dst.BeginField(st.Intern("op"))
 	dst.BeginList(-1)
 	err := encoderec(t.Op, dst, st, rw)
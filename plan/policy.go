@@ -0,0 +1,580 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// Policy is a row filter and a set of
+// column masks that applies to every
+// reference to a table in a query.
+type Policy struct {
+	// Filter, if non-nil, is a predicate
+	// that rows of the table must satisfy
+	// in order to be visible to the query.
+	Filter expr.Node
+	// Mask is the list of paths that are
+	// replaced with masked values.
+	Mask []Mask
+}
+
+// Mask replaces the value of a path.
+type Mask struct {
+	// Path is the masked path,
+	// relative to the rows of the table.
+	Path *expr.Path
+	// Expr is the expression that replaces
+	// Path. Paths in Expr (including Path itself)
+	// refer to the unmasked row.
+	Expr expr.Node
+}
+
+// Policer is an interface an Env can optionally
+// implement to apply access policies to the
+// tables referenced in a query.
+//
+// Policies are applied before a query is
+// planned, so they cannot be bypassed with
+// sub-queries or CTEs. References to masked
+// paths are replaced with the masking expression
+// (so masked values cannot be recovered with
+// WHERE, GROUP BY, etc.), and references that
+// would expose a masked path indirectly
+// (SELECT *, or a path that contains a masked path)
+// are rejected.
+type Policer interface {
+	// Policy returns the policy of
+	// the table tbl, or nil if no policy
+	// applies to it.
+	Policy(tbl expr.Node) (*Policy, error)
+}
+
+// ParsePolicy builds a Policy from a PartiQL
+// filter expression and a map from the
+// textual representation of paths to PartiQL
+// masking expressions. Either argument may be empty.
+func ParsePolicy(filter string, mask map[string]string) (*Policy, error) {
+	p := &Policy{}
+	if filter != "" {
+		q, err := partiql.Parse([]byte("SELECT * FROM t WHERE " + filter))
+		if err != nil {
+			return nil, fmt.Errorf("policy filter %q: %w", filter, err)
+		}
+		p.Filter = q.Body.(*expr.Select).Where
+	}
+	paths := make([]string, 0, len(mask))
+	for k := range mask {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	for _, str := range paths {
+		e, err := parseColumn(str)
+		if err != nil {
+			return nil, fmt.Errorf("policy mask path %q: %w", str, err)
+		}
+		path, ok := e.(*expr.Path)
+		if !ok {
+			return nil, fmt.Errorf("policy mask path %q is not a path", str)
+		}
+		for c := path.Rest; c != nil; c = c.Next() {
+			if _, ok := c.(expr.Star); ok {
+				return nil, fmt.Errorf("policy mask path %q: wildcards not supported", str)
+			}
+		}
+		e, err = parseColumn(mask[str])
+		if err != nil {
+			return nil, fmt.Errorf("policy mask of %q: %w", str, err)
+		}
+		p.Mask = append(p.Mask, Mask{Path: path, Expr: e})
+	}
+	return p, nil
+}
+
+func parseColumn(str string) (expr.Node, error) {
+	q, err := partiql.Parse([]byte("SELECT " + str + " FROM t"))
+	if err != nil {
+		return nil, err
+	}
+	s := q.Body.(*expr.Select)
+	if len(s.Columns) != 1 {
+		return nil, fmt.Errorf("expected one expression")
+	}
+	return s.Columns[0].Expr, nil
+}
+
+// Merge returns a policy that applies
+// both p and o: rows must satisfy both
+// filters, and the masks of both policies
+// are applied. If both policies mask
+// the same path, the mask in p is used.
+func (p *Policy) Merge(o *Policy) *Policy {
+	if p == nil {
+		return o
+	}
+	if o == nil {
+		return p
+	}
+	out := &Policy{Filter: p.Filter}
+	if o.Filter != nil {
+		if out.Filter == nil {
+			out.Filter = o.Filter
+		} else {
+			out.Filter = expr.And(out.Filter, o.Filter)
+		}
+	}
+	out.Mask = append(out.Mask, p.Mask...)
+outer:
+	for i := range o.Mask {
+		for j := range p.Mask {
+			if p.Mask[j].Path.Equals(o.Mask[i].Path) {
+				continue outer
+			}
+		}
+		out.Mask = append(out.Mask, o.Mask[i])
+	}
+	return out
+}
+
+// String returns a textual representation
+// of the policy that is suitable for hashing.
+func (p *Policy) String() string {
+	var sb strings.Builder
+	if p.Filter != nil {
+		sb.WriteString("WHERE ")
+		sb.WriteString(expr.ToString(p.Filter))
+	}
+	for i := range p.Mask {
+		sb.WriteString(" MASK ")
+		sb.WriteString(expr.ToString(p.Mask[i].Path))
+		sb.WriteString(" AS ")
+		sb.WriteString(expr.ToString(p.Mask[i].Expr))
+	}
+	return sb.String()
+}
+
+// ApplyPolicies applies the policies supplied
+// by env (if it is a Policer) to every SELECT in q
+// and returns whether any policy was applied.
+//
+// New and NewSplit call ApplyPolicies themselves;
+// it is only necessary to call it directly in order
+// to inspect a query the way it will be planned.
+func ApplyPolicies(q *expr.Query, env Env) (bool, error) {
+	pe, ok := env.(Policer)
+	if !ok {
+		return false, nil
+	}
+	var sels []*expr.Select
+	var collect visitfn
+	collect = func(e expr.Node) expr.Visitor {
+		if s, ok := e.(*expr.Select); ok {
+			sels = append(sels, s)
+		}
+		return collect
+	}
+	for i := range q.With {
+		expr.Walk(collect, q.With[i].As)
+	}
+	expr.Walk(collect, q.Body)
+	applied := false
+	for _, s := range sels {
+		ok, err := applyPolicy(pe, env, q.With, s)
+		if err != nil {
+			return applied, err
+		}
+		applied = applied || ok
+	}
+	return applied, nil
+}
+
+// redactPolicyError strips the text of
+// expressions out of an error produced while
+// planning a query to which a policy was applied,
+// since they may include parts of the policy
+// (e.g. a salt supplied to HASH)
+func redactPolicyError(err error) error {
+	var te *expr.TypeError
+	if errors.As(err, &te) && te.At != nil {
+		return &expr.SyntaxError{
+			Msg: fmt.Sprintf("%q is ill-typed: %s", expr.ToRedacted(te.At), te.Msg),
+		}
+	}
+	var se *expr.SyntaxError
+	if errors.As(err, &se) && se.At != nil {
+		return &expr.SyntaxError{
+			Msg: fmt.Sprintf("%q %s", expr.ToRedacted(se.At), se.Msg),
+		}
+	}
+	return err
+}
+
+// fromTable returns the table at the
+// root of a FROM clause
+func fromTable(f expr.From) *expr.Table {
+	for {
+		switch t := f.(type) {
+		case *expr.Table:
+			return t
+		case *expr.Join:
+			f = t.Left
+		default:
+			return nil
+		}
+	}
+}
+
+// policyOf returns the policy of tbl
+func policyOf(pe Policer, env Env, with []expr.CTE, tbl expr.Node) (*Policy, error) {
+	for i := range with {
+		if expr.IsIdentifier(tbl, with[i].Table) {
+			return nil, nil
+		}
+	}
+	var tables []expr.Node
+	switch e := tbl.(type) {
+	case *expr.Select:
+		// the sub-query has its own policy applied
+		return nil, nil
+	case *expr.Appended:
+		tables = e.Values
+	case *expr.Builtin:
+		if e.Func != expr.TableGlob && e.Func != expr.TablePattern {
+			break
+		}
+		tl, ok := env.(TableLister)
+		if !ok {
+			return nil, nil
+		}
+		db, m, err := compileGlob(e)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := m.(literalMatcher); ok {
+			return pe.Policy(tablePath(db, string(m)))
+		}
+		list, err := tl.ListTables(db)
+		if err != nil {
+			return nil, err
+		}
+		ta, _ := tl.(TableAuthorizer)
+		for i := range list {
+			if !m.MatchString(list[i]) || (ta != nil && !ta.AllowTable(db, list[i])) {
+				continue
+			}
+			tables = append(tables, tablePath(db, list[i]))
+		}
+	default:
+		return pe.Policy(tbl)
+	}
+	// policies are not supported for
+	// tables that are combined with others
+	for i := range tables {
+		p, err := policyOf(pe, env, with, tables[i])
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return nil, &expr.SyntaxError{
+				At:  tbl,
+				Msg: fmt.Sprintf("cannot be used with table %s, which has an access policy", expr.ToString(tables[i])),
+			}
+		}
+	}
+	return nil, nil
+}
+
+func tablePath(db, name string) *expr.Path {
+	if db != "" {
+		return &expr.Path{First: db, Rest: &expr.Dot{Field: name}}
+	}
+	return &expr.Path{First: name}
+}
+
+// applyPolicy applies the policy of the table
+// in the FROM clause of s to s
+func applyPolicy(pe Policer, env Env, with []expr.CTE, s *expr.Select) (bool, error) {
+	tbl := fromTable(s.From)
+	if tbl == nil {
+		return false, nil
+	}
+	p, err := policyOf(pe, env, with, tbl.Expr)
+	if p == nil || err != nil {
+		return false, err
+	}
+	m := &masker{policy: p}
+	if tbl.Explicit() {
+		m.bind = tbl.Result()
+	}
+	if len(p.Mask) > 0 {
+		for i := range s.Columns {
+			if _, ok := s.Columns[i].Expr.(expr.Star); ok {
+				return false, &expr.SyntaxError{
+					At:  tbl.Expr,
+					Msg: "has masked columns; SELECT * is not allowed",
+				}
+			}
+		}
+		if j, ok := s.From.(*expr.Join); ok {
+			m.rewriteJoin(j)
+		}
+		for i := range s.Columns {
+			m.rewriteBinding(&s.Columns[i])
+		}
+		s.Where = expr.Rewrite(m, s.Where)
+		for i := range s.GroupBy {
+			m.rewriteBinding(&s.GroupBy[i])
+		}
+		s.Having = expr.Rewrite(m, s.Having)
+		for i := range s.OrderBy {
+			s.OrderBy[i].Column = expr.Rewrite(m, s.OrderBy[i].Column)
+		}
+		if m.err != nil {
+			return false, m.err
+		}
+	}
+	if p.Filter != nil {
+		f, err := m.qualify(p.Filter)
+		if err != nil {
+			return false, err
+		}
+		if s.Where == nil {
+			s.Where = f
+		} else {
+			s.Where = expr.And(f, s.Where)
+		}
+	}
+	return true, nil
+}
+
+// masker is an expr.Rewriter that replaces
+// references to masked paths
+type masker struct {
+	policy *Policy
+	// bind is the explicit binding
+	// of the table, if any; references
+	// to the table must be qualified with it
+	bind string
+	// parent is the masker of the
+	// enclosing query, if any
+	parent *masker
+	err    error
+}
+
+func (m *masker) fail(err error) {
+	for m.parent != nil {
+		m = m.parent
+	}
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *masker) rewriteJoin(j *expr.Join) {
+	for {
+		j.On = expr.Rewrite(m, j.On)
+		m.rewriteBinding(&j.Right)
+		next, ok := j.Left.(*expr.Join)
+		if !ok {
+			return
+		}
+		j = next
+	}
+}
+
+// rewriteBinding rewrites b while
+// preserving the name of its result
+func (m *masker) rewriteBinding(b *expr.Binding) {
+	name := b.Result()
+	e := expr.Rewrite(m, b.Expr)
+	if e != b.Expr {
+		b.Expr = e
+		if !b.Explicit() && name != "" {
+			b.As(name)
+		}
+	}
+}
+
+func (m *masker) Walk(e expr.Node) expr.Rewriter {
+	s, ok := e.(*expr.Select)
+	if !ok {
+		return m
+	}
+	// a sub-query can only refer to
+	// the table through its binding
+	if m.bind == "" {
+		return nil
+	}
+	if t := fromTable(s.From); t != nil && t.Explicit() && t.Result() == m.bind {
+		return nil // binding is shadowed
+	}
+	for i := range s.Columns {
+		s.Columns[i].Result()
+	}
+	for i := range s.GroupBy {
+		s.GroupBy[i].Result()
+	}
+	return &masker{policy: m.policy, bind: m.bind, parent: m}
+}
+
+func (m *masker) Rewrite(e expr.Node) expr.Node {
+	if p, ok := e.(*expr.Path); ok {
+		return m.path(p)
+	}
+	return e
+}
+
+// components returns the path components
+// of p relative to the rows of the table,
+// or ok=false if p does not refer to the table
+func (m *masker) components(p *expr.Path) (lst []expr.PathComponent, whole, ok bool) {
+	var rest expr.PathComponent
+	switch {
+	case m.bind == "":
+		lst = append(lst, &expr.Dot{Field: p.First})
+		rest = p.Rest
+	case p.First == m.bind:
+		if p.Rest == nil {
+			return nil, true, true
+		}
+		rest = p.Rest
+	default:
+		return nil, false, false
+	}
+	for c := rest; c != nil; c = c.Next() {
+		lst = append(lst, c)
+	}
+	return lst, false, true
+}
+
+func (m *masker) path(p *expr.Path) expr.Node {
+	ref, whole, ok := m.components(p)
+	if !ok {
+		return p
+	}
+	for i := range m.policy.Mask {
+		mask := &m.policy.Mask[i]
+		if whole {
+			m.conflict(p, mask.Path)
+			return p
+		}
+		switch matchMask(ref, mask.Path) {
+		case maskNone:
+			continue
+		case maskExact:
+			e, err := m.qualify(mask.Expr)
+			if err != nil {
+				m.fail(err)
+				return p
+			}
+			return e
+		case maskInner:
+			return expr.Missing{}
+		case maskConflict:
+			m.conflict(p, mask.Path)
+			return p
+		}
+	}
+	return p
+}
+
+func (m *masker) conflict(p, masked *expr.Path) {
+	m.fail(&expr.SyntaxError{
+		At:  p,
+		Msg: fmt.Sprintf("cannot be referenced because it contains the masked path %s", expr.ToString(masked)),
+	})
+}
+
+const (
+	maskNone     = iota // unrelated paths
+	maskExact           // reference to the masked path
+	maskInner           // reference to a path within the masked path
+	maskConflict        // reference to a path that contains the masked path
+)
+
+// matchMask determines how the path
+// components in ref relate to mask
+func matchMask(ref []expr.PathComponent, mask *expr.Path) int {
+	masked := []expr.PathComponent{&expr.Dot{Field: mask.First}}
+	for c := mask.Rest; c != nil; c = c.Next() {
+		masked = append(masked, c)
+	}
+	wildcard := false
+	for i := range ref {
+		if i == len(masked) {
+			return maskInner
+		}
+		if _, ok := ref[i].(expr.Star); ok {
+			wildcard = true
+			continue
+		}
+		if !samecomponent(ref[i], masked[i]) {
+			return maskNone
+		}
+	}
+	if len(ref) == len(masked) && !wildcard {
+		return maskExact
+	}
+	return maskConflict
+}
+
+func samecomponent(a, b expr.PathComponent) bool {
+	switch a := a.(type) {
+	case *expr.Dot:
+		b, ok := b.(*expr.Dot)
+		return ok && a.Field == b.Field
+	case *expr.LiteralIndex:
+		b, ok := b.(*expr.LiteralIndex)
+		return ok && a.Field == b.Field
+	}
+	return false
+}
+
+// qualify returns a copy of e with
+// paths qualified with m.bind
+func (m *masker) qualify(e expr.Node) (expr.Node, error) {
+	var dst ion.Buffer
+	var st ion.Symtab
+	e.Encode(&dst, &st)
+	e, _, err := expr.Decode(&st, dst.Bytes())
+	if err != nil || m.bind == "" {
+		return e, err
+	}
+	return expr.Rewrite(qualifier(m.bind), e), nil
+}
+
+type qualifier string
+
+func (q qualifier) Walk(e expr.Node) expr.Rewriter {
+	if _, ok := e.(*expr.Select); ok {
+		return nil
+	}
+	return q
+}
+
+func (q qualifier) Rewrite(e expr.Node) expr.Node {
+	p, ok := e.(*expr.Path)
+	if !ok {
+		return e
+	}
+	return &expr.Path{First: string(q), Rest: &expr.Dot{Field: p.First, Rest: p.Rest}}
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// policyEnv is a testenv with named
+// JSON tables and their policies
+type policyEnv struct {
+	testenv
+	tables   map[string]string
+	policies map[string]*Policy
+}
+
+func (p *policyEnv) Stat(tbl, filter expr.Node) (TableHandle, error) {
+	if id, ok := tbl.(*expr.Path); ok && p.tables[id.First] != "" {
+		return str2json(expr.String(p.tables[id.First]))
+	}
+	return p.testenv.Stat(tbl, filter)
+}
+
+func (p *policyEnv) Policy(tbl expr.Node) (*Policy, error) {
+	if id, ok := tbl.(*expr.Path); ok {
+		return p.policies[id.First], nil
+	}
+	return nil, nil
+}
+
+func TestPolicy(t *testing.T) {
+	tickets := strings.Join([]string{
+		`{"id": 1, "org": "acme", "customer": {"email": "alice@acme.com", "name": "Alice"}}`,
+		`{"id": 2, "org": "acme", "customer": {"email": "bob@acme.com", "name": "Bob"}}`,
+		`{"id": 3, "org": "acme", "customer": {"email": "alice@acme.com", "name": "Alice"}}`,
+		`{"id": 4, "org": "other", "customer": {"email": "carol@other.com", "name": "Carol"}}`,
+	}, "\n")
+	orgs := `{"org": "acme", "id": 1} {"org": "other", "id": 4}`
+	pol, err := ParsePolicy("org = 'acme'", map[string]string{
+		"customer.email": "'redacted'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed, err := ParsePolicy("", map[string]string{
+		"customer.email": "HASH('salt', customer.email)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &policyEnv{
+		testenv: testenv{t: t},
+		tables: map[string]string{
+			"tickets": tickets,
+			"hashed":  tickets,
+			"orgs":    orgs,
+		},
+		policies: map[string]*Policy{
+			"tickets": pol,
+			"hashed":  hashed,
+		},
+	}
+	testcases := []struct {
+		query string
+		want  []string
+		err   string
+	}{
+		{
+			query: "SELECT id, customer.email FROM tickets ORDER BY id LIMIT 10",
+			want: []string{
+				`{"id": 1, "email": "redacted"}`,
+				`{"id": 2, "email": "redacted"}`,
+				`{"id": 3, "email": "redacted"}`,
+			},
+		},
+		{
+			query: "SELECT x.id, x.customer.email AS e, x.customer.name AS n FROM tickets AS x WHERE x.id = 2",
+			want:  []string{`{"id": 2, "e": "redacted", "n": "Bob"}`},
+		},
+		{
+			query: "SELECT x.customer.name AS n FROM tickets AS x WHERE x.customer.email = 'redacted' AND x.id = 1",
+			want:  []string{`{"n": "Alice"}`},
+		},
+		{
+			query: "SELECT COUNT(*) FROM tickets",
+			want:  []string{`{"count": 3}`},
+		},
+		{
+			// predicates only see the masked value
+			query: "SELECT COUNT(*) FROM tickets WHERE customer.email LIKE 'alice%'",
+			want:  []string{`{"count": 0}`},
+		},
+		{
+			query: "SELECT customer.email, COUNT(*) FROM tickets GROUP BY customer.email",
+			want:  []string{`{"email": "redacted", "count": 3}`},
+		},
+		{
+			// the row filter applies to sub-queries
+			query: "SELECT COUNT(*) FROM orgs WHERE id IN (SELECT id FROM tickets LIMIT 10)",
+			want:  []string{`{"count": 1}`},
+		},
+		{
+			// hashed values can still be correlated
+			query: "SELECT COUNT(*) FROM hashed GROUP BY customer.email ORDER BY COUNT(*) DESC LIMIT 1",
+			want:  []string{`{"count": 2}`},
+		},
+		{
+			query: "SELECT COUNT(*) FROM hashed WHERE customer.email = HASH('alice@acme.com')",
+			want:  []string{`{"count": 0}`},
+		},
+		{
+			query: "SELECT * FROM tickets",
+			err:   "SELECT * is not allowed",
+		},
+		{
+			query: "SELECT customer FROM tickets",
+			err:   "masked path customer.email",
+		},
+		{
+			query: "SELECT x FROM tickets AS x",
+			err:   "masked path customer.email",
+		},
+		{
+			query: "SELECT (SELECT x.customer FROM orgs) AS c FROM tickets AS x",
+			err:   "masked path customer.email",
+		},
+		{
+			query: "WITH t AS (SELECT * FROM tickets) SELECT id FROM t",
+			err:   "SELECT * is not allowed",
+		},
+		{
+			// the error must not reveal the salt
+			query: "SELECT COUNT(*) FROM hashed WHERE customer.email = 'alice@acme.com'",
+			err:   "is ill-typed",
+		},
+	}
+	for i := range testcases {
+		tc := &testcases[i]
+		q, err := partiql.Parse([]byte(tc.query))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		tree, err := New(q, env)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) || strings.Contains(err.Error(), "salt") {
+				t.Errorf("%s: got error %v, wanted %q", tc.query, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.query, err)
+			continue
+		}
+		var out bytes.Buffer
+		var stat ExecStats
+		if err := Exec(tree, &out, &stat); err != nil {
+			t.Errorf("%s: %s", tc.query, err)
+			continue
+		}
+		var got []string
+		var st ion.Symtab
+		rows := out.Bytes()
+		for len(rows) > 0 {
+			var d ion.Datum
+			d, rows, err = ion.ReadDatum(&st, rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d == nil {
+				continue
+			}
+			var buf ion.Buffer
+			d.Encode(&buf, &st)
+			got = append(got, strings.TrimSpace(buf2json(&st, &buf)))
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: got %q, wanted %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	a, err := ParsePolicy("org = 'acme'", map[string]string{"email": "NULL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParsePolicy("region = 'eu'", map[string]string{"email": "HASH(email)", "phone": "NULL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.Merge(b).String()
+	want := "WHERE org = 'acme' AND region = 'eu' MASK email AS NULL MASK phone AS NULL"
+	if got != want {
+		t.Errorf("got  %s", got)
+		t.Errorf("want %s", want)
+	}
+	if _, err := ParsePolicy("", map[string]string{"a[*]": "NULL"}); err == nil {
+		t.Error("expected an error for a wildcard path")
+	}
+	if _, err := ParsePolicy("", map[string]string{"UPPER(a)": "NULL"}); err == nil {
+		t.Error("expected an error for a non-path mask")
+	}
+}
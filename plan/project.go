@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"strings"
 
 	"github.com/SnellerInc/sneller/expr"
@@ -36,8 +37,8 @@ func (p *Project) rewrite(rw expr.Rewriter) {
 	}
 }
 
-func (p *Project) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
-	return p.From.exec(vm.NewProjection(vm.Selection(p.Using), dst), parallel, stats)
+func (p *Project) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
+	return execOp(ctx, p.From, vm.NewProjection(vm.Selection(p.Using), dst), parallel, stats)
 }
 
 func (p *Project) encode(dst *ion.Buffer, st *ion.Symtab) error {
@@ -0,0 +1,288 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRetryBuffer is the number of bytes of output
+// buffered for each subquery of a UnionMap;
+// a subquery that fails before producing more
+// output than this can be re-executed without
+// duplicating any of its output
+const maxRetryBuffer = 16 << 20
+
+// minSpeculate is the minimum amount of time
+// a subquery runs before it is speculatively
+// re-executed
+const minSpeculate = time.Second
+
+// errLost is returned to an execution of
+// a subquery once a different execution
+// of the same subquery has been chosen
+var errLost = errors.New("plan: subquery superseded by another execution")
+
+// retryable returns true if a subquery that
+// failed with err may succeed on a different
+// Transport; errors produced by the query
+// itself (rather than by the Transport) would
+// just happen again
+func retryable(ctx context.Context, err error) bool {
+	var re remoteError
+	var le *LimitError
+	return ctx.Err() == nil &&
+		!errors.As(err, &re) &&
+		!errors.As(err, &le) &&
+		!errors.Is(err, io.EOF)
+}
+
+// stragglers determines when a subquery
+// has taken long enough relative to the
+// other subqueries of a UnionMap that it
+// ought to be speculatively re-executed
+type stragglers struct {
+	lock     sync.Mutex
+	start    time.Time
+	factor   float64
+	want     int
+	times    []time.Duration
+	deadline time.Time
+	ready    chan struct{} // closed once deadline is set
+}
+
+func newStragglers(n int, factor float64) *stragglers {
+	if factor <= 0 || n < 2 {
+		return nil
+	}
+	return &stragglers{
+		start:  time.Now(),
+		factor: factor,
+		want:   (n + 1) / 2,
+		ready:  make(chan struct{}),
+	}
+}
+
+// done records that a subquery completed;
+// once half of the subqueries have completed,
+// the deadline for the rest is set
+func (s *stragglers) done() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.times = append(s.times, time.Since(s.start))
+	if len(s.times) != s.want {
+		return
+	}
+	sort.Slice(s.times, func(i, j int) bool { return s.times[i] < s.times[j] })
+	wait := time.Duration(float64(s.times[len(s.times)/2]) * s.factor)
+	if wait < minSpeculate {
+		wait = minSpeculate
+	}
+	s.deadline = s.start.Add(wait)
+	close(s.ready)
+}
+
+func (s *stragglers) wait() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.ready
+}
+
+// subquery manages the executions
+// of one subquery of a UnionMap
+type subquery struct {
+	dst   io.Writer
+	stub  *Tree
+	rw    TableRewrite
+	trace bool
+	strag *stragglers
+
+	lock sync.Mutex
+	// chosen is the execution whose
+	// output has been written to dst
+	chosen *execution
+}
+
+// execution is one execution of a subquery;
+// it buffers its output until it is chosen
+type execution struct {
+	parent *subquery
+	cancel context.CancelFunc
+	stats  ExecStats
+	buf    [][]byte
+	size   int
+}
+
+func (e *execution) Write(p []byte) (int, error) {
+	s := e.parent
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.chosen == e {
+		return s.dst.Write(p)
+	}
+	if s.chosen != nil {
+		return 0, errLost
+	}
+	if e.size+len(p) <= maxRetryBuffer {
+		e.buf = append(e.buf, append([]byte(nil), p...))
+		e.size += len(p)
+		return len(p), nil
+	}
+	// this execution has produced too much
+	// output to buffer, so it can no longer
+	// be replaced by a different execution
+	if err := s.choose(e); err != nil {
+		return 0, err
+	}
+	return s.dst.Write(p)
+}
+
+// choose writes the buffered output of e to
+// s.dst; the caller must hold s.lock
+func (s *subquery) choose(e *execution) error {
+	s.chosen = e
+	buf := e.buf
+	e.buf = nil
+	for i := range buf {
+		if _, err := s.dst.Write(buf[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish chooses e (if no other execution has been
+// chosen) and reports whether e was chosen
+func (s *subquery) finish(e *execution) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.chosen == e {
+		return true, nil
+	}
+	if s.chosen != nil {
+		return false, nil
+	}
+	return true, s.choose(e)
+}
+
+// replaceable returns true if no output
+// has been written to s.dst yet
+func (s *subquery) replaceable() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.chosen == nil
+}
+
+type result struct {
+	exec *execution
+	err  error
+}
+
+// run executes the subquery using tp; if tp fails
+// or (with speculation enabled) takes too long,
+// the subquery is re-executed locally
+func (s *subquery) run(ctx context.Context, tp Transport, stats *ExecStats) error {
+	_, local := tp.(*LocalTransport)
+	results := make(chan result, 2)
+	var execs []*execution
+	start := func(tp Transport) {
+		ectx, cancel := context.WithCancel(ctx)
+		e := &execution{parent: s, cancel: cancel}
+		e.stats.Trace = s.trace
+		execs = append(execs, e)
+		go func() {
+			results <- result{exec: e, err: tp.Exec(ectx, s.stub, s.rw, e, &e.stats)}
+		}()
+	}
+	defer func() {
+		for i := range execs {
+			execs[i].cancel()
+		}
+	}()
+
+	start(tp)
+	running := 1
+	var ready <-chan struct{}
+	if !local {
+		ready = s.strag.wait()
+	}
+	var timer *time.Timer
+	var expired <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	var err error
+	for running > 0 {
+		select {
+		case <-ready:
+			ready = nil
+			timer = time.NewTimer(time.Until(s.strag.deadline))
+			expired = timer.C
+		case <-expired:
+			expired = nil
+			if len(execs) == 1 && s.replaceable() {
+				start(&LocalTransport{})
+				running++
+				atomic.AddInt64(&stats.Speculative, 1)
+			}
+		case r := <-results:
+			running--
+			if r.err == nil {
+				ok, werr := s.finish(r.exec)
+				if werr != nil && !errors.Is(werr, io.EOF) {
+					// (io.EOF means that no more
+					// output is needed, e.g. for LIMIT)
+					return werr
+				}
+				if !ok {
+					// the other execution was already
+					// chosen; its result is what matters
+					continue
+				}
+				s.strag.done()
+				stats.atomicAdd(&r.exec.stats)
+				stats.addOps(r.exec.stats.Ops)
+				return nil
+			}
+			if errors.Is(r.err, errLost) {
+				continue
+			}
+			if !s.replaceable() {
+				// some of the output of the failed
+				// execution has already been used
+				return r.err
+			}
+			err = r.err
+			if running == 0 && len(execs) == 1 && !local && retryable(ctx, err) {
+				start(&LocalTransport{})
+				running++
+				atomic.AddInt64(&stats.Retries, 1)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// flakyTransport executes queries locally,
+// optionally after a delay, and then fails
+// with err after producing all of its output
+type flakyTransport struct {
+	delay time.Duration
+	err   error
+}
+
+func (f *flakyTransport) Exec(ctx context.Context, t *Tree, rw TableRewrite, dst io.Writer, stats *ExecStats) error {
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := (&LocalTransport{}).Exec(ctx, t, rw, dst, stats)
+	if err == nil {
+		err = f.err
+	}
+	return err
+}
+
+// listSplitter splits a table into one
+// subtable for each of its transports
+type listSplitter struct {
+	tps       []Transport
+	speculate float64
+}
+
+func (l *listSplitter) Split(t expr.Node, th TableHandle) (Subtables, error) {
+	var lst SubtableList
+	for i := range l.tps {
+		lst = append(lst, Subtable{
+			Transport: l.tps[i],
+			Table: &expr.Table{
+				Binding: expr.Bind(t, fmt.Sprintf("part.%d", i)),
+			},
+			Handle: th,
+		})
+	}
+	return lst, nil
+}
+
+func (l *listSplitter) Speculate() float64 { return l.speculate }
+
+func TestSplitRetry(t *testing.T) {
+	env := &testenv{t: t}
+	// testenv is not safe to open
+	// from multiple goroutines
+	env.get("../testdata/nyc-taxi.block")
+	run := func(split *listSplitter) (ExecStats, error) {
+		s, err := partiql.Parse([]byte(`SELECT COUNT(*) FROM 'nyc-taxi.block'`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := NewSplit(s, env, split)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		var stats ExecStats
+		err = Exec(tree, &out, &stats)
+		if err != nil {
+			return stats, err
+		}
+		var st ion.Symtab
+		row, _, err := ion.ReadDatum(&st, out.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ion.FromJSON(&st, json.NewDecoder(strings.NewReader(countmsg(8560*len(split.tps)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, want) {
+			t.Errorf("got %#v, want %#v", row, want)
+		}
+		return stats, nil
+	}
+
+	// a Transport failure is retried locally,
+	// and the output of the failed execution
+	// is discarded
+	stats, err := run(&listSplitter{tps: []Transport{
+		&LocalTransport{},
+		&flakyTransport{err: errors.New("connection reset by peer")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Retries != 1 || stats.Speculative != 0 {
+		t.Errorf("%d retries, %d speculative", stats.Retries, stats.Speculative)
+	}
+
+	// a query error is not retried
+	_, err = run(&listSplitter{tps: []Transport{
+		&LocalTransport{},
+		&flakyTransport{err: remoteError("query failed")},
+	}})
+	if err == nil || err.Error() != "query failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// a straggler is re-executed speculatively
+	start := time.Now()
+	stats, err = run(&listSplitter{
+		tps: []Transport{
+			&LocalTransport{},
+			&LocalTransport{},
+			&flakyTransport{delay: time.Minute},
+		},
+		speculate: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("query took %s", elapsed)
+	}
+	if stats.Retries != 0 || stats.Speculative != 1 {
+		t.Errorf("%d retries, %d speculative", stats.Retries, stats.Speculative)
+	}
+}
@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"runtime"
@@ -27,7 +28,15 @@ import (
 // Exec executes a plan and writes the
 // results of the query execution to dst.
 func Exec(t *Tree, dst io.Writer, stats *ExecStats) error {
-	return (&LocalTransport{}).Exec(t, nil, dst, stats)
+	return ExecContext(context.Background(), t, dst, stats)
+}
+
+// ExecContext is identical to Exec, except that
+// execution stops as soon as possible once ctx
+// is canceled, in which case ExecContext returns
+// an error wrapping ctx.Err().
+func ExecContext(ctx context.Context, t *Tree, dst io.Writer, stats *ExecStats) error {
+	return (&LocalTransport{}).Exec(ctx, t, nil, dst, stats)
 }
 
 // LocalTransport is a Transport
@@ -51,7 +60,13 @@ func (l *LocalTransport) Encode(dst *ion.Buffer, st *ion.Symtab) {
 }
 
 // Exec implements Transport.Exec
-func (l *LocalTransport) Exec(t *Tree, rw TableRewrite, dst io.Writer, stats *ExecStats) error {
+func (l *LocalTransport) Exec(ctx context.Context, t *Tree, rw TableRewrite, dst io.Writer, stats *ExecStats) error {
+	if t.Limits.MaxScanned > 0 {
+		ctx = withScanLimit(ctx, t.Limits.MaxScanned)
+	}
+	if t.Limits.MaxRows > 0 || t.Limits.MaxOutput > 0 {
+		dst = &outputLimiter{dst: dst, lim: &t.Limits}
+	}
 	s := vm.LockedSink(dst)
 	parallel := l.Threads
 	if parallel <= 0 {
@@ -64,7 +79,14 @@ func (l *LocalTransport) Exec(t *Tree, rw TableRewrite, dst io.Writer, stats *Ex
 			return err
 		}
 	}
-	return t.exec(s, parallel, stats)
+	if stats.Trace {
+		tr := newTracer(t)
+		ctx = context.WithValue(ctx, tracerKey{}, tr)
+		defer func() {
+			stats.addOps(tr.finish())
+		}()
+	}
+	return t.exec(ctx, s, parallel, stats)
 }
 
 type wrappedHandle int
@@ -137,5 +159,11 @@ type Transport interface {
 	// The TableRewrite provided to Exec, if non-nil,
 	// determines how table expressions are re-written
 	// before they are provided to Transport.
-	Exec(t *Tree, rw TableRewrite, dst io.Writer, stats *ExecStats) error
+	//
+	// Implementations should stop executing the
+	// query promptly once ctx is canceled.
+	//
+	// If stats.Trace is set, implementations
+	// should add per-op statistics for t to stats.Ops.
+	Exec(ctx context.Context, t *Tree, rw TableRewrite, dst io.Writer, stats *ExecStats) error
 }
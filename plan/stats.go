@@ -15,9 +15,11 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync/atomic"
+	"time"
 
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/SnellerInc/sneller/vm"
@@ -39,6 +41,48 @@ type ExecStats struct {
 	// BytesScanned is the number
 	// of bytes scanned.
 	BytesScanned int64
+	// Retries is the number of subqueries
+	// that were re-executed locally after
+	// their Transport failed.
+	Retries int64
+	// Speculative is the number of straggling
+	// subqueries that were speculatively
+	// re-executed locally.
+	// See also: UnionMap.Speculate.
+	Speculative int64
+
+	// Trace, if set before the query
+	// is executed, causes per-op statistics
+	// to be collected into Ops.
+	Trace bool
+	// Ops is the list of per-op statistics,
+	// ordered by Tree and then Index.
+	Ops []OpStats
+}
+
+// OpStats is a collection of statistics
+// for a single Op in a query plan.
+type OpStats struct {
+	// Tree is the position of the Tree
+	// containing the op in a pre-order
+	// traversal of the query plan (so
+	// the outermost Tree is 0).
+	Tree int
+	// Index is the position of the op
+	// in its Tree in execution order
+	// (so the table scan is 0).
+	Index int
+	// Op is the text of the op
+	// as it appears in Tree.String.
+	Op string
+	// RowsIn and RowsOut are the number
+	// of rows consumed and produced by the op.
+	RowsIn, RowsOut int64
+	// Time is the time spent in the op,
+	// summed across all of the threads
+	// that executed it. Time is not tracked
+	// for table scans.
+	Time time.Duration
 }
 
 // CachedTable is an interface optionally
@@ -57,6 +101,8 @@ func (e *ExecStats) atomicAdd(tmp *ExecStats) {
 	atomic.AddInt64(&e.CacheHits, tmp.CacheHits)
 	atomic.AddInt64(&e.CacheMisses, tmp.CacheMisses)
 	atomic.AddInt64(&e.BytesScanned, tmp.BytesScanned)
+	atomic.AddInt64(&e.Retries, tmp.Retries)
+	atomic.AddInt64(&e.Speculative, tmp.Speculative)
 }
 
 func (e *ExecStats) observe(table vm.Table) {
@@ -68,16 +114,23 @@ func (e *ExecStats) observe(table vm.Table) {
 	atomic.AddInt64(&e.CacheMisses, ct.Misses())
 }
 
-func track(into vm.QuerySink) *bytesTracker {
-	return &bytesTracker{into: into}
+func track(ctx context.Context, into vm.QuerySink) *bytesTracker {
+	return &bytesTracker{ctx: ctx, into: into, budget: scanLimit(ctx)}
 }
 
 // bytesTracker is a vm.QuerySink
 // that tracks the number of bytes
 // processed by the QuerySink
+//
+// bytesTracker also stops the scan
+// once ctx is canceled or the scan
+// budget (if any) is exhausted by
+// failing the next call to Write
 type bytesTracker struct {
+	ctx     context.Context
 	into    vm.QuerySink
 	scanned int64
+	budget  *scanBudget
 }
 
 type writeTracker struct {
@@ -97,6 +150,14 @@ func (b *bytesTracker) Open() (io.WriteCloser, error) {
 }
 
 func (w *writeTracker) Write(p []byte) (int, error) {
+	if err := w.parent.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("query canceled: %w", err)
+	}
+	if b := w.parent.budget; b != nil {
+		if err := b.use(int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
 	n, err := w.w.Write(p)
 	// NOTE: we're considering every byte
 	// passed to Write as scanned, because
@@ -136,9 +197,102 @@ func (e *ExecStats) Encode(dst *ion.Buffer, st *ion.Symtab) {
 		dst.BeginField(st.Intern("scanned"))
 		dst.WriteInt(e.BytesScanned)
 	}
+	if e.Retries != 0 {
+		dst.BeginField(st.Intern("retries"))
+		dst.WriteInt(e.Retries)
+	}
+	if e.Speculative != 0 {
+		dst.BeginField(st.Intern("speculative"))
+		dst.WriteInt(e.Speculative)
+	}
+	if len(e.Ops) > 0 {
+		dst.BeginField(st.Intern("ops"))
+		dst.BeginList(-1)
+		for i := range e.Ops {
+			e.Ops[i].encode(dst, st)
+		}
+		dst.EndList()
+	}
+	dst.EndStruct()
+}
+
+func (o *OpStats) encode(dst *ion.Buffer, st *ion.Symtab) {
+	dst.BeginStruct(-1)
+	dst.BeginField(st.Intern("tree"))
+	dst.WriteInt(int64(o.Tree))
+	dst.BeginField(st.Intern("index"))
+	dst.WriteInt(int64(o.Index))
+	dst.BeginField(st.Intern("op"))
+	dst.WriteString(o.Op)
+	dst.BeginField(st.Intern("in"))
+	dst.WriteInt(o.RowsIn)
+	dst.BeginField(st.Intern("out"))
+	dst.WriteInt(o.RowsOut)
+	dst.BeginField(st.Intern("time"))
+	dst.WriteInt(int64(o.Time))
 	dst.EndStruct()
 }
 
+func (o *OpStats) decode(buf []byte, st *ion.Symtab) error {
+	if ion.TypeOf(buf) != ion.StructType {
+		return fmt.Errorf("plan.OpStats.decode: unexpected ion type %s", ion.TypeOf(buf))
+	}
+	inner, _ := ion.Contents(buf)
+	if inner == nil {
+		return fmt.Errorf("plan.OpStats.decode: invalid TLV bytes")
+	}
+	var err error
+	var sym ion.Symbol
+	var i int64
+	for len(inner) > 0 {
+		sym, inner, err = ion.ReadLabel(inner)
+		if err != nil {
+			return err
+		}
+		switch st.Get(sym) {
+		case "tree":
+			i, inner, err = ion.ReadInt(inner)
+			o.Tree = int(i)
+		case "index":
+			i, inner, err = ion.ReadInt(inner)
+			o.Index = int(i)
+		case "op":
+			o.Op, inner, err = ion.ReadString(inner)
+		case "in":
+			o.RowsIn, inner, err = ion.ReadInt(inner)
+		case "out":
+			o.RowsOut, inner, err = ion.ReadInt(inner)
+		case "time":
+			i, inner, err = ion.ReadInt(inner)
+			o.Time = time.Duration(i)
+		default:
+			inner = inner[ion.SizeOf(inner):]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addOps adds the statistics in ops
+// to the statistics for the same ops in e
+func (e *ExecStats) addOps(ops []OpStats) {
+outer:
+	for i := range ops {
+		for j := range e.Ops {
+			o := &e.Ops[j]
+			if o.Tree == ops[i].Tree && o.Index == ops[i].Index {
+				o.RowsIn += ops[i].RowsIn
+				o.RowsOut += ops[i].RowsOut
+				o.Time += ops[i].Time
+				continue outer
+			}
+		}
+		e.Ops = append(e.Ops, ops[i])
+	}
+}
+
 func (e *ExecStats) Decode(buf []byte, st *ion.Symtab) error {
 	if len(buf) == 0 {
 		return fmt.Errorf("plan.ExecStats cannot be 0 encoded bytes")
@@ -164,6 +318,20 @@ func (e *ExecStats) Decode(buf []byte, st *ion.Symtab) error {
 			e.CacheMisses, inner, err = ion.ReadInt(inner)
 		case "scanned":
 			e.BytesScanned, inner, err = ion.ReadInt(inner)
+		case "retries":
+			e.Retries, inner, err = ion.ReadInt(inner)
+		case "speculative":
+			e.Speculative, inner, err = ion.ReadInt(inner)
+		case "ops":
+			e.Ops = e.Ops[:0]
+			inner, err = ion.UnpackList(inner, func(item []byte) error {
+				var o OpStats
+				if err := o.decode(item, st); err != nil {
+					return err
+				}
+				e.Ops = append(e.Ops, o)
+				return nil
+			})
 		default:
 			inner = inner[ion.SizeOf(inner):]
 		}
@@ -188,6 +356,15 @@ func init() {
 		"hits",
 		"misses",
 		"scanned",
+		"ops",
+		"tree",
+		"index",
+		"op",
+		"in",
+		"out",
+		"time",
+		"retries",
+		"speculative",
 	} {
 		statsSymtab.Intern(s)
 	}
@@ -0,0 +1,154 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/vm"
+)
+
+// tracer collects per-op statistics
+// for one execution of a Tree
+//
+// The ops are numbered by Tree in pre-order
+// and then by position in execution order,
+// so the ops in each Tree are contiguous.
+type tracer struct {
+	slots map[Op]int
+	ops   []OpStats
+	local []vm.TraceStats
+
+	// statistics from sub-queries
+	// executed through a Transport
+	lock   sync.Mutex
+	remote []OpStats
+}
+
+type tracerKey struct{}
+
+func newTracer(t *Tree) *tracer {
+	tr := &tracer{slots: make(map[Op]int)}
+	tr.walk(t)
+	tr.local = make([]vm.TraceStats, len(tr.ops))
+	tr.remote = make([]OpStats, len(tr.ops))
+	return tr
+}
+
+func (tr *tracer) walk(t *Tree) {
+	tree := 0
+	if len(tr.ops) > 0 {
+		tree = tr.ops[len(tr.ops)-1].Tree + 1
+	}
+	var chain []Op
+	for op := t.Op; op != nil; op = op.input() {
+		chain = append(chain, op)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		op := chain[i]
+		if _, ok := tr.slots[op]; ok {
+			// ops without any state (e.g. NoOutput)
+			// can't be told apart, so don't track them
+			tr.slots[op] = -1
+		} else {
+			tr.slots[op] = len(tr.ops)
+		}
+		tr.ops = append(tr.ops, OpStats{
+			Tree:  tree,
+			Index: len(chain) - 1 - i,
+			Op:    op.String(),
+		})
+	}
+	for i := range t.Children {
+		tr.walk(t.Children[i])
+	}
+}
+
+func tracing(ctx context.Context) *tracer {
+	tr, _ := ctx.Value(tracerKey{}).(*tracer)
+	return tr
+}
+
+// execOp executes op into dst, recording
+// the rows produced by op if the query
+// is being traced
+func execOp(ctx context.Context, op Op, dst vm.QuerySink, parallel int, stats *ExecStats) error {
+	if tr := tracing(ctx); tr != nil {
+		if i, ok := tr.slots[op]; ok && i >= 0 {
+			dst = vm.Trace(dst, &tr.local[i])
+		}
+	}
+	return op.exec(ctx, dst, parallel, stats)
+}
+
+// merge adds the statistics from executing
+// the input of u through a Transport
+func (tr *tracer) merge(u *UnionMap, ops []OpStats) {
+	i, ok := tr.slots[u]
+	if !ok || i < 0 {
+		return
+	}
+	base := i - tr.ops[i].Index
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	for j := range ops {
+		// the input of u is executed as
+		// a Tree with no children, so its
+		// ops are at the same positions
+		k := base + ops[j].Index
+		if ops[j].Tree != 0 || k >= i {
+			continue
+		}
+		r := &tr.remote[k]
+		r.RowsIn += ops[j].RowsIn
+		r.RowsOut += ops[j].RowsOut
+		r.Time += ops[j].Time
+		if k == i-1 {
+			// the output of the sub-query
+			// is the input of u
+			tr.remote[i].RowsIn += ops[j].RowsOut
+		}
+	}
+}
+
+// finish computes the final statistics;
+// each traced op records the rows it
+// produced and the time spent in the
+// ops that consumed them, so the time
+// spent in an op is the difference
+// between that of its input and its own
+func (tr *tracer) finish() []OpStats {
+	out := make([]OpStats, len(tr.ops))
+	for i := range tr.ops {
+		o := tr.ops[i]
+		local := &tr.local[i]
+		o.RowsOut = local.Rows + tr.remote[i].RowsOut
+		o.RowsIn = tr.remote[i].RowsIn
+		o.Time = tr.remote[i].Time
+		if o.Index == 0 {
+			o.RowsIn += local.Rows
+		} else {
+			in := &tr.local[i-1]
+			o.RowsIn += in.Rows
+			if d := in.Nanos - local.Nanos; d > 0 {
+				o.Time += time.Duration(d)
+			}
+		}
+		out[i] = o
+	}
+	return out
+}
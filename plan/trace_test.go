@@ -0,0 +1,157 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+)
+
+func TestTrace(t *testing.T) {
+	env := &testenv{t: t}
+	// planning modifies the query,
+	// so each test needs a fresh copy
+	parse := func(t *testing.T) *expr.Query {
+		q, err := partiql.Parse([]byte(`SELECT COUNT(*) FROM 'parking.10n' WHERE Make IS MISSING`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	const parkingRows = 1023
+
+	// check that each op has the expected
+	// number of output rows and that the
+	// input of each op is the output of
+	// the previous op
+	check := func(t *testing.T, tree *Tree, ops []OpStats, out []int64) {
+		t.Helper()
+		if len(ops) != len(out) {
+			t.Fatalf("got %d ops, expected %d", len(ops), len(out))
+		}
+		for i := range ops {
+			if ops[i].Tree != 0 || ops[i].Index != i {
+				t.Errorf("op %d at tree %d index %d", i, ops[i].Tree, ops[i].Index)
+			}
+			if ops[i].RowsOut != out[i] {
+				t.Errorf("op %q: %d rows out, expected %d", ops[i].Op, ops[i].RowsOut, out[i])
+			}
+			in := ops[i].RowsOut
+			if i > 0 {
+				in = ops[i-1].RowsOut
+			}
+			if ops[i].RowsIn != in {
+				t.Errorf("op %q: %d rows in, expected %d", ops[i].Op, ops[i].RowsIn, in)
+			}
+		}
+		if t.Failed() {
+			t.Logf("plan:\n%s", tree)
+		}
+	}
+
+	t.Run("local", func(t *testing.T) {
+		tree, err := New(parse(t), env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := ExecStats{Trace: true}
+		var out bytes.Buffer
+		if err := Exec(tree, &out, &stat); err != nil {
+			t.Fatal(err)
+		}
+		// scan, filter, count
+		check(t, tree, stat.Ops, []int64{parkingRows, 4, 1})
+	})
+	t.Run("split", func(t *testing.T) {
+		tree, err := NewSplit(parse(t), env, nopSplitter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := ExecStats{Trace: true}
+		var out bytes.Buffer
+		if err := Exec(tree, &out, &stat); err != nil {
+			t.Fatal(err)
+		}
+		// scan, filter, count, union map, sum
+		check(t, tree, stat.Ops, []int64{parkingRows, 4, 1, 1, 1})
+	})
+	t.Run("remote", func(t *testing.T) {
+		tree, err := New(parse(t), env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, remote := net.Pipe()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Serve(remote, env)
+		}()
+		c := Client{Pipe: local}
+		stat := ExecStats{Trace: true}
+		var out bytes.Buffer
+		err = c.Exec(context.Background(), tree, nil, &out, &stat)
+		c.Close()
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, tree, stat.Ops, []int64{parkingRows, 4, 1})
+	})
+	t.Run("untraced", func(t *testing.T) {
+		tree, err := New(parse(t), env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stat ExecStats
+		var out bytes.Buffer
+		if err := Exec(tree, &out, &stat); err != nil {
+			t.Fatal(err)
+		}
+		if len(stat.Ops) != 0 {
+			t.Errorf("got %d ops without tracing", len(stat.Ops))
+		}
+	})
+}
+
+func TestOpStatsEncode(t *testing.T) {
+	stat := ExecStats{
+		CacheHits:    1,
+		BytesScanned: 1000,
+		Ops: []OpStats{
+			{Tree: 0, Index: 0, Op: "'table'", RowsIn: 100, RowsOut: 100},
+			{Tree: 0, Index: 1, Op: "WHERE x = 1", RowsIn: 100, RowsOut: 3, Time: 12345},
+			{Tree: 1, Index: 0, Op: "'other'", RowsIn: 5, RowsOut: 5},
+		},
+	}
+	var buf ion.Buffer
+	stat.Marshal(&buf)
+	var out ExecStats
+	if err := out.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&out, &stat) {
+		t.Errorf("got  %+v", &out)
+		t.Errorf("want %+v", &stat)
+	}
+}
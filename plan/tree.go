@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -63,6 +64,11 @@ type Tree struct {
 	// and the terminal element of the list
 	// is the first in execution order.
 	Op Op
+
+	// Limits are the resource limits
+	// for executing this tree; they only
+	// apply to the outermost Tree of a query.
+	Limits Limits
 }
 
 func tabify(n int, dst *strings.Builder) {
@@ -106,9 +112,9 @@ func (t *Tree) String() string {
 	return out.String()
 }
 
-func (t *Tree) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (t *Tree) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	if len(t.Children) == 0 {
-		return t.Op.exec(dst, parallel, stats)
+		return execOp(ctx, t.Op, dst, parallel, stats)
 	}
 	var wg sync.WaitGroup
 	wg.Add(len(t.Children))
@@ -121,7 +127,7 @@ func (t *Tree) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	for i := range t.Children {
 		go func(i int) {
 			defer wg.Done()
-			errors[i] = t.Children[i].exec(&rp[i], subp, stats)
+			errors[i] = t.Children[i].exec(ctx, &rp[i], subp, stats)
 		}(i)
 	}
 	wg.Wait()
@@ -149,5 +155,5 @@ func (t *Tree) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	if rw.err != nil {
 		return rw.err
 	}
-	return t.Op.exec(dst, parallel, stats)
+	return execOp(ctx, t.Op, dst, parallel, stats)
 }
@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -32,6 +33,13 @@ type UnionMap struct {
 
 	Orig *expr.Table
 	Sub  Subtables
+
+	// Speculate, if non-zero, enables speculative
+	// execution: a subquery that is still running
+	// Speculate times longer than the median subquery
+	// is re-executed locally, and the output of
+	// whichever execution finishes first is used.
+	Speculate float64
 }
 
 var (
@@ -146,7 +154,7 @@ func decodeLocal(st *ion.Symtab, body []byte) (Transport, error) {
 	return t, nil
 }
 
-func (u *UnionMap) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
+func (u *UnionMap) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
 	w, err := dst.Open()
 	if err != nil {
 		return err
@@ -159,6 +167,8 @@ func (u *UnionMap) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error
 	// parallelism, so we union all the output bytes
 	// into a single thread here
 	errors := make([]error, u.Sub.Len())
+	tr := tracing(ctx)
+	strag := newStragglers(u.Sub.Len(), u.Speculate)
 	var wg sync.WaitGroup
 	wg.Add(u.Sub.Len())
 	for i := 0; i < u.Sub.Len(); i++ {
@@ -177,7 +187,24 @@ func (u *UnionMap) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error
 			// like we are executing a sub-query, which
 			// is approximately true
 			stub := &Tree{Op: u.From}
-			errors[i] = sub.Exec(stub, rw, s, stats)
+			if b := scanLimit(ctx); b != nil {
+				// each subquery is limited separately;
+				// the total is checked by the caller
+				stub.Limits.MaxScanned = b.max
+			}
+			sq := &subquery{
+				dst:   s,
+				stub:  stub,
+				rw:    rw,
+				trace: tr != nil,
+				strag: strag,
+			}
+			var tmp ExecStats
+			errors[i] = sq.run(ctx, sub.Transport, &tmp)
+			stats.atomicAdd(&tmp)
+			if tr != nil {
+				tr.merge(u, tmp.Ops)
+			}
 		}(i)
 	}
 	wg.Wait()
@@ -215,6 +242,10 @@ func (u *UnionMap) encode(dst *ion.Buffer, st *ion.Symtab) error {
 	if err := u.Sub.Encode(st, dst); err != nil {
 		return err
 	}
+	if u.Speculate != 0 {
+		dst.BeginField(st.Intern("speculate"))
+		dst.WriteFloat64(u.Speculate)
+	}
 	dst.EndStruct()
 	return nil
 }
@@ -237,6 +268,12 @@ func (u *UnionMap) setfield(d Decoder, name string, st *ion.Symtab, body []byte)
 			return err
 		}
 		u.Sub = sub
+	case "speculate":
+		f, _, err := ion.ReadFloat64(body)
+		if err != nil {
+			return err
+		}
+		u.Speculate = f
 	}
 	return nil
 }
@@ -15,6 +15,7 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -131,8 +132,8 @@ func (u *Unnest) String() string {
 	return out.String()
 }
 
-func (u *Unnest) exec(dst vm.QuerySink, parallel int, stats *ExecStats) error {
-	return u.From.exec(vm.NewUnnest(
+func (u *Unnest) exec(ctx context.Context, dst vm.QuerySink, parallel int, stats *ExecStats) error {
+	return execOp(ctx, u.From, vm.NewUnnest(
 		dst,
 		u.PivotField,
 		u.OuterProject,
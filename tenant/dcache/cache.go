@@ -21,6 +21,13 @@
 // and then use Cache.Table as the
 // vm.Table implementation to be
 // returned to the query planner.
+//
+// A cache may also keep copies of
+// frequently-accessed segments in memory
+// (see WithMemory) and may refuse to cache
+// segments that are large or have not been
+// accessed often enough (see WithMaxEntrySize
+// and WithMinAccesses).
 package dcache
 
 import (
@@ -74,8 +81,63 @@ type Cache struct {
 	// active user; otherwise we remove them
 	rocache map[string]*mapping
 
+	// mem, if non-nil, is the memory tier
+	mem *memtier
+	// freq, if non-nil, counts recent
+	// accesses of each segment
+	freq *sketch
+	// admission limits for filling entries
+	maxEntry    int64
+	minAccesses int
+
 	// statistics; accessed atomically
-	hits, misses, failures int64
+	hits, misses, failures, memhits, rejected int64
+}
+
+// Option is an optional argument
+// to New to indicate optional
+// Cache configuration.
+type Option func(c *Cache)
+
+// WithMemory is an option that can be
+// passed to New to keep copies of up to
+// size bytes of segments in memory, using
+// policy to choose the segments to evict.
+// Segments are added to the memory tier
+// when they are read from the disk tier.
+func WithMemory(size int64, policy Policy) Option {
+	return func(c *Cache) {
+		if size <= 0 {
+			c.mem = nil
+			return
+		}
+		c.mem = newMemtier(size, policy, nil)
+	}
+}
+
+// WithMaxEntrySize is an option that can
+// be passed to New to prevent segments larger
+// than size bytes from being cached at all.
+// Reads of those segments are counted as misses.
+func WithMaxEntrySize(size int64) Option {
+	return func(c *Cache) {
+		c.maxEntry = size
+	}
+}
+
+// WithMinAccesses is an option that can
+// be passed to New to prevent a segment
+// from being cached until it has been accessed
+// at least n times recently, so that segments
+// that are read once (for example, by a scan
+// of a large table) do not evict other entries.
+func WithMinAccesses(n int) Option {
+	return func(c *Cache) {
+		if n > 255 {
+			n = 255
+		}
+		c.minAccesses = n
+	}
 }
 
 type Logger interface {
@@ -119,6 +181,33 @@ func (c *Cache) Misses() int64 {
 	return atomic.LoadInt64(&c.misses)
 }
 
+// MemHits returns the number of hits
+// that were served from the memory tier.
+// (These are also counted by Hits.)
+func (c *Cache) MemHits() int64 {
+	return atomic.LoadInt64(&c.memhits)
+}
+
+// MemUsage returns the number of bytes
+// of segment data held in the memory tier
+// and the number of segments that have been
+// evicted from it.
+func (c *Cache) MemUsage() (bytes, evicted int64) {
+	if c.mem == nil {
+		return 0, 0
+	}
+	return c.mem.stats()
+}
+
+// Rejected returns the number of times
+// the cache declined to create a new entry
+// for a Segment because of the limits set
+// by WithMaxEntrySize or WithMinAccesses.
+// (These are also counted by Misses.)
+func (c *Cache) Rejected() int64 {
+	return atomic.LoadInt64(&c.rejected)
+}
+
 // Failures returns the number of times
 // the cache attempted to create a new
 // entry for a Segment but failed to allocate
@@ -144,13 +233,22 @@ type mapping struct {
 // The provided onFill function will be
 // called each time the cache is about
 // to fill a new cache entry.
-func New(dir string, onFill func()) *Cache {
+func New(dir string, onFill func(), opts ...Option) *Cache {
 	c := &Cache{
 		dir:      dir,
 		onFill:   onFill,
 		inflight: make(map[string]struct{}),
 		rocache:  make(map[string]*mapping),
 	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.minAccesses > 1 || (c.mem != nil && c.mem.policy == TinyLFU) {
+		c.freq = newSketch(sketchSize)
+		if c.mem != nil && c.mem.policy == TinyLFU {
+			c.mem.freq = c.freq
+		}
+	}
 	c.queue.reserved = make(map[string]*reservation)
 	parallel := runtime.GOMAXPROCS(0)
 	c.queue.out = make(chan *reservation, parallel)
@@ -269,6 +367,12 @@ func (c *Cache) mmap(s Segment, flags Flag) *mapping {
 		c.unlockID(id)
 		return nil
 	}
+	if !c.admit(s) {
+		atomic.AddInt64(&c.misses, 1)
+		atomic.AddInt64(&c.rejected, 1)
+		c.unlockID(id)
+		return nil
+	}
 	c.onFill()
 	// we are creating a new entry
 	f, err = os.Create(target + ".tmp")
@@ -314,6 +418,19 @@ func (c *Cache) mmap(s Segment, flags Flag) *mapping {
 	}
 }
 
+// sketchSize is the approximate number of
+// distinct segments whose accesses are counted
+const sketchSize = 1 << 14
+
+// admit determines if a new entry
+// should be created for s
+func (c *Cache) admit(s Segment) bool {
+	if c.maxEntry > 0 && s.Size() > c.maxEntry {
+		return false
+	}
+	return c.minAccesses <= 1 || c.freq.estimate(s.ETag()) >= c.minAccesses
+}
+
 // take a mapping that was not populated
 // and relink it so that it is a populated mapping
 func (c *Cache) finalize(mp *mapping, pop bool) {
@@ -413,7 +530,7 @@ type Table struct {
 // Stats is the a collection of
 // statistics about a Table or MultiTable.
 type Stats struct {
-	hits, misses int64
+	hits, misses, memhits int64
 }
 
 // Reset zeros all of the stats fields.
@@ -437,6 +554,11 @@ func (s *Stats) miss() {
 	atomic.AddInt64(&s.misses, 1)
 }
 
+func (s *Stats) memhit() {
+	atomic.AddInt64(&s.hits, 1)
+	atomic.AddInt64(&s.memhits, 1)
+}
+
 // Hits returns the accumulated total
 // of the number of cache hits.
 //
@@ -453,6 +575,11 @@ func (s *Stats) Hits() int64 { return atomic.LoadInt64(&s.hits) }
 // are both considered misses.
 func (s *Stats) Misses() int64 { return atomic.LoadInt64(&s.misses) }
 
+// MemHits returns the accumulated total
+// of the number of cache hits that were
+// served from the memory tier.
+func (s *Stats) MemHits() int64 { return atomic.LoadInt64(&s.memhits) }
+
 // Table returns a Table associated with
 // the given segment. The returned Table
 // implements vm.Table.
@@ -140,7 +140,9 @@ func (ts *testSegment) Open() (io.ReadCloser, error) {
 	if ts.inject.err != nil {
 		return nil, ts.inject.err
 	}
-	return io.NopCloser(bytes.NewReader(ts.all)), nil
+	// hide bytes.Reader.WriteTo so that
+	// read-through uses Decode
+	return io.NopCloser(struct{ io.Reader }{bytes.NewReader(ts.all)}), nil
 }
 
 func (ts *testSegment) Decode(dst io.Writer, src []byte) error {
@@ -659,3 +661,86 @@ func testMulti(t *testing.T, flags Flag, hits, misses int64) {
 		want += mo.possible[i].raw
 	}
 }
+
+func TestMemoryTier(t *testing.T) {
+	testFiles(t)
+	dir := t.TempDir()
+	c := New(dir, func() {}, WithMemory(1<<20, SLRU))
+	defer c.Close()
+	c.Logger = &testLogger{out: t}
+	seg := randseg(1000, 2, 3500)
+	tbl := c.Table(seg, 0)
+	for i := 0; i < 3; i++ {
+		out := seg.testout()
+		if err := tbl.WriteChunks(out, 4); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.check(); err != nil {
+			t.Fatalf("pass %d: %s", i, err)
+		}
+		if i == 0 {
+			// the memory tier should continue
+			// to serve the segment after the
+			// disk entry has been evicted
+			if err := os.Remove(filepath.Join(dir, seg.ETag())); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c.Misses() != 1 || c.Hits() != 2 || c.MemHits() != 2 {
+		t.Errorf("misses %d, hits %d, memory hits %d", c.Misses(), c.Hits(), c.MemHits())
+	}
+	if tbl.MemHits() != 2 || tbl.Hits() != 2 {
+		t.Errorf("table hits %d, memory hits %d", tbl.Hits(), tbl.MemHits())
+	}
+	if used, _ := c.MemUsage(); used != seg.Size()+slack {
+		t.Errorf("memory tier uses %d bytes", used)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	testFiles(t)
+	read := func(c *Cache, seg *testSegment) {
+		t.Helper()
+		out := seg.testout()
+		if err := c.Table(seg, 0).WriteChunks(out, 4); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(dir string, seg *testSegment) bool {
+		_, err := os.Stat(filepath.Join(dir, seg.ETag()))
+		return err == nil
+	}
+
+	dir := t.TempDir()
+	c := New(dir, func() {}, WithMaxEntrySize(4000))
+	small, large := randseg(1000, 2, 3500), randseg(1000, 2, 5000)
+	read(c, small)
+	read(c, large)
+	c.Close()
+	if !cached(dir, small) || cached(dir, large) {
+		t.Error("expected only the small segment to be cached")
+	}
+	if c.Rejected() != 1 || c.Misses() != 2 {
+		t.Errorf("rejected %d, misses %d", c.Rejected(), c.Misses())
+	}
+
+	dir = t.TempDir()
+	c = New(dir, func() {}, WithMinAccesses(2))
+	defer c.Close()
+	read(c, small)
+	if cached(dir, small) {
+		t.Error("segment cached after one access")
+	}
+	read(c, small)
+	if !cached(dir, small) {
+		t.Error("segment not cached after two accesses")
+	}
+	read(c, small)
+	if c.Rejected() != 1 || c.Misses() != 2 || c.Hits() != 1 {
+		t.Errorf("rejected %d, misses %d, hits %d", c.Rejected(), c.Misses(), c.Hits())
+	}
+}
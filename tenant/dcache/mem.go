@@ -0,0 +1,196 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Policy is the eviction policy
+// of the memory tier of a Cache.
+type Policy int
+
+const (
+	// LRU evicts the least-recently-used segment.
+	LRU Policy = iota
+	// SLRU (segmented LRU) moves segments that
+	// are accessed again after they are admitted
+	// into a protected segment that holds most of
+	// the memory tier, so segments that are only
+	// accessed once (for example, by a scan of a
+	// large table) can only evict each other.
+	SLRU
+	// TinyLFU is SLRU with an admission filter:
+	// a segment is only admitted if it has been
+	// accessed more often recently than each of
+	// the segments that it would evict.
+	TinyLFU
+)
+
+// protectedShare is the percentage of the
+// memory tier that SLRU reserves for the
+// protected segment
+const protectedShare = 80
+
+// memtier holds copies of hot segments in memory
+type memtier struct {
+	policy Policy
+	max    int64
+	freq   *sketch // TinyLFU only
+
+	lock      sync.Mutex
+	used      int64
+	protected int64 // bytes in prot
+	entries   map[string]*list.Element
+	probation list.List
+	prot      list.List
+	evictions int64
+}
+
+type memEntry struct {
+	etag      string
+	buf       []byte
+	protected bool
+}
+
+func (e *memEntry) size() int64 { return int64(cap(e.buf)) }
+
+func newMemtier(max int64, policy Policy, freq *sketch) *memtier {
+	return &memtier{
+		policy:  policy,
+		max:     max,
+		freq:    freq,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the contents of etag,
+// or nil if it is not in the memory tier;
+// the returned slice must not be modified
+func (m *memtier) get(etag string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	el := m.entries[etag]
+	if el == nil {
+		return nil
+	}
+	ent := el.Value.(*memEntry)
+	if ent.protected {
+		m.prot.MoveToFront(el)
+	} else if m.policy == LRU {
+		m.probation.MoveToFront(el)
+	} else {
+		m.probation.Remove(el)
+		ent.protected = true
+		m.entries[etag] = m.prot.PushFront(ent)
+		m.protected += ent.size()
+		// demote the least-recently-used protected
+		// segments once the protected segment is full
+		for m.protected > m.max*protectedShare/100 && m.prot.Len() > 1 {
+			back := m.prot.Remove(m.prot.Back()).(*memEntry)
+			back.protected = false
+			m.protected -= back.size()
+			m.entries[back.etag] = m.probation.PushFront(back)
+		}
+	}
+	return ent.buf
+}
+
+// victims returns the entries that would
+// have to be evicted to make room for size bytes
+func (m *memtier) victims(size int64) []*list.Element {
+	var out []*list.Element
+	need := m.used + size - m.max
+	for _, lst := range []*list.List{&m.probation, &m.prot} {
+		for el := lst.Back(); el != nil && need > 0; el = el.Prev() {
+			out = append(out, el)
+			need -= el.Value.(*memEntry).size()
+		}
+	}
+	return out
+}
+
+// admit returns whether a segment
+// of the given size should be added
+func (m *memtier) admit(etag string, size int64) bool {
+	if size > m.max {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[etag]; ok {
+		return false
+	}
+	if m.freq == nil {
+		return true
+	}
+	victims := m.victims(size)
+	if len(victims) == 0 {
+		return true
+	}
+	freq := m.freq.estimate(etag)
+	for _, el := range victims {
+		if freq <= m.freq.estimate(el.Value.(*memEntry).etag) {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds a copy of mem to the memory tier
+// if the admission policy allows it
+func (m *memtier) add(etag string, mem []byte) {
+	size := int64(len(mem) + slack)
+	if !m.admit(etag, size) {
+		return
+	}
+	// copy outside the lock; there
+	// may be a race to add the same entry,
+	// in which case the first one wins
+	buf := make([]byte, len(mem), size)
+	copy(buf, mem)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[etag]; ok {
+		return
+	}
+	for _, el := range m.victims(size) {
+		m.remove(el)
+		m.evictions++
+	}
+	m.entries[etag] = m.probation.PushFront(&memEntry{etag: etag, buf: buf})
+	m.used += size
+}
+
+func (m *memtier) remove(el *list.Element) {
+	ent := el.Value.(*memEntry)
+	if ent.protected {
+		m.prot.Remove(el)
+		m.protected -= ent.size()
+	} else {
+		m.probation.Remove(el)
+	}
+	delete(m.entries, ent.etag)
+	m.used -= ent.size()
+}
+
+// stats returns the number of bytes in use
+// and the number of evicted segments
+func (m *memtier) stats() (int64, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used, m.evictions
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemtierPolicy(t *testing.T) {
+	const entry = 100 - slack
+	hot := []string{"hot0", "hot1", "hot2"}
+	run := func(m *memtier) {
+		for _, etag := range hot {
+			m.add(etag, make([]byte, entry))
+		}
+		// make the hot entries hot
+		for i := 0; i < 3; i++ {
+			for _, etag := range hot {
+				if m.freq != nil {
+					m.freq.add(etag)
+				}
+				m.get(etag)
+			}
+		}
+		// scan a lot of segments once
+		for i := 0; i < 50; i++ {
+			etag := fmt.Sprintf("scan%d", i)
+			if m.freq != nil {
+				m.freq.add(etag)
+			}
+			if m.get(etag) == nil {
+				m.add(etag, make([]byte, entry))
+			}
+		}
+		if m.used > m.max {
+			t.Errorf("policy %d: using %d of %d bytes", m.policy, m.used, m.max)
+		}
+		if len(m.entries) != m.probation.Len()+m.prot.Len() {
+			t.Errorf("policy %d: %d entries but %d listed", m.policy, len(m.entries), m.probation.Len()+m.prot.Len())
+		}
+	}
+
+	m := newMemtier(500, LRU, nil)
+	run(m)
+	for _, etag := range hot {
+		if m.get(etag) != nil {
+			t.Errorf("LRU: %s survived the scan", etag)
+		}
+	}
+	if _, evicted := m.stats(); evicted != 48 {
+		t.Errorf("LRU: %d evictions", evicted)
+	}
+
+	for _, policy := range []Policy{SLRU, TinyLFU} {
+		m = newMemtier(500, policy, nil)
+		if policy == TinyLFU {
+			m.freq = newSketch(64)
+		}
+		run(m)
+		for _, etag := range hot {
+			if m.get(etag) == nil {
+				t.Errorf("policy %d: %s evicted by the scan", policy, etag)
+			}
+		}
+		if m.protected > m.max*protectedShare/100 {
+			t.Errorf("policy %d: %d protected bytes", policy, m.protected)
+		}
+	}
+	// TinyLFU only admits the scan if it is
+	// accessed more often than the victims
+	if m.probation.Len() != 2 {
+		t.Errorf("TinyLFU: %d probationary entries", m.probation.Len())
+	}
+
+	// entries larger than the tier are never admitted
+	m = newMemtier(500, LRU, nil)
+	m.add("big", make([]byte, 500))
+	if m.get("big") != nil || m.used != 0 {
+		t.Error("admitted an entry larger than the memory tier")
+	}
+}
+
+func TestSketch(t *testing.T) {
+	s := newSketch(64)
+	for i := 0; i < 10; i++ {
+		s.add("x")
+	}
+	s.add("y")
+	if n := s.estimate("x"); n < 10 {
+		t.Errorf("estimate(x) = %d", n)
+	}
+	if s.estimate("x") <= s.estimate("y") {
+		t.Errorf("estimate(x) = %d, estimate(y) = %d", s.estimate("x"), s.estimate("y"))
+	}
+	// old accesses decay
+	for i := 0; i < s.samples; i++ {
+		s.add(fmt.Sprintf("z%d", i%16))
+	}
+	if n := s.estimate("x"); n >= 10 {
+		t.Errorf("estimate(x) = %d after aging", n)
+	}
+}
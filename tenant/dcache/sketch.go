@@ -0,0 +1,106 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dcache
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// sketch is a count-min sketch that estimates
+// how often each segment has been accessed
+// recently (see TinyLFU). Counters are halved
+// every time the number of recorded accesses
+// reaches the sample size, so the estimates
+// favor recent accesses over old ones.
+type sketch struct {
+	lock    sync.Mutex
+	seed    maphash.Seed
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	added   int
+	samples int
+}
+
+const sketchDepth = 4
+
+// newSketch returns a sketch sized for
+// roughly n distinct entries
+func newSketch(n int) *sketch {
+	width := 64
+	for width < n {
+		width <<= 1
+	}
+	s := &sketch{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		samples: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) hash(etag string) (uint64, uint64) {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	h.WriteString(etag)
+	x := h.Sum64()
+	return x, (x >> 32) | 1
+}
+
+// add records an access of etag
+func (s *sketch) add(etag string) {
+	h0, h1 := s.hash(etag)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.rows {
+		c := &s.rows[i][(h0+uint64(i)*h1)&s.mask]
+		if *c < 255 {
+			*c++
+		}
+	}
+	s.added++
+	if s.added >= s.samples {
+		s.age()
+	}
+}
+
+// age halves every counter
+func (s *sketch) age() {
+	for i := range s.rows {
+		row := s.rows[i]
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	s.added /= 2
+}
+
+// estimate returns the approximate number
+// of recent accesses of etag
+func (s *sketch) estimate(etag string) int {
+	h0, h1 := s.hash(etag)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	min := uint8(255)
+	for i := range s.rows {
+		if c := s.rows[i][(h0+uint64(i)*h1)&s.mask]; c < min {
+			min = c
+		}
+	}
+	return int(min)
+}
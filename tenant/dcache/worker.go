@@ -17,6 +17,7 @@ package dcache
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
 type reservation struct {
@@ -122,9 +123,42 @@ func (r *reservation) miss() {
 	}
 }
 
+func (r *reservation) memhit() {
+	r.primary.stats.memhit()
+	for i := range r.aux {
+		r.aux[i].stats.memhit()
+	}
+}
+
 // Close closes the cache.
 // Further use of the cache after
 // a call to Close will cause panics.
+// remove res from the reserved map
+// so that res.aux is safe to access
+func (q *queue) unreserve(res *reservation) {
+	q.lock.Lock()
+	delete(q.reserved, res.etag)
+	q.lock.Unlock()
+}
+
+func (c *Cache) memget(etag string) []byte {
+	if c.mem == nil {
+		return nil
+	}
+	buf := c.mem.get(etag)
+	if buf != nil {
+		atomic.AddInt64(&c.hits, 1)
+		atomic.AddInt64(&c.memhits, 1)
+	}
+	return buf
+}
+
+func (c *Cache) memadd(etag string, mem []byte) {
+	if c.mem != nil {
+		c.mem.add(etag, mem)
+	}
+}
+
 func (c *Cache) Close() {
 	close(c.queue.out)
 	c.wg.Wait()
@@ -134,25 +168,33 @@ func (c *Cache) worker() {
 	defer c.wg.Done()
 	q := &c.queue
 	for res := range q.out {
+		if c.freq != nil {
+			c.freq.add(res.etag)
+		}
+		if buf := c.memget(res.etag); buf != nil {
+			q.unreserve(res)
+			res.memhit()
+			res.close(res.seg.Decode(res, buf))
+			continue
+		}
 		mp := c.mmap(res.seg, res.flags)
-
-		// remove from reserved map
-		// so that res.aux is safe to access
-		q.lock.Lock()
-		delete(q.reserved, res.etag)
-		q.lock.Unlock()
+		q.unreserve(res)
 
 		var err error
 		pop := false
 		if mp != nil && mp.populated {
 			res.hit()
 			err = res.seg.Decode(res, mp.mem)
+			c.memadd(res.etag, mp.mem)
 			c.unmap(mp)
 		} else {
 			res.miss()
 			pop, err = readThrough(res.seg, mp, res)
 			if mp != nil {
 				c.finalize(mp, pop)
+				if pop {
+					c.memadd(res.etag, mp.mem)
+				}
 				c.unmap(mp)
 			}
 		}
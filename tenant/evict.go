@@ -19,6 +19,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/SnellerInc/sneller/heap"
 )
@@ -60,6 +61,35 @@ import (
 // that have had their atimes jump forward.
 // In other words, the behavior with the candidate heap
 // is still "perfectly LRU" behavior.
+//
+// With EvictSLRU, files that have been accessed
+// since they were written (atime > mtime) are
+// considered "protected" and are kept in a separate
+// candidate heap; protected files are only evicted
+// once they make up more than protectedShare percent
+// of the cache, or once there are no other candidates.
+// This keeps files that are only read once (for example,
+// by a scan of a large table) from evicting the
+// working set of other queries.
+
+// EvictPolicy is the policy used to
+// select the cache files to be evicted.
+type EvictPolicy int
+
+const (
+	// EvictLRU evicts the least-recently-used files.
+	EvictLRU EvictPolicy = iota
+	// EvictSLRU evicts the least-recently-used
+	// files that have not been accessed since
+	// they were written before evicting files
+	// that have been accessed again.
+	EvictSLRU
+)
+
+// protectedShare is the percentage of
+// the cache that EvictSLRU reserves for
+// protected files
+const protectedShare = 80
 
 // these functions are overridden for testing
 var (
@@ -76,6 +106,10 @@ type fprio struct {
 type evictHeap struct {
 	lst    []fprio
 	sorted []fprio
+	// bytes is the total size of the files
+	// that belonged to this heap during the
+	// last walk, less the evicted files
+	bytes int64
 }
 
 // sort the final heap results by
@@ -113,47 +147,64 @@ func (e *evictHeap) pop() (string, int64, int64) {
 	return f.path, f.atime, f.size
 }
 
-func (m *Manager) evict(e *evictHeap, size int64) {
-	for {
-		if len(e.sorted) == 0 {
-			m.fill(e)
-			e.sort()
-			if len(e.sorted) == 0 {
+// victims returns the heap from which
+// the next file should be evicted, or nil
+// if the heaps need to be re-filled
+func (m *Manager) victims() *evictHeap {
+	p, q := &m.eheap, &m.pheap
+	// the heaps only hold a limited number
+	// of candidates, so an empty heap may
+	// just need to be re-filled
+	if (len(p.sorted) == 0 && p.bytes > 0) || (len(q.sorted) == 0 && q.bytes > 0) {
+		return nil
+	}
+	if len(q.sorted) == 0 {
+		if len(p.sorted) == 0 {
+			return nil
+		}
+		return p
+	}
+	if len(p.sorted) == 0 || 100*q.bytes > protectedShare*(p.bytes+q.bytes) {
+		return q
+	}
+	return p
+}
+
+func (m *Manager) evict(size int64) {
+	for size > 0 {
+		e := m.victims()
+		if e == nil {
+			m.fill()
+			if e = m.victims(); e == nil {
 				// nothing to evict...?
 				return
 			}
 		}
-		for i := range e.sorted {
-			f := &e.sorted[i]
-			fi, err := os.Stat(f.path)
-			if err != nil || fi.Size() != f.size || atime(fi) != f.atime {
-				continue
-			}
-			if os.Remove(f.path) == nil {
-				size -= f.size
-				if size <= 0 {
-					// copy remaining entries to the front of the cache
-					// so that we begin where we left off on the
-					// next call to evict()
-					e.sorted = e.sorted[:copy(e.sorted, e.sorted[i+1:])]
-					return
-				}
-			}
+		f := e.sorted[0]
+		e.sorted = e.sorted[:copy(e.sorted, e.sorted[1:])]
+		fi, err := os.Stat(f.path)
+		if err != nil || fi.Size() != f.size || atime(fi) != f.atime {
+			// anything that is stale will be
+			// picked up again by the next walk
+			continue
+		}
+		if os.Remove(f.path) == nil {
+			atomic.AddInt64(&m.evicted, 1)
+			atomic.AddInt64(&m.evictedBytes, f.size)
+			e.bytes -= f.size
+			size -= f.size
 		}
-		// if we iterated the whole list,
-		// anything that is left here must
-		// be stale, so we should re-fill
-		e.sorted = e.sorted[:0]
 	}
 }
 
-func (m *Manager) fill(e *evictHeap) {
+func (m *Manager) fill() {
 	// we limit the number of files considered
 	// for eviction so that the number of files
 	// present in the cache directory does not
 	// affect the amount of memory we need to
 	// consume in order to select good candidates
 	const maxbuffered = 25
+	m.eheap.bytes, m.pheap.bytes = 0, 0
 	walk := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -172,14 +223,21 @@ func (m *Manager) fill(e *evictHeap) {
 			}
 			return err
 		}
-		e.push(path, atime(info), info.Size())
+		e := &m.eheap
+		at := atime(info)
+		if m.evictPolicy == EvictSLRU && at > info.ModTime().UnixNano() {
+			e = &m.pheap
+		}
+		e.bytes += info.Size()
+		e.push(path, at, info.Size())
 		e.shrink(maxbuffered)
 		return nil
 	}
 	err := filepath.WalkDir(m.CacheDir, walk)
+	m.eheap.sort()
+	m.pheap.sort()
 	if err != nil {
 		m.errorf("cache eviction walk: %s", err)
-		return
 	}
 }
 
@@ -191,5 +249,5 @@ func (m *Manager) cacheEvict() {
 	if used < target {
 		return
 	}
-	m.evict(&m.eheap, used-target)
+	m.evict(used - target)
 }
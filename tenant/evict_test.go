@@ -116,6 +116,9 @@ func TestEvict(t *testing.T) {
 			t.Errorf("expected %s found %s", e.name, final[i].Name())
 		}
 	}
+	if files, bytes := m.Evicted(); files != 1 || bytes != begin[0].size {
+		t.Errorf("Evicted() = %d, %d", files, bytes)
+	}
 	if len(m.eheap.sorted) != len(final) {
 		t.Errorf("%d entries in sorted heap but %d final dirents?", len(m.eheap.sorted), len(final))
 
@@ -269,3 +272,86 @@ func TestIssue645(t *testing.T) {
 	}
 
 }
+
+func TestEvictSLRU(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this doesn't work on windows")
+	}
+
+	oldusage, oldatime := usage, atime
+	t.Cleanup(func() {
+		usage = oldusage
+		atime = oldatime
+	})
+	tmp := t.TempDir()
+
+	type fsent struct {
+		name         string
+		size         int64
+		atime, mtime int64
+	}
+	base := time.Now().UnixNano()
+	begin := []fsent{
+		// total size is 940/1000 in the starting state;
+		// "000" is the least-recently-used file, but
+		// it has been read since it was written
+		{"000", 300, base + 100, base},
+		{"001", 160, base + 200, base + 1000},
+		{"002", 160, base + 300, base + 1000},
+		{"003", 160, base + 400, base + 1000},
+		{"004", 160, base + 500, base + 1000},
+	}
+	usage = func(dir string) (int64, int64) {
+		contents, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := int64(0)
+		for i := range contents {
+			fi, err := contents[i].Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum += fi.Size()
+		}
+		return sum, 1000
+	}
+	atime = func(i fs.FileInfo) int64 {
+		for j := range begin {
+			if begin[j].name == i.Name() {
+				return begin[j].atime
+			}
+		}
+		t.Fatal("unknown file name", i.Name())
+		return 0
+	}
+	for i := range begin {
+		fullpath := filepath.Join(tmp, begin[i].name)
+		contents := []byte(strings.Repeat("a", int(begin[i].size)))
+		if err := os.WriteFile(fullpath, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(0, begin[i].mtime)
+		if err := os.Chtimes(fullpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewManager([]string{"/bin/false"}, WithEvictionPolicy(EvictSLRU))
+	m.CacheDir = tmp
+	m.cacheEvict()
+	final, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i := range final {
+		names = append(names, final[i].Name())
+	}
+	if got := strings.Join(names, " "); got != "000 002 003 004" {
+		t.Errorf("remaining files: %s", got)
+	}
+	if m.pheap.bytes != 300 || len(m.pheap.sorted) != 1 {
+		t.Errorf("protected heap has %d files, %d bytes", len(m.pheap.sorted), m.pheap.bytes)
+	}
+}
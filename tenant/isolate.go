@@ -0,0 +1,80 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tenant
+
+import (
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+// Isolation configures the native sandbox
+// (see WithIsolation) that Manager uses
+// instead of bwrap(1) to launch tenant processes.
+//
+// Each tenant process runs in its own pid, mount,
+// IPC and UTS namespaces (and a user namespace
+// if the Manager is not running as root)
+// with a read-only root filesystem, its cache
+// directory mounted at /tmp, and /var hidden.
+type Isolation struct {
+	// Cgroup is a cgroup v2 directory
+	// in which a cgroup is created for each
+	// tenant process. The memory, cpu and pids
+	// controllers must be available in Cgroup.
+	// If Cgroup is empty, the resource limits
+	// below are not applied.
+	Cgroup string
+	// Memory is the memory.max of each
+	// tenant process in bytes (0 is unlimited).
+	Memory int64
+	// CPUWeight is the cpu.weight of each
+	// tenant process, from 1 to 10000
+	// (0 leaves the default of 100).
+	CPUWeight int
+	// Pids is the pids.max of each
+	// tenant process (0 is unlimited).
+	Pids int
+	// Seccomp, if set, installs a seccomp
+	// filter in each tenant process that denies
+	// system calls that a tenant never needs,
+	// such as mount(2), ptrace(2) and the
+	// creation of new namespaces.
+	Seccomp bool
+
+	// Limits, if non-nil, overrides the
+	// limits above for individual tenants.
+	Limits func(id tnproto.ID) (memory int64, cpuWeight, pids int)
+}
+
+// limits returns the resource limits for id
+func (iso *Isolation) limits(id tnproto.ID) (int64, int, int) {
+	if iso.Limits != nil {
+		return iso.Limits(id)
+	}
+	return iso.Memory, iso.CPUWeight, iso.Pids
+}
+
+// WithIsolation is an option that can be
+// passed to NewManager to launch tenant
+// processes in the native sandbox described
+// by iso rather than with bwrap(1).
+// Manager.Sandbox is ignored when
+// iso is non-nil.
+//
+// See also CanIsolate.
+func WithIsolation(iso *Isolation) Option {
+	return func(m *Manager) {
+		m.isolation = iso
+	}
+}
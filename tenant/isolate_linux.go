@@ -0,0 +1,427 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package tenant
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+// isolateArg0 is the argv[0] with which
+// Manager re-executes its own binary
+// to set up the sandbox of a tenant
+// process from inside its namespaces
+const isolateArg0 = "sneller-tenant-init"
+
+func init() {
+	// this has to run before main so that
+	// any binary that launches tenants with
+	// WithIsolation can act as the sandbox
+	// setup process
+	if len(os.Args) > 0 && os.Args[0] == isolateArg0 {
+		isolateMain(os.Args[1:])
+	}
+}
+
+// CanIsolate returns whether or not
+// tenants can be sandboxed using WithIsolation.
+func CanIsolate() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	buf, err := os.ReadFile("/proc/sys/user/max_user_namespaces")
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	return err == nil && n > 0
+}
+
+// isolated is a tenant process
+// launched in the native sandbox
+type isolated struct {
+	cmd *exec.Cmd
+	iso *Isolation
+	id  tnproto.ID
+	// the sandbox setup process blocks
+	// reading from release until it has
+	// been placed in its cgroup
+	release, wait *os.File
+	// cgroup is the cgroup directory
+	// of the process, if any
+	cgroup string
+}
+
+// isolate returns the command that runs
+// cmdline in the sandbox described by m.isolation
+func (m *Manager) isolate(id tnproto.ID, cmdline []string) (*isolated, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{isolateArg0, "-c", m.cacheDir(id)}
+	if m.isolation.Seccomp {
+		args = append(args, "-s")
+	}
+	args = append(args, "--")
+	cmd := &exec.Cmd{
+		Path: self,
+		Args: append(args, cmdline...),
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
+				syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+	if uid, gid := os.Geteuid(), os.Getegid(); uid != 0 {
+		// unprivileged users need a user namespace
+		// in order to create the others
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	}
+	return &isolated{
+		cmd:     cmd,
+		iso:     m.isolation,
+		id:      id,
+		release: wr,
+		wait:    rd,
+	}, nil
+}
+
+// start starts the process and
+// moves it into its cgroup before
+// the tenant binary is executed
+func (i *isolated) start() error {
+	// the read end of the pipe is passed
+	// after any other extra files
+	fd := 3 + len(i.cmd.ExtraFiles)
+	i.cmd.ExtraFiles = append(i.cmd.ExtraFiles, i.wait)
+	i.cmd.Args = append([]string{isolateArg0, "-w", strconv.Itoa(fd)}, i.cmd.Args[1:]...)
+	err := i.cmd.Start()
+	i.wait.Close()
+	if err != nil {
+		i.release.Close()
+		return err
+	}
+	if i.iso.Cgroup != "" {
+		err = i.setCgroup()
+	}
+	if err == nil {
+		_, err = i.release.Write([]byte{0})
+	}
+	i.release.Close()
+	if err != nil {
+		i.cmd.Process.Kill()
+		i.cmd.Wait()
+		i.removeCgroup()
+		return err
+	}
+	return nil
+}
+
+func (i *isolated) setCgroup() error {
+	memory, weight, pids := i.iso.limits(i.id)
+	var ctl []string
+	if memory > 0 {
+		ctl = append(ctl, "+memory")
+	}
+	if weight > 0 {
+		ctl = append(ctl, "+cpu")
+	}
+	if pids > 0 {
+		ctl = append(ctl, "+pids")
+	}
+	if len(ctl) > 0 {
+		err := cgwrite(i.iso.Cgroup, "cgroup.subtree_control", strings.Join(ctl, " "))
+		if err != nil {
+			return err
+		}
+	}
+	// the pid makes the name unique, so that
+	// removing the cgroup of an exited process
+	// never races with a new process for the same tenant
+	dir := filepath.Join(i.iso.Cgroup, fmt.Sprintf("%s-%d", i.id, i.cmd.Process.Pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	i.cgroup = dir
+	if memory > 0 {
+		if err := cgwrite(dir, "memory.max", strconv.FormatInt(memory, 10)); err != nil {
+			return err
+		}
+		// don't let the tenant swap
+		// instead of being killed
+		if err := cgwrite(dir, "memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if weight > 0 {
+		if err := cgwrite(dir, "cpu.weight", strconv.Itoa(weight)); err != nil {
+			return err
+		}
+	}
+	if pids > 0 {
+		if err := cgwrite(dir, "pids.max", strconv.Itoa(pids)); err != nil {
+			return err
+		}
+	}
+	return cgwrite(dir, "cgroup.procs", strconv.Itoa(i.cmd.Process.Pid))
+}
+
+func cgwrite(dir, file, val string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(val)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("writing %q to %s: %w", val, file, err)
+	}
+	return nil
+}
+
+// ooms returns the number of processes in
+// the cgroup killed by the OOM killer
+func (i *isolated) ooms() int {
+	if i.cgroup == "" {
+		return 0
+	}
+	buf, err := os.ReadFile(filepath.Join(i.cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "oom_kill" {
+			n, _ := strconv.Atoi(f[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// removeCgroup removes the cgroup
+// of a process that has exited
+func (i *isolated) removeCgroup() error {
+	if i.cgroup == "" {
+		return nil
+	}
+	var err error
+	// the other processes in the pid namespace
+	// are killed when the tenant exits, but they
+	// may not have left the cgroup yet
+	for tries := 0; tries < 10; tries++ {
+		err = syscall.Rmdir(i.cgroup)
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == syscall.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+// isolateMain is the entry point of the
+// process that sets up the sandbox from inside
+// its namespaces and then executes the tenant
+func isolateMain(args []string) {
+	fs := flag.NewFlagSet(isolateArg0, flag.ExitOnError)
+	cache := fs.String("c", "", "cache directory")
+	wait := fs.Int("w", -1, "file descriptor to wait on")
+	filter := fs.Bool("s", false, "install seccomp filter")
+	fs.Parse(args)
+	cmdline := fs.Args()
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", isolateArg0, err)
+		os.Exit(1)
+	}
+	if len(cmdline) == 0 {
+		fail(errors.New("no command"))
+	}
+	if *wait >= 0 {
+		f := os.NewFile(uintptr(*wait), "wait")
+		var buf [1]byte
+		_, err := f.Read(buf[:])
+		f.Close()
+		if err != nil {
+			fail(fmt.Errorf("waiting for cgroup: %w", err))
+		}
+	}
+	// look up the binary before
+	// the filesystem is rearranged
+	path, err := exec.LookPath(cmdline[0])
+	if err != nil {
+		fail(err)
+	}
+	if err := confine(*cache); err != nil {
+		fail(err)
+	}
+	// the cache directory is
+	// now mounted at /tmp
+	os.Setenv("CACHEDIR", "/tmp")
+	if *filter {
+		if err := seccomp(); err != nil {
+			fail(err)
+		}
+	}
+	fail(syscall.Exec(path, cmdline, os.Environ()))
+}
+
+// statfs flags that have to be
+// preserved when remounting a filesystem
+// inside a user namespace
+var lockedFlags = []struct {
+	st, ms uintptr
+}{
+	{0x2, syscall.MS_NOSUID},
+	{0x4, syscall.MS_NODEV},
+	{0x8, syscall.MS_NOEXEC},
+	{0x400, syscall.MS_NOATIME},
+	{0x800, syscall.MS_NODIRATIME},
+	{0x1000, syscall.MS_RELATIME},
+}
+
+// confine rearranges the filesystem
+// in the same way as bubblewrap:
+// / and every mount below it are read-only,
+// cache is mounted at /tmp, /var is hidden
+// and /proc only shows the new pid namespace
+func confine(cache string) error {
+	mount := func(src, dst, fstype string, flags uintptr) error {
+		if err := syscall.Mount(src, dst, fstype, flags, ""); err != nil {
+			return fmt.Errorf("mounting %s: %w", dst, err)
+		}
+		return nil
+	}
+	// don't propagate any of this
+	// back to the parent namespace
+	if err := mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE); err != nil {
+		return err
+	}
+	if cache != "" {
+		if err := mount(cache, "/tmp", "", syscall.MS_BIND|syscall.MS_REC); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat("/var"); err == nil {
+		if err := mount("tmpfs", "/var", "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+			return err
+		}
+	}
+	if err := mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC); err != nil {
+		return err
+	}
+	// a read-only remount only applies to
+	// the mount itself, so each submount
+	// has to be remounted separately
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, dir := range mounts {
+		if cache != "" && under(dir, "/tmp") || under(dir, "/proc") || under(dir, "/var") {
+			continue
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				continue // hidden by another mount
+			}
+			return fmt.Errorf("statfs %s: %w", dir, err)
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		for _, f := range lockedFlags {
+			if uintptr(st.Flags)&f.st != 0 {
+				flags |= f.ms
+			}
+		}
+		if err := mount("", dir, "", flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountPoints returns the mount points listed
+// in /proc/self/mountinfo, parents first
+func mountPoints() ([]string, error) {
+	buf, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 5 {
+			continue
+		}
+		out = append(out, unescapeMount(f[4]))
+	}
+	// a mount point is always listed after the
+	// mount that contains it, but sorting makes
+	// sure / comes first regardless
+	sort.SliceStable(out, func(i, j int) bool {
+		return strings.Count(out[i], "/") < strings.Count(out[j], "/")
+	})
+	return out, nil
+}
+
+// unescapeMount undoes the octal escaping
+// of spaces, tabs, newlines and backslashes
+// in the fields of /proc/self/mountinfo
+func unescapeMount(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// under returns whether path is dir
+// or a path inside of dir
+func under(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package tenant
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIsolate(t *testing.T) {
+	if !CanIsolate() {
+		t.Skip("cannot create namespaces")
+	}
+	cgroot := t.TempDir()
+	iso := &Isolation{
+		// a plain directory stands in for cgroupfs
+		Cgroup:    cgroot,
+		Memory:    1 << 30,
+		CPUWeight: 50,
+		Pids:      100,
+		Seccomp:   true,
+	}
+	m := NewManager([]string{"true"}, WithIsolation(iso))
+	m.CacheDir = t.TempDir()
+	id := randomID()
+	if err := os.Mkdir(m.cacheDir(id), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// mounts below / have to be
+	// read-only as well; the test directory
+	// cannot be under /tmp, which is replaced
+	// by the cache directory
+	sub := ""
+	if os.Geteuid() == 0 {
+		dir, err := os.MkdirTemp(".", "isolate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { syscall.Unmount(dir, syscall.MNT_DETACH) })
+		sub, err = filepath.Abs(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script := strings.Join([]string{
+		"echo pid=$$",
+		"echo cachedir=$CACHEDIR",
+		"touch /tmp/hello && echo tmp=ok",
+		"touch /sneller-isolate-test 2>/dev/null || echo root=ro",
+		"echo var=$(ls -A /var | wc -l)",
+		"command -v unshare >/dev/null && { unshare -U true 2>/dev/null || echo unshare=denied; }",
+		"test -z \"$SUB\" || touch \"$SUB/hello\" 2>/dev/null || echo sub=ro",
+		"touch /dev/shm/sneller-isolate-test 2>/dev/null || echo shm=ro",
+	}, "; ")
+	c, err := m.isolate(id, []string{"/bin/sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	c.cmd.Stdout = &out
+	c.cmd.Stderr = &out
+	c.cmd.Env = []string{"PATH=/usr/bin:/bin", "SUB=" + sub}
+	if err := c.start(); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("cannot create namespaces:", err)
+		}
+		t.Fatal(err)
+	}
+	pid := c.cmd.Process.Pid
+	if err := c.cmd.Wait(); err != nil {
+		t.Fatalf("%s: %s", err, out.String())
+	}
+	got := out.String()
+	t.Log(got)
+	for _, want := range []string{
+		"pid=1\n",
+		"cachedir=/tmp\n",
+		"tmp=ok\n",
+		"root=ro\n",
+		"var=0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+	if strings.Contains(got, "unshare=") && !strings.Contains(got, "unshare=denied") {
+		t.Error("unshare(2) was not denied")
+	}
+	if sub != "" && !strings.Contains(got, "sub=ro") {
+		t.Error("submount is writable")
+	}
+	if _, err := os.Stat("/dev/shm/sneller-isolate-test"); err == nil {
+		os.Remove("/dev/shm/sneller-isolate-test")
+		t.Error("/dev/shm is writable")
+	}
+	if _, err := os.Stat(filepath.Join(m.cacheDir(id), "hello")); err != nil {
+		t.Errorf("cache directory not mounted at /tmp: %s", err)
+	}
+	if _, err := os.Stat("/sneller-isolate-test"); err == nil {
+		os.Remove("/sneller-isolate-test")
+	}
+
+	dir := filepath.Join(cgroot, id.String()+"-"+strconv.Itoa(pid))
+	if c.cgroup != dir {
+		t.Fatalf("cgroup %q, expected %q", c.cgroup, dir)
+	}
+	for file, want := range map[string]string{
+		"memory.max":   "1073741824",
+		"cpu.weight":   "50",
+		"pids.max":     "100",
+		"cgroup.procs": strconv.Itoa(pid),
+	} {
+		buf, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != want {
+			t.Errorf("%s = %q, expected %q", file, buf, want)
+		}
+	}
+	buf, err := os.ReadFile(filepath.Join(cgroot, "cgroup.subtree_control"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "+memory +cpu +pids" {
+		t.Errorf("subtree_control = %q", buf)
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	prog, err := seccompFilter()
+	if err != nil {
+		t.Skip(err)
+	}
+	if len(prog) > 4096 {
+		t.Fatalf("filter has %d instructions", len(prog))
+	}
+	for i, ins := range prog {
+		if ins.Code&0x07 != unix.BPF_JMP {
+			continue
+		}
+		if int(ins.Jt)+i+1 >= len(prog) || int(ins.Jf)+i+1 >= len(prog) {
+			t.Errorf("instruction %d jumps past the end", i)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package tenant
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+// CanIsolate returns whether or not
+// tenants can be sandboxed using WithIsolation.
+func CanIsolate() bool { return false }
+
+type isolated struct {
+	cmd *exec.Cmd
+}
+
+func (m *Manager) isolate(id tnproto.ID, cmdline []string) (*isolated, error) {
+	return nil, errors.New("tenant isolation is only supported on linux")
+}
+
+func (i *isolated) start() error        { return i.cmd.Start() }
+func (i *isolated) ooms() int           { return 0 }
+func (i *isolated) removeCgroup() error { return nil }
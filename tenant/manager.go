@@ -77,6 +77,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -107,6 +108,11 @@ const (
 //   locally via Manager.Remote.
 //
 type Manager struct {
+	// evicted and evictedBytes count the
+	// cache files removed by evict;
+	// they are first for 64-bit alignment
+	evicted, evictedBytes int64
+
 	// CacheDir is the root of the directory
 	// tree used for caching data.
 	CacheDir string
@@ -115,10 +121,18 @@ type Manager struct {
 	// with bwrap(1)
 	Sandbox bool
 
+	// isolation, if non-nil, is the native
+	// sandbox used instead of bwrap(1)
+	isolation *Isolation
+
 	// remote is the socket on which to
 	// listen for remote connections
 	// from Manager.Serve
 	remote net.Listener
+	// remoteKey, if non-nil, is the key
+	// used to verify the tokens of
+	// remote connections
+	remoteKey []byte
 
 	// execPath is the executable path
 	// of the tenant binary.
@@ -171,8 +185,10 @@ type Manager struct {
 	// candidates for cached files to
 	// be evicted when a child process
 	// indicates that it is filling a
-	// cache entry
-	eheap evictHeap
+	// cache entry; pheap holds the
+	// protected candidates for EvictSLRU
+	eheap, pheap evictHeap
+	evictPolicy  EvictPolicy
 
 	// when the manager is started,
 	// clean 100% of the cache and
@@ -184,6 +200,14 @@ type Manager struct {
 
 	// warn about being unable to sandbox exactly once
 	warnOnce sync.Once
+
+	// sched limits the number of
+	// concurrent calls to Do
+	sched scheduler
+
+	// memlimit, if non-zero, is the soft
+	// memory limit of each tenant process
+	memlimit int64
 }
 
 // Option is an optional argument
@@ -202,6 +226,78 @@ func WithGCInterval(interval time.Duration) Option {
 	}
 }
 
+// WithEvictionPolicy is an option that can
+// be passed to NewManager to select the policy
+// used to evict files from the cache.
+// The default policy is EvictLRU.
+func WithEvictionPolicy(p EvictPolicy) Option {
+	return func(m *Manager) {
+		m.evictPolicy = p
+	}
+}
+
+// WithConcurrency is an option that can
+// be passed to NewManager to limit the number
+// of queries started with Manager.Do that run
+// at once for each tenant (perTenant) and for
+// all tenants together (node).
+// A limit of zero means no limit.
+//
+// Queries over either limit wait in a queue
+// (see WithQueue) and are started in an order
+// that shares the node fairly between tenants
+// (see WithWeights).
+func WithConcurrency(perTenant, node int) Option {
+	return func(m *Manager) {
+		m.sched.tenant = perTenant
+		m.sched.node = node
+	}
+}
+
+// WithQueue is an option that can be
+// passed to NewManager to indicate how many
+// queries per tenant may wait for the concurrency
+// limits set by WithConcurrency, and for how long.
+// Manager.Do returns ErrOverloaded if the queue
+// is full or a query waits longer than timeout.
+// If timeout is zero, queries wait indefinitely.
+func WithQueue(size int, timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.sched.queue = size
+		m.sched.timeout = timeout
+	}
+}
+
+// WithWeights is an option that can be
+// passed to NewManager to weight the share
+// of the node-wide concurrency limit each tenant
+// receives when queries are waiting; a tenant
+// with weight 2 can run twice as many queries
+// as a tenant with weight 1.
+// Weights less than 1 are treated as 1.
+func WithWeights(fn func(id tnproto.ID) int) Option {
+	return func(m *Manager) {
+		m.sched.weight = fn
+	}
+}
+
+// WithMemoryLimit is an option that can
+// be passed to NewManager to set the soft
+// memory limit (GOMEMLIMIT) of each tenant
+// process to the given number of bytes.
+//
+// The limit is advisory: it makes the Go
+// runtime of the tenant collect garbage more
+// aggressively as the limit is approached,
+// but a tenant process may still exceed it.
+// Use Isolation.Memory (see WithIsolation)
+// to enforce a hard limit.
+func WithMemoryLimit(bytes int64) Option {
+	return func(m *Manager) {
+		m.memlimit = bytes
+	}
+}
+
 const DefaultCacheDir = "/tmp/tenant-cache"
 
 // DefaultEnv is the default
@@ -271,6 +367,18 @@ func WithRemote(l net.Listener) Option {
 	}
 }
 
+// WithRemoteKey is an option that can
+// be passed to NewManager to require that
+// remote connections carry a tnproto.Token
+// signed with key for the requested tenant.
+//
+// See also: tnproto.Sign
+func WithRemoteKey(key []byte) Option {
+	return func(m *Manager) {
+		m.remoteKey = key
+	}
+}
+
 // WithLogger is an option that
 // can be passed to NewManager to
 // have it log diagnostic information.
@@ -325,6 +433,9 @@ type child struct {
 	proc    *os.Process
 	ctl     *net.UnixConn
 	touched time.Time
+	// iso is set if the child
+	// was launched with WithIsolation
+	iso *isolated
 }
 
 var bufPool = sync.Pool{
@@ -402,6 +513,14 @@ func (m *Manager) reap(c *child, id tnproto.ID) {
 		panic(err)
 	}
 	_ = state // TODO: examine state
+	if c.iso != nil {
+		if n := c.iso.ooms(); n > 0 {
+			m.errorf("tenant %s: %d process(es) killed for exceeding the memory limit", id, n)
+		}
+		if err := c.iso.removeCgroup(); err != nil {
+			m.errorf("tenant %s: removing cgroup: %s", id, err)
+		}
+	}
 	m.lock.Lock()
 	// only delete this child if it
 	// precisely the same child instance
@@ -525,19 +644,20 @@ func (m *Manager) launch(id tnproto.ID) (*child, error) {
 	// open, since it is connected to the local fd
 	defer fd.Close()
 
-	// TODO: sandbox the query process.
-	// We can use a tool like bwrap(1) to make most
-	// of the filesystem and other pids invisible
-	// to the child process. We can also stick it
-	// in its own cgroup if we want to limit its
-	// memory and CPU use as well.
-	//
 	// the first file descriptor in exec.Cmd.ExtraFiles
 	// is always "3", so we pass that as the argument
 	// immediately following the tenant id
 	arglist := append(m.execArgs, "-t", id.String(), "-c", "3", "-e", "4")
 	var cmd *exec.Cmd
-	if m.Sandbox && CanSandbox() {
+	var iso *isolated
+	if m.isolation != nil {
+		iso, err = m.isolate(id, append([]string{m.execPath}, arglist...))
+		if err != nil {
+			local.Close()
+			return nil, err
+		}
+		cmd = iso.cmd
+	} else if m.Sandbox && CanSandbox() {
 		cmd = bubblewrap(append([]string{m.execPath}, arglist...), m.cacheDir(id))
 	} else {
 		if m.Sandbox {
@@ -549,6 +669,9 @@ func (m *Manager) launch(id tnproto.ID) (*child, error) {
 	}
 	// note: sandboxing will override
 	cmd.Env = m.envfn(m.cacheDir(id), id)
+	if m.memlimit > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GOMEMLIMIT=%d", m.memlimit))
+	}
 	cmd.Stdin = nil
 	if m.execStderr == nil {
 		cmd.Stdout = os.Stderr
@@ -562,7 +685,11 @@ func (m *Manager) launch(id tnproto.ID) (*child, error) {
 
 	// TODO: populate cmd.Stdout, cmd.Stderr
 	// so that logs go to the right place
-	err = cmd.Start()
+	if iso != nil {
+		err = iso.start()
+	} else {
+		err = cmd.Start()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -573,6 +700,7 @@ func (m *Manager) launch(id tnproto.ID) (*child, error) {
 		proc:    cmd.Process,
 		ctl:     local,
 		touched: time.Now(),
+		iso:     iso,
 	}, nil
 }
 
@@ -613,7 +741,10 @@ func (m *Manager) get(id tnproto.ID) (*child, error) {
 // outstanding simultaneously.
 // (The current implementation determines
 // this by bailing out of acquisition of
-// the child lock after 1 second of inactivity.)
+// the child lock after 1 second of inactivity,
+// or by the limits set with WithConcurrency
+// and WithQueue, in which case Do waits for
+// the query to be admitted.)
 //
 // Once Do returns, the query has begun execution.
 // The returned io.ReadCloser will indicate when
@@ -632,11 +763,28 @@ func (m *Manager) get(id tnproto.ID) (*child, error) {
 // to Do will not close the connection from
 // the perspective of the tenant process.)
 func (m *Manager) Do(id tnproto.ID, t *plan.Tree, ofmt tnproto.OutputFormat, into net.Conn) (io.ReadCloser, error) {
-	c, err := m.get(id)
-	if err != nil {
+	if !m.sched.enabled() {
+		c, err := m.get(id)
+		if err != nil {
+			return nil, err
+		}
+		return c.directExec(t, ofmt, into)
+	}
+	// the query holds its slot until
+	// the returned error pipe is closed
+	if err := m.sched.acquire(id); err != nil {
 		return nil, err
 	}
-	return c.directExec(t, ofmt, into)
+	c, err := m.get(id)
+	if err == nil {
+		var rc io.ReadCloser
+		rc, err = c.directExec(t, ofmt, into)
+		if err == nil {
+			return &releaser{ReadCloser: rc, release: func() { m.sched.release(id) }}, nil
+		}
+	}
+	m.sched.release(id)
+	return nil, err
 }
 
 // Quit sends a SIGQUIT to the tenant process
@@ -682,6 +830,21 @@ func Check(rc io.ReadCloser, stats *plan.ExecStats) error {
 	return &tnproto.RemoteError{Text: "(malformed OK response)"}
 }
 
+// Live returns the number of
+// tenant processes currently running.
+func (m *Manager) Live() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.live)
+}
+
+// Evicted returns the number of cache files
+// and the total number of bytes that have been
+// evicted from the cache since the Manager started.
+func (m *Manager) Evicted() (files, bytes int64) {
+	return atomic.LoadInt64(&m.evicted), atomic.LoadInt64(&m.evictedBytes)
+}
+
 func (m *Manager) errorf(msg string, args ...interface{}) {
 	if m.logger != nil {
 		m.logger.Printf(msg, args...)
@@ -693,7 +856,7 @@ func (m *Manager) errorf(msg string, args ...interface{}) {
 // tenant on *this* machine
 func (m *Manager) handleRemote(conn net.Conn) {
 	defer conn.Close()
-	id, err := tnproto.ReadID(conn)
+	id, tok, err := tnproto.ReadAttach(conn)
 	if err != nil {
 		m.errorf("connection: %s", err)
 		return
@@ -702,17 +865,61 @@ func (m *Manager) handleRemote(conn net.Conn) {
 		m.errorf("refusing to handle zero ID from %s", conn.RemoteAddr())
 		return
 	}
+	if m.remoteKey != nil {
+		if err := tok.Verify(m.remoteKey, id, time.Now()); err != nil {
+			m.errorf("refusing to handle %s from %s: %s", id, conn.RemoteAddr(), err)
+			return
+		}
+	}
 	c, err := m.get(id)
 	if err != nil {
 		m.errorf("couldn't spawn %x: %s", id, err)
 		return
 	}
+	// connections that are not backed by a file
+	// descriptor (i.e. TLS connections) cannot be
+	// passed to the tenant directly, so we pass
+	// one end of a socket pair and relay the
+	// traffic through the other end
+	if _, ok := conn.(syscall.Conn); !ok {
+		here, there, err := usock.SocketPair()
+		if err != nil {
+			m.errorf("id %s: socketpair: %s", id, err)
+			return
+		}
+		err = c.proxyExec(there)
+		there.Close()
+		if err != nil {
+			here.Close()
+			m.errorf("id %s: proxy-exec: %s", id, err)
+			return
+		}
+		relay(conn, here)
+		return
+	}
 	err = c.proxyExec(conn)
 	if err != nil {
 		m.errorf("id %s: proxy-exec: %s", id, err)
 	}
 }
 
+// relay copies data between a and b
+// until either side is closed, and
+// then closes both connections
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyto := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+	}
+	go copyto(a, b)
+	go copyto(b, a)
+	wg.Wait()
+}
+
 // Stop performs a graceful cleanup
 // of all of the tenant manager subprocesses.
 //
@@ -0,0 +1,156 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/plan"
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+// testCerts returns a server and a client
+// configuration that use certificates
+// signed by the same (fresh) CA
+func testCerts(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}
+	return server, client
+}
+
+// test that remote connections can use
+// mutual TLS and that attach tokens
+// are verified when the manager has a key
+func TestRemoteTLS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test will not work on windows")
+	}
+	srvcfg, clientcfg := testCerts(t)
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("peer secret")
+	var logbuf bytes.Buffer
+	m := NewManager([]string{"go", "run", "stub.go", "worker"},
+		WithGCInterval(time.Hour),
+		WithLogger(log.New(&logbuf, "", 0)),
+		WithRemote(tls.NewListener(l, srvcfg)),
+		WithRemoteKey(key),
+	)
+	m.Sandbox = CanSandbox()
+	m.CacheDir = t.TempDir()
+	go m.Serve()
+	defer m.Stop()
+
+	tnproto.SetClientTLS(clientcfg)
+	defer tnproto.SetClientTLS(nil)
+
+	id := randomID()
+	tree := mkplan(t, `SELECT * FROM '../testdata/parking.10n' LIMIT 1`)
+	exec := func(tok tnproto.Token) error {
+		r := &tnproto.Remote{
+			Tenant: id,
+			Net:    "tcp",
+			Addr:   l.Addr().String(),
+			Token:  tok,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		var out bytes.Buffer
+		var stats plan.ExecStats
+		return r.Exec(ctx, tree, nil, &out, &stats)
+	}
+	if err := exec(tnproto.Sign(key, id, time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("signed request: %s", err)
+	}
+	if err := exec(tnproto.Token{}); err == nil {
+		t.Error("unsigned request succeeded")
+	}
+	if err := exec(tnproto.Sign(key, randomID(), time.Now().Add(time.Minute))); err == nil {
+		t.Error("request signed for a different tenant succeeded")
+	}
+	if err := exec(tnproto.Sign([]byte("wrong"), id, time.Now().Add(time.Minute))); err == nil {
+		t.Error("request signed with the wrong key succeeded")
+	}
+	if !strings.Contains(logbuf.String(), "refusing") {
+		t.Errorf("expected refusals to be logged; got %q", logbuf.String())
+	}
+
+	// a client without a certificate
+	// should not be able to connect
+	tnproto.SetClientTLS(&tls.Config{RootCAs: clientcfg.RootCAs})
+	if err := exec(tnproto.Sign(key, id, time.Now().Add(time.Minute))); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+}
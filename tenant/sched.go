@@ -0,0 +1,212 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tenant
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+// scheduler admits queries subject to
+// per-tenant and per-node concurrency limits.
+//
+// Queries that cannot run immediately wait
+// in a bounded per-tenant queue. When a query
+// finishes, the next query to run is taken from
+// the tenant with the fewest running queries
+// relative to its weight, so tenants share
+// the node in proportion to their weights.
+type scheduler struct {
+	tenant  int           // max running per tenant; 0 is unlimited
+	node    int           // max running overall; 0 is unlimited
+	queue   int           // max waiting per tenant
+	timeout time.Duration // max time spent waiting
+	weight  func(id tnproto.ID) int
+
+	lock    sync.Mutex
+	running int
+	seq     uint64
+	tenants map[tnproto.ID]*tenantQueue
+}
+
+type tenantQueue struct {
+	weight  int
+	running int
+	waiting []*waiter
+}
+
+type waiter struct {
+	seq   uint64
+	ready chan struct{}
+}
+
+func (s *scheduler) enabled() bool {
+	return s.tenant > 0 || s.node > 0
+}
+
+func (s *scheduler) canRun(q *tenantQueue) bool {
+	return (s.tenant <= 0 || q.running < s.tenant) &&
+		(s.node <= 0 || s.running < s.node)
+}
+
+func (s *scheduler) get(id tnproto.ID) *tenantQueue {
+	if s.tenants == nil {
+		s.tenants = make(map[tnproto.ID]*tenantQueue)
+	}
+	q := s.tenants[id]
+	if q == nil {
+		q = &tenantQueue{weight: 1}
+		if s.weight != nil {
+			if w := s.weight(id); w > 0 {
+				q.weight = w
+			}
+		}
+		s.tenants[id] = q
+	}
+	return q
+}
+
+// acquire waits until a query for
+// the tenant id may run, or returns
+// ErrOverloaded if the tenant's queue
+// is full or the wait times out
+func (s *scheduler) acquire(id tnproto.ID) error {
+	s.lock.Lock()
+	q := s.get(id)
+	if len(q.waiting) == 0 && s.canRun(q) {
+		q.running++
+		s.running++
+		s.lock.Unlock()
+		return nil
+	}
+	if len(q.waiting) >= s.queue {
+		s.forget(id, q)
+		s.lock.Unlock()
+		return ErrOverloaded
+	}
+	s.seq++
+	w := &waiter{seq: s.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	s.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if s.timeout > 0 {
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-w.ready:
+		return nil
+	case <-timeout:
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-w.ready:
+		// raced with dispatch
+		return nil
+	default:
+	}
+	for i := range q.waiting {
+		if q.waiting[i] == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	s.forget(id, q)
+	return ErrOverloaded
+}
+
+// release releases a query
+// started by a call to acquire
+func (s *scheduler) release(id tnproto.ID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.tenants[id]
+	q.running--
+	s.running--
+	s.dispatch()
+	s.forget(id, q)
+}
+
+// dispatch starts waiting queries while
+// there is capacity, choosing the tenant with
+// the lowest running/weight ratio first
+// (and the oldest waiter to break ties)
+func (s *scheduler) dispatch() {
+	for {
+		var next *tenantQueue
+		for _, q := range s.tenants {
+			if len(q.waiting) == 0 || !s.canRun(q) {
+				continue
+			}
+			if next == nil {
+				next = q
+				continue
+			}
+			// compare running/weight without division
+			a, b := q.running*next.weight, next.running*q.weight
+			if a < b || (a == b && q.waiting[0].seq < next.waiting[0].seq) {
+				next = q
+			}
+		}
+		if next == nil {
+			return
+		}
+		w := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		next.running++
+		s.running++
+		close(w.ready)
+	}
+}
+
+// forget drops the state for an idle tenant
+func (s *scheduler) forget(id tnproto.ID, q *tenantQueue) {
+	if q.running == 0 && len(q.waiting) == 0 {
+		delete(s.tenants, id)
+	}
+}
+
+// releaser calls release once
+// when the query error pipe is closed
+type releaser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// SetReadDeadline forwards to the error pipe
+// so that callers can still set a deadline on it
+func (r *releaser) SetReadDeadline(t time.Time) error {
+	type readDeadliner interface {
+		SetReadDeadline(t time.Time) error
+	}
+	if rd, ok := r.ReadCloser.(readDeadliner); ok {
+		return rd.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tenant
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/tenant/tnproto"
+)
+
+func TestSchedulerLimits(t *testing.T) {
+	s := &scheduler{tenant: 2, queue: 1, timeout: 50 * time.Millisecond}
+	a, b := tnproto.ID{1}, tnproto.ID{2}
+	for i := 0; i < 2; i++ {
+		if err := s.acquire(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other tenants are unaffected
+	if err := s.acquire(b); err != nil {
+		t.Fatal(err)
+	}
+	// the third query for a times out in the queue...
+	start := time.Now()
+	if err := s.acquire(a); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	if time.Since(start) < s.timeout {
+		t.Error("did not wait for the timeout")
+	}
+	// ... and is admitted when a query finishes
+	done := make(chan error, 2)
+	go func() { done <- s.acquire(a) }()
+	for {
+		s.lock.Lock()
+		n := len(s.tenants[a].waiting)
+		s.lock.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the queue is full
+	if err := s.acquire(a); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	s.release(a)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	s.release(a)
+	s.release(a)
+	s.release(b)
+	if s.running != 0 || len(s.tenants) != 0 {
+		t.Errorf("%d running, %d tenants after release", s.running, len(s.tenants))
+	}
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	a, b, c := tnproto.ID{1}, tnproto.ID{2}, tnproto.ID{3}
+	s := &scheduler{
+		node:  3,
+		queue: 10,
+		weight: func(id tnproto.ID) int {
+			if id == a {
+				return 2
+			}
+			return 1
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.acquire(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waiting := func(id tnproto.ID) int {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if q := s.tenants[id]; q != nil {
+			return len(q.waiting)
+		}
+		return 0
+	}
+	queue := func(id tnproto.ID, n int) {
+		for i := 0; i < n; i++ {
+			go s.acquire(id)
+			for waiting(id) != i+1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	queue(b, 3)
+	queue(a, 3)
+	// as slots are freed, b goes first (it waited
+	// the longest) and then a gets two slots for
+	// every one slot b gets
+	for i := 0; i < 3; i++ {
+		s.release(c)
+	}
+	s.lock.Lock()
+	ra, rb := s.tenants[a].running, s.tenants[b].running
+	s.lock.Unlock()
+	if ra != 2 || rb != 1 {
+		t.Errorf("running: a=%d b=%d", ra, rb)
+	}
+	if waiting(a) != 1 || waiting(b) != 2 {
+		t.Errorf("waiting: a=%d b=%d", waiting(a), waiting(b))
+	}
+}
@@ -689,3 +689,56 @@ func (b *benchenv) Stat(_, _ expr.Node) (plan.TableHandle, error) {
 	}
 	return &benchHandle{&blob.List{lst}}, nil
 }
+
+func TestConcurrencyLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test will not work on windows")
+	}
+	m := NewManager([]string{"go", "run", "stub.go", "worker"},
+		WithGCInterval(time.Hour),
+		WithConcurrency(1, 0),
+		WithQueue(0, 0),
+		WithMemoryLimit(1<<30),
+	)
+	m.Sandbox = CanSandbox()
+	m.CacheDir = t.TempDir()
+	defer m.Stop()
+
+	id := randomID()
+	query := `SELECT * FROM '../testdata/parking.10n' LIMIT 1`
+	run := func() (io.ReadCloser, error) {
+		here, there := socketPair(t)
+		defer here.Close()
+		rc, err := m.Do(id, mkplan(t, query), tnproto.OutputRaw, here)
+		if err != nil {
+			there.Close()
+			return nil, err
+		}
+		go func() {
+			io.Copy(io.Discard, there)
+			there.Close()
+		}()
+		return rc, nil
+	}
+	rc, err := run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first query holds the only slot
+	// until its error pipe is closed
+	_, err = run()
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded; got %v", err)
+	}
+	var stats plan.ExecStats
+	if err := Check(rc, &stats); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(rc, &stats); err != nil {
+		t.Fatal(err)
+	}
+}
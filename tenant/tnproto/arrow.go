@@ -0,0 +1,418 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http/httputil"
+
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/plan"
+)
+
+// arrowType is the type of an Arrow column
+type arrowType uint8
+
+const (
+	arrowUtf8 arrowType = iota
+	arrowInt64
+	arrowFloat64
+	arrowBool
+	arrowTimestamp
+)
+
+// arrowTypeOf picks the Arrow type
+// for a column with the given TypeSet;
+// columns that may contain more than one
+// kind of value are written as strings
+func arrowTypeOf(t expr.TypeSet) arrowType {
+	t &^= expr.MissingType | expr.NullType
+	switch {
+	case t == 0:
+		return arrowUtf8
+	case t.Only(expr.BoolType):
+		return arrowBool
+	case t.Only(expr.IntegerType):
+		return arrowInt64
+	case t.Only(expr.NumericType):
+		return arrowFloat64
+	case t.Only(expr.TimeType):
+		return arrowTimestamp
+	default:
+		return arrowUtf8
+	}
+}
+
+// flatbuffer constants from the Arrow
+// Schema.fbs and Message.fbs definitions
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble = 2
+	arrowUnitMicrosecond = 2
+)
+
+// arrowColumn accumulates the buffers
+// of one column of a record batch
+type arrowColumn struct {
+	typ     arrowType
+	n       int
+	nulls   int
+	valid   []byte // validity bitmap
+	values  []byte // fixed-width values, bits, or string data
+	offsets []byte // string offsets
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendBit(bits []byte, n int, set bool) []byte {
+	if n%8 == 0 {
+		bits = append(bits, 0)
+	}
+	if set {
+		bits[n/8] |= 1 << (n % 8)
+	}
+	return bits
+}
+
+func (c *arrowColumn) reset() {
+	c.n = 0
+	c.nulls = 0
+	c.valid = c.valid[:0]
+	c.values = c.values[:0]
+	c.offsets = c.offsets[:0]
+	if c.typ == arrowUtf8 {
+		c.offsets = append(c.offsets, 0, 0, 0, 0)
+	}
+}
+
+// next appends a validity bit and
+// a zero value for fixed-width types
+func (c *arrowColumn) next(valid bool) {
+	c.valid = appendBit(c.valid, c.n, valid)
+	if !valid {
+		c.nulls++
+	}
+	switch c.typ {
+	case arrowInt64, arrowFloat64, arrowTimestamp:
+		c.values = append(c.values, 0, 0, 0, 0, 0, 0, 0, 0)
+	case arrowBool:
+		c.values = appendBit(c.values, c.n, false)
+	case arrowUtf8:
+		c.offsets = appendUint32(c.offsets, uint32(len(c.values)))
+	}
+	c.n++
+}
+
+func (c *arrowColumn) put64(v uint64) {
+	c.next(true)
+	binary.LittleEndian.PutUint64(c.values[len(c.values)-8:], v)
+}
+
+// arrowWriter translates ion structures
+// into an Arrow IPC stream; each chunk of
+// rows passed to Write becomes one record batch
+//
+// The columns and their types are taken from the
+// result set of the query, and values that do not
+// match the column type are written as null.
+// If the result set is not known, writing fails
+// before any output is produced.
+type arrowWriter struct {
+	rows   rowReader
+	types  []arrowType // nil if the result set is not known
+	cols   []arrowColumn
+	w      io.Writer
+	final  io.Closer
+	schema bool
+	n      int // rows in the current batch
+
+	fb    fbBuilder
+	text  bytes.Buffer
+	body  []byte
+	out   []byte
+	nodes [][2]int64
+	bufs  [][2]int64
+}
+
+// httpArrow returns a writer that writes
+// an Arrow IPC stream using HTTP chunked encoding
+func httpArrow(dst io.WriteCloser, cols plan.ResultSet) io.WriteCloser {
+	a := &arrowWriter{
+		w:     httputil.NewChunkedWriter(dst),
+		final: dst,
+	}
+	if names := columnNames(cols); names != nil {
+		a.rows.setColumns(names)
+		types := make([]arrowType, 0, len(a.rows.cols))
+		for i := range cols {
+			// skip duplicate column names
+			if a.rows.index[cols[i].Name] == len(types) {
+				types = append(types, arrowTypeOf(cols[i].Type))
+			}
+		}
+		a.setTypes(types)
+	}
+	return a
+}
+
+func (a *arrowWriter) setTypes(types []arrowType) {
+	a.types = types
+	a.cols = make([]arrowColumn, len(types))
+	for i := range a.cols {
+		a.cols[i].typ = types[i]
+	}
+}
+
+func (a *arrowWriter) value(c *arrowColumn, v []byte) error {
+	if isNull(v) {
+		c.next(false)
+		return nil
+	}
+	t := ion.TypeOf(v)
+	switch c.typ {
+	case arrowInt64:
+		if t == ion.IntType || t == ion.UintType {
+			if i, _, err := ion.ReadInt(v); err == nil {
+				c.put64(uint64(i))
+				return nil
+			}
+		}
+	case arrowFloat64:
+		switch t {
+		case ion.IntType:
+			i, _, err := ion.ReadInt(v)
+			if err != nil {
+				return err
+			}
+			c.put64(math.Float64bits(float64(i)))
+			return nil
+		case ion.UintType:
+			u, _, err := ion.ReadUint(v)
+			if err != nil {
+				return err
+			}
+			c.put64(math.Float64bits(float64(u)))
+			return nil
+		case ion.FloatType:
+			f, _, err := ion.ReadFloat64(v)
+			if err != nil {
+				return err
+			}
+			c.put64(math.Float64bits(f))
+			return nil
+		}
+	case arrowBool:
+		if t == ion.BoolType {
+			b, _, err := ion.ReadBool(v)
+			if err != nil {
+				return err
+			}
+			c.next(true)
+			if b {
+				c.values[(c.n-1)/8] |= 1 << ((c.n - 1) % 8)
+			}
+			return nil
+		}
+	case arrowTimestamp:
+		if t == ion.TimestampType {
+			ts, _, err := ion.ReadTime(v)
+			if err != nil {
+				return err
+			}
+			c.put64(uint64(ts.UnixMicro()))
+			return nil
+		}
+	case arrowUtf8:
+		a.text.Reset()
+		if err := a.rows.text(&a.text, v); err != nil {
+			return err
+		}
+		c.values = append(c.values, a.text.Bytes()...)
+		c.next(true)
+		return nil
+	}
+	// value does not match the column type
+	c.next(false)
+	return nil
+}
+
+func (a *arrowWriter) row() error {
+	a.n++
+	for i, v := range a.rows.fields {
+		if err := a.value(&a.cols[i], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *arrowWriter) Write(p []byte) (int, error) {
+	if a.types == nil {
+		return 0, errNoColumns
+	}
+	for i := range a.cols {
+		a.cols[i].reset()
+	}
+	a.n = 0
+	err := a.rows.each(p, a.row)
+	if err != nil {
+		return 0, err
+	}
+	if a.n == 0 {
+		return len(p), nil
+	}
+	if !a.schema {
+		if err := a.writeSchema(); err != nil {
+			return 0, err
+		}
+	}
+	if err := a.writeBatch(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// message writes an encapsulated IPC message
+func (a *arrowWriter) message(typ uint8, header uint32, body []byte) error {
+	b := &a.fb
+	b.startTable()
+	b.addInt64(3, int64(len(body)))
+	b.addOffset(2, header)
+	b.addInt16(0, arrowMetadataV5)
+	b.addUint8(1, typ)
+	meta := b.finish(b.endTable())
+	a.out = append(a.out[:0], 0xff, 0xff, 0xff, 0xff)
+	a.out = appendUint32(a.out, uint32(len(meta)))
+	a.out = append(a.out, meta...)
+	a.out = append(a.out, body...)
+	_, err := a.w.Write(a.out)
+	return err
+}
+
+func (a *arrowWriter) writeSchema() error {
+	a.schema = true
+	b := &a.fb
+	b.reset()
+	fields := make([]uint32, len(a.types))
+	for i := range a.types {
+		name := b.createString(a.rows.cols[i])
+		var id uint8
+		var typ uint32
+		switch a.types[i] {
+		case arrowInt64:
+			b.startTable()
+			b.addInt32(0, 64)
+			b.addBool(1, true)
+			typ, id = b.endTable(), arrowTypeInt
+		case arrowFloat64:
+			b.startTable()
+			b.addInt16(0, arrowPrecisionDouble)
+			typ, id = b.endTable(), arrowTypeFloatingPoint
+		case arrowBool:
+			b.startTable()
+			typ, id = b.endTable(), arrowTypeBool
+		case arrowTimestamp:
+			tz := b.createString("UTC")
+			b.startTable()
+			b.addOffset(1, tz)
+			b.addInt16(0, arrowUnitMicrosecond)
+			typ, id = b.endTable(), arrowTypeTimestamp
+		default:
+			b.startTable()
+			typ, id = b.endTable(), arrowTypeUtf8
+		}
+		children := b.createOffsets(nil)
+		b.startTable()
+		b.addOffset(0, name)
+		b.addOffset(3, typ)
+		b.addOffset(5, children)
+		b.addBool(1, true) // nullable
+		b.addUint8(2, id)
+		fields[i] = b.endTable()
+	}
+	lst := b.createOffsets(fields)
+	b.startTable()
+	b.addOffset(1, lst)
+	b.addInt16(0, 0) // little-endian
+	return a.message(arrowHeaderSchema, b.endTable(), nil)
+}
+
+// buffer appends buf to the record batch body,
+// padded to a multiple of 8 bytes
+func (a *arrowWriter) buffer(buf []byte) {
+	a.bufs = append(a.bufs, [2]int64{int64(len(a.body)), int64(len(buf))})
+	a.body = append(a.body, buf...)
+	for len(a.body)%8 != 0 {
+		a.body = append(a.body, 0)
+	}
+}
+
+func (a *arrowWriter) writeBatch() error {
+	a.nodes = a.nodes[:0]
+	a.bufs = a.bufs[:0]
+	a.body = a.body[:0]
+	for i := range a.cols {
+		c := &a.cols[i]
+		a.nodes = append(a.nodes, [2]int64{int64(c.n), int64(c.nulls)})
+		a.buffer(c.valid)
+		if c.typ == arrowUtf8 {
+			a.buffer(c.offsets)
+		}
+		a.buffer(c.values)
+	}
+	b := &a.fb
+	b.reset()
+	bufs := b.createPairs(a.bufs)
+	nodes := b.createPairs(a.nodes)
+	b.startTable()
+	b.addInt64(0, int64(a.n))
+	b.addOffset(1, nodes)
+	b.addOffset(2, bufs)
+	return a.message(arrowHeaderRecordBatch, b.endTable(), a.body)
+}
+
+// Close writes the schema if it has not
+// been written yet and the end-of-stream marker
+// and then closes the underlying connection.
+func (a *arrowWriter) Close() error {
+	var err error
+	if !a.schema && a.types != nil {
+		err = a.writeSchema()
+	}
+	if err == nil {
+		_, err = a.w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	}
+	err2 := a.final.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
@@ -57,6 +57,50 @@ func TestAttach(t *testing.T) {
 	}
 }
 
+func TestAttachToken(t *testing.T) {
+	key := []byte("secret key")
+	id := randomID()
+	now := time.Now()
+	tok := Sign(key, id, now.Add(time.Minute))
+
+	r, w := net.Pipe()
+	go func() {
+		err := AttachToken(w, id, &tok)
+		if err != nil {
+			panic(err)
+		}
+		w.Close()
+	}()
+	defer r.Close()
+	outid, outtok, err := ReadAttach(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != outid {
+		t.Fatalf("got id %x; wanted %x", outid, id)
+	}
+	if err := outtok.Verify(key, id, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := outtok.Verify([]byte("other key"), id, now); err != ErrBadToken {
+		t.Errorf("wrong key: got error %v", err)
+	}
+	if err := outtok.Verify(key, randomID(), now); err != ErrBadToken {
+		t.Errorf("wrong id: got error %v", err)
+	}
+	if err := outtok.Verify(key, id, now.Add(2*time.Minute)); err != ErrBadToken {
+		t.Errorf("expired: got error %v", err)
+	}
+	outtok[TokenSize-1] ^= 1
+	if err := outtok.Verify(key, id, now); err != ErrBadToken {
+		t.Errorf("modified: got error %v", err)
+	}
+	var zero Token
+	if err := zero.Verify(key, id, now); err != ErrNoToken {
+		t.Errorf("zero token: got error %v", err)
+	}
+}
+
 type largeOpaque struct{}
 
 func (l largeOpaque) Open() (vm.Table, error) {
@@ -136,3 +180,99 @@ func TestDirectExecHugeBody(t *testing.T) {
 	p.Close()
 	outerwg.Wait()
 }
+
+// endlessTable writes the same
+// chunk of rows until it fails
+type endlessTable struct{}
+
+func (e endlessTable) Open() (vm.Table, error) { return e, nil }
+
+func (e endlessTable) Encode(dst *ion.Buffer, st *ion.Symtab) error {
+	dst.WriteNull()
+	return nil
+}
+
+func (e endlessTable) DecodeHandle(*ion.Symtab, []byte) (plan.TableHandle, error) {
+	return e, nil
+}
+
+func (e endlessTable) Chunks() int { return -1 }
+
+func (e endlessTable) WriteChunks(dst vm.QuerySink, parallel int) error {
+	var st ion.Symtab
+	var body ion.Buffer
+	body.BeginStruct(-1)
+	body.BeginField(st.Intern("x"))
+	body.WriteInt(1)
+	body.EndStruct()
+	var chunk ion.Buffer
+	st.Marshal(&chunk, true)
+	chunk.UnsafeAppend(body.Bytes())
+	w, err := dst.Open()
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			w.Close()
+			return err
+		}
+	}
+}
+
+func TestDirectExecCancel(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip()
+	}
+	here, there, err := usock.SocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer here.Close()
+	defer there.Close()
+	myconn, thereconn, err := usock.SocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thereconn.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(here, endlessTable{})
+	}()
+
+	var b Buffer
+	err = b.Prepare(&plan.Tree{
+		Op: &plan.SimpleAggregate{
+			Nonterminal: plan.Nonterminal{
+				From: &plan.Leaf{
+					Expr: &expr.Table{
+						Binding: expr.Bind(expr.Identifier("foo"), ""),
+					},
+					Handle: endlessTable{},
+				},
+			},
+			Outputs: vm.Aggregation{{Expr: expr.Count(expr.Star{}), Result: "count"}},
+		}}, OutputRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := b.DirectExec(there, myconn)
+	myconn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	rc.Close()
+
+	// once the query is canceled, the
+	// tenant closes the output connection
+	thereconn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.Copy(io.Discard, thereconn)
+	if err != nil {
+		t.Fatalf("query was not canceled: %s", err)
+	}
+	there.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http/httputil"
+
+	"github.com/SnellerInc/sneller/plan"
+)
+
+// csvWriter translates ion structures
+// into CSV records. The header row is
+// written before the first record.
+type csvWriter struct {
+	rows   rowReader
+	w      *csv.Writer
+	final  io.Closer
+	header bool
+	record []string
+	text   bytes.Buffer
+}
+
+// httpCSV returns a writer that writes CSV
+// using HTTP chunked encoding; the columns
+// are taken from cols, and writing fails
+// before any output is produced if cols is empty
+func httpCSV(dst io.WriteCloser, cols plan.ResultSet) io.WriteCloser {
+	c := &csvWriter{
+		w:     csv.NewWriter(httputil.NewChunkedWriter(dst)),
+		final: dst,
+	}
+	if names := columnNames(cols); names != nil {
+		c.rows.setColumns(names)
+	}
+	return c
+}
+
+func (c *csvWriter) writeHeader() error {
+	c.header = true
+	return c.w.Write(c.rows.cols)
+}
+
+func (c *csvWriter) row() error {
+	if !c.header {
+		if err := c.writeHeader(); err != nil {
+			return err
+		}
+	}
+	c.record = c.record[:0]
+	for _, v := range c.rows.fields {
+		c.text.Reset()
+		if err := c.rows.text(&c.text, v); err != nil {
+			return err
+		}
+		c.record = append(c.record, c.text.String())
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvWriter) Write(p []byte) (int, error) {
+	if c.rows.cols == nil {
+		return 0, errNoColumns
+	}
+	err := c.rows.each(p, c.row)
+	c.w.Flush()
+	if err == nil {
+		err = c.w.Error()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the header row if no rows
+// were written and the columns are known
+// and then closes the underlying connection.
+func (c *csvWriter) Close() error {
+	var err error
+	if !c.header && c.rows.cols != nil {
+		err = c.writeHeader()
+		c.w.Flush()
+		if err == nil {
+			err = c.w.Error()
+		}
+	}
+	err2 := c.final.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
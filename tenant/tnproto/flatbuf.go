@@ -0,0 +1,188 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"encoding/binary"
+)
+
+// fbBuilder is a minimal flatbuffers builder.
+// Like the reference implementation, it builds
+// the buffer back-to-front, so objects must be
+// created before the objects that refer to them,
+// and offsets are measured from the end of the buffer.
+type fbBuilder struct {
+	buf    []byte
+	vtable []uint32 // offsets of the fields in the current table
+	start  uint32   // offset of the end of the current table
+}
+
+func (b *fbBuilder) reset() {
+	b.buf = b.buf[:0]
+}
+
+func (b *fbBuilder) offset() uint32 {
+	return uint32(len(b.buf))
+}
+
+// grow prepends n zero bytes to the buffer
+// and returns them
+func (b *fbBuilder) grow(n int) []byte {
+	b.buf = append(b.buf, make([]byte, n)...)
+	copy(b.buf[n:], b.buf[:len(b.buf)-n])
+	front := b.buf[:n]
+	for i := range front {
+		front[i] = 0
+	}
+	return front
+}
+
+// prep pads the buffer so that it is aligned
+// to size after writing extra more bytes
+func (b *fbBuilder) prep(size, extra int) {
+	pad := -(len(b.buf) + extra) & (size - 1)
+	if pad > 0 {
+		b.grow(pad)
+	}
+}
+
+func (b *fbBuilder) putUint16(v uint16) {
+	b.prep(2, 0)
+	binary.LittleEndian.PutUint16(b.grow(2), v)
+}
+
+func (b *fbBuilder) putUint32(v uint32) {
+	b.prep(4, 0)
+	binary.LittleEndian.PutUint32(b.grow(4), v)
+}
+
+func (b *fbBuilder) putUint64(v uint64) {
+	b.prep(8, 0)
+	binary.LittleEndian.PutUint64(b.grow(8), v)
+}
+
+// putOffset writes a reference to the
+// object at offset target
+func (b *fbBuilder) putOffset(target uint32) {
+	b.prep(4, 0)
+	b.putUint32(b.offset() + 4 - target)
+}
+
+func (b *fbBuilder) createString(s string) uint32 {
+	b.prep(4, len(s)+1)
+	b.grow(1) // NUL terminator
+	copy(b.grow(len(s)), s)
+	b.putUint32(uint32(len(s)))
+	return b.offset()
+}
+
+// createOffsets creates a vector of references
+func (b *fbBuilder) createOffsets(lst []uint32) uint32 {
+	b.prep(4, 4*len(lst))
+	for i := len(lst) - 1; i >= 0; i-- {
+		b.putOffset(lst[i])
+	}
+	b.putUint32(uint32(len(lst)))
+	return b.offset()
+}
+
+// createPairs creates a vector of
+// structs containing two 64-bit integers
+func (b *fbBuilder) createPairs(lst [][2]int64) uint32 {
+	b.prep(4, 16*len(lst))
+	b.prep(8, 16*len(lst))
+	for i := len(lst) - 1; i >= 0; i-- {
+		mem := b.grow(16)
+		binary.LittleEndian.PutUint64(mem, uint64(lst[i][0]))
+		binary.LittleEndian.PutUint64(mem[8:], uint64(lst[i][1]))
+	}
+	b.putUint32(uint32(len(lst)))
+	return b.offset()
+}
+
+func (b *fbBuilder) startTable() {
+	b.vtable = b.vtable[:0]
+	b.start = b.offset()
+}
+
+func (b *fbBuilder) slot(i int) {
+	for len(b.vtable) <= i {
+		b.vtable = append(b.vtable, 0)
+	}
+	b.vtable[i] = b.offset()
+}
+
+func (b *fbBuilder) addUint8(i int, v uint8) {
+	b.grow(1)[0] = v
+	b.slot(i)
+}
+
+func (b *fbBuilder) addBool(i int, v bool) {
+	if v {
+		b.addUint8(i, 1)
+	} else {
+		b.addUint8(i, 0)
+	}
+}
+
+func (b *fbBuilder) addInt16(i int, v int16) {
+	b.putUint16(uint16(v))
+	b.slot(i)
+}
+
+func (b *fbBuilder) addInt32(i int, v int32) {
+	b.putUint32(uint32(v))
+	b.slot(i)
+}
+
+func (b *fbBuilder) addInt64(i int, v int64) {
+	b.putUint64(uint64(v))
+	b.slot(i)
+}
+
+func (b *fbBuilder) addOffset(i int, target uint32) {
+	b.putOffset(target)
+	b.slot(i)
+}
+
+// endTable writes the table header and
+// its vtable and returns the table offset
+func (b *fbBuilder) endTable() uint32 {
+	b.putUint32(0) // vtable offset; patched below
+	obj := b.offset()
+	for i := len(b.vtable) - 1; i >= 0; i-- {
+		var pos uint16
+		if b.vtable[i] != 0 {
+			pos = uint16(obj - b.vtable[i])
+		}
+		b.putUint16(pos)
+	}
+	b.putUint16(uint16(obj - b.start))
+	b.putUint16(uint16(4 + 2*len(b.vtable)))
+	vt := b.offset()
+	// the vtable precedes the table, so
+	// the signed offset to it is positive
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-int(obj):], vt-obj)
+	return obj
+}
+
+// finish writes the root table reference
+// and returns the buffer; the size of
+// the buffer is a multiple of 8
+func (b *fbBuilder) finish(root uint32) []byte {
+	b.prep(8, 4)
+	b.putOffset(root)
+	return b.buf
+}
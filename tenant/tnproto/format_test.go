@@ -0,0 +1,448 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http/httputil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/plan"
+)
+
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (n *nopCloser) Close() error { return nil }
+
+// testRows returns a chunk of query output
+// containing a symbol table and three rows
+func testRows() []byte {
+	var st ion.Symtab
+	var body ion.Buffer
+	ts := date.FromTime(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC))
+	row := func(a interface{}, b string, f float64, ok bool, nested bool) {
+		body.BeginStruct(-1)
+		body.BeginField(st.Intern("a"))
+		switch a := a.(type) {
+		case int64:
+			body.WriteInt(a)
+		case nil:
+			body.WriteNull()
+		default:
+			body.WriteString("not a number")
+		}
+		body.BeginField(st.Intern("b"))
+		body.WriteString(b)
+		body.BeginField(st.Intern("t"))
+		body.WriteTime(ts)
+		body.BeginField(st.Intern("f"))
+		body.WriteFloat64(f)
+		body.BeginField(st.Intern("ok"))
+		body.WriteBool(ok)
+		if nested {
+			body.BeginField(st.Intern("n"))
+			body.BeginStruct(-1)
+			body.BeginField(st.Intern("x"))
+			body.WriteSymbol(st.Intern("sym"))
+			body.EndStruct()
+		}
+		body.EndStruct()
+	}
+	row(int64(1), "x,y", 1.5, true, true)
+	row(int64(-2), "z", 2, false, false)
+	row(nil, "", 3, true, true)
+	var out ion.Buffer
+	st.Marshal(&out, true)
+	return append(out.Bytes(), body.Bytes()...)
+}
+
+func unchunk(t *testing.T, buf []byte) []byte {
+	// the final chunk is written by net/http
+	buf = append(buf, "0\r\n\r\n"...)
+	out, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// testCols is the result set of testRows
+var testCols = plan.ResultSet{
+	{Name: "a", Type: expr.IntegerType | expr.NullType},
+	{Name: "b", Type: expr.StringType},
+	{Name: "t", Type: expr.TimeType},
+	{Name: "f", Type: expr.NumericType},
+	{Name: "ok", Type: expr.LogicalType},
+	{Name: "n", Type: expr.AnyType},
+}
+
+func TestCSVWriter(t *testing.T) {
+	var dst nopCloser
+	w := OutputFormat(OutputChunkedCSV).writer(&dst, testCols)
+	if _, err := w.Write(testRows()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "a,b,t,f,ok,n\n" +
+		"1,\"x,y\",2022-01-02T03:04:05Z,1.5,true,\"{\"\"x\"\": \"\"sym\"\"}\"\n" +
+		"-2,z,2022-01-02T03:04:05Z,2,false,\n" +
+		",,2022-01-02T03:04:05Z,3,true,\"{\"\"x\"\": \"\"sym\"\"}\"\n"
+	if got := string(unchunk(t, dst.Bytes())); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// the column order comes from the result set,
+	// and the header is written even without rows
+	cols := plan.ResultSet{{Name: "ok"}, {Name: "a"}}
+	dst.Reset()
+	w = OutputFormat(OutputChunkedCSV).writer(&dst, cols)
+	if _, err := w.Write(testRows()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	want = "ok,a\ntrue,1\nfalse,-2\ntrue,\n"
+	if got := string(unchunk(t, dst.Bytes())); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	dst.Reset()
+	w = OutputFormat(OutputChunkedCSV).writer(&dst, cols)
+	w.Close()
+	if got := string(unchunk(t, dst.Bytes())); got != "ok,a\n" {
+		t.Errorf("empty output: got %q", got)
+	}
+
+}
+
+// fbTable is a flatbuffers table
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+func (f fbTable) u32(pos int) int { return int(binary.LittleEndian.Uint32(f.buf[pos:])) }
+func (f fbTable) u16(pos int) int { return int(binary.LittleEndian.Uint16(f.buf[pos:])) }
+
+// field returns the position of field i,
+// or 0 if the field is absent
+func (f fbTable) field(i int) int {
+	vt := f.pos - int(int32(f.u32(f.pos)))
+	if 4+2*i >= f.u16(vt) {
+		return 0
+	}
+	off := f.u16(vt + 4 + 2*i)
+	if off == 0 {
+		return 0
+	}
+	return f.pos + off
+}
+
+func (f fbTable) ref(i int) int {
+	p := f.field(i)
+	return p + f.u32(p)
+}
+
+func (f fbTable) table(i int) fbTable { return fbTable{f.buf, f.ref(i)} }
+
+func (f fbTable) str(i int) string {
+	p := f.ref(i)
+	return string(f.buf[p+4 : p+4+f.u32(p)])
+}
+
+// vector returns the position of the first
+// element of vector i and its length
+func (f fbTable) vector(i int) (int, int) {
+	p := f.ref(i)
+	return p + 4, f.u32(p)
+}
+
+func fbRoot(buf []byte) fbTable {
+	return fbTable{buf, int(binary.LittleEndian.Uint32(buf))}
+}
+
+// readMessage reads an encapsulated Arrow IPC message;
+// it returns a nil table at the end of the stream
+func readMessage(t *testing.T, r *bufio.Reader) (*fbTable, []byte) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) != 0xffffffff {
+		t.Fatalf("missing continuation marker: %x", hdr)
+	}
+	size := int(binary.LittleEndian.Uint32(hdr[4:]))
+	if size == 0 {
+		return nil, nil
+	}
+	if size%8 != 0 {
+		t.Fatalf("metadata size %d not padded", size)
+	}
+	meta := make([]byte, size)
+	if _, err := io.ReadFull(r, meta); err != nil {
+		t.Fatal(err)
+	}
+	msg := fbRoot(meta)
+	if v := msg.u16(msg.field(0)); v != arrowMetadataV5 {
+		t.Fatalf("metadata version %d", v)
+	}
+	n := 0 // bodyLength defaults to zero
+	if p := msg.field(3); p != 0 {
+		n = int(binary.LittleEndian.Uint64(meta[p:]))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return &msg, body
+}
+
+func TestArrowWriter(t *testing.T) {
+	cols := testCols
+	var dst nopCloser
+	w := OutputFormat(OutputChunkedArrow).writer(&dst, cols)
+	if _, err := w.Write(testRows()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(bytes.NewReader(unchunk(t, dst.Bytes())))
+
+	// schema
+	msg, _ := readMessage(t, r)
+	if msg == nil || msg.buf[msg.field(1)] != arrowHeaderSchema {
+		t.Fatal("expected a schema message")
+	}
+	schema := msg.table(2)
+	start, n := schema.vector(1)
+	if n != len(cols) {
+		t.Fatalf("got %d fields", n)
+	}
+	wantTypes := []byte{arrowTypeInt, arrowTypeUtf8, arrowTypeTimestamp, arrowTypeFloatingPoint, arrowTypeBool, arrowTypeUtf8}
+	for i := 0; i < n; i++ {
+		p := start + 4*i
+		field := fbTable{schema.buf, p + schema.u32(p)}
+		if name := field.str(0); name != cols[i].Name {
+			t.Errorf("field %d name %q", i, name)
+		}
+		if typ := field.buf[field.field(2)]; typ != wantTypes[i] {
+			t.Errorf("field %d type %d", i, typ)
+		}
+		if _, children := field.vector(5); children != 0 {
+			t.Errorf("field %d has %d children", i, children)
+		}
+	}
+
+	// record batch
+	msg, body := readMessage(t, r)
+	if msg == nil || msg.buf[msg.field(1)] != arrowHeaderRecordBatch {
+		t.Fatal("expected a record batch message")
+	}
+	batch := msg.table(2)
+	if rows := binary.LittleEndian.Uint64(batch.buf[batch.field(0):]); rows != 3 {
+		t.Fatalf("got %d rows", rows)
+	}
+	start, n = batch.vector(1)
+	if n != len(cols) {
+		t.Fatalf("got %d nodes", n)
+	}
+	if start%8 != 0 {
+		t.Errorf("nodes at unaligned position %d", start)
+	}
+	nulls := binary.LittleEndian.Uint64(batch.buf[start+8:])
+	if nulls != 1 {
+		t.Errorf("column a has %d nulls", nulls)
+	}
+	start, n = batch.vector(2)
+	if n != 2+3+2+2+2+3 {
+		t.Fatalf("got %d buffers", n)
+	}
+	buffer := func(i int) []byte {
+		off := binary.LittleEndian.Uint64(batch.buf[start+16*i:])
+		size := binary.LittleEndian.Uint64(batch.buf[start+16*i+8:])
+		if off%8 != 0 {
+			t.Errorf("buffer %d at unaligned offset %d", i, off)
+		}
+		return body[off : off+size]
+	}
+	if valid := buffer(0); valid[0] != 0x3 {
+		t.Errorf("validity of a: %b", valid[0])
+	}
+	a := buffer(1)
+	if int64(binary.LittleEndian.Uint64(a)) != 1 || int64(binary.LittleEndian.Uint64(a[8:])) != -2 {
+		t.Errorf("values of a: %x", a)
+	}
+	if offsets, data := buffer(3), buffer(4); string(data) != "x,yz" ||
+		binary.LittleEndian.Uint32(offsets[12:]) != 4 {
+		t.Errorf("values of b: %x %q", offsets, data)
+	}
+	ts := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC).UnixMicro()
+	if got := int64(binary.LittleEndian.Uint64(buffer(6))); got != ts {
+		t.Errorf("values of t: %d", got)
+	}
+	if got := math.Float64frombits(binary.LittleEndian.Uint64(buffer(8)[8:])); got != 2 {
+		t.Errorf("values of f: %g", got)
+	}
+	if got := buffer(10); got[0] != 0x5 {
+		t.Errorf("values of ok: %b", got[0])
+	}
+	if got := string(buffer(13)); got != `{"x": "sym"}{"x": "sym"}` {
+		t.Errorf("values of n: %q", got)
+	}
+
+	if msg, _ := readMessage(t, r); msg != nil {
+		t.Fatal("expected end of stream")
+	}
+}
+
+func TestNoColumns(t *testing.T) {
+	// without a result set, the tabular
+	// formats fail before writing anything
+	for _, f := range []OutputFormat{OutputChunkedCSV, OutputChunkedArrow} {
+		var dst nopCloser
+		w := f.writer(&dst, nil)
+		if _, err := w.Write(testRows()); err != errNoColumns {
+			t.Errorf("format %d: got error %v", f, err)
+		}
+		if dst.Len() != 0 {
+			t.Errorf("format %d: wrote %q", f, dst.Bytes())
+		}
+	}
+}
+
+// arrowTable is the decoded form of
+// an Arrow IPC stream with one record batch
+type arrowTable struct {
+	fields []string   // name and type of each field
+	values [][]string // values of each column
+}
+
+// decodeArrow decodes the types and values
+// used by arrowWriter from an Arrow IPC stream
+func decodeArrow(t *testing.T, buf []byte) *arrowTable {
+	r := bufio.NewReader(bytes.NewReader(buf))
+	msg, _ := readMessage(t, r)
+	if msg == nil || msg.buf[msg.field(1)] != arrowHeaderSchema {
+		t.Fatal("expected a schema message")
+	}
+	out := &arrowTable{}
+	schema := msg.table(2)
+	start, n := schema.vector(1)
+	types := make([]byte, n)
+	for i := 0; i < n; i++ {
+		p := start + 4*i
+		field := fbTable{schema.buf, p + schema.u32(p)}
+		types[i] = field.buf[field.field(2)]
+		desc := fmt.Sprintf("%s type=%d nullable=%v", field.str(0), types[i], field.field(1) != 0 && field.buf[field.field(1)] != 0)
+		typ := field.table(3)
+		switch types[i] {
+		case arrowTypeInt:
+			desc += fmt.Sprintf(" bits=%d signed=%v", typ.u32(typ.field(0)), typ.buf[typ.field(1)] != 0)
+		case arrowTypeFloatingPoint:
+			desc += fmt.Sprintf(" precision=%d", typ.u16(typ.field(0)))
+		case arrowTypeTimestamp:
+			desc += fmt.Sprintf(" unit=%d tz=%s", typ.u16(typ.field(0)), typ.str(1))
+		}
+		out.fields = append(out.fields, desc)
+	}
+	msg, body := readMessage(t, r)
+	if msg == nil || msg.buf[msg.field(1)] != arrowHeaderRecordBatch {
+		t.Fatal("expected a record batch message")
+	}
+	batch := msg.table(2)
+	nodes, _ := batch.vector(1)
+	bufs, _ := batch.vector(2)
+	buffer := func(i int) []byte {
+		off := binary.LittleEndian.Uint64(batch.buf[bufs+16*i:])
+		size := binary.LittleEndian.Uint64(batch.buf[bufs+16*i+8:])
+		return body[off : off+size]
+	}
+	bit := func(b []byte, i int) bool { return b[i/8]&(1<<(i%8)) != 0 }
+	next := 0
+	for i := range types {
+		rows := int(binary.LittleEndian.Uint64(batch.buf[nodes+16*i:]))
+		valid := buffer(next)
+		var offsets []byte
+		if types[i] == arrowTypeUtf8 {
+			next++
+			offsets = buffer(next)
+		}
+		values := buffer(next + 1)
+		next += 2
+		col := make([]string, rows)
+		for j := range col {
+			if len(valid) > 0 && !bit(valid, j) {
+				col[j] = "null"
+				continue
+			}
+			switch types[i] {
+			case arrowTypeInt, arrowTypeTimestamp:
+				col[j] = fmt.Sprint(int64(binary.LittleEndian.Uint64(values[8*j:])))
+			case arrowTypeFloatingPoint:
+				col[j] = fmt.Sprint(math.Float64frombits(binary.LittleEndian.Uint64(values[8*j:])))
+			case arrowTypeBool:
+				col[j] = fmt.Sprint(bit(values, j))
+			case arrowTypeUtf8:
+				lo := binary.LittleEndian.Uint32(offsets[4*j:])
+				hi := binary.LittleEndian.Uint32(offsets[4*j+4:])
+				col[j] = fmt.Sprintf("%q", values[lo:hi])
+			}
+		}
+		out.values = append(out.values, col)
+	}
+	if msg, _ := readMessage(t, r); msg != nil {
+		t.Fatal("expected end of stream")
+	}
+	return out
+}
+
+// TestArrowReference compares the output of
+// arrowWriter with testdata/reference.arrows,
+// which was written by the Arrow Go library
+// (github.com/apache/arrow/go/v12) from the
+// same rows and schema as testRows and testCols
+func TestArrowReference(t *testing.T) {
+	ref, err := os.ReadFile("testdata/reference.arrows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst nopCloser
+	w := OutputFormat(OutputChunkedArrow).writer(&dst, testCols)
+	if _, err := w.Write(testRows()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := decodeArrow(t, ref)
+	got := decodeArrow(t, unchunk(t, dst.Bytes()))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
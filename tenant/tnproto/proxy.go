@@ -18,13 +18,13 @@ package tnproto
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http/httputil"
-	"os"
 	"time"
 
 	"github.com/SnellerInc/sneller/ion"
@@ -51,6 +51,16 @@ const (
 	// OutputChunkedJSONArray outputs a single
 	// JSON array object using HTTP chunked encoding
 	OutputChunkedJSONArray
+	// OutputChunkedCSV outputs CSV with a header row
+	// using HTTP chunked encoding
+	OutputChunkedCSV
+	// OutputChunkedArrow outputs an Arrow IPC stream
+	// using HTTP chunked encoding
+	OutputChunkedArrow
+	// OutputAnalyze discards the query output
+	// and collects per-op statistics (see plan.ExecStats.Trace),
+	// which are returned along with the other statistics
+	OutputAnalyze
 )
 
 func (o OutputFormat) String() string {
@@ -63,6 +73,12 @@ func (o OutputFormat) String() string {
 		return "chunked-json"
 	case OutputChunkedJSONArray:
 		return "chunked-json-array"
+	case OutputChunkedCSV:
+		return "chunked-csv"
+	case OutputChunkedArrow:
+		return "chunked-arrow"
+	case OutputAnalyze:
+		return "analyze"
 	default:
 		return fmt.Sprintf("unknown format %c", byte(o))
 	}
@@ -73,7 +89,9 @@ func (o OutputFormat) String() string {
 // handled by the net/http package when
 // the parent's HTTP handler returns,
 // hence we do not call http.NewChunkedWriter(...).Close()
-func (o OutputFormat) writer(dst io.WriteCloser) io.WriteCloser {
+//
+// The tabular formats take their columns from cols.
+func (o OutputFormat) writer(dst io.WriteCloser, cols plan.ResultSet) io.WriteCloser {
 	switch o {
 	case OutputRaw:
 		return dst
@@ -83,6 +101,12 @@ func (o OutputFormat) writer(dst io.WriteCloser) io.WriteCloser {
 		return httpChunkedJSON(dst)
 	case OutputChunkedJSONArray:
 		return httpJSONArray(dst)
+	case OutputChunkedCSV:
+		return httpCSV(dst, cols)
+	case OutputChunkedArrow:
+		return httpArrow(dst, cols)
+	case OutputAnalyze:
+		return &writerCloser{Writer: io.Discard, Closer: dst}
 	default:
 		panic(fmt.Sprintf("bad output format: %s", o))
 	}
@@ -230,6 +254,8 @@ func (b *Buffer) Prepare(t *plan.Tree, f OutputFormat) error {
 // Otherwise, the data returned via the ReadCloser
 // will consist of error text describing how the
 // query failed to execute.
+// Closing the ReadCloser before the query has
+// completed cancels the query.
 //
 // DirectExec makes multiple calls to read and
 // write data via 'ctl', so the caller is required
@@ -347,7 +373,7 @@ func Serve(ctl *net.UnixConn, dec plan.Decoder) error {
 				if err != nil {
 					return err
 				}
-				go serveDirect(t, ofmt.writer(conn), errorWriter)
+				go serveDirect(t, ofmt.writer(conn, t.OutputType), errorWriter, ofmt == OutputAnalyze)
 			}
 		} else {
 			if conn != nil {
@@ -363,9 +389,22 @@ func serveProxy(dec plan.Decoder, conn net.Conn) {
 	plan.Serve(conn, dec)
 }
 
-func serveDirect(t *plan.Tree, conn io.WriteCloser, errpipe io.WriteCloser) {
+func serveDirect(t *plan.Tree, conn io.WriteCloser, errpipe io.ReadWriteCloser, trace bool) {
 	defer errpipe.Close()
 
+	// the caller closes its end of the error
+	// pipe to indicate that the query should
+	// be canceled; nothing is ever written to
+	// this end, so any return from Read means
+	// either cancellation or that we are done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var tmp [1]byte
+		errpipe.Read(tmp[:])
+		cancel()
+	}()
+
 	// if we encounter a panic, we don't
 	// want to close the errpipe with no output,
 	// as that would indicate the query terminated
@@ -383,8 +422,8 @@ func serveDirect(t *plan.Tree, conn io.WriteCloser, errpipe io.WriteCloser) {
 			panic(e)
 		}
 	}()
-	var stats plan.ExecStats
-	err := plan.Exec(t, conn, &stats)
+	stats := plan.ExecStats{Trace: trace}
+	err := plan.ExecContext(ctx, t, conn, &stats)
 	// must close the connection before
 	// indicating the query status to the caller
 	conn.Close()
@@ -412,20 +451,20 @@ func errnow(ctl *net.UnixConn, err error, tmp []byte) error {
 // inside the tenant process,
 // indicate that we unpacked the plan
 // and have begun execution; use the returned
-// error pipe for receiving out-of-band error
-// notifications
-func detach(ctl *net.UnixConn) (io.WriteCloser, error) {
-	r, w, err := os.Pipe()
+// error pipe for sending out-of-band error
+// notifications and receiving cancellation
+func detach(ctl *net.UnixConn) (io.ReadWriteCloser, error) {
+	ours, theirs, err := usock.SocketPair()
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
-	_, err = usock.WriteWithFile(ctl, detachmsg, r)
+	defer theirs.Close()
+	_, err = usock.WriteWithConn(ctl, detachmsg, theirs)
 	if err != nil {
-		w.Close()
+		ours.Close()
 		return nil, err
 	}
-	return w, nil
+	return ours, nil
 }
 
 type writerCloser struct {
@@ -89,10 +89,23 @@ func (h *header) populate(id ID) {
 //
 // See also: Attach
 func ReadID(src net.Conn) (ID, error) {
+	id, _, err := ReadAttach(src)
+	return id, err
+}
+
+// ReadAttach is like ReadID, but it also returns
+// the Token included in the Attach message.
+// The Token is the zero Token if the message
+// was written with Attach rather than AttachToken.
+//
+// See also: AttachToken, Token.Verify
+func ReadAttach(src net.Conn) (ID, Token, error) {
 	var hdr header
+	var tok Token
 	_, err := io.ReadFull(src, hdr.body[:])
 	if err != nil {
-		return ID{}, err
+		return ID{}, tok, err
 	}
-	return hdr.ID(), hdr.validate()
+	copy(tok[:], hdr.body[tokenOffset:])
+	return hdr.ID(), tok, hdr.validate()
 }
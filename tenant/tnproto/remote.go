@@ -15,6 +15,8 @@
 package tnproto
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -53,6 +55,12 @@ type Remote struct {
 	// of dialing (like DNS resolution)
 	// are part of the timeout window.
 	Timeout time.Duration
+
+	// Token, if non-zero, is sent along with
+	// the Attach message so that the remote
+	// proxy can verify that the request is
+	// authorized. See Sign.
+	Token Token
 }
 
 // callback for decoding remote transports
@@ -80,6 +88,11 @@ func decodeRemote(st *ion.Symtab, fields []byte) (plan.Transport, error) {
 			if err == nil && copy(out.Tenant[:], buf) != len(out.Tenant[:]) {
 				err = fmt.Errorf("decoding tnproto.Remote: tenant ID should not be %d bytes", len(buf))
 			}
+		case "token":
+			buf, fields, err = ion.ReadBytesShared(fields)
+			if err == nil && copy(out.Token[:], buf) != len(out.Token[:]) {
+				err = fmt.Errorf("decoding tnproto.Remote: token should not be %d bytes", len(buf))
+			}
 		default:
 			fields = fields[ion.SizeOf(fields):]
 		}
@@ -100,6 +113,10 @@ func (r *Remote) Encode(dst *ion.Buffer, st *ion.Symtab) {
 	dst.WriteString(r.Addr)
 	dst.BeginField(st.Intern("id"))
 	dst.WriteBlob(r.Tenant[:])
+	if !r.Token.IsZero() {
+		dst.BeginField(st.Intern("token"))
+		dst.WriteBlob(r.Token[:])
+	}
 	dst.EndStruct()
 }
 
@@ -114,23 +131,37 @@ var clientPool = sync.Pool{
 // and sending it an Attach message, followed
 // by a single query execution request with
 // plan.Client.Exec.
+// If a TLS configuration has been set
+// with SetClientTLS, the connection uses TLS.
+//
+// Canceling ctx closes the connection,
+// which cancels the query on the remote tenant.
 //
 // See also: Attach
-func (r *Remote) Exec(t *plan.Tree, rw plan.TableRewrite, dst io.Writer, stats *plan.ExecStats) error {
-	var conn net.Conn
-	var err error
-	if r.Timeout != 0 {
-		conn, err = net.DialTimeout(r.Net, r.Addr, r.Timeout)
-	} else {
-		conn, err = net.Dial(r.Net, r.Addr)
-	}
+func (r *Remote) Exec(ctx context.Context, t *plan.Tree, rw plan.TableRewrite, dst io.Writer, stats *plan.ExecStats) error {
+	d := net.Dialer{Timeout: r.Timeout}
+	conn, err := d.DialContext(ctx, r.Net, r.Addr)
 	if err != nil {
 		return err
 	}
+	if cfg := getClientTLS(); cfg != nil {
+		if cfg.ServerName == "" {
+			host, _, _ := net.SplitHostPort(r.Addr)
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+	}
 	// tell the tenant manager to attach us
 	// to the right tenant instance
-	err = Attach(conn, r.Tenant)
+	err = AttachToken(conn, r.Tenant, &r.Token)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	// now we should be talking to the tenant itself;
@@ -141,5 +172,5 @@ func (r *Remote) Exec(t *plan.Tree, rw plan.TableRewrite, dst io.Writer, stats *
 		cl.Close()
 		clientPool.Put(cl)
 	}()
-	return cl.Exec(t, rw, dst, stats)
+	return cl.Exec(ctx, t, rw, dst, stats)
 }
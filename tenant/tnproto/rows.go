@@ -0,0 +1,199 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/SnellerInc/sneller/plan"
+)
+
+// errNoColumns is returned by the tabular
+// output formats when the result set of
+// the query is not known (as is the case
+// for SELECT * on data without a schema)
+var errNoColumns = errors.New("tnproto: tabular output requires a query with a known result set")
+
+// rowReader splits a stream of ion structures
+// into rows with a fixed set of columns
+// for the tabular output formats
+type rowReader struct {
+	st ion.Symtab
+	// cols is the list of column names;
+	// it is nil if the result set is not known
+	cols  []string
+	index map[string]int
+	// fields holds the value of each column
+	// in the current row, or nil if the
+	// column is MISSING from the row
+	fields [][]byte
+	tmp    []byte
+}
+
+func columnNames(rs plan.ResultSet) []string {
+	if len(rs) == 0 {
+		return nil
+	}
+	out := make([]string, len(rs))
+	for i := range rs {
+		out[i] = rs[i].Name
+	}
+	return out
+}
+
+func (r *rowReader) setColumns(names []string) {
+	r.cols = make([]string, 0, len(names))
+	r.index = make(map[string]int, len(names))
+	for i := range names {
+		if _, ok := r.index[names[i]]; ok {
+			continue
+		}
+		r.index[names[i]] = len(r.cols)
+		r.cols = append(r.cols, names[i])
+	}
+	r.fields = make([][]byte, len(r.cols))
+}
+
+// read sets r.fields to the values of the
+// columns in row; fields that are not
+// columns are ignored
+func (r *rowReader) read(row []byte) error {
+	if r.cols == nil {
+		return errNoColumns
+	}
+	body, _ := ion.Contents(row)
+	for i := range r.fields {
+		r.fields[i] = nil
+	}
+	for len(body) > 0 {
+		sym, rest, err := ion.ReadLabel(body)
+		if err != nil {
+			return err
+		}
+		size := ion.SizeOf(rest)
+		if size <= 0 || size > len(rest) {
+			return fmt.Errorf("tnproto: invalid field size %d", size)
+		}
+		name := r.st.Get(sym)
+		if i, ok := r.index[name]; ok {
+			r.fields[i] = rest[:size]
+		}
+		body = rest[size:]
+	}
+	return nil
+}
+
+// each calls fn for each row in src;
+// r.fields holds the values of the row
+// for the duration of the call
+func (r *rowReader) each(src []byte, fn func() error) error {
+	return r.walk(src, func(row []byte) error {
+		if err := r.read(row); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// walk calls fn with each structure in src,
+// updating r.st as symbol tables are encountered
+func (r *rowReader) walk(src []byte, fn func(row []byte) error) error {
+	var err error
+	for len(src) > 0 {
+		if ion.IsBVM(src) || ion.TypeOf(src) == ion.AnnotationType {
+			src, err = r.st.Unmarshal(src)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		size := ion.SizeOf(src)
+		if size <= 0 || size > len(src) {
+			return fmt.Errorf("tnproto: invalid object size %d", size)
+		}
+		switch t := ion.TypeOf(src); t {
+		case ion.NullType:
+			// nop pad
+		case ion.StructType:
+			if err := fn(src[:size]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("tnproto: unexpected top-level ion type %s", t)
+		}
+		src = src[size:]
+	}
+	return nil
+}
+
+// isNull returns whether v is MISSING or NULL
+func isNull(v []byte) bool {
+	return len(v) == 0 || v[0]&0x0f == 0x0f
+}
+
+// text writes the textual representation of
+// the value v into dst; strings and symbols
+// are written without quotes, scalars are
+// formatted as they would be in JSON, and
+// lists and structures are written as JSON
+func (r *rowReader) text(dst *bytes.Buffer, v []byte) error {
+	if isNull(v) {
+		return nil
+	}
+	var err error
+	switch ion.TypeOf(v) {
+	case ion.StringType:
+		var s []byte
+		s, _, err = ion.ReadStringShared(v)
+		dst.Write(s)
+	case ion.SymbolType:
+		var sym ion.Symbol
+		sym, _, err = ion.ReadSymbol(v)
+		dst.WriteString(r.st.Get(sym))
+	case ion.BoolType:
+		var b bool
+		b, _, err = ion.ReadBool(v)
+		r.tmp = strconv.AppendBool(r.tmp[:0], b)
+		dst.Write(r.tmp)
+	case ion.UintType:
+		var u uint64
+		u, _, err = ion.ReadUint(v)
+		r.tmp = strconv.AppendUint(r.tmp[:0], u, 10)
+		dst.Write(r.tmp)
+	case ion.IntType:
+		var i int64
+		i, _, err = ion.ReadInt(v)
+		r.tmp = strconv.AppendInt(r.tmp[:0], i, 10)
+		dst.Write(r.tmp)
+	case ion.FloatType:
+		var f float64
+		f, _, err = ion.ReadFloat64(v)
+		r.tmp = strconv.AppendFloat(r.tmp[:0], f, 'g', -1, 64)
+		dst.Write(r.tmp)
+	case ion.TimestampType:
+		var t date.Time
+		t, _, err = ion.ReadTime(v)
+		r.tmp = t.AppendRFC3339Nano(r.tmp[:0])
+		dst.Write(r.tmp)
+	default:
+		_, err = ion.WriteJSON(&r.st, dst, v)
+	}
+	return err
+}
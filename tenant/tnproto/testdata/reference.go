@@ -0,0 +1,63 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This program writes reference.arrows using the
+// Arrow Go library; it is not part of the build.
+// To regenerate the file, run it in a module
+// that requires github.com/apache/arrow/go/v12:
+//
+//	go run reference.go > reference.arrows
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+func main() {
+	mem := memory.NewGoAllocator()
+	// the same columns and rows as
+	// testCols and testRows in format_test.go
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "a", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "b", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "t", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, Nullable: true},
+		{Name: "f", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "ok", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+		{Name: "n", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(mem, schema)
+	defer b.Release()
+	ts := arrow.Timestamp(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC).UnixMicro())
+	b.Field(0).(*array.Int64Builder).AppendValues([]int64{1, -2, 0}, []bool{true, true, false})
+	b.Field(1).(*array.StringBuilder).AppendValues([]string{"x,y", "z", ""}, nil)
+	b.Field(2).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{ts, ts, ts}, nil)
+	b.Field(3).(*array.Float64Builder).AppendValues([]float64{1.5, 2, 3}, nil)
+	b.Field(4).(*array.BooleanBuilder).AppendValues([]bool{true, false, true}, nil)
+	b.Field(5).(*array.StringBuilder).AppendValues([]string{`{"x": "sym"}`, "", `{"x": "sym"}`}, []bool{true, false, true})
+	rec := b.NewRecord()
+	defer rec.Release()
+	w := ipc.NewWriter(os.Stdout, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+	if err := w.Write(rec); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tnproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// TokenSize is the size of a Token
+const TokenSize = HeaderSize - tokenOffset
+
+const (
+	// the token occupies the
+	// slack at the end of the header
+	tokenOffset  = idOffset + IDSize
+	expiryOffset = 0
+	expirySize   = 8
+	macOffset    = expiryOffset + expirySize
+)
+
+// Token authorizes an Attach message
+// for one tenant until it expires.
+// Tokens are produced by Sign using a
+// key that is shared between peers.
+type Token [TokenSize]byte
+
+var zeroToken Token
+
+// IsZero returns true if t is the zero Token.
+func (t *Token) IsZero() bool { return *t == zeroToken }
+
+var (
+	// ErrNoToken is returned by Token.Verify
+	// when an Attach message was not signed.
+	ErrNoToken = errors.New("tnproto: attach message has no token")
+	// ErrBadToken is returned by Token.Verify
+	// when an Attach message has an invalid
+	// or expired token.
+	ErrBadToken = errors.New("tnproto: invalid attach token")
+)
+
+func mac(key []byte, id ID, expiry []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("sneller-attach"))
+	h.Write(id[:])
+	h.Write(expiry)
+	return h.Sum(nil)
+}
+
+// Sign produces a Token that authorizes
+// attaching to the tenant id until expires.
+func Sign(key []byte, id ID, expires time.Time) Token {
+	var t Token
+	binary.LittleEndian.PutUint64(t[expiryOffset:], uint64(expires.Unix()))
+	copy(t[macOffset:], mac(key, id, t[expiryOffset:macOffset]))
+	return t
+}
+
+// Verify checks that t was produced by Sign
+// with the same key and id and that it
+// has not expired as of now.
+func (t *Token) Verify(key []byte, id ID, now time.Time) error {
+	if t.IsZero() {
+		return ErrNoToken
+	}
+	want := mac(key, id, t[expiryOffset:macOffset])
+	if !hmac.Equal(t[macOffset:], want[:TokenSize-macOffset]) {
+		return ErrBadToken
+	}
+	expires := int64(binary.LittleEndian.Uint64(t[expiryOffset:]))
+	if now.Unix() > expires {
+		return ErrBadToken
+	}
+	return nil
+}
+
+var clientTLS atomic.Value // *tls.Config
+
+// SetClientTLS sets the TLS configuration
+// used by Remote.Exec to connect to remote
+// tenant proxies. A nil config means that
+// connections are made in plaintext.
+func SetClientTLS(c *tls.Config) {
+	clientTLS.Store(c)
+}
+
+func getClientTLS() *tls.Config {
+	c, _ := clientTLS.Load().(*tls.Config)
+	return c
+}
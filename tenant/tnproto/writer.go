@@ -23,8 +23,17 @@ import (
 // attach this connection to the tenant
 // given by id.
 func Attach(dst net.Conn, id ID) error {
+	return AttachToken(dst, id, &zeroToken)
+}
+
+// AttachToken is like Attach, but it
+// includes a Token in the Attach message
+// so that the remote proxy can verify
+// that the request is authorized.
+func AttachToken(dst net.Conn, id ID, tok *Token) error {
 	var hdr header
 	hdr.populate(id)
+	copy(hdr.body[tokenOffset:], tok[:])
 	_, err := dst.Write(hdr.body[:])
 	return err
 }
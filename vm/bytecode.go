@@ -385,6 +385,7 @@ var opinfo = [_maxbcop]bcopinfo{
 	ophashvalueplus: {text: "hashvalue+", imms: bcImmsS16S16, flags: bcReadK | bcReadV | bcReadWriteH},
 	ophashmember:    {text: "hashmember", imms: bcImmsS16U16, flags: bcReadWriteK | bcReadH},
 	ophashlookup:    {text: "hashlookup", imms: bcImmsS16U16, flags: bcReadWriteK | bcWriteV | bcReadH},
+	ophashint:       {text: "hashint", imms: bcImmsS16, flags: bcReadK | bcWriteS | bcReadH},
 
 	// Simple aggregate operations
 	opaggsumf:  {text: "aggsum.f", imms: bcImmsS16, flags: bcReadK | bcReadS},
@@ -9384,6 +9384,24 @@ TEXT hashimpl_tail(SB), NOSPLIT|NOFRAME, $0
   VMOVDQU32        Z9, 192(R8)
   NEXT()
 
+// convert the low 64 bits of
+// each hash in a slot into an integer
+TEXT bchashint(SB), NOSPLIT|NOFRAME, $0
+  MOVWQZX          0(VIRT_PCREG), R8
+  ADDQ             $2, VIRT_PCREG
+  ADDQ             bytecode_hashmem(VIRT_BCPTR), R8
+  KSHIFTRW         $8, K1, K2
+  VMOVDQU64        0(R8), Z2
+  VMOVDQU64        64(R8), Z4
+  VPUNPCKLQDQ      Z4, Z2, Z2
+  VMOVDQU64        128(R8), Z3
+  VMOVDQU64        192(R8), Z4
+  VPUNPCKLQDQ      Z4, Z3, Z3
+  VMOVDQU64        permute64+0(SB), Z4
+  VPERMQ           Z2, Z4, K1, Z2
+  VPERMQ           Z3, Z4, K2, Z3
+  NEXT()
+
 #define QROUNDx4(rowa, rowb, rowc, rowd, ztmp) \
   VPADDD rowa, rowb, rowa                      \
   VPXORD rowa, rowd, ztmp                      \
@@ -866,6 +866,23 @@ func compilefunc(p *prog, b *expr.Builtin, args []expr.Node) (*value, error) {
 		}
 
 		return p.ssa2(sobjectsize, arg, p.mask(arg)), nil
+	case expr.Hash:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("HASH requires at least one argument")
+		}
+		var h *value
+		for i := range args {
+			v, err := p.serialized(args[i])
+			if err != nil {
+				return nil, err
+			}
+			if h == nil {
+				h = p.hash(v)
+			} else {
+				h = p.hashplus(h, v)
+			}
+		}
+		return p.hashint(h), nil
 	case expr.HashLookup:
 		return p.compileHashLookup(b.Args)
 	default:
@@ -198,61 +198,62 @@ const (
 	opboxstring              bcop = 192
 	ophashvalue              bcop = 193
 	ophashvalueplus          bcop = 194
-	ophashmember             bcop = 195
-	ophashlookup             bcop = 196
-	opaggsumf                bcop = 197
-	opaggsumi                bcop = 198
-	opaggminf                bcop = 199
-	opaggmini                bcop = 200
-	opaggmaxf                bcop = 201
-	opaggmaxi                bcop = 202
-	opaggcount               bcop = 203
-	opaggbucket              bcop = 204
-	opaggslotaddf            bcop = 205
-	opaggslotaddi            bcop = 206
-	opaggslotavgf            bcop = 207
-	opaggslotavgi            bcop = 208
-	opaggslotminf            bcop = 209
-	opaggslotmini            bcop = 210
-	opaggslotmaxf            bcop = 211
-	opaggslotmaxi            bcop = 212
-	opaggslotcount           bcop = 213
-	oplitref                 bcop = 214
-	opsplit                  bcop = 215
-	optuple                  bcop = 216
-	opdupv                   bcop = 217
-	opzerov                  bcop = 218
-	opobjectsize             bcop = 219
-	opCmpStrEqCs             bcop = 220
-	opCmpStrEqCi             bcop = 221
-	opCmpStrEqUTF8Ci         bcop = 222
-	opSkip1charLeft          bcop = 223
-	opSkip1charRight         bcop = 224
-	opSkipNcharLeft          bcop = 225
-	opSkipNcharRight         bcop = 226
-	opTrimWsLeft             bcop = 227
-	opTrimWsRight            bcop = 228
-	opTrim4charLeft          bcop = 229
-	opTrim4charRight         bcop = 230
-	opTrimPrefixCs           bcop = 231
-	opTrimPrefixCi           bcop = 232
-	opTrimSuffixCs           bcop = 233
-	opTrimSuffixCi           bcop = 234
-	opContainsSubstrCs       bcop = 235
-	opContainsSubstrCi       bcop = 236
-	opContainsSuffixCs       bcop = 237
-	opContainsSuffixCi       bcop = 238
-	opContainsSuffixUTF8Ci   bcop = 239
-	opContainsPrefixCs       bcop = 240
-	opContainsPrefixCi       bcop = 241
-	opContainsPrefixUTF8Ci   bcop = 242
-	opLengthStr              bcop = 243
-	opSubstr                 bcop = 244
-	opSplitPart              bcop = 245
-	opMatchpatCs             bcop = 246
-	opMatchpatCi             bcop = 247
-	opMatchpatUTF8Ci         bcop = 248
-	opIsSubnetOfIP4          bcop = 249
-	optrap                   bcop = 250
-	_maxbcop                      = 251
+	ophashint                bcop = 195
+	ophashmember             bcop = 196
+	ophashlookup             bcop = 197
+	opaggsumf                bcop = 198
+	opaggsumi                bcop = 199
+	opaggminf                bcop = 200
+	opaggmini                bcop = 201
+	opaggmaxf                bcop = 202
+	opaggmaxi                bcop = 203
+	opaggcount               bcop = 204
+	opaggbucket              bcop = 205
+	opaggslotaddf            bcop = 206
+	opaggslotaddi            bcop = 207
+	opaggslotavgf            bcop = 208
+	opaggslotavgi            bcop = 209
+	opaggslotminf            bcop = 210
+	opaggslotmini            bcop = 211
+	opaggslotmaxf            bcop = 212
+	opaggslotmaxi            bcop = 213
+	opaggslotcount           bcop = 214
+	oplitref                 bcop = 215
+	opsplit                  bcop = 216
+	optuple                  bcop = 217
+	opdupv                   bcop = 218
+	opzerov                  bcop = 219
+	opobjectsize             bcop = 220
+	opCmpStrEqCs             bcop = 221
+	opCmpStrEqCi             bcop = 222
+	opCmpStrEqUTF8Ci         bcop = 223
+	opSkip1charLeft          bcop = 224
+	opSkip1charRight         bcop = 225
+	opSkipNcharLeft          bcop = 226
+	opSkipNcharRight         bcop = 227
+	opTrimWsLeft             bcop = 228
+	opTrimWsRight            bcop = 229
+	opTrim4charLeft          bcop = 230
+	opTrim4charRight         bcop = 231
+	opTrimPrefixCs           bcop = 232
+	opTrimPrefixCi           bcop = 233
+	opTrimSuffixCs           bcop = 234
+	opTrimSuffixCi           bcop = 235
+	opContainsSubstrCs       bcop = 236
+	opContainsSubstrCi       bcop = 237
+	opContainsSuffixCs       bcop = 238
+	opContainsSuffixCi       bcop = 239
+	opContainsSuffixUTF8Ci   bcop = 240
+	opContainsPrefixCs       bcop = 241
+	opContainsPrefixCi       bcop = 242
+	opContainsPrefixUTF8Ci   bcop = 243
+	opLengthStr              bcop = 244
+	opSubstr                 bcop = 245
+	opSplitPart              bcop = 246
+	opMatchpatCs             bcop = 247
+	opMatchpatCi             bcop = 248
+	opMatchpatUTF8Ci         bcop = 249
+	opIsSubnetOfIP4          bcop = 250
+	optrap                   bcop = 251
+	_maxbcop                      = 252
 )
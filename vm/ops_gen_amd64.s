@@ -198,62 +198,62 @@ DATA opaddrs+0x5f8(SB)/8, $bcboxmask3(SB)
 DATA opaddrs+0x600(SB)/8, $bcboxstring(SB)
 DATA opaddrs+0x608(SB)/8, $bchashvalue(SB)
 DATA opaddrs+0x610(SB)/8, $bchashvalueplus(SB)
-DATA opaddrs+0x618(SB)/8, $bchashmember(SB)
-DATA opaddrs+0x620(SB)/8, $bchashlookup(SB)
-DATA opaddrs+0x628(SB)/8, $bcaggsumf(SB)
-DATA opaddrs+0x630(SB)/8, $bcaggsumi(SB)
-DATA opaddrs+0x638(SB)/8, $bcaggminf(SB)
-DATA opaddrs+0x640(SB)/8, $bcaggmini(SB)
-DATA opaddrs+0x648(SB)/8, $bcaggmaxf(SB)
-DATA opaddrs+0x650(SB)/8, $bcaggmaxi(SB)
-DATA opaddrs+0x658(SB)/8, $bcaggcount(SB)
-DATA opaddrs+0x660(SB)/8, $bcaggbucket(SB)
-DATA opaddrs+0x668(SB)/8, $bcaggslotaddf(SB)
-DATA opaddrs+0x670(SB)/8, $bcaggslotaddi(SB)
-DATA opaddrs+0x678(SB)/8, $bcaggslotavgf(SB)
-DATA opaddrs+0x680(SB)/8, $bcaggslotavgi(SB)
-DATA opaddrs+0x688(SB)/8, $bcaggslotminf(SB)
-DATA opaddrs+0x690(SB)/8, $bcaggslotmini(SB)
-DATA opaddrs+0x698(SB)/8, $bcaggslotmaxf(SB)
-DATA opaddrs+0x6a0(SB)/8, $bcaggslotmaxi(SB)
-DATA opaddrs+0x6a8(SB)/8, $bcaggslotcount(SB)
-DATA opaddrs+0x6b0(SB)/8, $bclitref(SB)
-DATA opaddrs+0x6b8(SB)/8, $bcsplit(SB)
-DATA opaddrs+0x6c0(SB)/8, $bctuple(SB)
-DATA opaddrs+0x6c8(SB)/8, $bcdupv(SB)
-DATA opaddrs+0x6d0(SB)/8, $bczerov(SB)
-DATA opaddrs+0x6d8(SB)/8, $bcobjectsize(SB)
-DATA opaddrs+0x6e0(SB)/8, $bcCmpStrEqCs(SB)
-DATA opaddrs+0x6e8(SB)/8, $bcCmpStrEqCi(SB)
-DATA opaddrs+0x6f0(SB)/8, $bcCmpStrEqUTF8Ci(SB)
-DATA opaddrs+0x6f8(SB)/8, $bcSkip1charLeft(SB)
-DATA opaddrs+0x700(SB)/8, $bcSkip1charRight(SB)
-DATA opaddrs+0x708(SB)/8, $bcSkipNcharLeft(SB)
-DATA opaddrs+0x710(SB)/8, $bcSkipNcharRight(SB)
-DATA opaddrs+0x718(SB)/8, $bcTrimWsLeft(SB)
-DATA opaddrs+0x720(SB)/8, $bcTrimWsRight(SB)
-DATA opaddrs+0x728(SB)/8, $bcTrim4charLeft(SB)
-DATA opaddrs+0x730(SB)/8, $bcTrim4charRight(SB)
-DATA opaddrs+0x738(SB)/8, $bcTrimPrefixCs(SB)
-DATA opaddrs+0x740(SB)/8, $bcTrimPrefixCi(SB)
-DATA opaddrs+0x748(SB)/8, $bcTrimSuffixCs(SB)
-DATA opaddrs+0x750(SB)/8, $bcTrimSuffixCi(SB)
-DATA opaddrs+0x758(SB)/8, $bcContainsSubstrCs(SB)
-DATA opaddrs+0x760(SB)/8, $bcContainsSubstrCi(SB)
-DATA opaddrs+0x768(SB)/8, $bcContainsSuffixCs(SB)
-DATA opaddrs+0x770(SB)/8, $bcContainsSuffixCi(SB)
-DATA opaddrs+0x778(SB)/8, $bcContainsSuffixUTF8Ci(SB)
-DATA opaddrs+0x780(SB)/8, $bcContainsPrefixCs(SB)
-DATA opaddrs+0x788(SB)/8, $bcContainsPrefixCi(SB)
-DATA opaddrs+0x790(SB)/8, $bcContainsPrefixUTF8Ci(SB)
-DATA opaddrs+0x798(SB)/8, $bcLengthStr(SB)
-DATA opaddrs+0x7a0(SB)/8, $bcSubstr(SB)
-DATA opaddrs+0x7a8(SB)/8, $bcSplitPart(SB)
-DATA opaddrs+0x7b0(SB)/8, $bcMatchpatCs(SB)
-DATA opaddrs+0x7b8(SB)/8, $bcMatchpatCi(SB)
-DATA opaddrs+0x7c0(SB)/8, $bcMatchpatUTF8Ci(SB)
-DATA opaddrs+0x7c8(SB)/8, $bcIsSubnetOfIP4(SB)
-DATA opaddrs+0x7d0(SB)/8, $bctrap(SB)
+DATA opaddrs+0x618(SB)/8, $bchashint(SB)
+DATA opaddrs+0x620(SB)/8, $bchashmember(SB)
+DATA opaddrs+0x628(SB)/8, $bchashlookup(SB)
+DATA opaddrs+0x630(SB)/8, $bcaggsumf(SB)
+DATA opaddrs+0x638(SB)/8, $bcaggsumi(SB)
+DATA opaddrs+0x640(SB)/8, $bcaggminf(SB)
+DATA opaddrs+0x648(SB)/8, $bcaggmini(SB)
+DATA opaddrs+0x650(SB)/8, $bcaggmaxf(SB)
+DATA opaddrs+0x658(SB)/8, $bcaggmaxi(SB)
+DATA opaddrs+0x660(SB)/8, $bcaggcount(SB)
+DATA opaddrs+0x668(SB)/8, $bcaggbucket(SB)
+DATA opaddrs+0x670(SB)/8, $bcaggslotaddf(SB)
+DATA opaddrs+0x678(SB)/8, $bcaggslotaddi(SB)
+DATA opaddrs+0x680(SB)/8, $bcaggslotavgf(SB)
+DATA opaddrs+0x688(SB)/8, $bcaggslotavgi(SB)
+DATA opaddrs+0x690(SB)/8, $bcaggslotminf(SB)
+DATA opaddrs+0x698(SB)/8, $bcaggslotmini(SB)
+DATA opaddrs+0x6a0(SB)/8, $bcaggslotmaxf(SB)
+DATA opaddrs+0x6a8(SB)/8, $bcaggslotmaxi(SB)
+DATA opaddrs+0x6b0(SB)/8, $bcaggslotcount(SB)
+DATA opaddrs+0x6b8(SB)/8, $bclitref(SB)
+DATA opaddrs+0x6c0(SB)/8, $bcsplit(SB)
+DATA opaddrs+0x6c8(SB)/8, $bctuple(SB)
+DATA opaddrs+0x6d0(SB)/8, $bcdupv(SB)
+DATA opaddrs+0x6d8(SB)/8, $bczerov(SB)
+DATA opaddrs+0x6e0(SB)/8, $bcobjectsize(SB)
+DATA opaddrs+0x6e8(SB)/8, $bcCmpStrEqCs(SB)
+DATA opaddrs+0x6f0(SB)/8, $bcCmpStrEqCi(SB)
+DATA opaddrs+0x6f8(SB)/8, $bcCmpStrEqUTF8Ci(SB)
+DATA opaddrs+0x700(SB)/8, $bcSkip1charLeft(SB)
+DATA opaddrs+0x708(SB)/8, $bcSkip1charRight(SB)
+DATA opaddrs+0x710(SB)/8, $bcSkipNcharLeft(SB)
+DATA opaddrs+0x718(SB)/8, $bcSkipNcharRight(SB)
+DATA opaddrs+0x720(SB)/8, $bcTrimWsLeft(SB)
+DATA opaddrs+0x728(SB)/8, $bcTrimWsRight(SB)
+DATA opaddrs+0x730(SB)/8, $bcTrim4charLeft(SB)
+DATA opaddrs+0x738(SB)/8, $bcTrim4charRight(SB)
+DATA opaddrs+0x740(SB)/8, $bcTrimPrefixCs(SB)
+DATA opaddrs+0x748(SB)/8, $bcTrimPrefixCi(SB)
+DATA opaddrs+0x750(SB)/8, $bcTrimSuffixCs(SB)
+DATA opaddrs+0x758(SB)/8, $bcTrimSuffixCi(SB)
+DATA opaddrs+0x760(SB)/8, $bcContainsSubstrCs(SB)
+DATA opaddrs+0x768(SB)/8, $bcContainsSubstrCi(SB)
+DATA opaddrs+0x770(SB)/8, $bcContainsSuffixCs(SB)
+DATA opaddrs+0x778(SB)/8, $bcContainsSuffixCi(SB)
+DATA opaddrs+0x780(SB)/8, $bcContainsSuffixUTF8Ci(SB)
+DATA opaddrs+0x788(SB)/8, $bcContainsPrefixCs(SB)
+DATA opaddrs+0x790(SB)/8, $bcContainsPrefixCi(SB)
+DATA opaddrs+0x798(SB)/8, $bcContainsPrefixUTF8Ci(SB)
+DATA opaddrs+0x7a0(SB)/8, $bcLengthStr(SB)
+DATA opaddrs+0x7a8(SB)/8, $bcSubstr(SB)
+DATA opaddrs+0x7b0(SB)/8, $bcSplitPart(SB)
+DATA opaddrs+0x7b8(SB)/8, $bcMatchpatCs(SB)
+DATA opaddrs+0x7c0(SB)/8, $bcMatchpatCi(SB)
+DATA opaddrs+0x7c8(SB)/8, $bcMatchpatUTF8Ci(SB)
+DATA opaddrs+0x7d0(SB)/8, $bcIsSubnetOfIP4(SB)
 DATA opaddrs+0x7d8(SB)/8, $bctrap(SB)
 DATA opaddrs+0x7e0(SB)/8, $bctrap(SB)
 DATA opaddrs+0x7e8(SB)/8, $bctrap(SB)
@@ -153,6 +153,7 @@ const (
 	shashvaluep // hash a value and add it to the current hash
 	shashmember // look up a hash in a tree for existence; returns predicate
 	shashlookup // look up a hash in a tree for a value; returns boxed
+	shashint    // convert a hash to an integer
 
 	sstorev // store value in a stack slot
 	sstorevblend
@@ -632,6 +633,7 @@ var _ssainfo = [_ssamax]ssaopinfo{
 
 	shashmember: {text: "hashmember", argtypes: []ssatype{stHash, stBool}, rettype: stBool, immfmt: fmtother, bc: ophashmember, emit: emithashmember},
 	shashlookup: {text: "hashlookup", argtypes: []ssatype{stHash, stBool}, rettype: stValue | stBool, immfmt: fmtother, bc: ophashlookup, emit: emithashlookup},
+	shashint:    {text: "hashint", argtypes: []ssatype{stHash, stBool}, rettype: stInt, immfmt: fmtslot, bc: ophashint},
 
 	sliteral: {text: "literal", rettype: stValue, immfmt: fmtother, emit: emitconst}, // yields <value>.kinit
 
@@ -3323,6 +3325,11 @@ func (p *prog) hashplus(h *value, v *value) *value {
 	}
 }
 
+// hashint converts the low 64 bits of a hash to an integer
+func (p *prog) hashint(h *value) *value {
+	return p.ssa2(shashint, h, p.mask(h))
+}
+
 // Name returns the textual SSA name of this value
 func (v *value) Name() string {
 	if v.op == sinvalid {
@@ -0,0 +1,132 @@
+// Copyright (C) 2022 Sneller, Inc.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// TraceStats is the set of statistics
+// collected by a QuerySink returned from Trace.
+// The fields are updated atomically.
+type TraceStats struct {
+	// Rows is the number of rows
+	// written to the destination.
+	Rows int64
+	// Nanos is the number of nanoseconds
+	// spent writing rows to the destination,
+	// summed across all of its streams.
+	Nanos int64
+}
+
+// Trace returns a QuerySink that writes
+// to dst and records the number of rows
+// written to dst and the time spent
+// writing them into stats.
+//
+// If the streams opened by dst implement
+// RowConsumer, then so do the streams
+// returned by Trace, so row data is
+// passed through without being re-materialized.
+func Trace(dst QuerySink, stats *TraceStats) QuerySink {
+	return &traceSink{dst: dst, stats: stats}
+}
+
+type traceSink struct {
+	dst   QuerySink
+	stats *TraceStats
+}
+
+func (t *traceSink) Open() (io.WriteCloser, error) {
+	w, err := t.dst.Open()
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := w.(RowConsumer); ok {
+		return Splitter(&traceRows{dst: rc, stats: t.stats}), nil
+	}
+	return &traceWriter{dst: w, stats: t.stats}, nil
+}
+
+func (t *traceSink) Close() error { return t.dst.Close() }
+
+type traceRows struct {
+	dst   RowConsumer
+	stats *TraceStats
+}
+
+func (t *traceRows) symbolize(st *ion.Symtab) error {
+	return t.dst.symbolize(st)
+}
+
+func (t *traceRows) writeRows(delims []vmref) error {
+	// empty rows are dropped when
+	// the rows are re-materialized,
+	// so they don't count
+	n := int64(0)
+	for i := range delims {
+		if delims[i][1] != 0 {
+			n++
+		}
+	}
+	start := time.Now()
+	err := t.dst.writeRows(delims)
+	atomic.AddInt64(&t.stats.Nanos, int64(time.Since(start)))
+	atomic.AddInt64(&t.stats.Rows, n)
+	return err
+}
+
+func (t *traceRows) Close() error { return t.dst.Close() }
+
+type traceWriter struct {
+	dst   io.WriteCloser
+	stats *TraceStats
+}
+
+func (t *traceWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.dst.Write(p)
+	atomic.AddInt64(&t.stats.Nanos, int64(time.Since(start)))
+	atomic.AddInt64(&t.stats.Rows, countRows(p))
+	return n, err
+}
+
+func (t *traceWriter) Close() error { return t.dst.Close() }
+
+// countRows counts the structures in
+// a block of ion data, skipping any
+// symbol tables and padding
+func countRows(buf []byte) int64 {
+	n := int64(0)
+	for len(buf) > 0 {
+		if ion.IsBVM(buf) {
+			buf = buf[4:]
+			continue
+		}
+		size := ion.SizeOf(buf)
+		if size <= 0 || size > len(buf) {
+			break
+		}
+		if ion.TypeOf(buf) == ion.StructType {
+			n++
+		}
+		buf = buf[size:]
+	}
+	return n
+}